@@ -0,0 +1,221 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/tabular"
+)
+
+type gzipResponseWriter struct {
+	io.Writer
+	http.ResponseWriter
+}
+
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.Writer.Write(b)
+}
+
+// dataFileName returns the name of the job's file in the payload area.
+// The worker may also write a precompressed copy of the file, found at the same name with a .gz extension.
+func dataFileName(jobID, fileName string) string {
+	return fmt.Sprintf("%s/%s", jobID, fileName)
+}
+
+// DataFileExists reports whether the job's file, or a precompressed copy of it, can be served
+func DataFileExists(jobID, fileName string) bool {
+	name := dataFileName(jobID, fileName)
+	for _, n := range []string{name, name + ".gz"} {
+		if fi, err := storage.Get().Stat(storage.Payload, n); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeJobFile writes the job's NDJSON, CSV or Parquet file to the response.
+// When the worker wrote a precompressed copy of the file, it is served as-is to clients that accept gzip, which
+// allows interrupted downloads to be resumed using Range requests. Clients that do not accept gzip receive the
+// uncompressed file, which is decompressed on the fly if the worker did not keep it.
+// Files without a precompressed copy are compressed on the fly for clients that accept gzip.
+// When a checksum was recorded for the file, it is used to set the ETag and Digest headers.
+// Encrypted files are always served as they're stored.
+func ServeJobFile(w http.ResponseWriter, r *http.Request, jobID, fileName string) {
+	w.Header().Set("Content-Type", tabular.FormatOf(fileName).ContentType())
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var useGZIP bool
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		if header == "gzip" {
+			useGZIP = true
+			break
+		}
+	}
+
+	// Unencrypted error files and files written before checksums were recorded will not have a digest
+	checksum, size, encrypted := fileDigest(jobID, fileName)
+
+	// Encrypted files are served as they're stored, since they won't benefit from compression
+	if encrypted {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		useGZIP = false
+	}
+	st := storage.Get()
+	name := dataFileName(jobID, fileName)
+
+	if gzFile, err := st.Open(storage.Payload, name+".gz"); err == nil {
+		defer closeAndLogError(gzFile)
+		if useGZIP {
+			servePrecompressed(w, r, gzFile, checksum)
+			return
+		}
+		if _, err := st.Stat(storage.Payload, name); os.IsNotExist(err) {
+			serveDecompressed(w, gzFile, checksum, size)
+			return
+		}
+	}
+
+	f, err := st.Open(storage.Payload, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer closeAndLogError(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if useGZIP {
+		w.Header().Set("Content-Encoding", "gzip")
+		if checksum != "" {
+			// The digest describes the uncompressed file, so the compressed response can only be weakly validated
+			w.Header().Set("ETag", fmt.Sprintf(`W/"%s"`, checksum))
+		}
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+
+		gzw := gzipResponseWriter{Writer: gz, ResponseWriter: w}
+		http.ServeContent(gzw, r, fi.Name(), fi.ModTime(), f)
+	} else {
+		setDigestHeaders(w, checksum)
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	}
+}
+
+// servePrecompressed serves the bytes of the precompressed file, including any ranges requested by the client
+func servePrecompressed(w http.ResponseWriter, r *http.Request, gzFile storage.File, checksum string) {
+	fi, err := gzFile.Stat()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	if checksum != "" {
+		// The compressed file never changes once written, so it can be strongly validated (e.g. by If-Range)
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-gzip"`, checksum))
+	}
+	// ServeContent only sets the Content-Length of range requests when Content-Encoding is set.
+	// It replaces this value when serving a range and removes it from error responses.
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), gzFile)
+}
+
+// serveDecompressed streams the uncompressed contents of the precompressed file. Ranges are not supported since
+// the file must be decompressed from the beginning.
+func serveDecompressed(w http.ResponseWriter, gzFile storage.File, checksum string, size int64) {
+	gz, err := gzip.NewReader(gzFile)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer gz.Close()
+
+	w.Header().Set("Accept-Ranges", "none")
+	setDigestHeaders(w, checksum)
+	if size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, gz); err != nil {
+		log.Error(err)
+	}
+}
+
+// closeAndLogError closes the stored file, logging any error
+func closeAndLogError(f storage.File) {
+	if err := f.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// setDigestHeaders sets the ETag and Digest headers describing the uncompressed file
+func setDigestHeaders(w http.ResponseWriter, checksum string) {
+	if checksum == "" {
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, checksum))
+	if digest, err := hex.DecodeString(checksum); err == nil {
+		w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest))
+	}
+}
+
+// fileDigest returns the hex-encoded SHA-256 digest and size recorded for the job's uncompressed file, if there is one,
+// and whether the file is encrypted. The digest and size of an encrypted file describe the encrypted file. Error files
+// are recorded on the key of the file they accompany, and only have a digest when they're encrypted.
+func fileDigest(jobID, fileName string) (string, int64, bool) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if strings.HasSuffix(fileName, errorFileSuffix) {
+		var jobKey models.JobKey
+		// The accompanied file has the same name without the suffix, in any of the output formats
+		err := db.Select("error_checksum, error_file_size, error_encrypted_key").
+			Where("job_id = ? and file_name like ? and has_error_file", jobID, strings.TrimSuffix(fileName, errorFileSuffix)+".%").
+			First(&jobKey).Error
+		if err != nil {
+			if !gorm.IsRecordNotFoundError(err) {
+				log.Error(err)
+			}
+			return "", 0, false
+		}
+		return strings.TrimSpace(jobKey.ErrorChecksum), jobKey.ErrorFileSize, jobKey.ErrorEncryptedKey != ""
+	}
+
+	var jobKey models.JobKey
+	if err := db.Select("checksum, file_size, encrypted_key").Where("job_id = ? and file_name = ?", jobID, fileName).First(&jobKey).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+		}
+		return "", 0, false
+	}
+
+	return strings.TrimSpace(jobKey.Checksum), jobKey.FileSize, jobKey.EncryptedKey != ""
+}
+
+// errorFileSuffix ends the names of error files, e.g. <file UUID>-error.ndjson
+const errorFileSuffix = "-error.ndjson"
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/manifest"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// JobListParams contains the filtering and pagination criteria supplied to the job listing endpoint
+type JobListParams struct {
+	Statuses     []models.JobStatus
+	CreatedAfter *time.Time
+	Page         int
+	Count        int
+}
+
+// Offset returns the number of jobs that precede the requested page
+func (p JobListParams) Offset() int {
+	return (p.Page - 1) * p.Count
+}
+
+// ParseJobListParams parses the status, createdAfter, page, and _count query parameters used to filter and
+// paginate the job listing. status may contain a comma-separated list of job statuses and createdAfter must
+// be a FHIR instant. _count defaults to BCDA_JOB_LIST_DEFAULT_COUNT and may not exceed BCDA_JOB_LIST_MAX_COUNT.
+// The returned error describes the invalid parameter and is suitable for returning to the caller.
+func ParseJobListParams(r *http.Request) (JobListParams, error) {
+	params := JobListParams{
+		Page:  1,
+		Count: utils.GetEnvInt("BCDA_JOB_LIST_DEFAULT_COUNT", 50),
+	}
+	query := r.URL.Query()
+
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			status := models.JobStatus(s)
+			if !status.IsValid() {
+				return params, jobListErr(fmt.Sprintf("%s is not a valid job status", s))
+			}
+			params.Statuses = append(params.Statuses, status)
+		}
+	}
+
+	if createdAfter := query.Get("createdAfter"); createdAfter != "" {
+		t, err := time.Parse(time.RFC3339Nano, createdAfter)
+		if err != nil {
+			return params, jobListErr("createdAfter must be in the FHIR Instant format")
+		}
+		params.CreatedAfter = &t
+	}
+
+	if page := query.Get("page"); page != "" {
+		p, err := strconv.Atoi(page)
+		if err != nil || p < 1 {
+			return params, jobListErr("page must be a positive integer")
+		}
+		params.Page = p
+	}
+
+	if count := query.Get("_count"); count != "" {
+		maxCount := utils.GetEnvInt("BCDA_JOB_LIST_MAX_COUNT", 100)
+		c, err := strconv.Atoi(count)
+		if err != nil || c < 1 || c > maxCount {
+			return params, jobListErr(fmt.Sprintf("_count must be an integer between 1 and %d", maxCount))
+		}
+		params.Count = c
+	}
+
+	return params, nil
+}
+
+func jobListErr(msg string) error {
+	return fmt.Errorf("Invalid parameter: %s", msg)
+}
+
+// FindJobs returns the page of the ACO's jobs matching the filter criteria, ordered from most to least recent,
+// along with the total number of matching jobs
+func FindJobs(db *gorm.DB, acoID string, params JobListParams) ([]models.Job, int, error) {
+	query := db.Model(&models.Job{}).Where("aco_id = ?", acoID)
+	if len(params.Statuses) > 0 {
+		query = query.Where("status in (?)", params.Statuses)
+	}
+	if params.CreatedAfter != nil {
+		query = query.Where("created_at > ?", *params.CreatedAfter)
+	}
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var jobs []models.Job
+	if err := query.Order("created_at desc, id desc").Offset(params.Offset()).Limit(params.Count).Find(&jobs).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return jobs, total, nil
+}
+
+// NewJobListBody returns the page of jobs found for the request.
+// The job and next page URLs are created using the supplied scheme and the request's host.
+func NewJobListBody(r *http.Request, scheme string, params JobListParams, jobs []models.Job, total int) JobListBody {
+	body := JobListBody{
+		Total: total,
+		Page:  params.Page,
+		Count: params.Count,
+		Jobs:  []JobListItem{},
+	}
+	for _, job := range jobs {
+		body.Jobs = append(body.Jobs, JobListItem{
+			ID:              job.ID,
+			URL:             JobURL(scheme, r.Host, job),
+			RequestURL:      job.RequestURL,
+			Status:          string(job.Status),
+			Progress:        job.StatusMessage(),
+			TransactionTime: job.TransactionTime,
+			CreatedAt:       job.CreatedAt,
+		})
+	}
+
+	if params.Offset()+len(jobs) < total {
+		next := *r.URL
+		q := next.Query()
+		q.Set("page", strconv.Itoa(params.Page+1))
+		next.RawQuery = q.Encode()
+		body.Next = fmt.Sprintf("%s://%s%s", scheme, r.Host, next.RequestURI())
+	}
+
+	return body
+}
+
+// JobURL returns the URL of the status endpoint for the job.
+// The endpoint belongs to the version of the API that created the job.
+func JobURL(scheme, host string, job models.Job) string {
+	return fmt.Sprintf("%s://%s/api/%s/jobs/%d", scheme, host, manifest.JobVersion(job), job.ID)
+}
+
+// CancelJob marks the job as cancelled and removes its remaining queue jobs, including those in the outbox, and its
+// staged files.
+// The returned bool is false if the job is no longer running and could not be cancelled.
+func CancelJob(db *gorm.DB, job *models.Job) (bool, error) {
+	if queuePool == nil {
+		return false, errors.New("queue pool not initialized")
+	}
+
+	cancelled, err := job.Cancel(db, queuePool)
+	if err != nil || !cancelled {
+		return cancelled, err
+	}
+
+	if err = storage.Get().RemoveAll(storage.Staging, strconv.FormatUint(uint64(job.ID), 10)); err != nil {
+		log.Error(err)
+	}
+
+	return true, nil
+}
+
+/*
+A page of the export jobs requested by the ACO, ordered from most to least recent.
+swagger:response jobListResponse
+*/
+// nolint
+type JobListResponse struct {
+	// in: body
+	Body JobListBody
+}
+
+type JobListBody struct {
+	// Total number of jobs matching the filter criteria
+	Total int `json:"total"`
+	// Page number of this set of results
+	Page int `json:"page"`
+	// Maximum number of jobs included in each page
+	Count int `json:"count"`
+	// URL of the next page of results, if there is one
+	Next string `json:"next,omitempty"`
+	// Jobs found on this page
+	Jobs []JobListItem `json:"jobs"`
+}
+
+// swagger:model jobListItem
+type JobListItem struct {
+	// ID of the job
+	ID uint `json:"id"`
+	// URL of the job status endpoint
+	URL string `json:"url"`
+	// URL of the bulk data export request
+	RequestURL string `json:"request"`
+	// Current status of the job
+	Status string `json:"status"`
+	// Status of the job, including progress of jobs that are in progress
+	Progress string `json:"progress"`
+	// Most recent data load transaction time from the FHIR data server
+	TransactionTime time.Time `json:"transactionTime"`
+	// Time the job was created
+	CreatedAt time.Time `json:"createdAt"`
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	fhirmodels "github.com/eug48/fhir/models"
+
+	fhir "github.com/CMSgov/bcda-app/bcda/models/fhir"
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+const mbiSystem = "http://hl7.org/fhir/sid/us-mbi"
+
+var mbiPattern = regexp.MustCompile(`^[0-9A-Za-z]{11}$`)
+
+// ParseExportParameters reads the FHIR Parameters resource supplied in the body of a POST $export request.
+// The _type, _since, _outputFormat, and _typeFilter parameters are returned as query values so they can be
+// validated and persisted in the same way as a GET request. The patient parameters are returned as a list of MBIs.
+// Patients may be referenced by MBI (Patient/<MBI>) or by an identifier using the us-mbi system.
+func ParseExportParameters(r *http.Request) (url.Values, []string, *fhirmodels.OperationOutcome) {
+	// Add one to the limit so we can detect bodies that exceed it
+	maxBytes := int64(utils.GetEnvInt("BCDA_MAX_EXPORT_BODY_BYTES", 1<<20))
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, nil, parametersErr("unable to read request body")
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, nil, parametersErr(fmt.Sprintf("request body must not exceed %d bytes", maxBytes))
+	}
+
+	var params fhir.Parameters
+	if err := json.Unmarshal(body, &params); err != nil || params.ResourceType != "Parameters" {
+		return nil, nil, parametersErr("request body must be a FHIR Parameters resource")
+	}
+
+	query := url.Values{}
+	var mbis []string
+	seen := make(map[string]bool)
+	for _, p := range params.Parameter {
+		switch p.Name {
+		case "_type", "_outputFormat":
+			if p.ValueString == "" {
+				return nil, nil, parametersErr(fmt.Sprintf("%s must be supplied as a valueString", p.Name))
+			}
+			if _, ok := query[p.Name]; ok {
+				return nil, nil, parametersErr(fmt.Sprintf("%s may only be supplied once", p.Name))
+			}
+			query.Set(p.Name, p.ValueString)
+		case "_since":
+			if p.ValueInstant == "" {
+				return nil, nil, parametersErr("_since must be supplied as a valueInstant")
+			}
+			if _, ok := query[p.Name]; ok {
+				return nil, nil, parametersErr("_since may only be supplied once")
+			}
+			query.Set(p.Name, p.ValueInstant)
+		case "_typeFilter":
+			if p.ValueString == "" {
+				return nil, nil, parametersErr("_typeFilter must be supplied as a valueString")
+			}
+			query.Add(p.Name, p.ValueString)
+		case "patient":
+			mbi, err := patientMBI(p.ValueReference)
+			if err != nil {
+				return nil, nil, parametersErr(err.Error())
+			}
+			if !seen[mbi] {
+				seen[mbi] = true
+				mbis = append(mbis, mbi)
+			}
+		default:
+			return nil, nil, parametersErr(fmt.Sprintf("parameter %s is not supported", p.Name))
+		}
+	}
+
+	if len(mbis) == 0 {
+		return nil, nil, parametersErr("at least one patient must be supplied")
+	}
+
+	if maxPatients := utils.GetEnvInt("BCDA_MAX_EXPORT_PATIENTS", 1000); len(mbis) > maxPatients {
+		return nil, nil, parametersErr(fmt.Sprintf("no more than %d patients may be supplied", maxPatients))
+	}
+
+	return query, mbis, nil
+}
+
+func patientMBI(ref *fhir.Reference) (string, error) {
+	var mbi string
+	switch {
+	case ref == nil:
+		return "", fmt.Errorf("patient must be supplied as a valueReference")
+	case ref.Identifier != nil:
+		if ref.Identifier.System != mbiSystem {
+			return "", fmt.Errorf("patient identifier system must be %s", mbiSystem)
+		}
+		mbi = ref.Identifier.Value
+	case strings.HasPrefix(ref.Reference, "Patient/"):
+		mbi = strings.TrimPrefix(ref.Reference, "Patient/")
+	default:
+		return "", fmt.Errorf("patient reference must be of the form Patient/<MBI>")
+	}
+
+	if !mbiPattern.MatchString(mbi) {
+		return "", fmt.Errorf("%s is not a valid MBI", mbi)
+	}
+	return strings.ToUpper(mbi), nil
+}
+
+func parametersErr(msg string) *fhirmodels.OperationOutcome {
+	return responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr,
+		fmt.Sprintf("Invalid Parameters: %s", msg))
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strconv"
@@ -14,24 +15,45 @@ import (
 
 	"github.com/bgentry/que-go"
 	fhirmodels "github.com/eug48/fhir/models"
+	"github.com/jackc/pgx"
+	"github.com/jinzhu/gorm"
 
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/CMSgov/bcda-app/bcda/auth"
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/manifest"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/models/postgres"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	responseutilsv2 "github.com/CMSgov/bcda-app/bcda/responseutils/v2"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
+	"github.com/CMSgov/bcda-app/bcda/tabular"
 	"github.com/CMSgov/bcda-app/bcda/utils"
+	"github.com/CMSgov/bcda-app/bcda/webhook"
 )
 
 var (
 	qc *que.Client
+	// queuePool is the connection pool qc uses, needed to remove queue jobs in a transaction
+	queuePool *pgx.ConnPool
 )
 
+// outputFormats maps the supported values of the _outputFormat parameter to the format of the job's files. NDJSON is
+// the empty format.
+var outputFormats = map[string]tabular.Format{
+	"application/fhir+ndjson":        "",
+	"application/ndjson":             "",
+	"ndjson":                         "",
+	"text/csv":                       tabular.CSV,
+	"csv":                            tabular.CSV,
+	"application/vnd.apache.parquet": tabular.Parquet,
+	"parquet":                        tabular.Parquet,
+}
+
 func init() {
 	// Ensure that models.go is properly initialized with the service reference.
 	// As we refactor more of the code, we should be able to remove the initialization
@@ -45,31 +67,47 @@ func init() {
 	models.GetService(repository, cutoffDuration, utils.GetEnvInt("BCDA_SUPPRESSION_LOOKBACK_DAYS", 60))
 }
 
-func BulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request, retrieveNewBeneHistData bool) {
+// BulkRequest creates an export job for the requesting ACO. The version is the API version that received the request;
+// it determines the FHIR version of the data exported by the job.
+func BulkRequest(version string, resourceTypes []string, w http.ResponseWriter, r *http.Request, retrieveNewBeneHistData bool) {
+	bulkRequest(version, resourceTypes, nil, w, r, retrieveNewBeneHistData)
+}
+
+// BulkPatientsRequest creates an export job limited to the beneficiaries identified by the supplied MBIs.
+// Every MBI must be attributed to the requesting ACO.
+func BulkPatientsRequest(version string, resourceTypes []string, mbis []string, w http.ResponseWriter, r *http.Request, retrieveNewBeneHistData bool) {
+	bulkRequest(version, resourceTypes, mbis, w, r, retrieveNewBeneHistData)
+}
+
+func bulkRequest(version string, resourceTypes []string, mbis []string, w http.ResponseWriter, r *http.Request, retrieveNewBeneHistData bool) {
 	var (
 		ad  auth.AuthData
 		err error
 	)
 
 	if ad, err = readAuthData(r); err != nil {
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.TokenErr, "")
-		responseutils.WriteError(oo, w, http.StatusUnauthorized)
+		writeError(w, version, http.StatusUnauthorized, responseutils.Exception, responseutils.TokenErr, "")
 		return
 	}
 
 	if qc == nil {
 		err = errors.New("queue client not initialized")
 		log.Error(err)
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
-		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.Processing, "")
 		return
 	}
 
-	bb, err := client.NewBlueButtonClient(client.NewConfig())
+	bbConfig, err := client.NewConfigForVersion(version)
 	if err != nil {
 		log.Error(err)
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
-		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.Processing, "")
+		return
+	}
+
+	bb, err := client.NewBlueButtonClient(bbConfig)
+	if err != nil {
+		log.Error(err)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.Processing, "")
 		return
 	}
 
@@ -77,19 +115,31 @@ func BulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request,
 	defer database.Close(db)
 	acoID := ad.ACOID
 
-	var jobs []models.Job
-	// If we really do find this record with the below matching criteria then this particular ACO has already made
-	// a bulk data request and it has yet to finish. Users will be presented with a 429 Too-Many-Requests error until either
-	// their job finishes or time expires (+24 hours default) for any remaining jobs left in a pending or in-progress state.
-	// Overall, this will prevent a queue of concurrent calls from slowing up our system.
-	// NOTE: this logic is relevant to PROD only; simultaneous requests in our lower environments is acceptable (i.e., shared opensbx creds)
-	if (os.Getenv("DEPLOYMENT_TARGET") == "prod") && (!db.Find(&jobs, "aco_id = ?", acoID).RecordNotFound()) {
-		if types, ok := check429(jobs, resourceTypes, w); !ok {
-			w.Header().Set("Retry-After", strconv.Itoa(utils.GetEnvInt("CLIENT_RETRY_AFTER_IN_SECONDS", 0)))
-			w.WriteHeader(http.StatusTooManyRequests)
+	var aco models.ACO
+	if err = db.First(&aco, "uuid = ?", acoID).Error; err != nil {
+		log.Error(err)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.DbErr, "")
+		return
+	}
+
+	allowPartial, err := parseAllowPartial(r, aco)
+	if err != nil {
+		writeError(w, version, http.StatusBadRequest, responseutils.Exception, responseutils.RequestErr, err.Error())
+		return
+	}
+
+	callbackURL := r.Header.Get(CallbackURLHeader)
+	if callbackURL != "" {
+		if err = validateCallbackURL(r.Context(), callbackURL); err != nil {
+			writeError(w, version, http.StatusBadRequest, responseutils.Exception, responseutils.RequestErr, err.Error())
+			return
+		}
+
+		// Notifications are signed with the ACO's secret, so one must be registered before a callback URL can be used
+		if aco.WebhookSecret == "" {
+			writeError(w, version, http.StatusBadRequest, responseutils.Exception, responseutils.RequestErr,
+				fmt.Sprintf("A webhook secret must be registered for the ACO before %s can be used", CallbackURLHeader))
 			return
-		} else {
-			resourceTypes = types
 		}
 	}
 
@@ -98,58 +148,63 @@ func BulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request,
 		scheme = "https"
 	}
 
+	// The _outputFormat parameter has already been validated
+	outputFormat := outputFormats[r.URL.Query().Get("_outputFormat")]
+
 	newJob := models.Job{
-		ACOID:      uuid.Parse(acoID),
-		RequestURL: fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL),
-		Status:     "Pending",
+		ACOID:           uuid.Parse(acoID),
+		RequestURL:      fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL),
+		Status:          models.JobStatusPending,
+		CallbackURL:     callbackURL,
+		Version:         version,
+		AllowPartial:    allowPartial,
+		Encrypt:         aco.EncryptExports,
+		SplitClaimTypes: aco.SplitClaimTypes,
+		OutputFormat:    string(outputFormat),
 	}
 
-	// Need to create job in transaction instead of the very end of the process because we need
-	// the newJob.ID field to be set in the associated queuejobs. By doing the job creation (and update)
-	// in a transaction, we can rollback if we encounter any errors with handling the data needed for the newJob
-	tx := db.Begin()
+	// The job is created before its queue jobs are found so that it counts against the ACO's quota while they are. The
+	// quota is checked in the same short transaction, which commits before any requests are made to the FHIR Data Server.
+	violation, err := models.CreateJobWithinQuota(db, &newJob, time.Now(), GetJobTimeout())
+	if err != nil {
+		log.Error(err)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.DbErr, "")
+		return
+	}
+	if violation != nil {
+		log.Infof("Rejecting request from ACO %s: %s", acoID, violation.Message)
+		w.Header().Set("Retry-After", strconv.Itoa(violation.RetryAfterSeconds()))
+		writeError(w, version, http.StatusTooManyRequests, responseutils.Throttled, responseutils.QuotaErr, violation.Message)
+		return
+	}
+
+	var enqueueJobs []*que.Job
 	defer func() {
 		if err != nil {
-			tx.Rollback()
-			// We've already written out the HTTP response so we can return after we've rolled back the transaction
+			// The job never started, so it's removed instead of being left Pending without any queue jobs. We've already
+			// written out the HTTP response.
+			if dErr := db.Unscoped().Delete(&newJob).Error; dErr != nil {
+				log.Errorf("Unable to remove job %d: %s", newJob.ID, dErr.Error())
+			}
 			return
 		}
 
-		// We create the job after populating all of the data needed for the job (including inserting all of the queue jobs) to
-		// ensure that the job will be able to be processed and it WILL NOT BE stuck in the Pending state.
-		// For example, we write that the job has 10 queuejobs. We fail after inserting 9 queuejobs. The job will
-		// never move out of the IN_PROGRESS (or PENDING) state since we'll never be able to add the last queuejob.
-		//
-		// Since the queue jobs may (and do) exist in a different database, we cannot use a single transaction to encompass
-		// both adding queuejobs and adding the parent job.
-		//
-		// This does introduce an error scenario where we have queuejobs but no parent job.
-		// We've added logic into the worker to handle this situation.
-		if err = tx.Commit().Error; err != nil {
-			log.Error(err.Error())
-			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
-			responseutils.WriteError(oo, w, http.StatusInternalServerError)
-			return
+		// The queue jobs are relayed from the outbox to the queue right away so that the job starts without waiting for
+		// the worker's relay. Any that cannot be relayed now are relayed by the worker.
+		if _, rErr := models.RelayOutboxJobs(db, qc, newJob.ID, len(enqueueJobs)); rErr != nil {
+			log.Warnf("Unable to relay queue jobs for job %d. They will be relayed by the worker: %s", newJob.ID, rErr.Error())
 		}
 
 		// We've successfully create the job
-		w.Header().Set("Content-Location", fmt.Sprintf("%s://%s/api/v1/jobs/%d", scheme, r.Host, newJob.ID))
+		w.Header().Set("Content-Location", JobURL(scheme, r.Host, newJob))
 		w.WriteHeader(http.StatusAccepted)
 	}()
 
-	if err = tx.Save(&newJob).Error; err != nil {
-		log.Error(err)
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
-		responseutils.WriteError(oo, w, http.StatusInternalServerError)
-		return
-	}
-
 	// request a fake patient in order to acquire the bundle's lastUpdated metadata
 	b, err := bb.GetPatient("FAKE_PATIENT", strconv.FormatUint(uint64(newJob.ID), 10), acoID, "", time.Now())
 	if err != nil {
 		log.Error(err)
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.FormatErr, "Failure to retrieve transactionTime metadata from FHIR Data Server.")
-		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.FormatErr, "Failure to retrieve transactionTime metadata from FHIR Data Server.")
 		return
 	}
 	newJob.TransactionTime = b.Meta.LastUpdated
@@ -161,72 +216,99 @@ func BulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request,
 		decodedSince, _ = url.QueryUnescape(params[0])
 	}
 
-	var enqueueJobs []*que.Job
-	enqueueJobs, err = newJob.GetEnqueJobs(resourceTypes, decodedSince, retrieveNewBeneHistData)
+	// The _typeFilter parameter has already been validated, so we only need to decode it so it can be persisted in job args
+	typeFilter, _ := ParseTypeFilter(r)
+
+	enqueueJobs, err = newJob.GetEnqueJobs(resourceTypes, decodedSince, typeFilter, mbis, retrieveNewBeneHistData)
+	if unattributed, ok := err.(*models.UnattributedPatientsError); ok {
+		log.Warn(err)
+		writeError(w, version, http.StatusBadRequest, responseutils.Exception, responseutils.RequestErr,
+			fmt.Sprintf("Invalid Parameters: patients not attributed to ACO: %s", strings.Join(unattributed.MBIs, ",")))
+		return
+	}
 	if err != nil {
 		log.Error(err)
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
-		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.Processing, "")
 		return
 	}
 	newJob.JobCount = len(enqueueJobs)
 
-	// We've now computed all of the fields necessary to populate a fully defined job
-	if err = tx.Save(&newJob).Error; err != nil {
-		log.Error(err.Error())
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
-		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+	// The completed job and its queue jobs, which are written to the outbox, are saved in a single transaction. Either
+	// the job is saved with all of its queue jobs, or it's removed, so the job will never be stuck in the Pending state
+	// waiting for queue jobs that were never added.
+	if err = saveJobAndQueueJobs(db, &newJob, enqueueJobs); err != nil {
+		log.Error(err)
+		writeError(w, version, http.StatusInternalServerError, responseutils.Exception, responseutils.DbErr, "")
 		return
 	}
+}
 
-	// Since we're enqueuing these queuejobs BEFORE we've created the actual job, we may encounter a transient
-	// error where the job does not exist. Since queuejobs are retried, the transient error will be resolved
-	// once we finish inserting the job.
-	for _, j := range enqueueJobs {
-		if err = qc.Enqueue(j); err != nil {
-			log.Error(err)
-			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
-			responseutils.WriteError(oo, w, http.StatusInternalServerError)
-			return
-		}
+// saveJobAndQueueJobs saves the job, now that all of its fields have been computed, and adds its queue jobs to the
+// outbox in a single transaction.
+func saveJobAndQueueJobs(db *gorm.DB, job *models.Job, enqueueJobs []*que.Job) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
 	}
+	if err := tx.Save(job).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := models.AddToOutbox(tx, job.ID, enqueueJobs); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
 
-func check429(jobs []models.Job, types []string, w http.ResponseWriter) ([]string, bool) {
-	var unworkedTypes []string
-
-	for _, t := range types {
-		worked := false
-		for _, job := range jobs {
-			req, err := url.Parse(job.RequestURL)
-			if err != nil {
-				log.Error(err)
-				oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
-				responseutils.WriteError(oo, w, http.StatusInternalServerError)
-			}
+// writeError writes an OperationOutcome describing the error in the FHIR version served by the API version: STU3 for v1
+// and R4 for v2.
+func writeError(w http.ResponseWriter, version string, status int, code, detailsCode, detailsDisplay string) {
+	if version == constants.V2Version {
+		responseutilsv2.WriteError(responseutilsv2.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay), w, status)
+		return
+	}
+	responseutils.WriteError(responseutils.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay), w, status)
+}
 
-			if requestedTypes, ok := req.Query()["_type"]; ok {
-				// if this type is being worked no need to keep looking, break out and go to the next type.
-				if strings.Contains(requestedTypes[0], t) && (job.Status == "Pending" || job.Status == "In Progress") && (job.CreatedAt.Add(GetJobTimeout()).After(time.Now())) {
-					worked = true
-					break
-				}
-			} else {
-				// check to see if the export all is still being worked
-				if (job.Status == "Pending" || job.Status == "In Progress") && (job.CreatedAt.Add(GetJobTimeout()).After(time.Now())) {
-					return nil, false
-				}
-			}
-		}
-		if !worked {
-			unworkedTypes = append(unworkedTypes, t)
-		}
+// CallbackURLHeader may be supplied with an export request to receive the job's notification at a URL
+// other than the one registered for the ACO
+const CallbackURLHeader = "X-Callback-URL"
+
+// AllowPartialHeader may be supplied with an export request to override the ACO's setting for partial exports. When
+// partial exports are allowed, the job completes with the files that succeeded, along with error files describing the
+// data that could not be exported, instead of failing.
+const AllowPartialHeader = "X-Allow-Partial-Export"
+
+// parseAllowPartial returns whether the job requested by r allows partial exports
+func parseAllowPartial(r *http.Request, aco models.ACO) (bool, error) {
+	header := r.Header.Get(AllowPartialHeader)
+	if header == "" {
+		return aco.AllowPartialExports, nil
 	}
-	if len(unworkedTypes) == 0 {
-		return nil, false
-	} else {
-		return unworkedTypes, true
+
+	allowPartial, err := strconv.ParseBool(header)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", AllowPartialHeader)
+	}
+	return allowPartial, nil
+}
+
+// validateCallbackURL ensures the callback URL is absolute and its host is public. Outside of local and test
+// environments, HTTPS is required.
+func validateCallbackURL(ctx context.Context, callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%s must be an absolute URL", CallbackURLHeader)
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || os.Getenv("DEPLOYMENT_TARGET") == "prod") {
+		return fmt.Errorf("%s must use HTTPS", CallbackURLHeader)
 	}
+	if err = webhook.CheckHost(ctx, u.Hostname()); err != nil {
+		log.Warnf("Rejected %s: %s", CallbackURLHeader, err.Error())
+		return fmt.Errorf("%s must resolve to a public address", CallbackURLHeader)
+	}
+	return nil
 }
 
 func ValidateRequest(r *http.Request) ([]string, *fhirmodels.OperationOutcome) {
@@ -272,12 +354,17 @@ func ValidateRequest(r *http.Request) ([]string, *fhirmodels.OperationOutcome) {
 	//validate "_outputFormat" parameter
 	params, ok = r.URL.Query()["_outputFormat"]
 	if ok {
-		if params[0] != "ndjson" && params[0] != "application/fhir+ndjson" && params[0] != "application/ndjson" {
-			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.FormatErr, "_outputFormat parameter must be application/fhir+ndjson, application/ndjson, or ndjson")
+		if _, ok := outputFormats[params[0]]; !ok {
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.FormatErr, "_outputFormat parameter must be application/fhir+ndjson, application/ndjson, ndjson, text/csv, csv, application/vnd.apache.parquet, or parquet")
 			return nil, oo
 		}
 	}
 
+	// validate optional "_typeFilter" parameter
+	if _, oo := ParseTypeFilter(r); oo != nil {
+		return nil, oo
+	}
+
 	// we do not support "_elements" parameter
 	_, ok = r.URL.Query()["_elements"]
 	if ok {
@@ -305,12 +392,9 @@ func SetQC(client *que.Client) {
 	qc = client
 }
 
-// swagger:model fileItem
-type FileItem struct {
-	// FHIR resource type of file contents
-	Type string `json:"type"`
-	// URL of the file
-	URL string `json:"url"`
+// SetQueuePool sets the connection pool of the queue client
+func SetQueuePool(pool *pgx.ConnPool) {
+	queuePool = pool
 }
 
 /*
@@ -320,19 +404,5 @@ swagger:response completedJobResponse
 // nolint
 type CompletedJobResponse struct {
 	// in: body
-	Body BulkResponseBody
-}
-
-type BulkResponseBody struct {
-	// Server time when the query was run
-	TransactionTime time.Time `json:"transactionTime"`
-	// URL of the bulk data export request
-	RequestURL string `json:"request"`
-	// Indicates whether an access token is required to download generated data files
-	RequiresAccessToken bool `json:"requiresAccessToken"`
-	// Information about generated data files, including URLs for downloading
-	Files []FileItem `json:"output"`
-	// Information about error files, including URLs for downloading
-	Errors []FileItem `json:"error"`
-	JobID  uint
+	Body manifest.BulkResponseBody
 }
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	fhirmodels "github.com/eug48/fhir/models"
+
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
+)
+
+// claimTypeSystem is the code system used by BFD for the ExplanationOfBenefit.type search parameter
+const claimTypeSystem = "https://bluebutton.cms.gov/resources/codesystem/eob-type"
+
+var (
+	claimTypes = map[string]bool{
+		"carrier":    true,
+		"dme":        true,
+		"hha":        true,
+		"hospice":    true,
+		"inpatient":  true,
+		"outpatient": true,
+		"pde":        true,
+		"snf":        true,
+	}
+
+	datePattern = regexp.MustCompile(`^(ge|gt|le|lt)(\d{4}-\d{2}-\d{2})$`)
+
+	// typeFilterParams contains the FHIR search parameters that may be supplied through _typeFilter
+	// for each resource type, along with the function used to validate the parameter's value.
+	typeFilterParams = map[string]map[string]func(string) error{
+		"ExplanationOfBenefit": {
+			"type":         validateClaimType,
+			"service-date": validateServiceDate,
+		},
+	}
+)
+
+// ParseTypeFilter parses the _typeFilter parameters found in the request into the FHIR search criteria
+// for each resource type. Each _typeFilter value must be of the form <ResourceType>?<search criteria>,
+// e.g. ExplanationOfBenefit?type=carrier,outpatient. A resource type may only be filtered once.
+func ParseTypeFilter(r *http.Request) (map[string]url.Values, *fhirmodels.OperationOutcome) {
+	params, ok := r.URL.Query()["_typeFilter"]
+	if !ok {
+		return nil, nil
+	}
+
+	var requestedTypes []string
+	if types, ok := r.URL.Query()["_type"]; ok {
+		requestedTypes = strings.Split(types[0], ",")
+	}
+
+	typeFilter := make(map[string]url.Values)
+	for _, p := range params {
+		parts := strings.SplitN(p, "?", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, typeFilterErr(fmt.Sprintf("%s must be of the form <ResourceType>?<search criteria>", p))
+		}
+
+		resourceType := parts[0]
+		supported, ok := typeFilterParams[resourceType]
+		if !ok {
+			return nil, typeFilterErr(fmt.Sprintf("filtering is not supported for resource type %s", resourceType))
+		}
+
+		if requestedTypes != nil && !containsType(requestedTypes, resourceType) {
+			return nil, typeFilterErr(fmt.Sprintf("resource type %s must be included in the _type parameter", resourceType))
+		}
+
+		if _, ok := typeFilter[resourceType]; ok {
+			return nil, typeFilterErr(fmt.Sprintf("only one filter may be supplied for resource type %s", resourceType))
+		}
+
+		criteria, err := url.ParseQuery(parts[1])
+		if err != nil {
+			return nil, typeFilterErr(fmt.Sprintf("unable to parse search criteria %s", parts[1]))
+		}
+
+		for name, values := range criteria {
+			validate, ok := supported[name]
+			if !ok {
+				return nil, typeFilterErr(fmt.Sprintf("search parameter %s is not supported for resource type %s", name, resourceType))
+			}
+			for _, v := range values {
+				if err := validate(v); err != nil {
+					return nil, typeFilterErr(err.Error())
+				}
+			}
+		}
+
+		typeFilter[resourceType] = criteria
+	}
+
+	return typeFilter, nil
+}
+
+func validateClaimType(value string) error {
+	for _, t := range strings.Split(value, ",") {
+		// Claim types may be supplied with or without the code system
+		t = strings.TrimPrefix(t, claimTypeSystem+"|")
+		if !claimTypes[t] {
+			return fmt.Errorf("%s is not a supported claim type", t)
+		}
+	}
+	return nil
+}
+
+func validateServiceDate(value string) error {
+	matches := datePattern.FindStringSubmatch(value)
+	if matches == nil {
+		return fmt.Errorf("service-date %s must be a date (YYYY-MM-DD) prefixed with one of ge, gt, le, or lt", value)
+	}
+	if _, err := time.Parse("2006-01-02", matches[2]); err != nil {
+		return fmt.Errorf("service-date %s is not a valid date", value)
+	}
+	return nil
+}
+
+func containsType(types []string, t string) bool {
+	for _, rt := range types {
+		if rt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func typeFilterErr(msg string) *fhirmodels.OperationOutcome {
+	return responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr,
+		fmt.Sprintf("Invalid _typeFilter parameter: %s", msg))
+}
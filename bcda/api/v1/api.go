@@ -1,16 +1,12 @@
 package v1
 
 import (
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"io"
 
 	"github.com/CMSgov/bcda-app/bcda/constants"
 
 	"net/http"
-	"os"
-	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -20,6 +16,7 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/auth"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/health"
+	"github.com/CMSgov/bcda-app/bcda/manifest"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
@@ -28,6 +25,9 @@ import (
 
 const (
 	groupAll = "all"
+
+	// apiVersion is recorded on the jobs created by this version of the API
+	apiVersion = constants.V1Version
 )
 
 /*
@@ -57,7 +57,7 @@ func BulkPatientRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	retrieveNewBeneHistData := false // historical data for new beneficiaries will not be retrieved (this capability is only available with /Group)
-	api.BulkRequest(resourceTypes, w, r, retrieveNewBeneHistData)
+	api.BulkRequest(apiVersion, resourceTypes, w, r, retrieveNewBeneHistData)
 }
 
 /*
@@ -97,7 +97,7 @@ func BulkGroupRequest(w http.ResponseWriter, r *http.Request) {
 			retrieveNewBeneHistData = true
 		}
 
-		api.BulkRequest(resourceTypes, w, r, retrieveNewBeneHistData)
+		api.BulkRequest(apiVersion, resourceTypes, w, r, retrieveNewBeneHistData)
 	} else {
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid group ID")
 		responseutils.WriteError(oo, w, http.StatusBadRequest)
@@ -105,6 +105,63 @@ func BulkGroupRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+	swagger:route POST /api/v1/Group/{groupId}/$export bulkData bulkGroupPostRequest
+
+    Start data export (for the specified group identifier) for a list of patients
+
+	Initiates a job to collect data from the Blue Button API for the specified patients attributed to your ACO. The only Group identifier supported by the system is `all`.  The export parameters are supplied in the request body as a FHIR Parameters resource.  Each patient must be supplied as a `patient` parameter containing a reference to the patient's MBI (i.e., `Patient/1A00A00AA00`).  The `_type`, `_since`, and `_typeFilter` parameters behave as they do for the GET request.  If any of the patients are not attributed to the ACO, no job is created.
+
+	Consumes:
+	- application/fhir+json
+
+	Produces:
+	- application/fhir+json
+
+	Security:
+		bearer_token:
+
+	Responses:
+		202: BulkRequestResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		429: tooManyRequestsResponse
+		500: errorResponse
+*/
+func BulkGroupPostRequest(w http.ResponseWriter, r *http.Request) {
+	retrieveNewBeneHistData := false
+
+	groupID := chi.URLParam(r, "groupId")
+	if groupID != groupAll {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid group ID")
+		responseutils.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+
+	query, mbis, oo := api.ParseExportParameters(r)
+	if oo != nil {
+		responseutils.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+	// The export parameters are validated and persisted (via the job's request URL) from the query string,
+	// so we move them there to be handled in the same way as a GET request.
+	r.URL.RawQuery = query.Encode()
+
+	resourceTypes, err := api.ValidateRequest(r)
+	if err != nil {
+		responseutils.WriteError(err, w, http.StatusBadRequest)
+		return
+	}
+
+	// Set flag to retrieve new beneficiaries' historical data if _since param is provided and feature is turned on
+	_, ok := r.URL.Query()["_since"]
+	if ok && utils.GetEnvBool("BCDA_ENABLE_NEW_GROUP", false) {
+		retrieveNewBeneHistData = true
+	}
+
+	api.BulkPatientsRequest(apiVersion, resourceTypes, mbis, w, r, retrieveNewBeneHistData)
+}
+
 /*
 	swagger:route GET /api/v1/jobs/{jobId} bulkData jobStatus
 
@@ -145,16 +202,16 @@ func JobStatus(w http.ResponseWriter, r *http.Request) {
 
 	switch job.Status {
 
-	case "Failed":
+	case models.JobStatusFailed:
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.InternalErr, "Service encountered numerous errors.  Unable to complete the request.")
 		responseutils.WriteError(oo, w, http.StatusInternalServerError)
-	case "Pending":
+	case models.JobStatusPending:
 		fallthrough
-	case "In Progress":
+	case models.JobStatusInProgress:
 		w.Header().Set("X-Progress", job.StatusMessage())
 		w.WriteHeader(http.StatusAccepted)
 		return
-	case "Completed":
+	case models.JobStatusCompleted, models.JobStatusPartiallyCompleted:
 		// If the job should be expired, but the cleanup job hasn't run for some reason, still respond with 410
 		if job.UpdatedAt.Add(api.GetJobTimeout()).Before(time.Now()) {
 			w.Header().Set("Expires", job.UpdatedAt.Add(api.GetJobTimeout()).String())
@@ -169,37 +226,14 @@ func JobStatus(w http.ResponseWriter, r *http.Request) {
 			scheme = "https"
 		}
 
-		rb := api.BulkResponseBody{
-			TransactionTime:     job.TransactionTime,
-			RequestURL:          job.RequestURL,
-			RequiresAccessToken: true,
-			Files:               []api.FileItem{},
-			Errors:              []api.FileItem{},
-			JobID:               job.ID,
-		}
-
-		var jobKeysObj []models.JobKey
-		db.Find(&jobKeysObj, "job_id = ?", job.ID)
-		for _, jobKey := range jobKeysObj {
-
-			// data files
-			fi := api.FileItem{
-				Type: jobKey.ResourceType,
-				URL:  fmt.Sprintf("%s://%s/data/%s/%s", scheme, r.Host, jobID, strings.TrimSpace(jobKey.FileName)),
-			}
-			rb.Files = append(rb.Files, fi)
-
-			// error files
-			errFileName := strings.Split(jobKey.FileName, ".")[0]
-			errFilePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_PAYLOAD_DIR"), jobID, errFileName)
-			if _, err := os.Stat(errFilePath); !os.IsNotExist(err) {
-				errFI := api.FileItem{
-					Type: "OperationOutcome",
-					URL:  fmt.Sprintf("%s://%s/data/%s/%s-error.ndjson", scheme, r.Host, jobID, errFileName),
-				}
-				rb.Errors = append(rb.Errors, errFI)
-			}
+		jobKeysObj, err := models.GetJobKeys(db, job.ID)
+		if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
 		}
+		rb := manifest.New(job, jobKeysObj, scheme, r.Host)
 
 		jsonData, err := json.Marshal(rb)
 		if err != nil {
@@ -216,22 +250,137 @@ func JobStatus(w http.ResponseWriter, r *http.Request) {
 		}
 
 		w.WriteHeader(http.StatusOK)
-	case "Archived":
+	case models.JobStatusCancelled:
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Not_found, "Job has been cancelled")
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+	case models.JobStatusArchived:
 		fallthrough
-	case "Expired":
+	case models.JobStatusExpired:
 		w.Header().Set("Expires", job.UpdatedAt.Add(api.GetJobTimeout()).String())
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Deleted, "")
 		responseutils.WriteError(oo, w, http.StatusGone)
 	}
 }
 
-type gzipResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
+/*
+	swagger:route DELETE /api/v1/jobs/{jobId} bulkData deleteJob
+
+	Cancel a job
+
+	Cancels a currently running export job. Any files that have been generated by the job are removed.
+
+	Produces:
+	- application/fhir+json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		202: deleteJobResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		410: goneResponse
+		500: errorResponse
+*/
+func DeleteJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var job models.Job
+	err := db.Find(&job, "id = ?", jobID).Error
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutils.WriteError(oo, w, http.StatusNotFound)
+		return
+	}
+
+	status := job.Status
+	cancelled, err := api.CancelJob(db, &job)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	if !cancelled {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Deleted,
+			fmt.Sprintf("Job is no longer running and cannot be cancelled. Current status: %s", status))
+		responseutils.WriteError(oo, w, http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
 }
 
-func (w gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+/*
+	swagger:route GET /api/v1/jobs bulkData listJobs
+
+	List jobs
+
+	Returns the export jobs requested by your ACO, ordered from most to least recent.  Jobs may be filtered by status and creation time.
+
+	Produces:
+	- application/json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		200: jobListResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		500: errorResponse
+*/
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	ad, ok := r.Context().Value(auth.AuthDataContextKey).(auth.AuthData)
+	if !ok {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.TokenErr, "")
+		responseutils.WriteError(oo, w, http.StatusUnauthorized)
+		return
+	}
+
+	params, err := api.ParseJobListParams(r)
+	if err != nil {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, err.Error())
+		responseutils.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	jobs, total, err := api.FindJobs(db, ad.ACOID, params)
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if servicemux.IsHTTPS(r) {
+		scheme = "https"
+	}
+	body := api.NewJobListBody(r, scheme, params, jobs, total)
+
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonData); err != nil {
+		log.Error(err)
+	}
 }
 
 /*
@@ -239,10 +388,12 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 
 	Get data file
 
-	Returns the NDJSON file of data generated by an export job.  Will be in the format <UUID>.ndjson.  Get the full value from the job status response
+	Returns the NDJSON file of data generated by an export job.  Will be in the format <UUID>.ndjson.  Get the full value from the job status response.  Clients that accept gzip encoding may resume interrupted downloads using Range requests.  Jobs requested with a tabular _outputFormat return CSV (<UUID>.csv) or Parquet (<UUID>.parquet) files of flattened tables, with a matching Content-Type.
 
 	Produces:
 	- application/fhir+json
+	- text/csv
+	- application/vnd.apache.parquet
 
 	Schemes: http, https
 
@@ -257,29 +408,7 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 		500: errorResponse
 */
 func ServeData(w http.ResponseWriter, r *http.Request) {
-	dataDir := os.Getenv("FHIR_PAYLOAD_DIR")
-	fileName := chi.URLParam(r, "fileName")
-	jobID := chi.URLParam(r, "jobID")
-	w.Header().Set("Content-Type", "application/fhir+ndjson")
-
-	var useGZIP bool
-	for _, header := range r.Header.Values("Accept-Encoding") {
-		if header == "gzip" {
-			useGZIP = true
-			break
-		}
-	}
-
-	if useGZIP {
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-
-		gzw := gzipResponseWriter{Writer: gz, ResponseWriter: w}
-		http.ServeFile(gzw, r, fmt.Sprintf("%s/%s/%s", dataDir, jobID, fileName))
-	} else {
-		http.ServeFile(w, r, fmt.Sprintf("%s/%s/%s", dataDir, jobID, fileName))
-	}
+	api.ServeJobFile(w, r, chi.URLParam(r, "jobID"), chi.URLParam(r, "fileName"))
 }
 
 /*
@@ -1,9 +1,13 @@
 package v1
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,7 +15,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,6 +34,8 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/auth"
 	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/encryption"
+	"github.com/CMSgov/bcda-app/bcda/manifest"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
@@ -318,6 +326,43 @@ func (s *APITestSuite) TestBulkConcurrentRequestTime() {
 	bulkConcurrentRequestTimeHelper("Group/all", s)
 }
 
+// Requests made at the same time are checked one at a time, so they can't all be allowed by the same count
+func (s *APITestSuite) TestBulkConcurrentRequestParallel() {
+	acoID := acoUnderTest
+	assert.Nil(s.T(), s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{}).Error)
+	defer s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{})
+	assert.Nil(s.T(), models.SaveACOQuota(s.db, models.ACOQuota{ACOID: uuid.Parse(acoID), MaxConcurrentJobs: 1}))
+	defer s.db.Unscoped().Delete(models.ACOQuota{}, "aco_id = ?", acoID)
+
+	pool := makeConnPool(s)
+	defer pool.Close()
+
+	codes := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, handlerFunc, req := bulkRequestHelper("Patient", RequestParams{resourceType: "Patient"})
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(acoID)))
+			rr := httptest.NewRecorder()
+			handlerFunc(rr, req)
+			codes[i] = rr.Code
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, code := range codes {
+		if code == http.StatusAccepted {
+			accepted++
+		} else {
+			assert.Equal(s.T(), http.StatusTooManyRequests, code)
+		}
+	}
+	assert.Equal(s.T(), 1, accepted)
+}
+
 func (s *APITestSuite) TestValidateRequest() {
 	validateRequestHelper("Patient", s)
 	s.TearDownTest()
@@ -325,6 +370,327 @@ func (s *APITestSuite) TestValidateRequest() {
 	validateRequestHelper("Group/all", s)
 }
 
+func (s *APITestSuite) TestValidateRequestTypeFilter() {
+	tests := []struct {
+		name        string
+		types       string
+		typeFilters []string
+		expFilter   map[string]url.Values
+		expErr      string
+	}{
+		{"NoFilter", "", nil, nil, ""},
+		{"ClaimType", "", []string{"ExplanationOfBenefit?type=carrier,outpatient"},
+			map[string]url.Values{"ExplanationOfBenefit": {"type": []string{"carrier,outpatient"}}}, ""},
+		{"ClaimTypeWithSystem", "ExplanationOfBenefit", []string{"ExplanationOfBenefit?type=https://bluebutton.cms.gov/resources/codesystem/eob-type|pde"},
+			map[string]url.Values{"ExplanationOfBenefit": {"type": []string{"https://bluebutton.cms.gov/resources/codesystem/eob-type|pde"}}}, ""},
+		{"ServiceDate", "", []string{"ExplanationOfBenefit?service-date=ge2020-01-01&service-date=lt2020-07-01"},
+			map[string]url.Values{"ExplanationOfBenefit": {"service-date": []string{"ge2020-01-01", "lt2020-07-01"}}}, ""},
+		{"MissingCriteria", "", []string{"ExplanationOfBenefit"}, nil,
+			"Invalid _typeFilter parameter: ExplanationOfBenefit must be of the form <ResourceType>?<search criteria>"},
+		{"UnsupportedResource", "", []string{"Patient?gender=female"}, nil,
+			"Invalid _typeFilter parameter: filtering is not supported for resource type Patient"},
+		{"ResourceNotRequested", "Patient", []string{"ExplanationOfBenefit?type=carrier"}, nil,
+			"Invalid _typeFilter parameter: resource type ExplanationOfBenefit must be included in the _type parameter"},
+		{"RepeatedResource", "", []string{"ExplanationOfBenefit?type=carrier", "ExplanationOfBenefit?type=dme"}, nil,
+			"Invalid _typeFilter parameter: only one filter may be supplied for resource type ExplanationOfBenefit"},
+		{"UnsupportedParameter", "", []string{"ExplanationOfBenefit?patient=12345"}, nil,
+			"Invalid _typeFilter parameter: search parameter patient is not supported for resource type ExplanationOfBenefit"},
+		{"UnsupportedClaimType", "", []string{"ExplanationOfBenefit?type=carrier,dental"}, nil,
+			"Invalid _typeFilter parameter: dental is not a supported claim type"},
+		{"InvalidServiceDate", "", []string{"ExplanationOfBenefit?service-date=2020-01-01"}, nil,
+			"Invalid _typeFilter parameter: service-date 2020-01-01 must be a date (YYYY-MM-DD) prefixed with one of ge, gt, le, or lt"},
+		{"InvalidServiceDateValue", "", []string{"ExplanationOfBenefit?service-date=ge2020-13-01"}, nil,
+			"Invalid _typeFilter parameter: service-date ge2020-13-01 is not a valid date"},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			if tt.types != "" {
+				q.Set("_type", tt.types)
+			}
+			for _, f := range tt.typeFilters {
+				q.Add("_typeFilter", f)
+			}
+			req := httptest.NewRequest("GET", "/api/v1/Patient/$export?"+q.Encode(), nil)
+
+			_, oo := api.ValidateRequest(req)
+			typeFilter, _ := api.ParseTypeFilter(req)
+			if tt.expErr != "" {
+				assert.NotNil(t, oo)
+				assert.Equal(t, responseutils.RequestErr, oo.Issue[0].Details.Coding[0].Code)
+				assert.Equal(t, tt.expErr, oo.Issue[0].Details.Coding[0].Display)
+				return
+			}
+			assert.Nil(t, oo)
+			assert.Equal(t, tt.expFilter, typeFilter)
+		})
+	}
+}
+
+func (s *APITestSuite) TestParseExportParameters() {
+	tests := []struct {
+		name     string
+		body     string
+		expQuery url.Values
+		expMBIs  []string
+		expErr   string
+	}{
+		{"PatientReference", `{"resourceType":"Parameters","parameter":[{"name":"patient","valueReference":{"reference":"Patient/1a00a00aa00"}}]}`,
+			url.Values{}, []string{"1A00A00AA00"}, ""},
+		{"PatientIdentifier", `{"resourceType":"Parameters","parameter":[{"name":"patient","valueReference":{"identifier":{"system":"http://hl7.org/fhir/sid/us-mbi","value":"1A00A00AA00"}}}]}`,
+			url.Values{}, []string{"1A00A00AA00"}, ""},
+		{"AllParameters", `{"resourceType":"Parameters","parameter":[` +
+			`{"name":"_type","valueString":"ExplanationOfBenefit"},` +
+			`{"name":"_since","valueInstant":"2020-02-13T08:00:00.000-05:00"},` +
+			`{"name":"_typeFilter","valueString":"ExplanationOfBenefit?type=carrier"},` +
+			`{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA00"}},` +
+			`{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA01"}},` +
+			`{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA00"}}]}`,
+			url.Values{"_type": {"ExplanationOfBenefit"}, "_since": {"2020-02-13T08:00:00.000-05:00"}, "_typeFilter": {"ExplanationOfBenefit?type=carrier"}},
+			[]string{"1A00A00AA00", "1A00A00AA01"}, ""},
+		{"NotJSON", `patient=1A00A00AA00`, nil, nil, "Invalid Parameters: request body must be a FHIR Parameters resource"},
+		{"WrongResource", `{"resourceType":"Patient"}`, nil, nil, "Invalid Parameters: request body must be a FHIR Parameters resource"},
+		{"NoPatients", `{"resourceType":"Parameters","parameter":[{"name":"_type","valueString":"Patient"}]}`, nil, nil,
+			"Invalid Parameters: at least one patient must be supplied"},
+		{"RepeatedType", `{"resourceType":"Parameters","parameter":[{"name":"_type","valueString":"Patient"},{"name":"_type","valueString":"Coverage"}]}`, nil, nil,
+			"Invalid Parameters: _type may only be supplied once"},
+		{"SinceAsString", `{"resourceType":"Parameters","parameter":[{"name":"_since","valueString":"2020-02-13T08:00:00.000-05:00"}]}`, nil, nil,
+			"Invalid Parameters: _since must be supplied as a valueInstant"},
+		{"UnsupportedParameter", `{"resourceType":"Parameters","parameter":[{"name":"_elements","valueString":"id"}]}`, nil, nil,
+			"Invalid Parameters: parameter _elements is not supported"},
+		{"InvalidMBI", `{"resourceType":"Parameters","parameter":[{"name":"patient","valueReference":{"reference":"Patient/12345"}}]}`, nil, nil,
+			"Invalid Parameters: 12345 is not a valid MBI"},
+		{"InvalidReference", `{"resourceType":"Parameters","parameter":[{"name":"patient","valueReference":{"reference":"Group/all"}}]}`, nil, nil,
+			"Invalid Parameters: patient reference must be of the form Patient/<MBI>"},
+		{"InvalidIdentifierSystem", `{"resourceType":"Parameters","parameter":[{"name":"patient","valueReference":{"identifier":{"system":"http://example.com","value":"1A00A00AA00"}}}]}`, nil, nil,
+			"Invalid Parameters: patient identifier system must be http://hl7.org/fhir/sid/us-mbi"},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/Group/all/$export", strings.NewReader(tt.body))
+			query, mbis, oo := api.ParseExportParameters(req)
+			if tt.expErr != "" {
+				assert.NotNil(t, oo)
+				assert.Equal(t, responseutils.RequestErr, oo.Issue[0].Details.Coding[0].Code)
+				assert.Equal(t, tt.expErr, oo.Issue[0].Details.Coding[0].Display)
+				return
+			}
+			assert.Nil(t, oo)
+			assert.Equal(t, tt.expQuery, query)
+			assert.Equal(t, tt.expMBIs, mbis)
+		})
+	}
+}
+
+func (s *APITestSuite) TestParseExportParametersLimits() {
+	body := `{"resourceType":"Parameters","parameter":[` +
+		`{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA00"}},` +
+		`{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA01"}}]}`
+
+	defer os.Unsetenv("BCDA_MAX_EXPORT_PATIENTS")
+	os.Setenv("BCDA_MAX_EXPORT_PATIENTS", "1")
+	req := httptest.NewRequest("POST", "/api/v1/Group/all/$export", strings.NewReader(body))
+	_, _, oo := api.ParseExportParameters(req)
+	assert.NotNil(s.T(), oo)
+	assert.Equal(s.T(), "Invalid Parameters: no more than 1 patients may be supplied", oo.Issue[0].Details.Coding[0].Display)
+
+	defer os.Unsetenv("BCDA_MAX_EXPORT_BODY_BYTES")
+	os.Setenv("BCDA_MAX_EXPORT_BODY_BYTES", "10")
+	req = httptest.NewRequest("POST", "/api/v1/Group/all/$export", strings.NewReader(body))
+	_, _, oo = api.ParseExportParameters(req)
+	assert.NotNil(s.T(), oo)
+	assert.Equal(s.T(), "Invalid Parameters: request body must not exceed 10 bytes", oo.Issue[0].Details.Coding[0].Display)
+}
+
+func (s *APITestSuite) TestBulkGroupPostRequestInvalidGroup() {
+	body := `{"resourceType":"Parameters","parameter":[{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA00"}}]}`
+	req := httptest.NewRequest("POST", "/api/v1/Group/foo/$export", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupId", "foo")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	BulkGroupPostRequest(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusBadRequest, s.rr.Code)
+	var respOO fhirmodels.OperationOutcome
+	assert.NoError(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &respOO))
+	assert.Equal(s.T(), "Invalid group ID", respOO.Issue[0].Details.Coding[0].Display)
+}
+
+func (s *APITestSuite) TestBulkGroupPostRequestInvalidParameters() {
+	body := `{"resourceType":"Parameters","parameter":[{"name":"_type","valueString":"Patient"}]}`
+	req := httptest.NewRequest("POST", "/api/v1/Group/all/$export", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupId", groupAll)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	BulkGroupPostRequest(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusBadRequest, s.rr.Code)
+	var respOO fhirmodels.OperationOutcome
+	assert.NoError(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &respOO))
+	assert.Equal(s.T(), "Invalid Parameters: at least one patient must be supplied", respOO.Issue[0].Details.Coding[0].Display)
+}
+
+func (s *APITestSuite) TestBulkGroupPostRequestInvalidType() {
+	body := `{"resourceType":"Parameters","parameter":[{"name":"_type","valueString":"Practitioner"},` +
+		`{"name":"patient","valueReference":{"reference":"Patient/1A00A00AA00"}}]}`
+	req := httptest.NewRequest("POST", "/api/v1/Group/all/$export", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupId", groupAll)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	BulkGroupPostRequest(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusBadRequest, s.rr.Code)
+	var respOO fhirmodels.OperationOutcome
+	assert.NoError(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &respOO))
+	assert.Equal(s.T(), "Invalid resource type", respOO.Issue[0].Details.Coding[0].Display)
+}
+
+func (s *APITestSuite) TestBulkRequestCallbackURL() {
+	var aco models.ACO
+	assert.NoError(s.T(), s.db.First(&aco, "uuid = ?", acoUnderTest).Error)
+	defer s.db.Model(&aco).Update("webhook_secret", aco.WebhookSecret)
+	defer s.db.Unscoped().Where("aco_id = ?", aco.UUID).Delete(models.Job{})
+
+	pool := makeConnPool(s)
+	defer pool.Close()
+
+	tests := []struct {
+		name        string
+		secret      string
+		callbackURL string
+		expCode     int
+		expErr      string
+	}{
+		{"RelativeURL", "secret", "/callback", http.StatusBadRequest, "X-Callback-URL must be an absolute URL"},
+		{"UnsupportedScheme", "secret", "ftp://example.com/callback", http.StatusBadRequest, "X-Callback-URL must use HTTPS"},
+		{"Loopback", "secret", "https://127.0.0.1/callback", http.StatusBadRequest, "X-Callback-URL must resolve to a public address"},
+		{"MetadataService", "secret", "https://169.254.169.254/latest", http.StatusBadRequest,
+			"X-Callback-URL must resolve to a public address"},
+		{"NoSecret", "", "https://example.com/callback", http.StatusBadRequest,
+			"A webhook secret must be registered for the ACO before X-Callback-URL can be used"},
+		{"Valid", "secret", "https://example.com/callback", http.StatusAccepted, ""},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, s.db.Model(&aco).Update("webhook_secret", tt.secret).Error)
+
+			rr := httptest.NewRecorder()
+			_, handlerFunc, req := bulkRequestHelper("Patient", RequestParams{resourceType: "Patient"})
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(aco.UUID.String())))
+			req.Header.Set(api.CallbackURLHeader, tt.callbackURL)
+
+			handlerFunc(rr, req)
+
+			assert.Equal(t, tt.expCode, rr.Code)
+			if tt.expErr != "" {
+				var respOO fhirmodels.OperationOutcome
+				assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &respOO))
+				assert.Equal(t, tt.expErr, respOO.Issue[0].Details.Coding[0].Display)
+				return
+			}
+
+			var job models.Job
+			assert.NoError(t, s.db.Last(&job, "aco_id = ?", aco.UUID).Error)
+			assert.Equal(t, tt.callbackURL, job.CallbackURL)
+		})
+	}
+}
+
+func (s *APITestSuite) TestBulkRequestAllowPartial() {
+	var aco models.ACO
+	assert.NoError(s.T(), s.db.First(&aco, "uuid = ?", acoUnderTest).Error)
+	defer s.db.Model(&aco).Update("allow_partial_exports", aco.AllowPartialExports)
+	defer s.db.Unscoped().Where("aco_id = ?", aco.UUID).Delete(models.Job{})
+
+	pool := makeConnPool(s)
+	defer pool.Close()
+
+	tests := []struct {
+		name       string
+		acoSetting bool
+		header     string
+		expCode    int
+		expAllowed bool
+	}{
+		{"ACODefault", false, "", http.StatusAccepted, false},
+		{"ACOEnabled", true, "", http.StatusAccepted, true},
+		{"HeaderEnabled", false, "true", http.StatusAccepted, true},
+		{"HeaderDisabled", true, "false", http.StatusAccepted, false},
+		{"InvalidHeader", false, "sometimes", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, s.db.Model(&aco).Update("allow_partial_exports", tt.acoSetting).Error)
+			assert.NoError(t, s.db.Unscoped().Where("aco_id = ?", aco.UUID).Delete(models.Job{}).Error)
+
+			rr := httptest.NewRecorder()
+			_, handlerFunc, req := bulkRequestHelper("Patient", RequestParams{resourceType: "Patient"})
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(aco.UUID.String())))
+			if tt.header != "" {
+				req.Header.Set(api.AllowPartialHeader, tt.header)
+			}
+
+			handlerFunc(rr, req)
+
+			assert.Equal(t, tt.expCode, rr.Code)
+			if tt.expCode != http.StatusAccepted {
+				var respOO fhirmodels.OperationOutcome
+				assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &respOO))
+				assert.Equal(t, "X-Allow-Partial-Export must be true or false", respOO.Issue[0].Details.Coding[0].Display)
+				return
+			}
+
+			var job models.Job
+			assert.NoError(t, s.db.Last(&job, "aco_id = ?", aco.UUID).Error)
+			assert.Equal(t, tt.expAllowed, job.AllowPartial)
+		})
+	}
+}
+
+func (s *APITestSuite) TestBulkRequestOutputFormat() {
+	defer s.db.Unscoped().Where("aco_id = ?", acoUnderTest).Delete(models.Job{})
+
+	pool := makeConnPool(s)
+	defer pool.Close()
+
+	tests := []struct {
+		outputFormat string
+		expFormat    string
+	}{
+		{"", ""},
+		{"application/fhir+ndjson", ""},
+		{"ndjson", ""},
+		{"text/csv", "csv"},
+		{"csv", "csv"},
+		{"application/vnd.apache.parquet", "parquet"},
+		{"parquet", "parquet"},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.outputFormat, func(t *testing.T) {
+			assert.NoError(t, s.db.Unscoped().Where("aco_id = ?", acoUnderTest).Delete(models.Job{}).Error)
+
+			rr := httptest.NewRecorder()
+			_, handlerFunc, req := bulkRequestHelper("Patient", RequestParams{resourceType: "Coverage", outputFormat: tt.outputFormat})
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(acoUnderTest)))
+
+			handlerFunc(rr, req)
+
+			assert.Equal(t, http.StatusAccepted, rr.Code)
+			var job models.Job
+			assert.NoError(t, s.db.Last(&job, "aco_id = ?", acoUnderTest).Error)
+			assert.Equal(t, tt.expFormat, job.OutputFormat)
+		})
+	}
+}
+
 func (s *APITestSuite) TestBulkPatientRequestBBClientFailure() {
 	bulkPatientRequestBBClientFailureHelper("Patient", s)
 	s.TearDownTest()
@@ -365,6 +731,15 @@ func bulkEOBRequestHelper(endpoint, since string, s *APITestSuite) {
 
 	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
 
+	var job models.Job
+	assert.NoError(s.T(), s.db.Last(&job, "aco_id = ?", acoID).Error)
+	assert.Equal(s.T(), constants.V1Version, job.Version)
+
+	// The job's queue jobs are relayed from the outbox to the queue once the job is created
+	outboxed, err := models.CountOutboxJobs(s.db, job.ID)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, outboxed)
+
 	s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{})
 }
 
@@ -747,7 +1122,7 @@ func bulkCoverageRequestInvalidOutputHelper(endpoint, outputFormat string, s *AP
 
 	assert.Equal(s.T(), responseutils.Error, respOO.Issue[0].Severity)
 	assert.Equal(s.T(), responseutils.Exception, respOO.Issue[0].Code)
-	assert.Equal(s.T(), "_outputFormat parameter must be application/fhir+ndjson, application/ndjson, or ndjson", respOO.Issue[0].Details.Coding[0].Display)
+	assert.Equal(s.T(), "_outputFormat parameter must be application/fhir+ndjson, application/ndjson, ndjson, text/csv, csv, application/vnd.apache.parquet, or parquet", respOO.Issue[0].Details.Coding[0].Display)
 	assert.Equal(s.T(), http.StatusBadRequest, s.rr.Code)
 }
 
@@ -790,11 +1165,11 @@ func bulkRequestInvalidTypeHelper(endpoint string, s *APITestSuite) {
 }
 
 func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
-	err := os.Setenv("DEPLOYMENT_TARGET", "prod")
-	assert.Nil(s.T(), err)
 	acoID := acoUnderTest
-	err = s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{}).Error
+	err := s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{}).Error
 	assert.Nil(s.T(), err)
+	assert.Nil(s.T(), models.SaveACOQuota(s.db, models.ACOQuota{ACOID: uuid.Parse(acoID), MaxConcurrentJobs: 1}))
+	defer s.db.Unscoped().Delete(models.ACOQuota{}, "aco_id = ?", acoID)
 
 	firstRequestParams := RequestParams{resourceType: "ExplanationOfBenefit"}
 	requestUrl, handlerFunc, req := bulkRequestHelper(endpoint, firstRequestParams)
@@ -816,6 +1191,9 @@ func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
 	assert.Equal(s.T(), http.StatusTooManyRequests, s.rr.Code)
+	retryAfter, err := strconv.Atoi(s.rr.Header().Get("Retry-After"))
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), retryAfter >= 60, "Retry-After %d", retryAfter)
 
 	// change status to Pending and serve job
 	var job models.Job
@@ -848,6 +1226,17 @@ func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
 	s.db.Where("aco_id = ?", acoID).Last(&lastRequestJob)
 	s.db.Unscoped().Delete(&lastRequestJob)
 
+	// change status to Cancelled and serve job
+	err = s.db.Find(&job, "id = ?", j.ID).Error
+	assert.Nil(s.T(), err)
+	assert.Nil(s.T(), s.db.Model(&job).Update("status", "Cancelled").Error)
+	s.rr = httptest.NewRecorder()
+	handler.ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
+	lastRequestJob = models.Job{}
+	s.db.Where("aco_id = ?", acoID).Last(&lastRequestJob)
+	s.db.Unscoped().Delete(&lastRequestJob)
+
 	// change status to Archived
 	err = s.db.Find(&job, "id = ?", j.ID).Error
 	assert.Nil(s.T(), err)
@@ -887,6 +1276,7 @@ func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
 	handler.ServeHTTP(s.rr, req)
 	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
 
+	// every running job counts towards the limit, whatever resource types it exports
 	secondRequestParams := RequestParams{resourceType: "Patient"}
 	_, handlerFunc, req = bulkRequestHelper(endpoint, secondRequestParams)
 	ad = makeContextValues(acoID)
@@ -894,7 +1284,7 @@ func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
 	handler = http.HandlerFunc(handlerFunc)
 	s.rr = httptest.NewRecorder()
 	handler.ServeHTTP(s.rr, req)
-	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
+	assert.Equal(s.T(), http.StatusTooManyRequests, s.rr.Code)
 
 	// do another patient call behind this one
 	s.rr = httptest.NewRecorder()
@@ -904,16 +1294,14 @@ func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
 	lastRequestJob = models.Job{}
 	s.db.Where("aco_id = ?", acoID).Last(&lastRequestJob)
 	s.db.Unscoped().Delete(&lastRequestJob)
-
-	os.Unsetenv("DEPLOYMENT_TARGET")
 }
 
 func bulkConcurrentRequestTimeHelper(endpoint string, s *APITestSuite) {
-	err := os.Setenv("DEPLOYMENT_TARGET", "prod")
-	assert.Nil(s.T(), err)
 	acoID := acoUnderTest
-	err = s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{}).Error
+	err := s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{}).Error
 	assert.Nil(s.T(), err)
+	assert.Nil(s.T(), models.SaveACOQuota(s.db, models.ACOQuota{ACOID: uuid.Parse(acoID), MaxConcurrentJobs: 1}))
+	defer s.db.Unscoped().Delete(models.ACOQuota{}, "aco_id = ?", acoID)
 
 	requestParams := RequestParams{resourceType: "ExplanationOfBenefit"}
 	requestUrl, handlerFunc, req := bulkRequestHelper(endpoint, requestParams)
@@ -945,7 +1333,6 @@ func bulkConcurrentRequestTimeHelper(endpoint string, s *APITestSuite) {
 	s.rr = httptest.NewRecorder()
 	handler.ServeHTTP(s.rr, req)
 	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
-	os.Unsetenv("DEPLOYMENT_TARGET")
 }
 
 func validateRequestHelper(endpoint string, s *APITestSuite) {
@@ -1117,6 +1504,113 @@ func (s *APITestSuite) TestJobStatusJobDoesNotExist() {
 	assert.Equal(s.T(), responseutils.DbErr, respOO.Issue[0].Details.Coding[0].Code)
 }
 
+func (s *APITestSuite) TestListJobs() {
+	aco := models.ACO{Name: "Job List Test ACO", UUID: uuid.NewRandom()}
+	s.db.Create(&aco)
+	defer s.db.Unscoped().Delete(&aco)
+
+	otherACOID := uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	jobs := []models.Job{
+		{ACOID: aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: "Completed", JobCount: 1, CompletedJobCount: 1},
+		{ACOID: aco.UUID, RequestURL: "/api/v1/Group/all/$export", Status: "In Progress", JobCount: 4, CompletedJobCount: 1},
+		{ACOID: aco.UUID, RequestURL: "/api/v1/Patient/$export?_type=Coverage", Status: "Pending"},
+		{ACOID: otherACOID, RequestURL: "/api/v1/Patient/$export", Status: "Pending"},
+	}
+	for i := range jobs {
+		s.db.Save(&jobs[i])
+		// Ensure the jobs have distinct creation times
+		s.db.Model(&jobs[i]).UpdateColumn("created_at", time.Now().Add(time.Duration(i-len(jobs))*time.Hour))
+		defer s.db.Unscoped().Delete(&jobs[i])
+	}
+	createdAfter := time.Now().Add(time.Duration(-len(jobs)) * time.Hour).Add(time.Minute)
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		expIDs   []uint
+		expTotal int
+		expNext  bool
+	}{
+		{"AllJobs", url.Values{}, []uint{jobs[2].ID, jobs[1].ID, jobs[0].ID}, 3, false},
+		{"Status", url.Values{"status": {"Pending,In Progress"}}, []uint{jobs[2].ID, jobs[1].ID}, 2, false},
+		{"CreatedAfter", url.Values{"createdAfter": {createdAfter.Format(time.RFC3339Nano)}}, []uint{jobs[2].ID, jobs[1].ID}, 2, false},
+		{"FirstPage", url.Values{"_count": {"2"}}, []uint{jobs[2].ID, jobs[1].ID}, 3, true},
+		{"LastPage", url.Values{"_count": {"2"}, "page": {"2"}}, []uint{jobs[0].ID}, 3, false},
+		{"PastLastPage", url.Values{"_count": {"2"}, "page": {"3"}}, []uint{}, 3, false},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/api/v1/jobs?"+tt.query.Encode(), nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(aco.UUID.String())))
+
+			ListJobs(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			var body api.JobListBody
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, tt.expTotal, body.Total)
+
+			ids := []uint{}
+			for _, j := range body.Jobs {
+				ids = append(ids, j.ID)
+				assert.Equal(t, fmt.Sprintf("http://example.com/api/v1/jobs/%d", j.ID), j.URL)
+			}
+			assert.Equal(t, tt.expIDs, ids)
+
+			if tt.expNext {
+				next, err := url.Parse(body.Next)
+				assert.NoError(t, err)
+				assert.Equal(t, strconv.Itoa(body.Page+1), next.Query().Get("page"))
+			} else {
+				assert.Empty(t, body.Next)
+			}
+		})
+	}
+
+	// Verify the fields of an individual job
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/jobs?status=In%20Progress", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(aco.UUID.String())))
+	ListJobs(rr, req)
+	var body api.JobListBody
+	assert.NoError(s.T(), json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Len(s.T(), body.Jobs, 1)
+	assert.Equal(s.T(), "/api/v1/Group/all/$export", body.Jobs[0].RequestURL)
+	assert.Equal(s.T(), "In Progress", body.Jobs[0].Status)
+	assert.Equal(s.T(), "In Progress (25%)", body.Jobs[0].Progress)
+}
+
+func (s *APITestSuite) TestListJobsInvalidParameters() {
+	tests := []struct {
+		name   string
+		query  string
+		expErr string
+	}{
+		{"InvalidStatus", "status=Running", "Invalid parameter: Running is not a valid job status"},
+		{"InvalidCreatedAfter", "createdAfter=2020-01-01", "Invalid parameter: createdAfter must be in the FHIR Instant format"},
+		{"InvalidPage", "page=0", "Invalid parameter: page must be a positive integer"},
+		{"InvalidCount", "_count=1000", "Invalid parameter: _count must be an integer between 1 and 100"},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/api/v1/jobs?"+tt.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, makeContextValues(acoUnderTest)))
+
+			ListJobs(rr, req)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			var respOO fhirmodels.OperationOutcome
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &respOO))
+			assert.Equal(t, responseutils.RequestErr, respOO.Issue[0].Details.Coding[0].Code)
+			assert.Equal(t, tt.expErr, respOO.Issue[0].Details.Coding[0].Display)
+		})
+	}
+}
+
 func (s *APITestSuite) TestJobStatusPending() {
 	j := models.Job{
 		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
@@ -1240,7 +1734,7 @@ func (s *APITestSuite) TestJobStatusCompleted() {
 	fmt.Println(str)
 	assertExpiryEquals(s.Suite, j.CreatedAt.Add(api.GetJobTimeout()), s.rr.Header().Get("Expires"))
 
-	var rb api.BulkResponseBody
+	var rb manifest.BulkResponseBody
 	err := json.Unmarshal(s.rr.Body.Bytes(), &rb)
 	if err != nil {
 		s.T().Error(err)
@@ -1278,6 +1772,7 @@ func (s *APITestSuite) TestJobStatusCompletedErrorFileExists() {
 		JobID:        j.ID,
 		FileName:     fileName,
 		ResourceType: "ExplanationOfBenefit",
+		HasErrorFile: true,
 	}
 	s.db.Save(&jobKey)
 	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
@@ -1311,7 +1806,7 @@ func (s *APITestSuite) TestJobStatusCompletedErrorFileExists() {
 	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
 	assert.Equal(s.T(), "application/json", s.rr.Header().Get("Content-Type"))
 
-	var rb api.BulkResponseBody
+	var rb manifest.BulkResponseBody
 	err = json.Unmarshal(s.rr.Body.Bytes(), &rb)
 	if err != nil {
 		s.T().Error(err)
@@ -1331,6 +1826,48 @@ func (s *APITestSuite) TestJobStatusCompletedErrorFileExists() {
 	os.Remove(errFilePath)
 }
 
+func (s *APITestSuite) TestJobStatusPartiallyCompleted() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=Patient,Coverage",
+		Status:     models.JobStatusPartiallyCompleted,
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	// The Coverage queue job failed, so it only has an error file
+	succeeded := models.JobKey{JobID: j.ID, FileName: uuid.NewRandom().String() + ".ndjson", ResourceType: "Patient"}
+	failed := models.JobKey{JobID: j.ID, FileName: uuid.NewRandom().String() + ".ndjson", ResourceType: "Coverage", Failed: true,
+		HasErrorFile: true}
+	s.db.Save(&succeeded)
+	s.db.Save(&failed)
+
+	payloadDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), j.ID)
+	assert.NoError(s.T(), os.MkdirAll(payloadDir, os.ModePerm))
+	defer os.RemoveAll(payloadDir)
+	errFileName := strings.TrimSuffix(failed.FileName, ".ndjson") + "-error.ndjson"
+	assert.NoError(s.T(), ioutil.WriteFile(fmt.Sprintf("%s/%s", payloadDir, errFileName), []byte("{}\n"), 0600))
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	http.HandlerFunc(JobStatus).ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+
+	var rb manifest.BulkResponseBody
+	assert.NoError(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &rb))
+	assert.Len(s.T(), rb.Files, 1)
+	assert.Equal(s.T(), "Patient", rb.Files[0].Type)
+	assert.Len(s.T(), rb.Errors, 1)
+	assert.Equal(s.T(), fmt.Sprintf("http://example.com/data/%d/%s", j.ID, errFileName), rb.Errors[0].URL)
+	assert.NotNil(s.T(), rb.Extension)
+	assert.True(s.T(), rb.Extension.Partial)
+}
+
 func (s *APITestSuite) TestJobStatusExpired() {
 	j := models.Job{
 		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
@@ -1412,6 +1949,473 @@ func (s *APITestSuite) TestJobStatusArchived() {
 	s.db.Unscoped().Delete(&j)
 }
 
+func (s *APITestSuite) TestJobStatusCancelled() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Cancelled",
+	}
+
+	s.db.Save(&j)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+
+	handler := http.HandlerFunc(JobStatus)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+	handler.ServeHTTP(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusNotFound, s.rr.Code)
+	s.db.Unscoped().Delete(&j)
+}
+
+func (s *APITestSuite) TestDeleteJob() {
+	origStaging := os.Getenv("FHIR_STAGING_DIR")
+	defer os.Setenv("FHIR_STAGING_DIR", origStaging)
+	stagingDir, err := ioutil.TempDir("", "staging")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(stagingDir)
+	os.Setenv("FHIR_STAGING_DIR", stagingDir)
+
+	pool := makeConnPool(s)
+	defer pool.Close()
+
+	tests := []struct {
+		status       string
+		expCode      int
+		expStatus    models.JobStatus
+		expRemovedFS bool
+	}{
+		{"Pending", http.StatusAccepted, "Cancelled", true},
+		{"In Progress", http.StatusAccepted, "Cancelled", true},
+		{"Completed", http.StatusGone, "Completed", false},
+		{"Failed", http.StatusGone, "Failed", false},
+		{"Cancelled", http.StatusGone, "Cancelled", false},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.status, func(t *testing.T) {
+			j := models.Job{
+				ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+				RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+				Status:     models.JobStatus(tt.status),
+				JobCount:   1,
+			}
+			s.db.Save(&j)
+			defer s.db.Unscoped().Delete(&j)
+
+			jobStaging := fmt.Sprintf("%s/%d", stagingDir, j.ID)
+			assert.NoError(t, os.MkdirAll(jobStaging, os.ModePerm))
+			assert.NoError(t, ioutil.WriteFile(fmt.Sprintf("%s/%s.ndjson", jobStaging, uuid.NewRandom()), []byte("{}"), 0600))
+
+			req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			ad := makeContextValues("DBBD1CE1-AE24-435C-807D-ED45953077D3")
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(DeleteJob).ServeHTTP(rr, req)
+			assert.Equal(t, tt.expCode, rr.Code)
+
+			var job models.Job
+			assert.NoError(t, s.db.First(&job, j.ID).Error)
+			assert.Equal(t, tt.expStatus, job.Status)
+
+			_, err := os.Stat(jobStaging)
+			assert.Equal(t, tt.expRemovedFS, os.IsNotExist(err))
+		})
+	}
+}
+
+func (s *APITestSuite) TestDeleteJobRemovesQueueJobs() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=ExplanationOfBenefit",
+		Status:     "Pending",
+		JobCount:   2,
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	pool := makeConnPool(s)
+	defer pool.Close()
+	qc := que.NewClient(pool)
+	for i := 0; i < 2; i++ {
+		args, err := json.Marshal(models.JobEnqueueArgs{ID: int(j.ID), ACOID: j.ACOID.String(), ResourceType: "Patient"})
+		assert.NoError(s.T(), err)
+		// Schedule the jobs in the future so the worker does not pick them up during the test
+		assert.NoError(s.T(), qc.Enqueue(&que.Job{Type: "ProcessJob", Args: args, RunAt: time.Now().Add(time.Hour)}))
+	}
+	args, err := json.Marshal(models.JobEnqueueArgs{ID: int(j.ID), ACOID: j.ACOID.String(), ResourceType: "Coverage"})
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), models.AddToOutbox(s.db, j.ID, []*que.Job{{Type: "ProcessJob", Args: args}}))
+
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	http.HandlerFunc(DeleteJob).ServeHTTP(s.rr, req)
+	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
+
+	var count int
+	err = pool.QueryRow(`SELECT count(*) FROM que_jobs WHERE args->>'ID' = $1`, fmt.Sprint(j.ID)).Scan(&count)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, count)
+	count, err = models.CountOutboxJobs(s.db, j.ID)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, count)
+}
+
+func (s *APITestSuite) TestJobStatusCompletedFileMetadata() {
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export?_type=Patient",
+		Status:     "Completed",
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	checksum := strings.Repeat("ab", 32)
+	jobKeys := []models.JobKey{
+		{JobID: j.ID, FileName: "with-checksum.ndjson", ResourceType: "Patient", Checksum: checksum, FileSize: 2048, ResourceCount: 10},
+		{JobID: j.ID, FileName: "without-checksum.ndjson", ResourceType: "Patient"},
+		{JobID: j.ID, FileName: "encrypted.ndjson", ResourceType: "Patient", Checksum: checksum, FileSize: 4096, ResourceCount: 20,
+			EncryptedKey: "a2V5", Nonce: "bm9uY2U=", HasErrorFile: true, ErrorEncryptedKey: "ZXJyb3Iga2V5",
+			ErrorNonce: "ZXJyb3Igbm9uY2U=", ErrorChecksum: checksum, ErrorFileSize: 512},
+		{JobID: j.ID, FileName: "with-claim-type.ndjson", ResourceType: "ExplanationOfBenefit", Checksum: checksum, FileSize: 1024,
+			ResourceCount: 5, ClaimType: "carrier"},
+	}
+	for i := range jobKeys {
+		assert.NoError(s.T(), s.db.Save(&jobKeys[i]).Error)
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	JobStatus(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	var rb manifest.BulkResponseBody
+	assert.NoError(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &rb))
+	assert.Len(s.T(), rb.Files, 4)
+	for _, fi := range rb.Files {
+		if strings.HasSuffix(fi.URL, "/with-checksum.ndjson") {
+			assert.Equal(s.T(), 10, fi.Count)
+			assert.Equal(s.T(), &manifest.FileItemExtension{Checksum: "sha256:" + checksum, FileSize: 2048}, fi.Extension)
+		} else if strings.HasSuffix(fi.URL, "/encrypted.ndjson") {
+			assert.Equal(s.T(), 20, fi.Count)
+			assert.Equal(s.T(), &manifest.FileItemExtension{Checksum: "sha256:" + checksum, FileSize: 4096,
+				Encryption: &manifest.FileEncryption{Algorithm: encryption.Algorithm, EncryptedKey: "a2V5", Nonce: "bm9uY2U="}}, fi.Extension)
+		} else if strings.HasSuffix(fi.URL, "/with-claim-type.ndjson") {
+			assert.Equal(s.T(), "ExplanationOfBenefit", fi.Type)
+			assert.Equal(s.T(), &manifest.FileItemExtension{Checksum: "sha256:" + checksum, FileSize: 1024, ClaimType: "carrier"},
+				fi.Extension)
+		} else {
+			assert.Equal(s.T(), 0, fi.Count)
+			assert.Nil(s.T(), fi.Extension)
+		}
+	}
+
+	// Error files are encrypted along with the files they accompany
+	if assert.Len(s.T(), rb.Errors, 1) {
+		assert.True(s.T(), strings.HasSuffix(rb.Errors[0].URL, "/encrypted-error.ndjson"))
+		assert.Equal(s.T(), &manifest.FileItemExtension{Checksum: "sha256:" + checksum, FileSize: 512,
+			Encryption: &manifest.FileEncryption{Algorithm: encryption.Algorithm, EncryptedKey: "ZXJyb3Iga2V5",
+				Nonce: "ZXJyb3Igbm9uY2U="}}, rb.Errors[0].Extension)
+	}
+}
+
+func (s *APITestSuite) TestJobStatusCompletedTabularFileMetadata() {
+	j := models.Job{
+		ACOID:        uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL:   "/api/v1/Patient/$export?_type=ExplanationOfBenefit&_outputFormat=text/csv",
+		Status:       "Completed",
+		OutputFormat: "csv",
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	checksum := strings.Repeat("ab", 32)
+	jobKeys := []models.JobKey{
+		{JobID: j.ID, FileName: "eob.csv", ResourceType: "ExplanationOfBenefit", Checksum: checksum, FileSize: 2048, ResourceCount: 10},
+		{JobID: j.ID, FileName: "eob-eob_line.csv", ResourceType: "ExplanationOfBenefit", Checksum: checksum, FileSize: 4096,
+			ResourceCount: 25, OutputTable: "eob_line"},
+	}
+	for i := range jobKeys {
+		assert.NoError(s.T(), s.db.Save(&jobKeys[i]).Error)
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", fmt.Sprint(j.ID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	JobStatus(s.rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, s.rr.Code)
+	var rb manifest.BulkResponseBody
+	assert.NoError(s.T(), json.Unmarshal(s.rr.Body.Bytes(), &rb))
+	if assert.Len(s.T(), rb.Files, 2) {
+		// The main table's file is recorded without a table
+		assert.True(s.T(), strings.HasSuffix(rb.Files[0].URL, "/eob.csv"))
+		assert.Equal(s.T(), &manifest.FileItemExtension{Checksum: "sha256:" + checksum, FileSize: 2048, ContentType: "text/csv",
+			Table: "eob"}, rb.Files[0].Extension)
+		assert.True(s.T(), strings.HasSuffix(rb.Files[1].URL, "/eob-eob_line.csv"))
+		assert.Equal(s.T(), 25, rb.Files[1].Count)
+		assert.Equal(s.T(), &manifest.FileItemExtension{Checksum: "sha256:" + checksum, FileSize: 4096, ContentType: "text/csv",
+			Table: "eob_line"}, rb.Files[1].Extension)
+	}
+}
+
+func (s *APITestSuite) TestServeDataTabular() {
+	payloadDir, err := ioutil.TempDir("", "bcda_payload_")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+	origPayloadDir := os.Getenv("FHIR_PAYLOAD_DIR")
+	defer os.Setenv("FHIR_PAYLOAD_DIR", origPayloadDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	j := models.Job{ACOID: uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"), RequestURL: "/api/v1/Patient/$export",
+		Status: "Completed", OutputFormat: "csv"}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	jobID := fmt.Sprint(j.ID)
+	assert.NoError(s.T(), os.MkdirAll(fmt.Sprintf("%s/%s", payloadDir, jobID), os.ModePerm))
+
+	tests := []struct {
+		fileName       string
+		expContentType string
+	}{
+		{"data.csv", "text/csv"},
+		{"data.parquet", "application/vnd.apache.parquet"},
+		{"data-error.ndjson", "application/fhir+ndjson"},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.fileName, func(t *testing.T) {
+			data := []byte("data")
+			assert.NoError(t, ioutil.WriteFile(fmt.Sprintf("%s/%s/%s", payloadDir, jobID, tt.fileName), data, 0600))
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", fmt.Sprintf("/data/%s/%s", jobID, tt.fileName), nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("jobID", jobID)
+			rctx.URLParams.Add("fileName", tt.fileName)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			ServeData(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expContentType, rr.Header().Get("Content-Type"))
+			assert.Equal(t, data, rr.Body.Bytes())
+		})
+	}
+}
+
+func (s *APITestSuite) TestServeDataChecksum() {
+	payloadDir, err := ioutil.TempDir("", "bcda_payload_")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+	origPayloadDir := os.Getenv("FHIR_PAYLOAD_DIR")
+	defer os.Setenv("FHIR_PAYLOAD_DIR", origPayloadDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	j := models.Job{ACOID: uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"), RequestURL: "/api/v1/Patient/$export", Status: "Completed"}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	data := []byte(`{"resourceType":"Patient","id":"1"}` + "\n")
+	digest := sha256.Sum256(data)
+	checksum := hex.EncodeToString(digest[:])
+	jobID := fmt.Sprint(j.ID)
+	assert.NoError(s.T(), os.MkdirAll(fmt.Sprintf("%s/%s", payloadDir, jobID), os.ModePerm))
+	assert.NoError(s.T(), ioutil.WriteFile(fmt.Sprintf("%s/%s/data.ndjson", payloadDir, jobID), data, 0600))
+	assert.NoError(s.T(), s.db.Save(&models.JobKey{JobID: j.ID, FileName: "data.ndjson", ResourceType: "Patient", Checksum: checksum}).Error)
+
+	tests := []struct {
+		name      string
+		gzip      bool
+		expETag   string
+		expDigest string
+	}{
+		{"non-gzip", false, fmt.Sprintf(`"%s"`, checksum), "SHA-256=" + base64.StdEncoding.EncodeToString(digest[:])},
+		{"gzip", true, fmt.Sprintf(`W/"%s"`, checksum), ""},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", fmt.Sprintf("/data/%s/data.ndjson", jobID), nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("jobID", jobID)
+			rctx.URLParams.Add("fileName", "data.ndjson")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			if tt.gzip {
+				req.Header.Add("Accept-Encoding", "gzip")
+			}
+
+			ServeData(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.expETag, rr.Header().Get("ETag"))
+			assert.Equal(t, tt.expDigest, rr.Header().Get("Digest"))
+		})
+	}
+
+	// Conditional requests using the ETag should not return the file again
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", fmt.Sprintf("/data/%s/data.ndjson", jobID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	rctx.URLParams.Add("fileName", "data.ndjson")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	req.Header.Set("If-None-Match", fmt.Sprintf(`"%s"`, checksum))
+	ServeData(rr, req)
+	assert.Equal(s.T(), http.StatusNotModified, rr.Code)
+}
+
+func (s *APITestSuite) TestServeDataEncrypted() {
+	payloadDir, err := ioutil.TempDir("", "bcda_payload_")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+	origPayloadDir := os.Getenv("FHIR_PAYLOAD_DIR")
+	defer os.Setenv("FHIR_PAYLOAD_DIR", origPayloadDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	j := models.Job{ACOID: uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"), RequestURL: "/api/v1/Patient/$export", Status: "Completed"}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	ciphertext := []byte(strings.Repeat("encrypted", 100))
+	digest := sha256.Sum256(ciphertext)
+	checksum := hex.EncodeToString(digest[:])
+	jobID := fmt.Sprint(j.ID)
+	assert.NoError(s.T(), os.MkdirAll(fmt.Sprintf("%s/%s", payloadDir, jobID), os.ModePerm))
+	assert.NoError(s.T(), ioutil.WriteFile(fmt.Sprintf("%s/%s/data.ndjson", payloadDir, jobID), ciphertext, 0600))
+	errorCiphertext := []byte(strings.Repeat("encrypted errors", 10))
+	errorDigest := sha256.Sum256(errorCiphertext)
+	assert.NoError(s.T(), ioutil.WriteFile(fmt.Sprintf("%s/%s/data-error.ndjson", payloadDir, jobID), errorCiphertext, 0600))
+	assert.NoError(s.T(), s.db.Save(&models.JobKey{JobID: j.ID, FileName: "data.ndjson", ResourceType: "Patient",
+		Checksum: checksum, FileSize: int64(len(ciphertext)), EncryptedKey: "a2V5", Nonce: "bm9uY2U=", HasErrorFile: true,
+		ErrorChecksum: hex.EncodeToString(errorDigest[:]), ErrorFileSize: int64(len(errorCiphertext)),
+		ErrorEncryptedKey: "a2V5", ErrorNonce: "bm9uY2U="}).Error)
+
+	// Encrypted files are never compressed, even for clients that accept gzip
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", fmt.Sprintf("/data/%s/data.ndjson", jobID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	rctx.URLParams.Add("fileName", "data.ndjson")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	req.Header.Set("Accept-Encoding", "gzip")
+	ServeData(rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	assert.Equal(s.T(), "application/octet-stream", rr.Header().Get("Content-Type"))
+	assert.Empty(s.T(), rr.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), fmt.Sprintf(`"%s"`, checksum), rr.Header().Get("ETag"))
+	assert.Equal(s.T(), "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]), rr.Header().Get("Digest"))
+	assert.Equal(s.T(), ciphertext, rr.Body.Bytes())
+
+	// So are their error files
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", fmt.Sprintf("/data/%s/data-error.ndjson", jobID), nil)
+	rctx = chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	rctx.URLParams.Add("fileName", "data-error.ndjson")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	req.Header.Set("Accept-Encoding", "gzip")
+	ServeData(rr, req)
+
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	assert.Equal(s.T(), "application/octet-stream", rr.Header().Get("Content-Type"))
+	assert.Empty(s.T(), rr.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), fmt.Sprintf(`"%s"`, hex.EncodeToString(errorDigest[:])), rr.Header().Get("ETag"))
+	assert.Equal(s.T(), errorCiphertext, rr.Body.Bytes())
+}
+
+func (s *APITestSuite) TestServeDataPrecompressed() {
+	payloadDir, err := ioutil.TempDir("", "bcda_payload_")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+	origPayloadDir := os.Getenv("FHIR_PAYLOAD_DIR")
+	defer os.Setenv("FHIR_PAYLOAD_DIR", origPayloadDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	j := models.Job{ACOID: uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"), RequestURL: "/api/v1/Patient/$export", Status: "Completed"}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	data := []byte(strings.Repeat(`{"resourceType":"Patient","id":"1"}`+"\n", 100))
+	digest := sha256.Sum256(data)
+	checksum := hex.EncodeToString(digest[:])
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write(data)
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), gz.Close())
+
+	// Only the precompressed file is written
+	jobID := fmt.Sprint(j.ID)
+	assert.NoError(s.T(), os.MkdirAll(fmt.Sprintf("%s/%s", payloadDir, jobID), os.ModePerm))
+	assert.NoError(s.T(), ioutil.WriteFile(fmt.Sprintf("%s/%s/data.ndjson.gz", payloadDir, jobID), compressed.Bytes(), 0600))
+	assert.NoError(s.T(), s.db.Save(&models.JobKey{JobID: j.ID, FileName: "data.ndjson", ResourceType: "Patient",
+		Checksum: checksum, FileSize: int64(len(data))}).Error)
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", fmt.Sprintf("/data/%s/data.ndjson", jobID), nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("jobID", jobID)
+		rctx.URLParams.Add("fileName", "data.ndjson")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		ServeData(rr, req)
+		return rr
+	}
+
+	// The precompressed bytes are served as-is
+	rr := serve(map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	assert.Equal(s.T(), "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), "application/fhir+ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(s.T(), strconv.Itoa(compressed.Len()), rr.Header().Get("Content-Length"))
+	assert.Equal(s.T(), "bytes", rr.Header().Get("Accept-Ranges"))
+	assert.Equal(s.T(), fmt.Sprintf(`"%s-gzip"`, checksum), rr.Header().Get("ETag"))
+	assert.Equal(s.T(), compressed.Bytes(), rr.Body.Bytes())
+
+	// Interrupted downloads can be resumed
+	etag := rr.Header().Get("ETag")
+	rr = serve(map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=10-", "If-Range": etag})
+	assert.Equal(s.T(), http.StatusPartialContent, rr.Code)
+	assert.Equal(s.T(), fmt.Sprintf("bytes 10-%d/%d", compressed.Len()-1, compressed.Len()), rr.Header().Get("Content-Range"))
+	assert.Equal(s.T(), strconv.Itoa(compressed.Len()-10), rr.Header().Get("Content-Length"))
+	assert.Equal(s.T(), compressed.Bytes()[10:], rr.Body.Bytes())
+
+	// Clients that do not accept gzip receive the decompressed file
+	rr = serve(nil)
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	assert.Empty(s.T(), rr.Header().Get("Content-Encoding"))
+	assert.Equal(s.T(), strconv.Itoa(len(data)), rr.Header().Get("Content-Length"))
+	assert.Equal(s.T(), "none", rr.Header().Get("Accept-Ranges"))
+	assert.Equal(s.T(), fmt.Sprintf(`"%s"`, checksum), rr.Header().Get("ETag"))
+	assert.Equal(s.T(), "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]), rr.Header().Get("Digest"))
+	assert.Equal(s.T(), data, rr.Body.Bytes())
+}
+
 func (s *APITestSuite) TestServeData() {
 	os.Setenv("FHIR_PAYLOAD_DIR", "../../../bcdaworker/data/test")
 
@@ -1647,6 +2651,7 @@ func makeConnPool(s *APITestSuite) *pgx.ConnPool {
 	}
 	qc := que.NewClient(pgxpool)
 	api.SetQC(qc)
+	api.SetQueuePool(pgxpool)
 
 	return pgxpool
 }
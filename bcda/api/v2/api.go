@@ -11,8 +11,13 @@ import (
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 
 	api "github.com/CMSgov/bcda-app/bcda/api"
+	"github.com/CMSgov/bcda-app/bcda/auth"
 	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/manifest"
+	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	responseutilsv2 "github.com/CMSgov/bcda-app/bcda/responseutils/v2"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 	log "github.com/sirupsen/logrus"
@@ -20,6 +25,9 @@ import (
 
 const (
 	groupAll = "all"
+
+	// apiVersion is recorded on the jobs created by this version of the API
+	apiVersion = constants.V2Version
 )
 
 /*
@@ -45,11 +53,11 @@ const (
 func BulkPatientRequest(w http.ResponseWriter, r *http.Request) {
 	resourceTypes, err := api.ValidateRequest(r)
 	if err != nil {
-		responseutils.WriteError(err, w, http.StatusBadRequest)
+		responseutilsv2.WriteError(responseutilsv2.FromSTU3(err), w, http.StatusBadRequest)
 		return
 	}
 	retrieveNewBeneHistData := false // historical data for new beneficiaries will not be retrieved (this capability is only available with /Group)
-	api.BulkRequest(resourceTypes, w, r, retrieveNewBeneHistData)
+	api.BulkRequest(apiVersion, resourceTypes, w, r, retrieveNewBeneHistData)
 }
 
 /*
@@ -79,7 +87,7 @@ func BulkGroupRequest(w http.ResponseWriter, r *http.Request) {
 	if groupID == groupAll {
 		resourceTypes, err := api.ValidateRequest(r)
 		if err != nil {
-			responseutils.WriteError(err, w, http.StatusBadRequest)
+			responseutilsv2.WriteError(responseutilsv2.FromSTU3(err), w, http.StatusBadRequest)
 			return
 		}
 
@@ -89,12 +97,318 @@ func BulkGroupRequest(w http.ResponseWriter, r *http.Request) {
 			retrieveNewBeneHistData = true
 		}
 
-		api.BulkRequest(resourceTypes, w, r, retrieveNewBeneHistData)
+		api.BulkRequest(apiVersion, resourceTypes, w, r, retrieveNewBeneHistData)
 	} else {
-		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid group ID")
-		responseutils.WriteError(oo, w, http.StatusBadRequest)
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid group ID")
+		responseutilsv2.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+}
+
+/*
+	swagger:route POST /api/v2/Group/{groupId}/$export bulkDataV2 bulkGroupPostRequest
+
+    Start data export (for the specified group identifier) for a list of patients
+
+	Initiates a job to collect data from the Blue Button API for the specified patients attributed to your ACO. The only Group identifier supported by the system is `all`.  The export parameters are supplied in the request body as a FHIR Parameters resource.  Each patient must be supplied as a `patient` parameter containing a reference to the patient's MBI (i.e., `Patient/1A00A00AA00`).  The `_type`, `_since`, and `_typeFilter` parameters behave as they do for the GET request.  If any of the patients are not attributed to the ACO, no job is created.
+
+	Consumes:
+	- application/fhir+json
+
+	Produces:
+	- application/fhir+json
+
+	Security:
+		bearer_token:
+
+	Responses:
+		202: BulkRequestResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		429: tooManyRequestsResponse
+		500: errorResponse
+*/
+func BulkGroupPostRequest(w http.ResponseWriter, r *http.Request) {
+	retrieveNewBeneHistData := false
+
+	groupID := chi.URLParam(r, "groupId")
+	if groupID != groupAll {
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid group ID")
+		responseutilsv2.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+
+	query, mbis, oo := api.ParseExportParameters(r)
+	if oo != nil {
+		responseutilsv2.WriteError(responseutilsv2.FromSTU3(oo), w, http.StatusBadRequest)
+		return
+	}
+	// The export parameters are validated and persisted (via the job's request URL) from the query string,
+	// so we move them there to be handled in the same way as a GET request.
+	r.URL.RawQuery = query.Encode()
+
+	resourceTypes, err := api.ValidateRequest(r)
+	if err != nil {
+		responseutilsv2.WriteError(responseutilsv2.FromSTU3(err), w, http.StatusBadRequest)
+		return
+	}
+
+	// Set flag to retrieve new beneficiaries' historical data if _since param is provided and feature is turned on
+	_, ok := r.URL.Query()["_since"]
+	if ok && utils.GetEnvBool("BCDA_ENABLE_NEW_GROUP", false) {
+		retrieveNewBeneHistData = true
+	}
+
+	api.BulkPatientsRequest(apiVersion, resourceTypes, mbis, w, r, retrieveNewBeneHistData)
+}
+
+/*
+	swagger:route GET /api/v2/jobs/{jobId} bulkDataV2 jobStatus
+
+	Get job status
+
+	Returns the current status of an export job.
+
+	Produces:
+	- application/fhir+json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		202: jobStatusResponse
+		200: completedJobResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		410: goneResponse
+		500: errorResponse
+*/
+func JobStatus(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var job models.Job
+	err := db.Find(&job, "id = ?", jobID).Error
+	if err != nil {
+		log.Error(err)
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutilsv2.WriteError(oo, w, http.StatusNotFound)
 		return
 	}
+
+	switch job.Status {
+
+	case models.JobStatusFailed:
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.InternalErr, "Service encountered numerous errors.  Unable to complete the request.")
+		responseutilsv2.WriteError(oo, w, http.StatusInternalServerError)
+	case models.JobStatusPending:
+		fallthrough
+	case models.JobStatusInProgress:
+		w.Header().Set("X-Progress", job.StatusMessage())
+		w.WriteHeader(http.StatusAccepted)
+	case models.JobStatusCompleted, models.JobStatusPartiallyCompleted:
+		// If the job should be expired, but the cleanup job hasn't run for some reason, still respond with 410
+		if job.UpdatedAt.Add(api.GetJobTimeout()).Before(time.Now()) {
+			w.Header().Set("Expires", job.UpdatedAt.Add(api.GetJobTimeout()).String())
+			oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Deleted, "")
+			responseutilsv2.WriteError(oo, w, http.StatusGone)
+			return
+		}
+		scheme := "http"
+		if servicemux.IsHTTPS(r) {
+			scheme = "https"
+		}
+
+		jobKeys, err := models.GetJobKeys(db, job.ID)
+		if err != nil {
+			log.Error(err)
+			oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+			responseutilsv2.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+		jsonData, err := json.Marshal(manifest.New(job, jobKeys, scheme, r.Host))
+		if err != nil {
+			oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
+			responseutilsv2.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Expires", job.UpdatedAt.Add(api.GetJobTimeout()).String())
+		if _, err = w.Write(jsonData); err != nil {
+			log.Error(err)
+		}
+	case models.JobStatusCancelled:
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Not_found, "Job has been cancelled")
+		responseutilsv2.WriteError(oo, w, http.StatusNotFound)
+	case models.JobStatusArchived:
+		fallthrough
+	case models.JobStatusExpired:
+		w.Header().Set("Expires", job.UpdatedAt.Add(api.GetJobTimeout()).String())
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Deleted, "")
+		responseutilsv2.WriteError(oo, w, http.StatusGone)
+	}
+}
+
+/*
+	swagger:route DELETE /api/v2/jobs/{jobId} bulkDataV2 deleteJob
+
+	Cancel a job
+
+	Cancels a currently running export job. Any files that have been generated by the job are removed.
+
+	Produces:
+	- application/fhir+json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		202: deleteJobResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		410: goneResponse
+		500: errorResponse
+*/
+func DeleteJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var job models.Job
+	err := db.Find(&job, "id = ?", jobID).Error
+	if err != nil {
+		log.Error(err)
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutilsv2.WriteError(oo, w, http.StatusNotFound)
+		return
+	}
+
+	status := job.Status
+	cancelled, err := api.CancelJob(db, &job)
+	if err != nil {
+		log.Error(err)
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutilsv2.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	if !cancelled {
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Deleted,
+			fmt.Sprintf("Job is no longer running and cannot be cancelled. Current status: %s", status))
+		responseutilsv2.WriteError(oo, w, http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/*
+	swagger:route GET /api/v2/jobs bulkDataV2 listJobs
+
+	List jobs
+
+	Returns the export jobs requested by your ACO, ordered from most to least recent.  Jobs may be filtered by status and creation time.
+
+	Produces:
+	- application/json
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		200: jobListResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		500: errorResponse
+*/
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	ad, ok := r.Context().Value(auth.AuthDataContextKey).(auth.AuthData)
+	if !ok {
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.TokenErr, "")
+		responseutilsv2.WriteError(oo, w, http.StatusUnauthorized)
+		return
+	}
+
+	params, err := api.ParseJobListParams(r)
+	if err != nil {
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, err.Error())
+		responseutilsv2.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	jobs, total, err := api.FindJobs(db, ad.ACOID, params)
+	if err != nil {
+		log.Error(err)
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutilsv2.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if servicemux.IsHTTPS(r) {
+		scheme = "https"
+	}
+	jsonData, err := json.Marshal(api.NewJobListBody(r, scheme, params, jobs, total))
+	if err != nil {
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
+		responseutilsv2.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonData); err != nil {
+		log.Error(err)
+	}
+}
+
+/*
+	swagger:route GET /data/v2/{jobId}/{filename} bulkDataV2 serveData
+
+	Get data file
+
+	Returns the NDJSON file of data generated by an export job.  Will be in the format <UUID>.ndjson.  Get the full value from the job status response.  Clients that accept gzip encoding may resume interrupted downloads using Range requests.  Jobs requested with a tabular _outputFormat return CSV (<UUID>.csv) or Parquet (<UUID>.parquet) files of flattened tables, with a matching Content-Type.
+
+	Produces:
+	- application/fhir+json
+	- text/csv
+	- application/vnd.apache.parquet
+
+	Schemes: http, https
+
+	Security:
+		bearer_token:
+
+	Responses:
+		200: FileNDJSON
+		400: badRequestResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		500: errorResponse
+*/
+func ServeData(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	fileName := chi.URLParam(r, "fileName")
+
+	// http.ServeFile reports a missing file as plain text, so we check for it first to return an OperationOutcome
+	if !api.DataFileExists(jobID, fileName) {
+		oo := responseutilsv2.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Not_found, "")
+		responseutilsv2.WriteError(oo, w, http.StatusNotFound)
+		return
+	}
+
+	api.ServeJobFile(w, r, jobID, fileName)
 }
 
 /*
@@ -129,8 +443,7 @@ func Metadata(w http.ResponseWriter, r *http.Request) {
 		Date:      dt.Format(dateFormat),
 		Publisher: getStringPtr("Centers for Medicare & Medicaid Services"),
 		Kind:      fhir.CapabilityStatementKindInstance,
-		// TODO (BCDA-3732): Update to r4 once endpoint is available
-		Instantiates: []string{bbServer + "/baseDstu3/metadata/", "http://hl7.org/fhir/uv/bulkdata/CapabilityStatement/bulk-data"},
+		Instantiates: []string{bbServer + "/v2/fhir/metadata/", "http://hl7.org/fhir/uv/bulkdata/CapabilityStatement/bulk-data"},
 		Software: &fhir.CapabilityStatementSoftware{
 			Name:        "Beneficiary Claims Data API",
 			Version:     &constants.Version,
@@ -1,17 +1,267 @@
 package v2_test
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
-	v2 "github.com/CMSgov/bcda-app/bcda/api/v2"
+	"github.com/go-chi/chi"
+	"github.com/jackc/pgx"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	api "github.com/CMSgov/bcda-app/bcda/api"
+	v2 "github.com/CMSgov/bcda-app/bcda/api/v2"
+	"github.com/CMSgov/bcda-app/bcda/auth"
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/manifest"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
 )
 
+type APITestSuite struct {
+	suite.Suite
+	db  *gorm.DB
+	aco models.ACO
+}
+
+func (s *APITestSuite) SetupTest() {
+	models.InitializeGormModels()
+	s.db = database.GetGORMDbConnection()
+	s.aco = models.ACO{Name: "V2 API Test ACO", UUID: uuid.NewRandom()}
+	assert.NoError(s.T(), s.db.Create(&s.aco).Error)
+}
+
+func (s *APITestSuite) TearDownTest() {
+	var jobs []models.Job
+	s.db.Find(&jobs, "aco_id = ?", s.aco.UUID.String())
+	for _, j := range jobs {
+		s.db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+		s.db.Unscoped().Delete(&j)
+	}
+	s.db.Unscoped().Delete(&s.aco)
+	database.Close(s.db)
+}
+
+func TestAPITestSuite(t *testing.T) {
+	suite.Run(t, new(APITestSuite))
+}
+
+func (s *APITestSuite) TestJobStatusCompleted() {
+	j := s.createJob(constants.V2Version, "Completed")
+	fileName := fmt.Sprintf("%s.ndjson", uuid.NewRandom().String())
+	assert.NoError(s.T(), s.db.Create(&models.JobKey{JobID: j.ID, FileName: fileName, ResourceType: "Patient", ResourceCount: 1}).Error)
+
+	rr := httptest.NewRecorder()
+	v2.JobStatus(rr, s.jobRequest("GET", j))
+
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	var rb manifest.BulkResponseBody
+	assert.NoError(s.T(), json.Unmarshal(rr.Body.Bytes(), &rb))
+	assert.Len(s.T(), rb.Files, 1)
+	assert.Equal(s.T(), fmt.Sprintf("http://example.com/data/v2/%d/%s", j.ID, fileName), rb.Files[0].URL)
+	assert.Equal(s.T(), 1, rb.Files[0].Count)
+}
+
+func (s *APITestSuite) TestJobStatusErrors() {
+	tests := []struct {
+		status        string
+		expStatusCode int
+		expCode       string
+	}{
+		{"Failed", http.StatusInternalServerError, responseutils.InternalErr},
+		{"Cancelled", http.StatusNotFound, responseutils.Not_found},
+		{"Expired", http.StatusGone, responseutils.Deleted},
+		{"Archived", http.StatusGone, responseutils.Deleted},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.status, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			v2.JobStatus(rr, s.jobRequest("GET", s.createJob(constants.V2Version, models.JobStatus(tt.status))))
+
+			assert.Equal(t, tt.expStatusCode, rr.Code)
+			assertOpOutcome(t, rr, tt.expCode)
+		})
+	}
+
+	// Job does not exist
+	rr := httptest.NewRecorder()
+	v2.JobStatus(rr, s.jobRequest("GET", models.Job{}))
+	assert.Equal(s.T(), http.StatusNotFound, rr.Code)
+	assertOpOutcome(s.T(), rr, responseutils.DbErr)
+}
+
+// Errors found while kicking off an export are reported as R4 OperationOutcomes
+func (s *APITestSuite) TestBulkRequestErrors() {
+	tests := []struct {
+		name          string
+		handler       http.HandlerFunc
+		url           string
+		groupID       string
+		expStatusCode int
+		expCode       string
+	}{
+		{"InvalidType", v2.BulkPatientRequest, "/api/v2/Patient/$export?_type=Foo", "", http.StatusBadRequest, responseutils.RequestErr},
+		{"InvalidSince", v2.BulkGroupRequest, "/api/v2/Group/all/$export?_since=yesterday", "all", http.StatusBadRequest,
+			responseutils.FormatErr},
+		{"InvalidGroup", v2.BulkGroupRequest, "/api/v2/Group/foo/$export", "foo", http.StatusBadRequest, responseutils.RequestErr},
+		// The request has not been authenticated
+		{"NoAuthData", v2.BulkPatientRequest, "/api/v2/Patient/$export", "", http.StatusUnauthorized, responseutils.TokenErr},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("groupId", tt.groupID)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+
+			assert.Equal(t, tt.expStatusCode, rr.Code)
+			assertOpOutcome(t, rr, tt.expCode)
+		})
+	}
+}
+
+func (s *APITestSuite) TestJobStatusInProgress() {
+	rr := httptest.NewRecorder()
+	v2.JobStatus(rr, s.jobRequest("GET", s.createJob(constants.V2Version, "In Progress")))
+
+	assert.Equal(s.T(), http.StatusAccepted, rr.Code)
+	assert.Equal(s.T(), "In Progress", rr.Header().Get("X-Progress"))
+}
+
+func (s *APITestSuite) TestDeleteJob() {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	assert.NoError(s.T(), err)
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: pgxcfg})
+	assert.NoError(s.T(), err)
+	defer pool.Close()
+	api.SetQueuePool(pool)
+
+	j := s.createJob(constants.V2Version, "Pending")
+
+	rr := httptest.NewRecorder()
+	v2.DeleteJob(rr, s.jobRequest("DELETE", j))
+	assert.Equal(s.T(), http.StatusAccepted, rr.Code)
+	assert.NoError(s.T(), s.db.First(&j, j.ID).Error)
+	assert.Equal(s.T(), models.JobStatusCancelled, j.Status)
+
+	// The job can no longer be cancelled
+	rr = httptest.NewRecorder()
+	v2.DeleteJob(rr, s.jobRequest("DELETE", j))
+	assert.Equal(s.T(), http.StatusGone, rr.Code)
+	oo := assertOpOutcome(s.T(), rr, responseutils.Deleted)
+	assert.Equal(s.T(), "Job is no longer running and cannot be cancelled. Current status: Cancelled", *oo.Issue[0].Details.Text)
+}
+
+func (s *APITestSuite) TestListJobs() {
+	v1Job := s.createJob(constants.V1Version, "Completed")
+	v2Job := s.createJob(constants.V2Version, "Pending")
+
+	rr := httptest.NewRecorder()
+	v2.ListJobs(rr, s.listRequest(""))
+
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	var body api.JobListBody
+	assert.NoError(s.T(), json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(s.T(), 2, body.Total)
+	urls := map[uint]string{}
+	for _, j := range body.Jobs {
+		urls[j.ID] = j.URL
+	}
+	// Each job's status is found in the version of the API that created it
+	assert.Equal(s.T(), fmt.Sprintf("http://example.com/api/v1/jobs/%d", v1Job.ID), urls[v1Job.ID])
+	assert.Equal(s.T(), fmt.Sprintf("http://example.com/api/v2/jobs/%d", v2Job.ID), urls[v2Job.ID])
+
+	rr = httptest.NewRecorder()
+	v2.ListJobs(rr, s.listRequest("status=Running"))
+	assert.Equal(s.T(), http.StatusBadRequest, rr.Code)
+	oo := assertOpOutcome(s.T(), rr, responseutils.RequestErr)
+	assert.Equal(s.T(), "Invalid parameter: Running is not a valid job status", *oo.Issue[0].Details.Text)
+}
+
+func (s *APITestSuite) TestServeData() {
+	payloadDir, err := ioutil.TempDir("", "bcda_payload_")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+	origPayloadDir := os.Getenv("FHIR_PAYLOAD_DIR")
+	defer os.Setenv("FHIR_PAYLOAD_DIR", origPayloadDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	j := s.createJob(constants.V2Version, "Completed")
+	jobID := fmt.Sprint(j.ID)
+	data := `{"resourceType":"Patient","id":"1"}` + "\n"
+	assert.NoError(s.T(), os.MkdirAll(fmt.Sprintf("%s/%s", payloadDir, jobID), os.ModePerm))
+	assert.NoError(s.T(), ioutil.WriteFile(fmt.Sprintf("%s/%s/data.ndjson", payloadDir, jobID), []byte(data), 0600))
+
+	rr := httptest.NewRecorder()
+	v2.ServeData(rr, s.dataRequest(jobID, "data.ndjson"))
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	assert.Equal(s.T(), "application/fhir+ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(s.T(), data, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	v2.ServeData(rr, s.dataRequest(jobID, "missing.ndjson"))
+	assert.Equal(s.T(), http.StatusNotFound, rr.Code)
+	assertOpOutcome(s.T(), rr, responseutils.Not_found)
+}
+
+func (s *APITestSuite) createJob(version string, status models.JobStatus) models.Job {
+	j := models.Job{ACOID: s.aco.UUID, RequestURL: fmt.Sprintf("/api/%s/Patient/$export", version), Status: status, Version: version}
+	assert.NoError(s.T(), s.db.Create(&j).Error)
+	return j
+}
+
+func (s *APITestSuite) jobRequest(method string, j models.Job) *http.Request {
+	jobID := fmt.Sprint(j.ID)
+	req := httptest.NewRequest(method, fmt.Sprintf("/api/v2/jobs/%s", jobID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	return req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, s.authData()))
+}
+
+func (s *APITestSuite) listRequest(query string) *http.Request {
+	req := httptest.NewRequest("GET", "/api/v2/jobs?"+query, nil)
+	return req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, s.authData()))
+}
+
+func (s *APITestSuite) dataRequest(jobID, fileName string) *http.Request {
+	req := httptest.NewRequest("GET", fmt.Sprintf("/data/v2/%s/%s", jobID, fileName), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	rctx.URLParams.Add("fileName", fileName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func (s *APITestSuite) authData() auth.AuthData {
+	return auth.AuthData{ACOID: s.aco.UUID.String(), TokenID: uuid.NewRandom().String()}
+}
+
+// assertOpOutcome verifies that the response contains an R4 OperationOutcome with the supplied details code
+func assertOpOutcome(t *testing.T, rr *httptest.ResponseRecorder, expCode string) fhir.OperationOutcome {
+	oo, err := fhir.UnmarshalOperationOutcome(rr.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Len(t, oo.Issue, 1)
+	assert.Equal(t, fhir.IssueSeverityError, oo.Issue[0].Severity)
+	assert.Equal(t, fhir.IssueTypeException, oo.Issue[0].Code)
+	assert.Equal(t, expCode, *oo.Issue[0].Details.Coding[0].Code)
+	return oo
+}
+
 func TestMetadataResponse(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(v2.Metadata))
 	defer ts.Close()
@@ -2,13 +2,16 @@ package bcdacli
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/CMSgov/bcda-app/bcda/api"
@@ -16,15 +19,20 @@ import (
 	authclient "github.com/CMSgov/bcda-app/bcda/auth/client"
 	"github.com/CMSgov/bcda-app/bcda/cclf"
 	cclfUtils "github.com/CMSgov/bcda-app/bcda/cclf/testutils"
+	"github.com/CMSgov/bcda-app/bcda/client"
 	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/models/postgres"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/suppression"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/CMSgov/bcda-app/bcda/web"
+	"github.com/CMSgov/bcda-app/bcda/webhook"
 	"github.com/bgentry/que-go"
 	"github.com/jackc/pgx"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -45,7 +53,10 @@ func setUpApp() *cli.App {
 	app.Name = Name
 	app.Usage = Usage
 	app.Version = constants.Version
-	var acoName, acoCMSID, acoID, accessToken, threshold, acoSize, filePath, dirToDelete, environment, groupID, groupName string
+	var acoName, acoCMSID, acoID, accessToken, threshold, acoSize, filePath, dirToDelete, environment, groupID, groupName, webhookURL string
+	var maxConcurrentJobs, maxDailyRequests, maxDailyBytes string
+	var cclfFileID, concurrency, mbis, deadLetterID, jobID string
+	var rotateSecret, resetQuota, allMBIs, disablePartialExports, disableEncryption, disableClaimTypeSplit bool
 	app.Commands = []cli.Command{
 		{
 			Name:  "start-api",
@@ -70,6 +81,7 @@ func setUpApp() *cli.App {
 				qc = que.NewClient(pgxpool)
 
 				api.SetQC(qc)
+				api.SetQueuePool(pgxpool)
 
 				fmt.Fprintf(app.Writer, "%s\n", "Starting bcda...")
 				if os.Getenv("DEBUG") == "true" {
@@ -220,6 +232,171 @@ func setUpApp() *cli.App {
 				return nil
 			},
 		},
+		{
+			Name:     "set-aco-webhook",
+			Category: "Authentication tools",
+			Usage:    "Register the URL that is notified when an ACO's export jobs complete or fail",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.StringFlag{
+					Name:        "url",
+					Usage:       "Webhook URL; if not supplied, the ACO's webhook is removed",
+					Destination: &webhookURL,
+				},
+				cli.BoolFlag{
+					Name:        "rotate-secret",
+					Usage:       "Generate a new secret used to sign notifications",
+					Destination: &rotateSecret,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := setACOWebhook(acoCMSID, webhookURL, rotateSecret)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "set-aco-partial-exports",
+			Category: "Authentication tools",
+			Usage:    "Allow an ACO's jobs to complete with the files that succeeded when some of their queue jobs fail",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.BoolFlag{
+					Name:        "disable",
+					Usage:       "Fail the ACO's jobs when any of their queue jobs fail",
+					Destination: &disablePartialExports,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := setACOPartialExports(acoCMSID, !disablePartialExports)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "set-aco-encryption",
+			Category: "Authentication tools",
+			Usage:    "Encrypt the files of an ACO's jobs with the ACO's public key",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.BoolFlag{
+					Name:        "disable",
+					Usage:       "Stop encrypting the files of the ACO's jobs",
+					Destination: &disableEncryption,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := setACOEncryption(acoCMSID, !disableEncryption)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "set-aco-claim-type-split",
+			Category: "Authentication tools",
+			Usage:    "Write the ExplanationOfBenefit resources of an ACO's jobs to a file per claim type",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.BoolFlag{
+					Name:        "disable",
+					Usage:       "Write all of the ExplanationOfBenefit resources of the ACO's jobs to the same files",
+					Destination: &disableClaimTypeSplit,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := setACOClaimTypeSplit(acoCMSID, !disableClaimTypeSplit)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "set-aco-quota",
+			Category: "Authentication tools",
+			Usage:    "Set the limits placed on an ACO's export requests; a limit of 0 means the ACO is unlimited",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+				cli.StringFlag{
+					Name:        "max-concurrent-jobs",
+					Usage:       "Maximum number of jobs that may be pending or in progress",
+					Destination: &maxConcurrentJobs,
+				},
+				cli.StringFlag{
+					Name:        "max-daily-requests",
+					Usage:       "Maximum number of export requests in a 24 hour period",
+					Destination: &maxDailyRequests,
+				},
+				cli.StringFlag{
+					Name:        "max-daily-bytes",
+					Usage:       "Maximum bytes of data generated by export requests in a 24 hour period",
+					Destination: &maxDailyBytes,
+				},
+				cli.BoolFlag{
+					Name:        "reset",
+					Usage:       "Remove the ACO's quota so the default limits apply",
+					Destination: &resetQuota,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := setACOQuota(acoCMSID, maxConcurrentJobs, maxDailyRequests, maxDailyBytes, resetQuota)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "get-aco-quota",
+			Category: "Authentication tools",
+			Usage:    "Show the limits placed on an ACO's export requests",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO",
+					Destination: &acoCMSID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := getACOQuota(acoCMSID)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
 		{
 			Name:     "revoke-token",
 			Category: "Authentication tools",
@@ -358,6 +535,165 @@ func setUpApp() *cli.App {
 				return err
 			},
 		},
+		{
+			Name:     "warm-bb-id-cache",
+			Category: "Data import",
+			Usage:    "Retrieve and cache the Blue Button IDs of the beneficiaries in a CCLF8 file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of ACO whose most recently imported CCLF8 file is used",
+					Destination: &acoCMSID,
+				},
+				cli.StringFlag{
+					Name:        "file-id",
+					Usage:       "ID of the CCLF8 file; takes precedence over --cms-id",
+					Destination: &cclfFileID,
+				},
+				cli.StringFlag{
+					Name:        "concurrency",
+					Usage:       "Maximum number of requests made to Blue Button at a time",
+					Value:       "10",
+					Destination: &concurrency,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				bb, err := client.NewBlueButtonClient(client.NewConfig())
+				if err != nil {
+					return err
+				}
+				msg, err := warmBlueButtonIDCache(bb, acoCMSID, cclfFileID, concurrency)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "invalidate-bb-id-cache",
+			Category: "Cleanup",
+			Usage:    "Remove cached Blue Button IDs so they're retrieved from Blue Button the next time they're needed",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "mbis",
+					Usage:       "Comma-separated list of the MBIs whose IDs are removed",
+					Destination: &mbis,
+				},
+				cli.BoolFlag{
+					Name:        "all",
+					Usage:       "Remove every cached ID",
+					Destination: &allMBIs,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := invalidateBlueButtonIDCache(mbis, allMBIs)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "list-dead-letter-jobs",
+			Category: "Queue management",
+			Usage:    "List the queue jobs that were removed from the queue after failing too many times",
+			Action: func(c *cli.Context) error {
+				msg, err := listDeadLetterJobs()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "show-dead-letter-job",
+			Category: "Queue management",
+			Usage:    "Show the arguments and last error of a dead-lettered queue job",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of the dead-lettered job",
+					Destination: &deadLetterID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := showDeadLetterJob(deadLetterID)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "requeue-dead-letter-job",
+			Category: "Queue management",
+			Usage:    "Put a dead-lettered job back on the queue with its attempts reset",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of the dead-lettered job",
+					Destination: &deadLetterID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				pool, err := newQueuePool()
+				if err != nil {
+					return err
+				}
+				defer pool.Close()
+
+				msg, err := requeueDeadLetterJob(que.NewClient(pool), deadLetterID)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "discard-dead-letter-job",
+			Category: "Queue management",
+			Usage:    "Remove a dead-lettered job without putting it back on the queue",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of the dead-lettered job",
+					Destination: &deadLetterID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := discardDeadLetterJob(deadLetterID)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
+		{
+			Name:     "job-timeline",
+			Category: "Job management",
+			Usage:    "Show every change in a job's status",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "job-id",
+					Usage:       "ID of the job",
+					Destination: &jobID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				msg, err := jobTimeline(jobID)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(app.Writer, msg)
+				return nil
+			},
+		},
 		{
 			Name:     "delete-dir-contents",
 			Category: "Cleanup",
@@ -494,6 +830,433 @@ func createACO(name, cmsID string) (string, error) {
 	return acoUUID.String(), nil
 }
 
+// setACOWebhook registers the ACO's webhook URL, generating a signing secret if the ACO does not already have one
+// (or if rotateSecret is set). Any generated secret is included in the returned message since it cannot be retrieved later.
+func setACOWebhook(cmsID, webhookURL string, rotateSecret bool) (string, error) {
+	if cmsID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) must be provided")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return "", err
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if webhookURL == "" {
+		if err = db.Model(&aco).Updates(map[string]interface{}{"webhook_url": "", "webhook_secret": ""}).Error; err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Webhook removed for ACO %s", cmsID), nil
+	}
+
+	u, err := url.Parse(webhookURL)
+	if err != nil || !u.IsAbs() || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", errors.New("webhook URL (--url) must be an absolute HTTP(S) URL")
+	}
+	if err = webhook.CheckHost(context.Background(), u.Hostname()); err != nil {
+		return "", errors.Wrap(err, "webhook URL (--url) must resolve to a public address")
+	}
+
+	updates := map[string]interface{}{"webhook_url": webhookURL}
+	secret := ""
+	if aco.WebhookSecret == "" || rotateSecret {
+		if secret, err = webhook.GenerateSecret(); err != nil {
+			return "", err
+		}
+		updates["webhook_secret"] = secret
+	}
+
+	if err = db.Model(&aco).Updates(updates).Error; err != nil {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("Webhook saved for ACO %s", cmsID)
+	if secret != "" {
+		msg = fmt.Sprintf("%s\n%s", msg, secret)
+	}
+	return msg, nil
+}
+
+// setACOPartialExports sets whether the ACO's jobs allow partial exports when the job is requested without the
+// X-Allow-Partial-Export header
+func setACOPartialExports(cmsID string, allow bool) (string, error) {
+	if cmsID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) must be provided")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return "", err
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if err = db.Model(&aco).Update("allow_partial_exports", allow).Error; err != nil {
+		return "", err
+	}
+
+	if allow {
+		return fmt.Sprintf("Partial exports enabled for ACO %s", cmsID), nil
+	}
+	return fmt.Sprintf("Partial exports disabled for ACO %s", cmsID), nil
+}
+
+// setACOEncryption sets whether the files of the ACO's jobs are encrypted. Encryption can only be enabled for ACOs
+// with a valid public key. Jobs that have already been requested are not affected.
+func setACOEncryption(cmsID string, enable bool) (string, error) {
+	if cmsID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) must be provided")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return "", err
+	}
+
+	if enable {
+		if _, err = aco.GetPublicKey(); err != nil {
+			return "", errors.Wrap(err, "ACO must have a valid public key to encrypt its files")
+		}
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if err = db.Model(&aco).Update("encrypt_exports", enable).Error; err != nil {
+		return "", err
+	}
+
+	if enable {
+		return fmt.Sprintf("Encryption enabled for ACO %s", cmsID), nil
+	}
+	return fmt.Sprintf("Encryption disabled for ACO %s", cmsID), nil
+}
+
+// setACOClaimTypeSplit sets whether the ExplanationOfBenefit resources of the ACO's jobs are split into a file per claim
+// type. Jobs that have already been requested are not affected.
+func setACOClaimTypeSplit(cmsID string, split bool) (string, error) {
+	if cmsID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) must be provided")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return "", err
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if err = db.Model(&aco).Update("split_claim_types", split).Error; err != nil {
+		return "", err
+	}
+
+	if split {
+		return fmt.Sprintf("Claim type split enabled for ACO %s", cmsID), nil
+	}
+	return fmt.Sprintf("Claim type split disabled for ACO %s", cmsID), nil
+}
+
+// setACOQuota updates the limits supplied for the ACO. Limits that are not supplied keep their current value.
+func setACOQuota(cmsID, maxConcurrentJobs, maxDailyRequests, maxDailyBytes string, reset bool) (string, error) {
+	if cmsID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) must be provided")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return "", err
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if reset {
+		if err = db.Unscoped().Delete(models.ACOQuota{}, "aco_id = ?", aco.UUID.String()).Error; err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Quota removed for ACO %s; default limits apply", cmsID), nil
+	}
+
+	quota, err := models.GetACOQuota(db, aco.UUID)
+	if err != nil {
+		return "", err
+	}
+
+	limits := []struct {
+		flag  string
+		value string
+		set   func(int64)
+	}{
+		{"max-concurrent-jobs", maxConcurrentJobs, func(v int64) { quota.MaxConcurrentJobs = int(v) }},
+		{"max-daily-requests", maxDailyRequests, func(v int64) { quota.MaxDailyRequests = int(v) }},
+		{"max-daily-bytes", maxDailyBytes, func(v int64) { quota.MaxDailyBytes = v }},
+	}
+	for _, l := range limits {
+		if l.value == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(l.value, 10, 64)
+		if err != nil || v < 0 {
+			return "", fmt.Errorf("%s must be a non-negative integer", l.flag)
+		}
+		l.set(v)
+	}
+
+	if err = models.SaveACOQuota(db, quota); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Quota saved for ACO %s\n%s", cmsID, formatQuota(quota)), nil
+}
+
+func getACOQuota(cmsID string) (string, error) {
+	if cmsID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) must be provided")
+	}
+
+	aco, err := auth.GetACOByCMSID(cmsID)
+	if err != nil {
+		return "", err
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	quota, err := models.GetACOQuota(db, aco.UUID)
+	if err != nil {
+		return "", err
+	}
+
+	return formatQuota(quota), nil
+}
+
+func formatQuota(quota models.ACOQuota) string {
+	return fmt.Sprintf("max-concurrent-jobs: %d\nmax-daily-requests: %d\nmax-daily-bytes: %d",
+		quota.MaxConcurrentJobs, quota.MaxDailyRequests, quota.MaxDailyBytes)
+}
+
+// warmBlueButtonIDCache caches the Blue Button IDs of the beneficiaries in the CCLF8 file identified by fileID or, if
+// fileID is not supplied, the ACO's most recently imported CCLF8 file
+func warmBlueButtonIDCache(bb client.APIClient, cmsID, fileID, concurrency string) (string, error) {
+	if cmsID == "" && fileID == "" {
+		return "", errors.New("ACO CMS ID (--cms-id) or CCLF file ID (--file-id) must be provided")
+	}
+
+	c, err := strconv.Atoi(concurrency)
+	if err != nil || c < 1 {
+		return "", errors.New("concurrency must be a positive integer")
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var cclfFile models.CCLFFile
+	if fileID != "" {
+		id, err := strconv.ParseUint(fileID, 10, 64)
+		if err != nil {
+			return "", errors.New("CCLF file ID (--file-id) must be a positive integer")
+		}
+		if err = db.First(&cclfFile, "id = ? and cclf_num = 8", id).Error; err != nil {
+			return "", errors.Wrapf(err, "could not find CCLF8 file %d", id)
+		}
+	} else {
+		f, err := postgres.NewRepository(db).GetLatestCCLFFile(cmsID, 8, constants.ImportComplete, time.Time{}, time.Time{})
+		if err != nil {
+			return "", err
+		}
+		if f == nil {
+			return "", fmt.Errorf("no CCLF8 file has been imported for ACO %s", cmsID)
+		}
+		cclfFile = *f
+	}
+
+	result, err := models.WarmBlueButtonIDCache(db, bb, cclfFile.ID, c)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Warmed Blue Button ID cache for CCLF8 file %d (%s)\nbeneficiaries: %d\nalready cached: %d\nretrieved: %d\nfailed: %d",
+		cclfFile.ID, cclfFile.Name, result.Beneficiaries, result.AlreadyCached, result.Retrieved, result.Failed), nil
+}
+
+func invalidateBlueButtonIDCache(mbis string, all bool) (string, error) {
+	if (mbis == "") == !all {
+		return "", errors.New("either MBIs (--mbis) or --all must be provided")
+	}
+
+	var mbiList []string
+	if mbis != "" {
+		for _, mbi := range strings.Split(mbis, ",") {
+			if mbi = strings.TrimSpace(mbi); mbi != "" {
+				mbiList = append(mbiList, mbi)
+			}
+		}
+		if len(mbiList) == 0 {
+			return "", errors.New("MBIs (--mbis) must contain at least one MBI")
+		}
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	count, err := models.InvalidateBlueButtonIDs(db, mbiList...)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Removed %d cached Blue Button IDs", count), nil
+}
+
+// newQueuePool connects to the database containing the job queue
+func newQueuePool() (*pgx.ConnPool, error) {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig:   pgxcfg,
+		AfterConnect: que.PrepareStatements,
+	})
+}
+
+func listDeadLetterJobs() (string, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	jobs, err := models.GetDeadLetterJobs(db)
+	if err != nil {
+		return "", err
+	}
+	if len(jobs) == 0 {
+		return "No dead-lettered jobs", nil
+	}
+
+	lines := make([]string, len(jobs))
+	for i, dlj := range jobs {
+		lines[i] = fmt.Sprintf("%d\t%s\tjob %d\t%d attempts\t%s\t%s", dlj.ID, dlj.Type, dlj.JobID, dlj.ErrorCount,
+			dlj.CreatedAt.Format(time.RFC3339), dlj.LastError)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func showDeadLetterJob(id string) (string, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	dlj, err := getDeadLetterJob(db, id)
+	if err != nil {
+		return "", err
+	}
+
+	// Export jobs are shown using their JobEnqueueArgs; other jobs' arguments are shown as they were queued
+	var args interface{} = json.RawMessage(dlj.Args)
+	if dlj.Type == "ProcessJob" {
+		if args, err = dlj.EnqueueArgs(); err != nil {
+			return "", err
+		}
+	}
+	argsJSON, err := json.MarshalIndent(args, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("id: %d\ntype: %s\nqueue job: %d\njob: %d\nattempts: %d\ndead-lettered at: %s\nlast error: %s\nargs: %s",
+		dlj.ID, dlj.Type, dlj.QueueJobID, dlj.JobID, dlj.ErrorCount, dlj.CreatedAt.Format(time.RFC3339), dlj.LastError, argsJSON), nil
+}
+
+func requeueDeadLetterJob(qc *que.Client, id string) (string, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	dlj, err := getDeadLetterJob(db, id)
+	if err != nil {
+		return "", err
+	}
+
+	if err = dlj.Requeue(db, qc); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Requeued dead-lettered job %d for job %d", dlj.ID, dlj.JobID), nil
+}
+
+func discardDeadLetterJob(id string) (string, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	dlj, err := getDeadLetterJob(db, id)
+	if err != nil {
+		return "", err
+	}
+
+	if err = dlj.Discard(db); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Discarded dead-lettered job %d for job %d", dlj.ID, dlj.JobID), nil
+}
+
+func getDeadLetterJob(db *gorm.DB, id string) (models.DeadLetterJob, error) {
+	if id == "" {
+		return models.DeadLetterJob{}, errors.New("dead-lettered job ID (--id) must be provided")
+	}
+
+	dlID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return models.DeadLetterJob{}, errors.New("dead-lettered job ID (--id) must be a positive integer")
+	}
+
+	dlj, err := models.GetDeadLetterJob(db, uint(dlID))
+	if gorm.IsRecordNotFoundError(err) {
+		return dlj, fmt.Errorf("no dead-lettered job found with ID %d", dlID)
+	}
+	return dlj, err
+}
+
+func jobTimeline(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("job ID (--job-id) must be provided")
+	}
+
+	jID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return "", errors.New("job ID (--job-id) must be a positive integer")
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var job models.Job
+	if err = db.First(&job, jID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return "", fmt.Errorf("no job found with ID %d", jID)
+		}
+		return "", err
+	}
+
+	history, err := models.GetJobStatusHistory(db, job.ID)
+	if err != nil {
+		return "", err
+	}
+
+	// Jobs are created as Pending, so the creation time is the start of the timeline
+	lines := []string{
+		fmt.Sprintf("job %d: %s", job.ID, job.Status),
+		fmt.Sprintf("%s\tcreated\t%s", job.CreatedAt.Format(time.RFC3339), job.RequestURL),
+	}
+	for _, h := range history {
+		lines = append(lines, fmt.Sprintf("%s\t%s -> %s\t%s\t%s", h.CreatedAt.Format(time.RFC3339), h.FromStatus,
+			h.ToStatus, h.Actor, h.Reason))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 func generateClientCredentials(acoCMSID string) (string, error) {
 	if acoCMSID == "" {
 		return "", errors.New("ACO CMS ID (--cms-id) is required")
@@ -529,7 +1292,7 @@ func archiveExpiring(hrThreshold int) error {
 	defer database.Close(db)
 
 	var jobs []models.Job
-	err := db.Find(&jobs, "status = ?", "Completed").Error
+	err := db.Find(&jobs, "status in (?)", []models.JobStatus{models.JobStatusCompleted, models.JobStatusPartiallyCompleted}).Error
 	if err != nil {
 		log.Error(err)
 		return err
@@ -542,18 +1305,15 @@ func archiveExpiring(hrThreshold int) error {
 		if int(elapsed) >= hrThreshold {
 
 			id := int(j.ID)
-			jobDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), id)
-			expDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_ARCHIVE_DIR"), id)
-
-			err = os.Rename(jobDir, expDir)
+			err = storage.MoveAll(storage.Get(), storage.Payload, storage.Archive, strconv.Itoa(id))
 			if err != nil {
 				log.Error(err)
 				lastJobError = err
 				continue
 			}
 
-			j.Status = "Archived"
-			err = db.Save(j).Error
+			_, err = j.TransitionStatus(db, models.JobStatusArchived, models.JobStatusActorCLI,
+				fmt.Sprintf("job files moved to the archive after %d hours", hrThreshold))
 			if err != nil {
 				log.Error(err)
 				lastJobError = err
@@ -571,7 +1331,7 @@ func cleanupArchive(hrThreshold int) error {
 	maxDate := time.Now().Add(-(time.Hour * time.Duration(hrThreshold)))
 
 	var jobs []models.Job
-	err := db.Find(&jobs, "status = ? AND updated_at <= ?", "Archived", maxDate).Error
+	err := db.Find(&jobs, "status = ? AND updated_at <= ?", models.JobStatusArchived, maxDate).Error
 	if err != nil {
 		return err
 	}
@@ -587,17 +1347,15 @@ func cleanupArchive(hrThreshold int) error {
 		if int(elapsed) >= hrThreshold {
 
 			id := int(job.ID)
-			jobArchiveDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_ARCHIVE_DIR"), id)
-
-			err = os.RemoveAll(jobArchiveDir)
+			err = storage.Get().RemoveAll(storage.Archive, strconv.Itoa(id))
 			if err != nil {
-				e := fmt.Sprintf("Unable to remove %s because %s", jobArchiveDir, err)
+				e := fmt.Sprintf("Unable to remove archived files of job %d because %s", id, err)
 				log.Error(e)
 				continue
 			}
 
-			job.Status = "Expired"
-			err = db.Save(job).Error
+			_, err = job.TransitionStatus(db, models.JobStatusExpired, models.JobStatusActorCLI,
+				fmt.Sprintf("job files removed from the archive after %d hours", hrThreshold))
 			if err != nil {
 				return err
 			}
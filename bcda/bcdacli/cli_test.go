@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/bgentry/que-go"
 	"github.com/jinzhu/gorm"
 
 	"github.com/CMSgov/bcda-app/bcda/utils"
@@ -25,6 +26,8 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/CMSgov/bcda-app/bcda/auth"
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
@@ -293,7 +296,7 @@ func (s *CLITestSuite) TestArchiveExpiring() {
 	db.First(&testjob, "id = ?", j.ID)
 
 	// check the status of the job
-	assert.Equal("Archived", testjob.Status)
+	assert.Equal(models.JobStatusArchived, testjob.Status)
 
 	// clean up
 	os.RemoveAll(os.Getenv("FHIR_ARCHIVE_DIR"))
@@ -351,7 +354,7 @@ func (s *CLITestSuite) TestArchiveExpiringWithThreshold() {
 	db.First(&testjob, "id = ?", j.ID)
 
 	// check the status of the job
-	assert.Equal(s.T(), "Completed", testjob.Status)
+	assert.Equal(s.T(), models.JobStatusCompleted, testjob.Status)
 
 	// clean up
 	os.Remove(dataPath)
@@ -456,13 +459,13 @@ func (s *CLITestSuite) TestCleanArchive() {
 
 	var beforeJob models.Job
 	db.First(&beforeJob, "id = ?", beforeJobID)
-	assert.Equal("Expired", beforeJob.Status)
+	assert.Equal(models.JobStatusExpired, beforeJob.Status)
 
 	assert.FileExists(after.Name(), "%s not found; it should have been", after.Name())
 
 	var afterJob models.Job
 	db.First(&afterJob, "id = ?", afterJobID)
-	assert.Equal("Archived", afterJob.Status)
+	assert.Equal(models.JobStatusArchived, afterJob.Status)
 
 	// I think this is an application directory and should always exist, but that doesn't seem to be the norm
 	os.RemoveAll(os.Getenv("FHIR_ARCHIVE_DIR"))
@@ -558,6 +561,397 @@ func (s *CLITestSuite) TestCreateGroup_InvalidACOID() {
 	assert.Empty(s.T(), buf.String())
 }
 
+func (s *CLITestSuite) TestSetACOPartialExports() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9907"
+	_, err := models.CreateACO("Partial Export Test ACO", &cmsID)
+	assert.Nil(err)
+	aco, err := auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	defer db.Unscoped().Delete(&aco)
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-partial-exports"})
+	assert.EqualError(err, "ACO CMS ID (--cms-id) must be provided")
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-partial-exports", "--cms-id", cmsID})
+	assert.Nil(err)
+	assert.Equal("Partial exports enabled for ACO A9907\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.True(aco.AllowPartialExports)
+	buf.Reset()
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-partial-exports", "--cms-id", cmsID, "--disable"})
+	assert.Nil(err)
+	assert.Equal("Partial exports disabled for ACO A9907\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.False(aco.AllowPartialExports)
+}
+
+func (s *CLITestSuite) TestSetACOEncryption() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9908"
+	_, err := models.CreateACO("Encryption Test ACO", &cmsID)
+	assert.Nil(err)
+	aco, err := auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	defer db.Unscoped().Delete(&aco)
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-encryption"})
+	assert.EqualError(err, "ACO CMS ID (--cms-id) must be provided")
+
+	// Files cannot be encrypted for an ACO without a public key
+	err = s.testApp.Run([]string{"bcda", "set-aco-encryption", "--cms-id", cmsID})
+	assert.EqualError(err, "ACO must have a valid public key to encrypt its files: not able to decode PEM-formatted public key")
+	assert.Empty(buf.String())
+
+	f, err := os.Open("../../shared_files/ATO_public.pem")
+	assert.Nil(err)
+	defer f.Close()
+	assert.Nil(aco.SavePublicKey(f))
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-encryption", "--cms-id", cmsID})
+	assert.Nil(err)
+	assert.Equal("Encryption enabled for ACO A9908\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.True(aco.EncryptExports)
+	buf.Reset()
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-encryption", "--cms-id", cmsID, "--disable"})
+	assert.Nil(err)
+	assert.Equal("Encryption disabled for ACO A9908\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.False(aco.EncryptExports)
+}
+
+func (s *CLITestSuite) TestSetACOClaimTypeSplit() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9909"
+	_, err := models.CreateACO("Claim Type Split Test ACO", &cmsID)
+	assert.Nil(err)
+	aco, err := auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	defer db.Unscoped().Delete(&aco)
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-claim-type-split"})
+	assert.EqualError(err, "ACO CMS ID (--cms-id) must be provided")
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-claim-type-split", "--cms-id", cmsID})
+	assert.Nil(err)
+	assert.Equal("Claim type split enabled for ACO A9909\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.True(aco.SplitClaimTypes)
+	buf.Reset()
+
+	err = s.testApp.Run([]string{"bcda", "set-aco-claim-type-split", "--cms-id", cmsID, "--disable"})
+	assert.Nil(err)
+	assert.Equal("Claim type split disabled for ACO A9909\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.False(aco.SplitClaimTypes)
+}
+
+func (s *CLITestSuite) TestSetACOWebhook() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9902"
+	_, err := models.CreateACO("Webhook Test ACO", &cmsID)
+	assert.Nil(err)
+	aco, err := auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	defer db.Unscoped().Delete(&aco)
+
+	// Missing CMS ID
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--url", "https://example.com/webhook"})
+	assert.EqualError(err, "ACO CMS ID (--cms-id) must be provided")
+
+	// Invalid URL
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--cms-id", cmsID, "--url", "example.com/webhook"})
+	assert.EqualError(err, "webhook URL (--url) must be an absolute HTTP(S) URL")
+
+	// Non-public URL
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--cms-id", cmsID, "--url", "https://10.0.0.1/webhook"})
+	assert.EqualError(err, "webhook URL (--url) must resolve to a public address: 10.0.0.1 is not a public address")
+
+	// A secret is generated when the webhook is first registered
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--cms-id", cmsID, "--url", "https://example.com/webhook"})
+	assert.Nil(err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal([]string{"Webhook saved for ACO A9902", lines[1]}, lines)
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.Equal("https://example.com/webhook", aco.WebhookURL)
+	assert.Equal(lines[1], aco.WebhookSecret)
+	secret := aco.WebhookSecret
+	buf.Reset()
+
+	// The secret is kept when the URL changes...
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--cms-id", cmsID, "--url", "https://example.com/webhook2"})
+	assert.Nil(err)
+	assert.Equal("Webhook saved for ACO A9902\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.Equal("https://example.com/webhook2", aco.WebhookURL)
+	assert.Equal(secret, aco.WebhookSecret)
+	buf.Reset()
+
+	// ...unless it is rotated
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--cms-id", cmsID, "--url", "https://example.com/webhook2", "--rotate-secret"})
+	assert.Nil(err)
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.NotEqual(secret, aco.WebhookSecret)
+	assert.Contains(buf.String(), aco.WebhookSecret)
+	buf.Reset()
+
+	// Removing the webhook
+	err = s.testApp.Run([]string{"bcda", "set-aco-webhook", "--cms-id", cmsID})
+	assert.Nil(err)
+	assert.Equal("Webhook removed for ACO A9902\n", buf.String())
+	aco, err = auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	assert.Empty(aco.WebhookURL)
+	assert.Empty(aco.WebhookSecret)
+}
+
+func (s *CLITestSuite) TestSetACOQuota() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9903"
+	_, err := models.CreateACO("Quota Test ACO", &cmsID)
+	assert.Nil(err)
+	aco, err := auth.GetACOByCMSID(cmsID)
+	assert.Nil(err)
+	defer db.Unscoped().Delete(&aco)
+	defer db.Unscoped().Delete(models.ACOQuota{}, "aco_id = ?", aco.UUID.String())
+
+	// Missing CMS ID
+	err = s.testApp.Run([]string{"bcda", "set-aco-quota", "--max-concurrent-jobs", "1"})
+	assert.EqualError(err, "ACO CMS ID (--cms-id) must be provided")
+
+	// Invalid limits
+	err = s.testApp.Run([]string{"bcda", "set-aco-quota", "--cms-id", cmsID, "--max-daily-requests", "-1"})
+	assert.EqualError(err, "max-daily-requests must be a non-negative integer")
+	err = s.testApp.Run([]string{"bcda", "set-aco-quota", "--cms-id", cmsID, "--max-daily-bytes", "lots"})
+	assert.EqualError(err, "max-daily-bytes must be a non-negative integer")
+
+	// Limits that are not supplied start from the defaults
+	err = s.testApp.Run([]string{"bcda", "set-aco-quota", "--cms-id", cmsID, "--max-concurrent-jobs", "1", "--max-daily-bytes", "1000"})
+	assert.Nil(err)
+	assert.Equal("Quota saved for ACO A9903\nmax-concurrent-jobs: 1\nmax-daily-requests: 100\nmax-daily-bytes: 1000\n", buf.String())
+	buf.Reset()
+
+	// ...and keep their current values on later updates
+	err = s.testApp.Run([]string{"bcda", "set-aco-quota", "--cms-id", cmsID, "--max-daily-requests", "0"})
+	assert.Nil(err)
+	buf.Reset()
+	err = s.testApp.Run([]string{"bcda", "get-aco-quota", "--cms-id", cmsID})
+	assert.Nil(err)
+	assert.Equal("max-concurrent-jobs: 1\nmax-daily-requests: 0\nmax-daily-bytes: 1000\n", buf.String())
+	buf.Reset()
+
+	// Removing the quota
+	err = s.testApp.Run([]string{"bcda", "set-aco-quota", "--cms-id", cmsID, "--reset"})
+	assert.Nil(err)
+	assert.Equal("Quota removed for ACO A9903; default limits apply\n", buf.String())
+	quota, err := models.GetACOQuota(db, aco.UUID)
+	assert.Nil(err)
+	assert.Equal(models.DefaultACOQuota(aco.UUID), quota)
+}
+
+func (s *CLITestSuite) TestWarmBlueButtonIDCache() {
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9904"
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 20, Name: uuid.New(), ImportStatus: constants.ImportComplete}
+	assert.Nil(db.Create(&cclfFile).Error)
+	defer db.Unscoped().Delete(&cclfFile)
+	defer db.Unscoped().Delete(models.CCLFBeneficiary{}, "file_id = ?", cclfFile.ID)
+
+	mbis := []string{"1W000000001", "1W000000002"}
+	defer models.InvalidateBlueButtonIDs(db, mbis...) // nolint
+	bbc := testUtils.BlueButtonClient{}
+	for i, mbi := range mbis {
+		assert.Nil(db.Create(&models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: mbi}).Error)
+		bbc.MBI = &mbis[i]
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(mbi)).Return(bbc.GetData("Patient", fmt.Sprintf("-1999000000000%d", i)))
+	}
+
+	_, err := warmBlueButtonIDCache(&bbc, "", "", "10")
+	assert.EqualError(err, "ACO CMS ID (--cms-id) or CCLF file ID (--file-id) must be provided")
+	_, err = warmBlueButtonIDCache(&bbc, cmsID, "", "0")
+	assert.EqualError(err, "concurrency must be a positive integer")
+	_, err = warmBlueButtonIDCache(&bbc, "A9905", "", "10")
+	assert.EqualError(err, "no CCLF8 file has been imported for ACO A9905")
+
+	// The ACO's latest CCLF8 file is used when the file isn't specified
+	msg, err := warmBlueButtonIDCache(&bbc, cmsID, "", "2")
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("Warmed Blue Button ID cache for CCLF8 file %d (%s)\nbeneficiaries: 2\nalready cached: 0\nretrieved: 2\nfailed: 0", cclfFile.ID, cclfFile.Name), msg)
+
+	// IDs are only retrieved once
+	msg, err = warmBlueButtonIDCache(&bbc, "", strconv.Itoa(int(cclfFile.ID)), "2")
+	assert.Nil(err)
+	assert.Contains(msg, "already cached: 2\nretrieved: 0")
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 2)
+}
+
+func (s *CLITestSuite) TestInvalidateBlueButtonIDCache() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	mbis := []string{"1X000000001", "1X000000002", "1X000000003"}
+	for _, mbi := range mbis {
+		assert.Nil(models.CacheBlueButtonID(db, mbi, "-"+mbi))
+	}
+	defer models.InvalidateBlueButtonIDs(db, mbis...) // nolint
+
+	err := s.testApp.Run([]string{"bcda", "invalidate-bb-id-cache"})
+	assert.EqualError(err, "either MBIs (--mbis) or --all must be provided")
+	err = s.testApp.Run([]string{"bcda", "invalidate-bb-id-cache", "--mbis", mbis[0], "--all"})
+	assert.EqualError(err, "either MBIs (--mbis) or --all must be provided")
+
+	err = s.testApp.Run([]string{"bcda", "invalidate-bb-id-cache", "--mbis", mbis[0] + ", " + mbis[1]})
+	assert.Nil(err)
+	assert.Equal("Removed 2 cached Blue Button IDs\n", buf.String())
+
+	cached, err := models.GetCachedBlueButtonIDs(db, mbis)
+	assert.Nil(err)
+	assert.Equal(map[string]string{mbis[2]: "-" + mbis[2]}, cached)
+}
+
+func (s *CLITestSuite) TestDeadLetterJobs() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	args := `{"ID": 9999, "ACOID": "00000000-0000-0000-0000-000000000000", "BeneficiaryIDs": ["1", "2"], "ResourceType": "Coverage"}`
+	dljs := []models.DeadLetterJob{
+		{QueueJobID: time.Now().UnixNano(), Type: "ProcessJob", Args: args, ErrorCount: 10, LastError: "Blue Button is down", JobID: 9999},
+		{QueueJobID: time.Now().UnixNano() + 1, Type: "ProcessJob", Args: args, ErrorCount: 10, LastError: "Blue Button is down", JobID: 9999},
+	}
+	for i := range dljs {
+		assert.Nil(models.SaveDeadLetterJob(db, &dljs[i]))
+		defer db.Unscoped().Delete(&dljs[i])
+	}
+
+	err := s.testApp.Run([]string{"bcda", "list-dead-letter-jobs"})
+	assert.Nil(err)
+	assert.Contains(buf.String(), fmt.Sprintf("%d\tProcessJob\tjob 9999\t10 attempts\t", dljs[0].ID))
+	buf.Reset()
+
+	err = s.testApp.Run([]string{"bcda", "show-dead-letter-job"})
+	assert.EqualError(err, "dead-lettered job ID (--id) must be provided")
+	err = s.testApp.Run([]string{"bcda", "show-dead-letter-job", "--id", "0"})
+	assert.EqualError(err, "no dead-lettered job found with ID 0")
+	err = s.testApp.Run([]string{"bcda", "show-dead-letter-job", "--id", strconv.Itoa(int(dljs[0].ID))})
+	assert.Nil(err)
+	assert.Contains(buf.String(), "last error: Blue Button is down\n")
+	assert.Contains(buf.String(), `"ResourceType": "Coverage"`)
+	buf.Reset()
+
+	err = s.testApp.Run([]string{"bcda", "discard-dead-letter-job", "--id", strconv.Itoa(int(dljs[0].ID))})
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("Discarded dead-lettered job %d for job 9999\n", dljs[0].ID), buf.String())
+	_, err = models.GetDeadLetterJob(db, dljs[0].ID)
+	assert.True(gorm.IsRecordNotFoundError(err))
+
+	// Requeued jobs are put back on the queue with their attempts reset
+	pool, err := newQueuePool()
+	assert.Nil(err)
+	defer pool.Close()
+	msg, err := requeueDeadLetterJob(que.NewClient(pool), strconv.Itoa(int(dljs[1].ID)))
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("Requeued dead-lettered job %d for job 9999", dljs[1].ID), msg)
+	_, err = models.GetDeadLetterJob(db, dljs[1].ID)
+	assert.True(gorm.IsRecordNotFoundError(err))
+
+	var errorCount int32
+	err = pool.QueryRow(`SELECT error_count FROM que_jobs WHERE args->>'ID' = '9999' AND args->>'ResourceType' = 'Coverage'`).Scan(&errorCount)
+	assert.Nil(err)
+	assert.Equal(int32(0), errorCount)
+	_, err = pool.Exec(`DELETE FROM que_jobs WHERE args->>'ID' = '9999'`)
+	assert.Nil(err)
+}
+
+func (s *CLITestSuite) TestJobTimeline() {
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	j := models.Job{ACOID: uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"), RequestURL: "/api/v1/Patient/$export",
+		Status: models.JobStatusPending}
+	assert.Nil(db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+	defer db.Delete(models.JobStatusHistory{}, "job_id = ?", j.ID)
+
+	_, err := j.TransitionStatus(db, models.JobStatusInProgress, models.JobStatusActorWorker, "queue job 1 started")
+	assert.Nil(err)
+	_, err = j.TransitionStatus(db, models.JobStatusCancelled, models.JobStatusActorAPI, "cancelled by requester")
+	assert.Nil(err)
+
+	err = s.testApp.Run([]string{"bcda", "job-timeline"})
+	assert.EqualError(err, "job ID (--job-id) must be provided")
+	err = s.testApp.Run([]string{"bcda", "job-timeline", "--job-id", "abc"})
+	assert.EqualError(err, "job ID (--job-id) must be a positive integer")
+	err = s.testApp.Run([]string{"bcda", "job-timeline", "--job-id", "0"})
+	assert.EqualError(err, "no job found with ID 0")
+
+	err = s.testApp.Run([]string{"bcda", "job-timeline", "--job-id", strconv.Itoa(int(j.ID))})
+	assert.Nil(err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 4)
+	assert.Equal(fmt.Sprintf("job %d: Cancelled", j.ID), lines[0])
+	assert.Contains(lines[1], "\tcreated\t/api/v1/Patient/$export")
+	assert.Contains(lines[2], "\tPending -> In Progress\tworker\tqueue job 1 started")
+	assert.Contains(lines[3], "\tIn Progress -> Cancelled\tapi\tcancelled by requester")
+}
+
 func (s *CLITestSuite) TestCreateACO() {
 	// init
 	db := database.GetGORMDbConnection()
@@ -19,6 +19,7 @@ import (
 	"github.com/cenkalti/backoff"
 
 	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	models "github.com/CMSgov/bcda-app/bcda/models/fhir"
 	"github.com/CMSgov/bcda-app/bcda/monitoring"
 	"github.com/CMSgov/bcda-app/bcda/utils"
@@ -33,39 +34,83 @@ import (
 
 var logger *logrus.Logger
 
-const blueButtonBasePath = "/v1/fhir"
+// Paths of the Blue Button endpoints serving FHIR STU3 (v1) and R4 (v2) data
+const (
+	blueButtonV1BasePath = "/v1/fhir"
+	blueButtonV2BasePath = "/v2/fhir"
+)
+
+// defaultPageSize is the number of resources requested per page when BB_CLIENT_PAGE_SIZE isn't set. Setting it to 0
+// requests each bundle in a single response.
+const defaultPageSize = 50
 
 // BlueButtonConfig holds the configuration settings needed to create a BlueButtonClient
 // TODO (BCDA-3755): Move the other env vars used in NewBlueButtonClient to this struct
 type BlueButtonConfig struct {
-	BBServer string
+	BBServer   string
+	BBBasePath string
 }
 
 // NewConfig generates a new BlueButtonConfig using various environment variables.
+// The configuration targets the Blue Button v1 (STU3) endpoints.
 func NewConfig() BlueButtonConfig {
 	return BlueButtonConfig{
-		BBServer: os.Getenv("BB_SERVER_LOCATION"),
+		BBServer:   os.Getenv("BB_SERVER_LOCATION"),
+		BBBasePath: blueButtonV1BasePath,
+	}
+}
+
+// NewConfigForVersion generates a new BlueButtonConfig targeting the Blue Button endpoints that serve the
+// FHIR version used by the supplied API version: STU3 for v1 and R4 for v2.
+func NewConfigForVersion(version string) (BlueButtonConfig, error) {
+	config := NewConfig()
+	switch version {
+	case constants.V1Version:
+	case constants.V2Version:
+		config.BBBasePath = blueButtonV2BasePath
+	default:
+		return config, fmt.Errorf("unsupported API version %s", version)
 	}
+	return config, nil
 }
 
 type APIClient interface {
-	GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error)
+	GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (*models.Bundle, error)
 	GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error)
 	GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error)
 	GetPatientByIdentifierHash(hashedIdentifier string) (string, error)
 }
 
+// StreamingAPIClient is an APIClient that can pass each page of a bundle to the caller as it's received
+// instead of accumulating every page into a single bundle. Only one page is held in memory at a time,
+// regardless of the number of resources in the bundle, as long as paging is enabled (BB_CLIENT_PAGE_SIZE).
+// Retrieval stops at the first error returned by the BundlePageFunc and that error is returned to the caller.
+// If a later page can't be retrieved, the error is returned after the earlier pages have been passed to the
+// BundlePageFunc, so callers that write pages as they're received must treat what they wrote as partial.
+type StreamingAPIClient interface {
+	APIClient
+	StreamExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values, fn BundlePageFunc) error
+	StreamPatient(patientID, jobID, cmsID, since string, transactionTime time.Time, fn BundlePageFunc) error
+	StreamCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, fn BundlePageFunc) error
+}
+
+// BundlePageFunc receives a single page of a bundle.
+type BundlePageFunc func(page *models.RawBundle) error
+
 type BlueButtonClient struct {
 	client fhir.Client
 
 	maxTries      uint64
 	retryInterval time.Duration
+	pageSize      int
 
-	bbServer string
+	bbServer   string
+	bbBasePath string
 }
 
-// Ensure BlueButtonClient satisfies the interface
+// Ensure BlueButtonClient satisfies the interfaces
 var _ APIClient = &BlueButtonClient{}
+var _ StreamingAPIClient = &BlueButtonClient{}
 
 func init() {
 	logger = logrus.New()
@@ -86,7 +131,7 @@ func init() {
 func NewBlueButtonClient(config BlueButtonConfig) (*BlueButtonClient, error) {
 	certFile := os.Getenv("BB_CLIENT_CERT_FILE")
 	keyFile := os.Getenv("BB_CLIENT_KEY_FILE")
-	pageSize := utils.GetEnvInt("BB_CLIENT_PAGE_SIZE", 0)
+	pageSize := utils.GetEnvInt("BB_CLIENT_PAGE_SIZE", defaultPageSize)
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not load Blue Button keypair")
@@ -129,16 +174,24 @@ func NewBlueButtonClient(config BlueButtonConfig) (*BlueButtonClient, error) {
 	client := fhir.NewClient(httpClient, pageSize)
 	maxTries := uint64(utils.GetEnvInt("BB_REQUEST_MAX_TRIES", 3))
 	retryInterval := time.Duration(utils.GetEnvInt("BB_REQUEST_RETRY_INTERVAL_MS", 1000)) * time.Millisecond
-	return &BlueButtonClient{client, maxTries, retryInterval, config.BBServer}, nil
+	return &BlueButtonClient{client, maxTries, retryInterval, pageSize, config.BBServer, config.BBBasePath}, nil
 }
 
 type BeneDataFunc func(string, string, string, string, time.Time) (*models.Bundle, error)
 
 func (bbc *BlueButtonClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+	return bbc.getBundleData(bbc.bbBasePath+"/Patient/", patientParams(patientID, since, transactionTime), jobID, cmsID)
+}
+
+func (bbc *BlueButtonClient) StreamPatient(patientID, jobID, cmsID, since string, transactionTime time.Time, fn BundlePageFunc) error {
+	return bbc.streamBundleData(bbc.bbBasePath+"/Patient/", patientParams(patientID, since, transactionTime), jobID, cmsID, fn)
+}
+
+func patientParams(patientID, since string, transactionTime time.Time) url.Values {
 	params := GetDefaultParams()
 	params.Set("_id", patientID)
 	updateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getBundleData(blueButtonBasePath+"/Patient/", params, jobID, cmsID)
+	return params
 }
 
 func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier string) (string, error) {
@@ -146,37 +199,60 @@ func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier string)
 
 	// FHIR spec requires a FULLY qualified namespace so this is in fact the argument, not a URL
 	params.Set("identifier", fmt.Sprintf("https://bluebutton.cms.gov/resources/identifier/%s|%v", "mbi-hash", hashedIdentifier))
-	return bbc.getRawData(blueButtonBasePath+"/Patient/", params, "", "")
+	return bbc.getRawData(bbc.bbBasePath+"/Patient/", params, "", "")
 }
 
 func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+	return bbc.getBundleData(bbc.bbBasePath+"/Coverage/", coverageParams(beneficiaryID, since, transactionTime), jobID, cmsID)
+}
+
+func (bbc *BlueButtonClient) StreamCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, fn BundlePageFunc) error {
+	return bbc.streamBundleData(bbc.bbBasePath+"/Coverage/", coverageParams(beneficiaryID, since, transactionTime), jobID, cmsID, fn)
+}
+
+func coverageParams(beneficiaryID, since string, transactionTime time.Time) url.Values {
 	params := GetDefaultParams()
 	params.Set("beneficiary", beneficiaryID)
 	updateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getBundleData(blueButtonBasePath+"/Coverage/", params, jobID, cmsID)
+	return params
 }
 
-func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (*models.Bundle, error) {
+	params := eobParams(patientID, since, transactionTime, typeFilter)
+	return bbc.getBundleData(bbc.bbBasePath+"/ExplanationOfBenefit/", params, jobID, cmsID)
+}
+
+func (bbc *BlueButtonClient) StreamExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values, fn BundlePageFunc) error {
+	params := eobParams(patientID, since, transactionTime, typeFilter)
+	return bbc.streamBundleData(bbc.bbBasePath+"/ExplanationOfBenefit/", params, jobID, cmsID, fn)
+}
+
+func eobParams(patientID, since string, transactionTime time.Time, typeFilter url.Values) url.Values {
 	params := GetDefaultParams()
 	params.Set("patient", patientID)
 	params.Set("excludeSAMHSA", "true")
+	updateParamWithTypeFilter(&params, typeFilter)
 	updateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getBundleData(blueButtonBasePath+"/ExplanationOfBenefit/", params, jobID, cmsID)
+	return params
 }
 
 func (bbc *BlueButtonClient) GetMetadata() (string, error) {
-	return bbc.getRawData(blueButtonBasePath+"/metadata/", GetDefaultParams(), "", "")
+	return bbc.getRawData(bbc.bbBasePath+"/metadata/", GetDefaultParams(), "", "")
 }
 
 func (bbc *BlueButtonClient) getBundleData(path string, params url.Values, jobID, cmsID string) (*models.Bundle, error) {
-	req, err := bbc.getRequest(path, params)
+	req, err := bbc.getBundleRequest(path, params)
 	if err != nil {
 		return nil, err
 	}
 
 	var b *models.Bundle
 	for ok := true; ok; {
-		result, nextReq, err := bbc.tryBundleRequest(req, jobID, cmsID)
+		var result *models.Bundle
+		nextReq, err := bbc.tryBundleRequest(req, jobID, cmsID, func(req *http.Request) (nextReq *http.Request, err error) {
+			result, nextReq, err = bbc.client.DoBundleRequest(req)
+			return nextReq, err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -194,7 +270,37 @@ func (bbc *BlueButtonClient) getBundleData(path string, params url.Values, jobID
 	return b, nil
 }
 
-func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID string) (*models.Bundle, *http.Request, error) {
+// streamBundleData requests the bundle one page at a time, passing each page to fn before requesting the next one.
+// Pages already passed to fn are not withdrawn when a later page fails.
+func (bbc *BlueButtonClient) streamBundleData(path string, params url.Values, jobID, cmsID string, fn BundlePageFunc) error {
+	req, err := bbc.getBundleRequest(path, params)
+	if err != nil {
+		return err
+	}
+
+	for req != nil {
+		var page *models.RawBundle
+		nextReq, err := bbc.tryBundleRequest(req, jobID, cmsID, func(req *http.Request) (nextReq *http.Request, err error) {
+			page, nextReq, err = bbc.client.DoRawBundleRequest(req)
+			return nextReq, err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = fn(page); err != nil {
+			return err
+		}
+
+		req = nextReq
+	}
+
+	return nil
+}
+
+// tryBundleRequest makes a request for a page of a bundle using doRequest, retrying the request if it fails.
+// It returns the request for the next page, if there is one.
+func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID string, doRequest func(*http.Request) (*http.Request, error)) (*http.Request, error) {
 	m := monitoring.GetMonitor()
 	txn := m.Start(req.URL.Path, nil, nil)
 	defer m.End(txn)
@@ -203,7 +309,6 @@ func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID st
 	addRequestHeaders(req, queryID, jobID, cmsID)
 
 	var (
-		result  *models.Bundle
 		nextReq *http.Request
 		err     error
 	)
@@ -213,7 +318,7 @@ func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID st
 	b := backoff.WithMaxRetries(eb, bbc.maxTries)
 
 	err = backoff.RetryNotify(func() error {
-		result, nextReq, err = bbc.client.DoBundleRequest(req)
+		nextReq, err = doRequest(req)
 		if err != nil {
 			logger.Error(err)
 		}
@@ -226,10 +331,10 @@ func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID st
 	)
 
 	if err != nil {
-		return nil, nil, fmt.Errorf("blue button request %s failed %d time(s) %s", queryID, bbc.maxTries, err.Error())
+		return nil, fmt.Errorf("blue button request %s failed %d time(s) %s", queryID, bbc.maxTries, err.Error())
 	}
 
-	return result, nextReq, nil
+	return nextReq, nil
 }
 
 func (bbc *BlueButtonClient) getRawData(path string, params url.Values, jobID, cmsID string) (string, error) {
@@ -271,6 +376,15 @@ func (bbc *BlueButtonClient) getRawData(path string, params url.Values, jobID, c
 	return result, nil
 }
 
+// getBundleRequest returns the request for the first page of a bundle. The page size is set here, as well as by the
+// FHIR client, so that it's included in the URL and query reported in the request's BlueButton-Original* headers.
+func (bbc *BlueButtonClient) getBundleRequest(path string, params url.Values) (*http.Request, error) {
+	if bbc.pageSize > 0 {
+		params.Set("_count", strconv.Itoa(bbc.pageSize))
+	}
+	return bbc.getRequest(path, params)
+}
+
 func (bbc *BlueButtonClient) getRequest(path string, params url.Values) (*http.Request, error) {
 	req, err := http.NewRequest("GET", bbc.bbServer+path, nil)
 	if err != nil {
@@ -336,6 +450,16 @@ func updateParamWithLastUpdated(params *url.Values, since string, transactionTim
 	}
 }
 
+// updateParamWithTypeFilter adds the search criteria supplied via _typeFilter.
+// The criteria are validated against an allowlist before the job is created, so they will not override any of our parameters.
+func updateParamWithTypeFilter(params *url.Values, typeFilter url.Values) {
+	for name, values := range typeFilter {
+		for _, v := range values {
+			params.Add(name, v)
+		}
+	}
+}
+
 type httpLogger struct {
 	t *http.Transport
 	l *logrus.Logger
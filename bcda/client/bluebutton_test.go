@@ -2,6 +2,8 @@ package client_test
 
 import (
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -11,9 +13,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+
 	models "github.com/CMSgov/bcda-app/bcda/models/fhir"
 
 	"github.com/CMSgov/bcda-app/bcda/client"
@@ -62,9 +68,8 @@ func (s *BBRequestTestSuite) BeforeTest(suiteName, testName string) {
 		s.ts = ts200
 	}
 
-	config := client.BlueButtonConfig{
-		BBServer: s.ts.URL,
-	}
+	config := client.NewConfig()
+	config.BBServer = s.ts.URL
 	if bbClient, err := client.NewBlueButtonClient(config); err != nil {
 		s.Fail("Failed to create Blue Button client", err)
 	} else {
@@ -193,6 +198,20 @@ func (s *BBTestSuite) TestGetDefaultParams() {
 
 }
 
+func (s *BBTestSuite) TestNewConfigForVersion() {
+	config, err := client.NewConfigForVersion("v1")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "/v1/fhir", config.BBBasePath)
+	assert.Equal(s.T(), os.Getenv("BB_SERVER_LOCATION"), config.BBServer)
+
+	config, err = client.NewConfigForVersion("v2")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "/v2/fhir", config.BBBasePath)
+
+	_, err = client.NewConfigForVersion("v3")
+	assert.EqualError(s.T(), err, "unsupported API version v3")
+}
+
 /* Tests that make requests, using clients configured with the 200 response and 500 response httptest.Servers initialized in SetupSuite() */
 func (s *BBRequestTestSuite) TestGetPatient() {
 	p, err := s.bbClient.GetPatient("012345", "543210", "A0000", "", now)
@@ -220,14 +239,14 @@ func (s *BBRequestTestSuite) TestGetCoverage_500() {
 }
 
 func (s *BBRequestTestSuite) TestGetExplanationOfBenefit() {
-	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now)
+	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now, nil)
 	assert.Nil(s.T(), err)
 	assert.Equal(s.T(), 33, len(e.Entries))
 	assert.Equal(s.T(), "carrier-10525061996", e.Entries[3]["resource"].(map[string]interface{})["id"])
 }
 
 func (s *BBRequestTestSuite) TestGetExplanationOfBenefit_500() {
-	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now)
+	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now, nil)
 	assert.Regexp(s.T(), `blue button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Nil(s.T(), e)
 }
@@ -289,7 +308,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 		{
 			"GetExplanationOfBenefit",
 			func(bbClient *client.BlueButtonClient, jobID, cmsID string) (interface{}, error) {
-				return bbClient.GetExplanationOfBenefit("patient1", jobID, cmsID, since, now)
+				return bbClient.GetExplanationOfBenefit("patient1", jobID, cmsID, since, now, nil)
 			},
 			func(t *testing.T, payload interface{}) {
 				result, ok := payload.(*models.Bundle)
@@ -297,6 +316,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 				assert.NotEmpty(t, result.Entries)
 			},
 			[]func(*testing.T, string){
+				v1PathChecker,
 				sinceChecker,
 				nowChecker,
 				excludeSAMHSAChecker,
@@ -305,7 +325,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 		{
 			"GetExplanationOfBenefitNoSince",
 			func(bbClient *client.BlueButtonClient, jobID, cmsID string) (interface{}, error) {
-				return bbClient.GetExplanationOfBenefit("patient1", jobID, cmsID, "", now)
+				return bbClient.GetExplanationOfBenefit("patient1", jobID, cmsID, "", now, nil)
 			},
 			func(t *testing.T, payload interface{}) {
 				result, ok := payload.(*models.Bundle)
@@ -313,11 +333,31 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 				assert.NotEmpty(t, result.Entries)
 			},
 			[]func(*testing.T, string){
+				v1PathChecker,
 				noSinceChecker,
 				nowChecker,
 				excludeSAMHSAChecker,
 			},
 		},
+		{
+			"GetExplanationOfBenefitWithTypeFilter",
+			func(bbClient *client.BlueButtonClient, jobID, cmsID string) (interface{}, error) {
+				typeFilter := url.Values{"type": []string{"carrier,outpatient"}, "service-date": []string{"ge2020-01-01"}}
+				return bbClient.GetExplanationOfBenefit("patient1", jobID, cmsID, since, now, typeFilter)
+			},
+			func(t *testing.T, payload interface{}) {
+				result, ok := payload.(*models.Bundle)
+				assert.True(t, ok)
+				assert.NotEmpty(t, result.Entries)
+			},
+			[]func(*testing.T, string){
+				v1PathChecker,
+				sinceChecker,
+				nowChecker,
+				excludeSAMHSAChecker,
+				typeFilterChecker,
+			},
+		},
 		{
 			"GetPatient",
 			func(bbClient *client.BlueButtonClient, jobID, cmsID string) (interface{}, error) {
@@ -329,6 +369,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 				assert.NotEmpty(t, result.Entries)
 			},
 			[]func(*testing.T, string){
+				v1PathChecker,
 				sinceChecker,
 				nowChecker,
 				noExcludeSAMHSAChecker,
@@ -345,6 +386,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 				assert.NotEmpty(t, result.Entries)
 			},
 			[]func(*testing.T, string){
+				v1PathChecker,
 				noSinceChecker,
 				nowChecker,
 				noExcludeSAMHSAChecker,
@@ -361,6 +403,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 				assert.NotEmpty(t, result.Entries)
 			},
 			[]func(*testing.T, string){
+				v1PathChecker,
 				sinceChecker,
 				nowChecker,
 				noExcludeSAMHSAChecker,
@@ -377,6 +420,7 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 				assert.NotEmpty(t, result.Entries)
 			},
 			[]func(*testing.T, string){
+				v1PathChecker,
 				noSinceChecker,
 				nowChecker,
 				noExcludeSAMHSAChecker,
@@ -439,9 +483,8 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 			}))
 			defer tsValidation.Close()
 
-			config := client.BlueButtonConfig{
-				BBServer: tsValidation.URL,
-			}
+			config := client.NewConfig()
+			config.BBServer = tsValidation.URL
 			bbClient, err := client.NewBlueButtonClient(config)
 			if err != nil {
 				assert.FailNow(t, err.Error())
@@ -457,6 +500,157 @@ func (s *BBRequestTestSuite) TestValidateRequest() {
 	}
 }
 
+func (s *BBRequestTestSuite) TestStreamExplanationOfBenefit() {
+	var entries []models.RawBundleEntry
+	err := s.bbClient.StreamExplanationOfBenefit("012345", "543210", "A0000", "", now, nil, func(page *models.RawBundle) error {
+		entries = append(entries, page.Entries...)
+		return nil
+	})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 33, len(entries))
+
+	var eob map[string]interface{}
+	assert.NoError(s.T(), json.Unmarshal(entries[3].Resource, &eob))
+	assert.Equal(s.T(), "carrier-10525061996", eob["id"])
+}
+
+func (s *BBRequestTestSuite) TestStreamExplanationOfBenefit_500() {
+	called := false
+	err := s.bbClient.StreamExplanationOfBenefit("012345", "543210", "A0000", "", now, nil, func(page *models.RawBundle) error {
+		called = true
+		return nil
+	})
+	assert.Regexp(s.T(), `blue button request .+ failed \d+ time\(s\)`, err.Error())
+	assert.False(s.T(), called)
+}
+
+// TestStreamPages verifies that each page is passed to the caller before the next page is requested
+// and that no more pages are requested once the caller returns an error
+func (s *BBRequestTestSuite) TestStreamPages() {
+	var bfd *httptest.Server
+	var requested int32
+	bfd = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requested, 1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		b := models.RawBundle{Entries: []models.RawBundleEntry{{Resource: json.RawMessage(fmt.Sprintf(`{"id":"%d"}`, page))}}}
+		if page < 2 {
+			b.Links = []models.BundleLink{{Relation: "next", URL: fmt.Sprintf("%s/v1/fhir/Coverage/?page=%d", bfd.URL, page+1)}}
+		}
+		assert.NoError(s.T(), json.NewEncoder(w).Encode(b))
+	}))
+	defer bfd.Close()
+
+	origPageSize := os.Getenv("BB_CLIENT_PAGE_SIZE")
+	defer os.Setenv("BB_CLIENT_PAGE_SIZE", origPageSize)
+	os.Setenv("BB_CLIENT_PAGE_SIZE", "1")
+
+	config := client.NewConfig()
+	config.BBServer = bfd.URL
+	bbClient, err := client.NewBlueButtonClient(config)
+	assert.NoError(s.T(), err)
+
+	var ids []string
+	err = bbClient.StreamCoverage("012345", "543210", "A0000", since, now, func(page *models.RawBundle) error {
+		assert.EqualValues(s.T(), len(ids)+1, atomic.LoadInt32(&requested))
+		for _, entry := range page.Entries {
+			ids = append(ids, string(entry.Resource))
+		}
+		return nil
+	})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{`{"id":"0"}`, `{"id":"1"}`, `{"id":"2"}`}, ids)
+
+	atomic.StoreInt32(&requested, 0)
+	stop := errors.New("stop")
+	err = bbClient.StreamCoverage("012345", "543210", "A0000", since, now, func(page *models.RawBundle) error {
+		return stop
+	})
+	assert.Equal(s.T(), stop, err)
+	assert.EqualValues(s.T(), 1, atomic.LoadInt32(&requested))
+}
+
+// TestDefaultPageSize verifies that bundles are requested in pages when BB_CLIENT_PAGE_SIZE isn't set
+func (s *BBRequestTestSuite) TestDefaultPageSize() {
+	var counts []string
+	var mu sync.Mutex
+	bfd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts = append(counts, r.URL.Query().Get("_count"))
+		mu.Unlock()
+		assert.NoError(s.T(), json.NewEncoder(w).Encode(models.RawBundle{}))
+	}))
+	defer bfd.Close()
+
+	origPageSize, ok := os.LookupEnv("BB_CLIENT_PAGE_SIZE")
+	if ok {
+		defer os.Setenv("BB_CLIENT_PAGE_SIZE", origPageSize)
+	}
+	os.Unsetenv("BB_CLIENT_PAGE_SIZE")
+
+	config := client.NewConfig()
+	config.BBServer = bfd.URL
+	bbClient, err := client.NewBlueButtonClient(config)
+	assert.NoError(s.T(), err)
+
+	err = bbClient.StreamCoverage("012345", "543210", "A0000", since, now, func(page *models.RawBundle) error {
+		return nil
+	})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{"50"}, counts)
+}
+
+// TestV2 uses a fake BFD that only serves R4 data from the v2 endpoints to verify that v2 clients request R4 data
+func (s *BBRequestTestSuite) TestV2() {
+	var paths []string
+	var mu sync.Mutex
+	bfd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		if !strings.HasPrefix(r.URL.Path, "/v2/fhir/") {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		resourceType := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/fhir/"), "/")
+		http.ServeFile(w, r, fmt.Sprintf("testdata/v2/%s.json", resourceType))
+	}))
+	defer bfd.Close()
+
+	config, err := client.NewConfigForVersion("v2")
+	assert.NoError(s.T(), err)
+	config.BBServer = bfd.URL
+	bbClient, err := client.NewBlueButtonClient(config)
+	assert.NoError(s.T(), err)
+
+	p, err := bbClient.GetPatientByIdentifierHash("hashedIdentifier")
+	assert.NoError(s.T(), err)
+	assert.Contains(s.T(), p, `"id": "-20000000000001"`)
+
+	patients, err := bbClient.GetPatient("-20000000000001", "543210", "A0000", since, now)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), patients.Entries, 1)
+
+	coverage, err := bbClient.GetCoverage("-20000000000001", "543210", "A0000", since, now)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), coverage.Entries, 2)
+
+	eobs, err := bbClient.GetExplanationOfBenefit("-20000000000001", "543210", "A0000", since, now, nil)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), eobs.Entries, 2)
+
+	// The resources are R4 resources (e.g. an R4 ExplanationOfBenefit requires an outcome)
+	for _, entry := range eobs.Entries {
+		b, err := json.Marshal(entry["resource"])
+		assert.NoError(s.T(), err)
+		eob, err := fhir.UnmarshalExplanationOfBenefit(b)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), fhir.ClaimProcessingCodesComplete, eob.Outcome)
+	}
+
+	assert.Equal(s.T(), []string{"/v2/fhir/Patient/", "/v2/fhir/Patient/", "/v2/fhir/Coverage/", "/v2/fhir/ExplanationOfBenefit/"}, paths)
+}
+
 func handlerFunc(w http.ResponseWriter, r *http.Request, useGZIP bool) {
 	path := r.URL.Path
 	var (
@@ -499,6 +693,9 @@ func handlerFunc(w http.ResponseWriter, r *http.Request, useGZIP bool) {
 	}
 }
 
+func v1PathChecker(t *testing.T, url string) {
+	assert.True(t, strings.HasPrefix(url, "/v1/fhir/"), "%s is not a v1 path", url)
+}
 func noSinceChecker(t *testing.T, url string) {
 	assert.NotContains(t, url, "_lastUpdated=gt")
 }
@@ -511,6 +708,10 @@ func noExcludeSAMHSAChecker(t *testing.T, url string) {
 func excludeSAMHSAChecker(t *testing.T, url string) {
 	assert.Contains(t, url, "excludeSAMHSA=true")
 }
+func typeFilterChecker(t *testing.T, url string) {
+	assert.Contains(t, url, "type=carrier%2Coutpatient")
+	assert.Contains(t, url, "service-date=ge2020-01-01")
+}
 func nowChecker(t *testing.T, url string) {
 	assert.Contains(t, url, fmt.Sprintf("_lastUpdated=le%s", nowFormatted))
 }
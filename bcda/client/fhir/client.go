@@ -15,6 +15,9 @@ import (
 type Client interface {
 	DoBundleRequest(req *http.Request) (bundle *models.Bundle, nextReq *http.Request, err error)
 
+	// DoRawBundleRequest makes a request for a single page of a bundle, leaving the entries' resources undecoded
+	DoRawBundleRequest(req *http.Request) (bundle *models.RawBundle, nextReq *http.Request, err error)
+
 	// DoRaw makes a request and return the raw response from the service
 	DoRaw(req *http.Request) (string, error)
 }
@@ -38,17 +41,31 @@ type singleClient struct {
 var _ Client = &singleClient{}
 
 func (c *singleClient) DoBundleRequest(req *http.Request) (bundle *models.Bundle, nextReq *http.Request, err error) {
+	var b models.Bundle
+	if err := c.doBundleRequest(req, &b); err != nil {
+		return nil, nil, err
+	}
+	return &b, nil, nil
+}
 
+func (c *singleClient) DoRawBundleRequest(req *http.Request) (bundle *models.RawBundle, nextReq *http.Request, err error) {
+	var b models.RawBundle
+	if err := c.doBundleRequest(req, &b); err != nil {
+		return nil, nil, err
+	}
+	return &b, nil, nil
+}
+
+func (c *singleClient) doBundleRequest(req *http.Request, bundle interface{}) error {
 	// Ensure that we'll receive the entire bundle response in a single request
 	vals := req.URL.Query()
 	vals.Del("_count")
 	req.URL.RawQuery = vals.Encode()
 
-	b, err := getBundleResponse(c.httpClient, req)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get bundle response: %w", err)
+	if err := getBundleResponse(c.httpClient, req, bundle); err != nil {
+		return fmt.Errorf("failed to get bundle response: %w", err)
 	}
-	return b, nil, nil
+	return nil
 }
 
 func (c *singleClient) DoRaw(req *http.Request) (string, error) {
@@ -69,21 +86,52 @@ type client struct {
 var _ Client = &client{}
 
 func (c *client) DoBundleRequest(req *http.Request) (bundle *models.Bundle, nextReq *http.Request, err error) {
-	const (
-		nextRelation = "next" // Relation that contains the next URL that we should be requesting
-	)
+	var b models.Bundle
+	if err := c.doBundleRequest(req, &b); err != nil {
+		return nil, nil, err
+	}
+
+	nextReq, err = nextRequest(req, b.Links)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &b, nextReq, nil
+}
+
+func (c *client) DoRawBundleRequest(req *http.Request) (bundle *models.RawBundle, nextReq *http.Request, err error) {
+	var b models.RawBundle
+	if err := c.doBundleRequest(req, &b); err != nil {
+		return nil, nil, err
+	}
+
+	nextReq, err = nextRequest(req, b.Links)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &b, nextReq, nil
+}
+
+func (c *client) doBundleRequest(req *http.Request, bundle interface{}) error {
 	// Set page size to our configured value
 	vals := req.URL.Query()
 	vals.Set("_count", c.pageSize)
 	req.URL.RawQuery = vals.Encode()
 
-	b, err := getBundleResponse(c.httpClient, req)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get bundle response: %w", err)
+	if err := getBundleResponse(c.httpClient, req, bundle); err != nil {
+		return fmt.Errorf("failed to get bundle response: %w", err)
 	}
+	return nil
+}
+
+// nextRequest returns the request for the page following the one returned by req.
+// A nil request is returned when req returned the last page.
+func nextRequest(req *http.Request, links []models.BundleLink) (*http.Request, error) {
+	const (
+		nextRelation = "next" // Relation that contains the next URL that we should be requesting
+	)
 
 	var nextURL string
-	for _, link := range b.Links {
+	for _, link := range links {
 		if link.Relation == nextRelation {
 			nextURL = link.URL
 			break
@@ -92,18 +140,18 @@ func (c *client) DoBundleRequest(req *http.Request) (bundle *models.Bundle, next
 
 	// We've reached the last page
 	if nextURL == "" {
-		return b, nil, nil
+		return nil, nil
 	}
 
 	url, err := url.Parse(nextURL)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse URL %s: %w", nextURL, err)
+		return nil, fmt.Errorf("failed to parse URL %s: %w", nextURL, err)
 	}
 
 	newReq := req.Clone(req.Context())
 	newReq.URL = url
 
-	return b, newReq, nil
+	return newReq, nil
 }
 
 func (c *client) DoRaw(req *http.Request) (string, error) {
@@ -114,18 +162,13 @@ func (c *client) DoRaw(req *http.Request) (string, error) {
 	return string(resp), nil
 }
 
-func getBundleResponse(c *http.Client, req *http.Request) (*models.Bundle, error) {
+func getBundleResponse(c *http.Client, req *http.Request, bundle interface{}) error {
 	body, err := getResponse(c, req)
 	if err != nil {
-		return nil, err
-	}
-
-	var b models.Bundle
-	if err := json.Unmarshal(body, &b); err != nil {
-		return nil, err
+		return err
 	}
 
-	return &b, nil
+	return json.Unmarshal(body, bundle)
 }
 
 func getResponse(c *http.Client, req *http.Request) (body []byte, err error) {
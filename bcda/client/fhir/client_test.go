@@ -86,6 +86,50 @@ func TestMultipleRequestBundle(t *testing.T) {
 	assertEqualsBundle(t, "./testdata/bundlePartialComplete.json", bundle)
 }
 
+func TestMultipleRequestRawBundle(t *testing.T) {
+	count := 10
+	r := &requestHandler{
+		countChecker: func(r *http.Request) {
+			assert.Equal(t, strconv.Itoa(count), r.URL.Query().Get("_count"))
+		},
+	}
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	testHost := u.Host
+
+	client := NewClient(http.DefaultClient, count)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/bundlePartial1.json", s.URL), nil)
+	assert.NoError(t, err)
+
+	var entries []models.RawBundleEntry
+	for ok := true; ok; {
+		b, next, err := client.DoRawBundleRequest(req)
+		assert.NoError(t, err)
+		assert.NotNil(t, b)
+		entries = append(entries, b.Entries...)
+
+		if next == nil {
+			ok = false
+			continue
+		}
+
+		next.URL.Host = testHost
+		req = next
+	}
+
+	assert.Equal(t, 3, r.numRequestsReceived)
+
+	data, err := ioutil.ReadFile("./testdata/bundlePartialComplete.json")
+	assert.NoError(t, err)
+	var expected models.Bundle
+	assert.NoError(t, json.Unmarshal(data, &expected))
+	assert.Len(t, entries, len(expected.Entries))
+}
+
 func TestRawRequest(t *testing.T) {
 	msg := "Hello world!"
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
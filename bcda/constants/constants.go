@@ -11,3 +11,7 @@ const ImportFail = "Failed"
 
 // This is set during compilation.  See build_and_package.sh in the ops repo
 var Version = "latest"
+
+// Versions of the API. v1 serves FHIR STU3 data and v2 serves FHIR R4 data.
+const V1Version = "v1"
+const V2Version = "v2"
@@ -0,0 +1,132 @@
+// Decrypt decrypts an export file that was encrypted with an ACO's public key, using the ACO's private key and the
+// values found in the file's "https://bluebutton.cms.gov/encryption" extension in the job's manifest.
+//
+// Usage:
+//
+//	go run github.com/CMSgov/bcda-app/bcda/encryption/decrypt -file <downloaded file> -private-key <PEM file> \
+//		-encrypted-key <encryptedKey> -nonce <nonce> > <decrypted file>
+//
+// The file is decrypted one segment at a time, so it's never held in memory; see package encryption for the segment
+// format. Each segment is authenticated before it's written. The decrypted NDJSON is written to stdout, or to the file
+// named by -out. Decryption fails if the file was modified or was not encrypted for the private key. When writing to
+// stdout, the segments before the one that failed will already have been written, so the output must be discarded.
+// The file named by -out is only created once the whole file has been decrypted.
+package main
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/CMSgov/bcda-app/bcda/encryption"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	var filePath, keyPath, encryptedKey, nonce, outPath string
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	flags.StringVar(&filePath, "file", "", "path of the encrypted file")
+	flags.StringVar(&keyPath, "private-key", "", "path of the ACO's PEM-encoded RSA private key")
+	flags.StringVar(&encryptedKey, "encrypted-key", "", "base64-encoded encryptedKey from the file's manifest entry")
+	flags.StringVar(&nonce, "nonce", "", "base64-encoded nonce from the file's manifest entry")
+	flags.StringVar(&outPath, "out", "", "path to write the decrypted file to (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if filePath == "" || keyPath == "" || encryptedKey == "" || nonce == "" {
+		return errors.New("-file, -private-key, -encrypted-key and -nonce must be provided")
+	}
+
+	privateKey, err := readPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	var env encryption.Envelope
+	if env.EncryptedKey, err = base64.StdEncoding.DecodeString(encryptedKey); err != nil {
+		return errors.Wrap(err, "invalid encrypted key")
+	}
+	if env.Nonce, err = base64.StdEncoding.DecodeString(nonce); err != nil {
+		return errors.Wrap(err, "invalid nonce")
+	}
+
+	/* #nosec -- reading file named by the user */
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := encryption.NewReader(bufio.NewReader(f), env, privateKey)
+	if err != nil {
+		return err
+	}
+
+	if outPath == "" {
+		_, err = io.Copy(stdout, r)
+		return err
+	}
+	return writeFile(outPath, r)
+}
+
+// writeFile decrypts to a temporary file next to the path, which is renamed to the path once decryption succeeds
+func writeFile(path string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readPrivateKey reads a PEM-encoded RSA private key in PKCS #1 or PKCS #8 form
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	/* #nosec -- reading file named by the user */
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not able to decode PEM-formatted private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse private key")
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key must be an RSA key")
+	}
+	return rsaKey, nil
+}
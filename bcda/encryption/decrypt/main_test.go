@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/encryption"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bcda_decrypt_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+
+	// Keys are accepted in either PKCS #1 or PKCS #8 form
+	pkcs1Path, pkcs8Path := filepath.Join(dir, "pkcs1.pem"), filepath.Join(dir, "pkcs8.pem")
+	assert.NoError(t, ioutil.WriteFile(pkcs1Path,
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600))
+	assert.NoError(t, ioutil.WriteFile(pkcs8Path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+
+	plaintext := []byte(`{"resourceType":"Patient","id":"1"}` + "\n")
+	ciphertext, env, err := encryption.Encrypt(plaintext, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	filePath := filepath.Join(dir, "data.ndjson")
+	assert.NoError(t, ioutil.WriteFile(filePath, ciphertext, 0600))
+
+	encryptedKey, nonce := base64.StdEncoding.EncodeToString(env.EncryptedKey), base64.StdEncoding.EncodeToString(env.Nonce)
+	for _, keyPath := range []string{pkcs1Path, pkcs8Path} {
+		var out bytes.Buffer
+		err = run([]string{"-file", filePath, "-private-key", keyPath, "-encrypted-key", encryptedKey, "-nonce", nonce}, &out)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, out.Bytes())
+	}
+
+	outPath := filepath.Join(dir, "decrypted.ndjson")
+	err = run([]string{"-file", filePath, "-private-key", pkcs1Path, "-encrypted-key", encryptedKey, "-nonce", nonce,
+		"-out", outPath}, ioutil.Discard)
+	assert.NoError(t, err)
+	decrypted, err := ioutil.ReadFile(outPath)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	err = run([]string{"-file", filePath, "-private-key", pkcs1Path}, ioutil.Discard)
+	assert.EqualError(t, err, "-file, -private-key, -encrypted-key and -nonce must be provided")
+
+	err = run([]string{"-file", filePath, "-private-key", filePath, "-encrypted-key", encryptedKey, "-nonce", nonce}, ioutil.Discard)
+	assert.EqualError(t, err, "not able to decode PEM-formatted private key")
+
+	err = run([]string{"-file", filePath, "-private-key", pkcs1Path, "-encrypted-key", encryptedKey, "-nonce", "%"}, ioutil.Discard)
+	assert.EqualError(t, err, "invalid nonce: illegal base64 data at input byte 0")
+
+	// Modified files are not decrypted
+	ciphertext[0] ^= 1
+	assert.NoError(t, ioutil.WriteFile(filePath, ciphertext, 0600))
+	var out bytes.Buffer
+	err = run([]string{"-file", filePath, "-private-key", pkcs1Path, "-encrypted-key", encryptedKey, "-nonce", nonce}, &out)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+	assert.Empty(t, out.Bytes())
+}
+
+func TestRunSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bcda_decrypt_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyPath := filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600))
+
+	line := []byte(`{"resourceType":"ExplanationOfBenefit","id":"1"}` + "\n")
+	plaintext := bytes.Repeat(line, 3*encryption.SegmentSize/len(line))
+	ciphertext, env, err := encryption.Encrypt(plaintext, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	filePath := filepath.Join(dir, "data.ndjson")
+	assert.NoError(t, ioutil.WriteFile(filePath, ciphertext, 0600))
+
+	args := []string{"-file", filePath, "-private-key", keyPath, "-encrypted-key",
+		base64.StdEncoding.EncodeToString(env.EncryptedKey), "-nonce", base64.StdEncoding.EncodeToString(env.Nonce)}
+	outPath := filepath.Join(dir, "decrypted.ndjson")
+	assert.NoError(t, run(append(args, "-out", outPath), ioutil.Discard))
+	decrypted, err := ioutil.ReadFile(outPath)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+	assert.NoError(t, os.Remove(outPath))
+
+	// When a later segment was modified, the file named by -out isn't created
+	ciphertext[len(ciphertext)-1] ^= 1
+	assert.NoError(t, ioutil.WriteFile(filePath, ciphertext, 0600))
+	err = run(append(args, "-out", outPath), ioutil.Discard)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+	_, err = os.Stat(outPath)
+	assert.True(t, os.IsNotExist(err))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
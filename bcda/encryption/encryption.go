@@ -0,0 +1,263 @@
+// Package encryption envelope-encrypts export files for the ACO that requested them.
+//
+// Each file is encrypted with its own random AES-256 key. The key is wrapped with the ACO's RSA public key using
+// RSA-OAEP with SHA-256, so only the ACO can recover it. The wrapped key and the nonce are published in the job's
+// manifest alongside the file; neither is secret. The ACO unwraps the key with its private key and uses it, along with
+// the nonce, to decrypt and authenticate the file.
+//
+// Files are encrypted as a stream of segments, so that they can be encrypted and decrypted without holding them in
+// memory. The plaintext is split into segments of SegmentSize bytes; only the last segment may be shorter, and it is
+// empty only when the whole file is. Each segment is encrypted with AES-256-GCM and stored as its ciphertext followed
+// by its 16 byte tag, so every segment but the last occupies SegmentSize+16 bytes of the file. The 12 byte GCM nonce
+// of each segment is the file's 7 byte nonce, followed by the segment's index (counting from 0) as a 4 byte big-endian
+// integer, followed by a byte that is 1 for the last segment and 0 otherwise. Because the index and the last segment
+// are authenticated, segments cannot be reordered, removed or added without decryption failing.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Algorithm identifies the encryption scheme in job manifests
+const Algorithm = "AES-256-GCM-STREAM-64K+RSA-OAEP-SHA256"
+
+const (
+	// SegmentSize is the size in bytes of the plaintext of every segment but the last
+	SegmentSize = 64 * 1024
+	// NonceSize is the size in bytes of a file's nonce, which begins the nonce of each of its segments
+	NonceSize = 7
+
+	// keySize is the size in bytes of the AES-256 keys used to encrypt files
+	keySize = 32
+	tagSize = 16
+)
+
+// Envelope holds what's needed, along with the ACO's private key, to decrypt a file
+type Envelope struct {
+	// EncryptedKey is the file's AES key, wrapped with the ACO's public key using RSA-OAEP with SHA-256
+	EncryptedKey []byte
+	// Nonce begins the GCM nonce of each of the file's segments
+	Nonce []byte
+}
+
+// segmentNonce returns the GCM nonce of the segment at the index
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, NonceSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[NonceSize:], index)
+	if last {
+		nonce[NonceSize+4] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts the segments of a file as they're written. It must be closed to write the last segment.
+type Writer struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	nonce  []byte
+	index  uint32
+	buf    []byte // plaintext of the segment being written
+	out    []byte // ciphertext of the segment being written
+	closed bool
+}
+
+// NewWriter returns a writer that encrypts the file written to it with a new random key, which is wrapped with the
+// public key. The encrypted file is written to w.
+func NewWriter(w io.Writer, publicKey *rsa.PublicKey) (*Writer, Envelope, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, Envelope{}, errors.Wrap(err, "could not generate encryption key")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, Envelope{}, err
+	}
+
+	nonce := make([]byte, NonceSize)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, Envelope{}, errors.Wrap(err, "could not generate nonce")
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, Envelope{}, errors.Wrap(err, "could not wrap encryption key")
+	}
+
+	return &Writer{w: w, gcm: gcm, nonce: nonce, buf: make([]byte, 0, SegmentSize),
+		out: make([]byte, 0, SegmentSize+tagSize)}, Envelope{EncryptedKey: encryptedKey, Nonce: nonce}, nil
+}
+
+// Write encrypts each segment once it's full. The last full segment is kept until more is written, since it's only
+// known to be the last segment when the writer is closed.
+func (e *Writer) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(e.buf) == SegmentSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):SegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close encrypts the last segment. It does not close the underlying writer.
+func (e *Writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+func (e *Writer) flush(last bool) error {
+	if e.index == math.MaxUint32 {
+		return errors.New("file is too large to encrypt")
+	}
+	e.out = e.gcm.Seal(e.out[:0], segmentNonce(e.nonce, e.index, last), e.buf, nil)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// Reader decrypts the segments of a file as they're read. Each segment is authenticated before any of its plaintext
+// is returned.
+type Reader struct {
+	r     io.Reader
+	gcm   cipher.AEAD
+	nonce []byte
+	index uint32
+	in    []byte // ciphertext of the next segment, and the byte after it
+	buf   []byte // plaintext of the current segment that hasn't been read
+	done  bool
+}
+
+// NewReader unwraps the envelope's key with the private key and returns a reader that decrypts the file read from r.
+// Reading returns an error if the file has been modified or was not encrypted for the private key.
+func NewReader(r io.Reader, env Envelope, privateKey *rsa.PrivateKey) (*Reader, error) {
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, env.EncryptedKey, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unwrap encryption key")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != NonceSize {
+		return nil, errors.Errorf("nonce must be %d bytes", NonceSize)
+	}
+
+	return &Reader{r: r, gcm: gcm, nonce: env.Nonce, in: make([]byte, 0, SegmentSize+tagSize+1)}, nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next segment. A byte beyond the segment is read to find out whether it's the last segment, and
+// is kept as the beginning of the following segment.
+func (d *Reader) next() error {
+	start := len(d.in)
+	d.in = d.in[:cap(d.in)]
+	n, err := io.ReadFull(d.r, d.in[start:])
+	d.in = d.in[:start+n]
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+
+	segment := d.in
+	if !last {
+		segment = d.in[:SegmentSize+tagSize]
+	}
+	if len(segment) < tagSize {
+		return errors.New("could not decrypt file: file is truncated")
+	}
+
+	plaintext, err := d.gcm.Open(nil, segmentNonce(d.nonce, d.index, last), segment, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not decrypt file")
+	}
+	d.index++
+	d.buf = plaintext
+	d.done = last
+
+	if !last {
+		d.in = append(d.in[:0], d.in[SegmentSize+tagSize:]...)
+	}
+	return nil
+}
+
+// Encrypt encrypts the plaintext with a new random key, which is wrapped with the public key
+func Encrypt(plaintext []byte, publicKey *rsa.PublicKey) ([]byte, Envelope, error) {
+	var buf bytes.Buffer
+	w, env, err := NewWriter(&buf, publicKey)
+	if err != nil {
+		return nil, Envelope{}, err
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return nil, Envelope{}, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, Envelope{}, err
+	}
+	return buf.Bytes(), env, nil
+}
+
+// Decrypt unwraps the envelope's key with the private key and uses it to decrypt the ciphertext. An error is returned
+// if the ciphertext has been modified or was not encrypted for the private key.
+func Decrypt(ciphertext []byte, env Envelope, privateKey *rsa.PrivateKey) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(ciphertext), env, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,119 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	plaintext := []byte(`{"resourceType":"Patient"}` + "\n")
+	ciphertext, env, err := Encrypt(plaintext, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "Patient")
+	assert.Len(t, env.EncryptedKey, 256)
+	assert.Len(t, env.Nonce, NonceSize)
+	assert.Len(t, ciphertext, len(plaintext)+tagSize)
+
+	decrypted, err := Decrypt(ciphertext, env, privateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// Every file gets its own key and nonce
+	_, env2, err := Encrypt(plaintext, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, env.EncryptedKey, env2.EncryptedKey)
+	assert.NotEqual(t, env.Nonce, env2.Nonce)
+
+	_, err = Decrypt(ciphertext, env, otherKey)
+	assert.Error(t, err)
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[0] ^= 1
+	_, err = Decrypt(tampered, env, privateKey)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+
+	_, err = Decrypt(ciphertext, Envelope{EncryptedKey: env.EncryptedKey, Nonce: env.Nonce[1:]}, privateKey)
+	assert.EqualError(t, err, "nonce must be 7 bytes")
+
+	// Empty files are encrypted too
+	ciphertext, env, err = Encrypt(nil, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	decrypted, err = Decrypt(ciphertext, env, privateKey)
+	assert.NoError(t, err)
+	assert.Empty(t, decrypted)
+}
+
+func TestEncryptDecryptSegments(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// Two full segments and a partial one, written in pieces that don't line up with segments
+	plaintext := make([]byte, 2*SegmentSize+SegmentSize/2)
+	_, err = rand.Read(plaintext)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	w, env, err := NewWriter(&buf, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err = w.Write(p[:n])
+		assert.NoError(t, err)
+		p = p[n:]
+	}
+	assert.NoError(t, w.Close())
+	ciphertext := buf.Bytes()
+	assert.Len(t, ciphertext, len(plaintext)+3*tagSize)
+
+	r, err := NewReader(bytes.NewReader(ciphertext), env, privateKey)
+	assert.NoError(t, err)
+	decrypted, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// A file that is an exact number of segments has no empty segment at the end
+	exact, env2, err := Encrypt(plaintext[:SegmentSize], &privateKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Len(t, exact, SegmentSize+tagSize)
+	decrypted, err = Decrypt(exact, env2, privateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext[:SegmentSize], decrypted)
+
+	segment := SegmentSize + tagSize
+
+	// Dropping the last segments is detected, because the new last segment wasn't encrypted as the last one
+	_, err = Decrypt(ciphertext[:segment], env, privateKey)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+	_, err = Decrypt(ciphertext[:2*segment], env, privateKey)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+	_, err = Decrypt(ciphertext[:2*segment+tagSize-1], env, privateKey)
+	assert.EqualError(t, err, "could not decrypt file: file is truncated")
+
+	// So is reordering segments
+	reordered := append(append(append([]byte{}, ciphertext[segment:2*segment]...), ciphertext[:segment]...),
+		ciphertext[2*segment:]...)
+	_, err = Decrypt(reordered, env, privateKey)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+
+	// Segments are authenticated before they're returned, so nothing from a modified segment is read
+	tampered := append([]byte{}, ciphertext...)
+	tampered[segment] ^= 1
+	r, err = NewReader(bytes.NewReader(tampered), env, privateKey)
+	assert.NoError(t, err)
+	decrypted, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, "could not decrypt file: cipher: message authentication failed")
+	assert.Equal(t, plaintext[:SegmentSize], decrypted)
+}
@@ -0,0 +1,186 @@
+// Package manifest describes the files generated by completed export jobs. The manifest is served by the job status
+// endpoints and included in the notifications sent to ACOs' webhooks.
+package manifest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/encryption"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/tabular"
+)
+
+type BulkResponseBody struct {
+	// Server time when the query was run
+	TransactionTime time.Time `json:"transactionTime"`
+	// URL of the bulk data export request
+	RequestURL string `json:"request"`
+	// Indicates whether an access token is required to download generated data files
+	RequiresAccessToken bool `json:"requiresAccessToken"`
+	// Information about generated data files, including URLs for downloading
+	Files []FileItem `json:"output"`
+	// Information about error files, including URLs for downloading
+	Errors []FileItem `json:"error"`
+	// Present when the export is partial
+	Extension *BulkResponseExtension `json:"extension,omitempty"`
+	JobID     uint
+}
+
+// swagger:model bulkResponseExtension
+type BulkResponseExtension struct {
+	// Indicates that some of the requested data could not be exported. The error files describe the data that is missing.
+	Partial bool `json:"https://bluebutton.cms.gov/partial"`
+}
+
+// New returns the manifest describing the files generated by a completed job.
+// The file URLs are created using the supplied scheme and host.
+func New(job models.Job, jobKeys []models.JobKey, scheme, host string) BulkResponseBody {
+	rb := BulkResponseBody{
+		TransactionTime:     job.TransactionTime,
+		RequestURL:          job.RequestURL,
+		RequiresAccessToken: true,
+		Files:               []FileItem{},
+		Errors:              []FileItem{},
+		JobID:               job.ID,
+	}
+
+	// Failed queue jobs may not have files of their own when the job's files have been grouped
+	if job.Status == models.JobStatusPartiallyCompleted {
+		rb.Extension = &BulkResponseExtension{Partial: true}
+	}
+
+	for _, jobKey := range jobKeys {
+
+		// Failed queue jobs in partial exports only have an error file
+		if jobKey.Failed {
+			rb.Extension = &BulkResponseExtension{Partial: true}
+		} else {
+			// data files
+			fi := FileItem{
+				Type:  jobKey.ResourceType,
+				URL:   DataURL(scheme, host, job, strings.TrimSpace(jobKey.FileName)),
+				Count: jobKey.ResourceCount,
+			}
+			// Files written before checksums were recorded will not have one
+			if checksum := strings.TrimSpace(jobKey.Checksum); checksum != "" {
+				fi.Extension = &FileItemExtension{
+					Checksum:  "sha256:" + checksum,
+					FileSize:  jobKey.FileSize,
+					ClaimType: jobKey.ClaimType,
+				}
+				if job.OutputFormat != "" {
+					fi.Extension.ContentType = tabular.Format(job.OutputFormat).ContentType()
+					fi.Extension.Table = outputTable(jobKey)
+				}
+				if jobKey.EncryptedKey != "" {
+					fi.Extension.Encryption = &FileEncryption{
+						Algorithm:    encryption.Algorithm,
+						EncryptedKey: jobKey.EncryptedKey,
+						Nonce:        jobKey.Nonce,
+					}
+				}
+			}
+			rb.Files = append(rb.Files, fi)
+		}
+
+		// error files
+		if jobKey.HasErrorFile {
+			errFileName := strings.Split(jobKey.FileName, ".")[0]
+			errFI := FileItem{
+				Type: "OperationOutcome",
+				URL:  DataURL(scheme, host, job, errFileName+"-error.ndjson"),
+			}
+			// Error files identify beneficiaries, so they're encrypted along with the job's other files
+			if jobKey.ErrorEncryptedKey != "" {
+				errFI.Extension = &FileItemExtension{
+					Checksum: "sha256:" + strings.TrimSpace(jobKey.ErrorChecksum),
+					FileSize: jobKey.ErrorFileSize,
+					Encryption: &FileEncryption{
+						Algorithm:    encryption.Algorithm,
+						EncryptedKey: jobKey.ErrorEncryptedKey,
+						Nonce:        jobKey.ErrorNonce,
+					},
+				}
+			}
+			rb.Errors = append(rb.Errors, errFI)
+		}
+	}
+
+	return rb
+}
+
+// swagger:model fileItem
+type FileItem struct {
+	// FHIR resource type of file contents
+	Type string `json:"type"`
+	// URL of the file
+	URL string `json:"url"`
+	// Number of resources in the file
+	Count int `json:"count,omitempty"`
+	// Additional information used to verify the contents of the file
+	Extension *FileItemExtension `json:"extension,omitempty"`
+}
+
+// swagger:model fileItemExtension
+type FileItemExtension struct {
+	// SHA-256 digest of the file, in the format sha256:<hex digest>
+	Checksum string `json:"https://bluebutton.cms.gov/checksum"`
+	// Size of the file in bytes
+	FileSize int64 `json:"https://bluebutton.cms.gov/fileSize"`
+	// Describes how to decrypt the file when it's encrypted. The checksum and size describe the encrypted file.
+	Encryption *FileEncryption `json:"https://bluebutton.cms.gov/encryption,omitempty"`
+	// Claim type of the ExplanationOfBenefit resources in the file, e.g. carrier, when the resources are split by
+	// claim type
+	ClaimType string `json:"https://bluebutton.cms.gov/claimType,omitempty"`
+	// Media type of the file when the job's resources are flattened into tables, e.g. text/csv
+	ContentType string `json:"https://bluebutton.cms.gov/contentType,omitempty"`
+	// Table in the file when the job's resources are flattened into tables, e.g. eob_line. The tables are described in
+	// the tabular package's README.
+	Table string `json:"https://bluebutton.cms.gov/table,omitempty"`
+}
+
+// outputTable returns the name of the table in a tabular job's file. Files of a resource type's main table are recorded
+// without a table.
+func outputTable(jobKey models.JobKey) string {
+	if jobKey.OutputTable != "" {
+		return jobKey.OutputTable
+	}
+	if tables := tabular.Tables(jobKey.ResourceType); len(tables) > 0 {
+		return tables[0].Name
+	}
+	return ""
+}
+
+// swagger:model fileEncryption
+type FileEncryption struct {
+	// Encryption scheme: the file is encrypted with AES-256-GCM using a random key, which is wrapped with the ACO's
+	// public key using RSA-OAEP with SHA-256. The file is a sequence of segments, each holding 64 KiB of plaintext
+	// (only the last may hold less) encrypted separately and followed by its 16 byte tag. The 12 byte nonce of each
+	// segment is the 7 byte nonce below, the segment's index counting from 0 as a 4 byte big-endian integer, and a
+	// byte that is 1 for the last segment and 0 otherwise.
+	Algorithm string `json:"algorithm"`
+	// Base64-encoded key used to encrypt the file, wrapped with the ACO's public key
+	EncryptedKey string `json:"encryptedKey"`
+	// Base64-encoded 7 byte nonce that begins the AES-GCM nonce of each of the file's segments
+	Nonce string `json:"nonce"`
+}
+
+// DataURL returns the URL from which the job's file can be downloaded.
+// Files created by v1 jobs are served from /data to remain compatible with existing clients.
+func DataURL(scheme, host string, job models.Job, fileName string) string {
+	if version := JobVersion(job); version != constants.V1Version {
+		return fmt.Sprintf("%s://%s/data/%s/%d/%s", scheme, host, version, job.ID, fileName)
+	}
+	return fmt.Sprintf("%s://%s/data/%d/%s", scheme, host, job.ID, fileName)
+}
+
+// JobVersion returns the API version of the job. Jobs created before the version was recorded belong to v1.
+func JobVersion(job models.Job) string {
+	if job.Version == "" {
+		return constants.V1Version
+	}
+	return job.Version
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	fhirmodels "github.com/eug48/fhir/models"
+
+	"github.com/CMSgov/bcda-app/bcda/models/fhir"
 )
 
 // BulkRequestResponse is the return from a request to initiate a bulk data collection process
@@ -78,6 +80,11 @@ type JobStatusResponse struct {
 	XProgress string `json:"X-Progress"`
 }
 
+// Data export job has been cancelled.
+// swagger:response deleteJobResponse
+type DeleteJobResponse struct {
+}
+
 // JSON object containing a version field
 // swagger:response VersionResponse
 type VersionResponse struct {
@@ -111,6 +118,10 @@ type FileNDJSON struct {
 	// Optional header defining encoding type used
 	// enum: gzip
 	ContentEncoding string `json:"Content-Encoding"`
+	// SHA-256 digest of the file.  The tag is weak when the response is gzip encoded.
+	ETag string
+	// SHA-256 digest of the file, in the format SHA-256=<base64 digest>.  Omitted when the response is gzip encoded.
+	Digest string
 	// in: body
 	Body NDJSON
 }
@@ -121,7 +132,7 @@ type NDJSON string
 // A JobStatus parameter model.
 //
 // This is used for operations that want the ID of a job in the path
-// swagger:parameters jobStatus serveData
+// swagger:parameters jobStatus deleteJob serveData
 type JobIDParam struct {
 	// ID of data export job
 	//
@@ -130,6 +141,26 @@ type JobIDParam struct {
 	JobID int `json:"jobId"`
 }
 
+// swagger:parameters listJobs
+type JobListParams struct {
+	// (Optional) Comma-separated list of job statuses to include (i.e., `Pending,In Progress`)
+	// in: query
+	// required: false
+	Status string `json:"status"`
+	// (Optional) Only include jobs created after the given instant in time.  Format of string must align with the FHIR Instant datatype (i.e., `2020-02-13T08:00:00.000-05:00`)
+	// in: query
+	// required: false
+	CreatedAfter string `json:"createdAfter"`
+	// (Optional) Page of results to return, starting at 1
+	// in: query
+	// required: false
+	Page int `json:"page"`
+	// (Optional) Maximum number of jobs to return per page
+	// in: query
+	// required: false
+	Count int `json:"_count"`
+}
+
 // swagger:parameters serveData
 type FileParam struct {
 	// Name of file to be downloaded
@@ -164,6 +195,22 @@ type SinceParam struct {
 }
 
 // swagger:parameters bulkPatientRequest bulkGroupRequest
+type TypeFilterParam struct {
+	// (Optional) Only include ExplanationOfBenefit resources matching the supplied FHIR search criteria.  Format of string must be `ExplanationOfBenefit?<criteria>` (URL encoded) where the supported criteria are `type` (i.e., `carrier,outpatient`) and `service-date` (i.e., `ge2020-01-01`)
+	// in: query
+	// required: false
+	TypeFilter []string `json:"_typeFilter"`
+}
+
+// swagger:parameters bulkGroupPostRequest
+type ExportParametersBody struct {
+	// FHIR Parameters resource containing the export parameters.  Each patient must be supplied as a `patient` parameter with a `valueReference` of the form `Patient/<MBI>`.  The optional `_type` and `_typeFilter` parameters must be supplied as a `valueString` and `_since` as a `valueInstant`.
+	// in: body
+	// required: true
+	Body fhir.Parameters
+}
+
+// swagger:parameters bulkPatientRequest bulkGroupRequest bulkGroupPostRequest
 type BulkRequestHeaders struct {
 	// required: true
 	// in: header
@@ -171,10 +218,26 @@ type BulkRequestHeaders struct {
 	Prefer string
 }
 
+// swagger:parameters bulkPatientRequest bulkGroupRequest bulkGroupPostRequest
+type CallbackURLHeader struct {
+	// (Optional) URL notified when the job completes or fails, overriding the webhook URL registered for the ACO.  Notifications are signed with the ACO's webhook secret, which must be registered before this header can be used.
+	// in: header
+	// required: false
+	CallbackURL string `json:"X-Callback-URL"`
+}
+
+// swagger:parameters bulkPatientRequest bulkGroupRequest bulkGroupPostRequest
+type AllowPartialExportHeader struct {
+	// (Optional) When true, the job completes with the files that were exported successfully even if some of the data could not be exported, overriding the setting for the ACO.  Partial exports are marked as such in the job's manifest and error files describe the data that is missing.
+	// in: header
+	// required: false
+	AllowPartialExport bool `json:"X-Allow-Partial-Export"`
+}
+
 // A BulkGroupRequest parameter model.
 //
 // This is used for operations that want the groupID of a group in the path
-// swagger:parameters bulkGroupRequest
+// swagger:parameters bulkGroupRequest bulkGroupPostRequest
 type GroupIDParam struct {
 	// ID of group export
 	// in: path
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// blueButtonIDCacheBatchSize is the number of beneficiaries read from a CCLF file at a time when warming the cache
+const blueButtonIDCacheBatchSize = 1000
+
+// BlueButtonIDCacheEntry maps a beneficiary's MBI to their Blue Button ID. Unlike the ID saved on each CCLF beneficiary,
+// the cache is keyed by MBI so the IDs remain available after the ACO's next CCLF file is imported.
+type BlueButtonIDCacheEntry struct {
+	MBI          string    `gorm:"type:varchar(11);primary_key"`
+	BlueButtonID string    `gorm:"type:text;not null"`
+	UpdatedAt    time.Time `gorm:"not null;index:idx_blue_button_id_cache_updated_at"` // when the ID was last retrieved from Blue Button
+}
+
+func (BlueButtonIDCacheEntry) TableName() string {
+	return "blue_button_id_cache"
+}
+
+// BlueButtonIDCacheTTL returns how long a cached ID is used before it's retrieved from Blue Button again.
+// Caching is disabled when BCDA_BB_ID_CACHE_TTL_HOURS is 0.
+func BlueButtonIDCacheTTL() time.Duration {
+	return time.Duration(utils.GetEnvInt("BCDA_BB_ID_CACHE_TTL_HOURS", 720)) * time.Hour
+}
+
+// GetCachedBlueButtonIDs returns the unexpired Blue Button IDs cached for the MBIs, keyed by MBI.
+// MBIs without an unexpired ID are not included.
+func GetCachedBlueButtonIDs(db *gorm.DB, mbis []string) (map[string]string, error) {
+	ids := make(map[string]string)
+	ttl := BlueButtonIDCacheTTL()
+	if ttl <= 0 || len(mbis) == 0 {
+		return ids, nil
+	}
+
+	var entries []BlueButtonIDCacheEntry
+	if err := db.Where("mbi in (?) and updated_at > ?", mbis, time.Now().Add(-ttl)).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ids[entry.MBI] = entry.BlueButtonID
+	}
+	return ids, nil
+}
+
+// CacheBlueButtonID saves the beneficiary's Blue Button ID, replacing any ID already cached for the MBI
+func CacheBlueButtonID(db *gorm.DB, mbi, blueButtonID string) error {
+	if BlueButtonIDCacheTTL() <= 0 {
+		return nil
+	}
+
+	return db.Exec(`INSERT INTO blue_button_id_cache (mbi, blue_button_id, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (mbi) DO UPDATE SET blue_button_id = excluded.blue_button_id, updated_at = excluded.updated_at`,
+		mbi, blueButtonID, time.Now()).Error
+}
+
+// InvalidateBlueButtonIDs removes the IDs cached for the MBIs so they're retrieved from Blue Button the next time
+// they're needed. Every cached ID is removed if no MBIs are supplied. The number of IDs removed is returned.
+func InvalidateBlueButtonIDs(db *gorm.DB, mbis ...string) (int64, error) {
+	query := db.Unscoped()
+	if len(mbis) > 0 {
+		query = query.Where("mbi in (?)", mbis)
+	}
+	result := query.Delete(BlueButtonIDCacheEntry{})
+	return result.RowsAffected, result.Error
+}
+
+// BlueButtonIDCacheWarmResult summarizes the beneficiaries processed by WarmBlueButtonIDCache
+type BlueButtonIDCacheWarmResult struct {
+	Beneficiaries int // beneficiaries in the CCLF file
+	AlreadyCached int // beneficiaries with an unexpired ID in the cache
+	Retrieved     int // beneficiaries whose ID was retrieved from Blue Button and cached
+	Failed        int // beneficiaries whose ID could not be retrieved
+}
+
+// WarmBlueButtonIDCache retrieves the Blue Button IDs of the beneficiaries in the CCLF file that do not have an
+// unexpired ID in the cache, making at most concurrency requests to Blue Button at a time. The retrieved IDs are
+// cached and saved on the CCLF beneficiaries so that export jobs for the ACO don't need to request them.
+// Beneficiaries whose IDs cannot be retrieved are logged and counted, but do not stop the cache from being warmed.
+func WarmBlueButtonIDCache(db *gorm.DB, bb client.APIClient, fileID uint, concurrency int) (BlueButtonIDCacheWarmResult, error) {
+	var result BlueButtonIDCacheWarmResult
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var lastID uint
+	for {
+		var benes []CCLFBeneficiary
+		err := db.Where("file_id = ? and id > ?", fileID, lastID).Order("id").Limit(blueButtonIDCacheBatchSize).Find(&benes).Error
+		if err != nil {
+			return result, err
+		}
+		if len(benes) == 0 {
+			return result, nil
+		}
+		lastID = benes[len(benes)-1].ID
+		result.Beneficiaries += len(benes)
+
+		mbis := make([]string, len(benes))
+		for i, bene := range benes {
+			mbis[i] = bene.MBI
+		}
+		cached, err := GetCachedBlueButtonIDs(db, mbis)
+		if err != nil {
+			return result, err
+		}
+
+		toRetrieve := make(chan CCLFBeneficiary, len(benes))
+		for _, bene := range benes {
+			if _, ok := cached[bene.MBI]; ok {
+				result.AlreadyCached++
+				continue
+			}
+			toRetrieve <- bene
+		}
+		close(toRetrieve)
+
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for n := 0; n < concurrency; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for bene := range toRetrieve {
+					err := cacheBeneficiaryBlueButtonID(db, bb, bene)
+					if err != nil {
+						log.Errorf("Failed to cache Blue Button ID for CCLF beneficiary %d: %s", bene.ID, err.Error())
+					}
+
+					mu.Lock()
+					if err != nil {
+						result.Failed++
+					} else {
+						result.Retrieved++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// cacheBeneficiaryBlueButtonID retrieves the beneficiary's Blue Button ID, caches it, and saves it on the beneficiary
+func cacheBeneficiaryBlueButtonID(db *gorm.DB, bb client.APIClient, bene CCLFBeneficiary) error {
+	bbID, err := bene.GetBlueButtonID(bb)
+	if err != nil {
+		return err
+	}
+
+	if err = CacheBlueButtonID(db, bene.MBI, bbID); err != nil {
+		return err
+	}
+
+	if bene.BlueButtonID != bbID {
+		return db.Model(&bene).Update("blue_button_id", bbID).Error
+	}
+	return nil
+}
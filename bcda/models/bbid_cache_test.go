@@ -0,0 +1,114 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/testUtils"
+)
+
+type BlueButtonIDCacheTestSuite struct {
+	suite.Suite
+	db   *gorm.DB
+	mbis []string
+}
+
+func (s *BlueButtonIDCacheTestSuite) SetupTest() {
+	InitializeGormModels()
+	s.db = database.GetGORMDbConnection()
+	s.mbis = []string{"1Y000000001", "1Y000000002", "1Y000000003"}
+}
+
+func (s *BlueButtonIDCacheTestSuite) TearDownTest() {
+	_, err := InvalidateBlueButtonIDs(s.db, s.mbis...)
+	assert.NoError(s.T(), err)
+	os.Unsetenv("BCDA_BB_ID_CACHE_TTL_HOURS")
+	database.Close(s.db)
+}
+
+func TestBlueButtonIDCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(BlueButtonIDCacheTestSuite))
+}
+
+func (s *BlueButtonIDCacheTestSuite) TestCache() {
+	assert.NoError(s.T(), CacheBlueButtonID(s.db, s.mbis[0], "-1"))
+	assert.NoError(s.T(), CacheBlueButtonID(s.db, s.mbis[1], "-2"))
+
+	// Caching an ID for the same MBI replaces it
+	assert.NoError(s.T(), CacheBlueButtonID(s.db, s.mbis[1], "-20"))
+
+	ids, err := GetCachedBlueButtonIDs(s.db, s.mbis)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{s.mbis[0]: "-1", s.mbis[1]: "-20"}, ids)
+
+	// Expired IDs are not returned
+	assert.NoError(s.T(), s.db.Model(&BlueButtonIDCacheEntry{}).Where("mbi = ?", s.mbis[0]).
+		Update("updated_at", time.Now().Add(-BlueButtonIDCacheTTL()-time.Minute)).Error)
+	ids, err = GetCachedBlueButtonIDs(s.db, s.mbis)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{s.mbis[1]: "-20"}, ids)
+
+	count, err := InvalidateBlueButtonIDs(s.db, s.mbis[1], s.mbis[2])
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), count)
+	ids, err = GetCachedBlueButtonIDs(s.db, s.mbis)
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), ids)
+}
+
+func (s *BlueButtonIDCacheTestSuite) TestCacheDisabled() {
+	assert.NoError(s.T(), CacheBlueButtonID(s.db, s.mbis[0], "-1"))
+
+	os.Setenv("BCDA_BB_ID_CACHE_TTL_HOURS", "0")
+	ids, err := GetCachedBlueButtonIDs(s.db, s.mbis)
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), ids)
+
+	// IDs are not cached while caching is disabled
+	assert.NoError(s.T(), CacheBlueButtonID(s.db, s.mbis[1], "-2"))
+	os.Unsetenv("BCDA_BB_ID_CACHE_TTL_HOURS")
+	ids, err = GetCachedBlueButtonIDs(s.db, s.mbis)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{s.mbis[0]: "-1"}, ids)
+}
+
+func (s *BlueButtonIDCacheTestSuite) TestWarmBlueButtonIDCache() {
+	cclfFile := CCLFFile{CCLFNum: 8, ACOCMSID: "A9906", Timestamp: time.Now(), PerformanceYear: 20, Name: uuid.New()}
+	assert.NoError(s.T(), s.db.Create(&cclfFile).Error)
+	defer s.db.Unscoped().Delete(&cclfFile)
+	defer s.db.Unscoped().Delete(CCLFBeneficiary{}, "file_id = ?", cclfFile.ID)
+
+	bbc := testUtils.BlueButtonClient{}
+	bbIDs := []string{"-19990000000001", "-19990000000002"}
+	for i := range s.mbis {
+		assert.NoError(s.T(), s.db.Create(&CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: s.mbis[i]}).Error)
+	}
+	// The first beneficiary is already cached and the last beneficiary can't be found
+	assert.NoError(s.T(), CacheBlueButtonID(s.db, s.mbis[0], bbIDs[0]))
+	bbc.MBI = &s.mbis[1]
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(s.mbis[1])).Return(bbc.GetData("Patient", bbIDs[1]))
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(s.mbis[2])).Return("", errors.New("patient not found"))
+
+	result, err := WarmBlueButtonIDCache(s.db, &bbc, cclfFile.ID, 2)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), BlueButtonIDCacheWarmResult{Beneficiaries: 3, AlreadyCached: 1, Retrieved: 1, Failed: 1}, result)
+	bbc.AssertNotCalled(s.T(), "GetPatientByIdentifierHash", client.HashIdentifier(s.mbis[0]))
+
+	ids, err := GetCachedBlueButtonIDs(s.db, s.mbis)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{s.mbis[0]: bbIDs[0], s.mbis[1]: bbIDs[1]}, ids)
+
+	// The retrieved ID is also saved on the CCLF beneficiary
+	var bene CCLFBeneficiary
+	assert.NoError(s.T(), s.db.First(&bene, "file_id = ? and mbi = ?", cclfFile.ID, s.mbis[1]).Error)
+	assert.Equal(s.T(), bbIDs[1], bene.BlueButtonID)
+}
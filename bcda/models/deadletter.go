@@ -0,0 +1,122 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bgentry/que-go"
+	"github.com/jinzhu/gorm"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// DeadLetterJob is a queue job that was removed from the queue after it failed too many times to be retried again.
+// It keeps everything needed to put the job back on the queue once the cause of the failure has been addressed.
+type DeadLetterJob struct {
+	gorm.Model
+	QueueJobID int64  `gorm:"unique_index"` // ID of the job in que_jobs
+	Type       string `gorm:"not null"`
+	Queue      string
+	Priority   int16
+	Args       string `gorm:"type:jsonb;not null"`
+	ErrorCount int32  // failed attempts, including the final one
+	LastError  string `gorm:"type:text"`
+	JobID      uint   `gorm:"index"` // export job the queue job belongs to, or 0 if it could not be determined
+}
+
+// MaxQueueJobAttempts returns the number of times a queue job is attempted before it's moved to the dead-letter table
+func MaxQueueJobAttempts() int32 {
+	return int32(utils.GetEnvInt("BCDA_WORKER_MAX_JOB_ATTEMPTS", 10))
+}
+
+// NewDeadLetterJob describes the queue job that failed with lastErr on its final attempt
+func NewDeadLetterJob(j *que.Job, lastErr error) DeadLetterJob {
+	dlj := DeadLetterJob{
+		QueueJobID: j.ID,
+		Type:       j.Type,
+		Queue:      j.Queue,
+		Priority:   j.Priority,
+		Args:       string(j.Args),
+		ErrorCount: j.ErrorCount + 1,
+		LastError:  lastErr.Error(),
+	}
+
+	// Both export and notification jobs identify their export job by ID
+	var args struct{ ID uint }
+	if err := json.Unmarshal(j.Args, &args); err == nil {
+		dlj.JobID = args.ID
+	}
+
+	return dlj
+}
+
+// SaveDeadLetterJob adds the queue job to the dead-letter table. The queue job is only added once, even if it's
+// dead-lettered again because it could not be removed from the queue.
+func SaveDeadLetterJob(db *gorm.DB, dlj *DeadLetterJob) error {
+	err := db.Set("gorm:insert_option", "ON CONFLICT (queue_job_id) DO NOTHING").Create(dlj).Error
+	// No ID is returned when the queue job is already in the table
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// GetDeadLetterJobs returns the dead-lettered queue jobs, oldest first
+func GetDeadLetterJobs(db *gorm.DB) ([]DeadLetterJob, error) {
+	var jobs []DeadLetterJob
+	err := db.Order("created_at, id").Find(&jobs).Error
+	return jobs, err
+}
+
+// GetDeadLetterJob returns the dead-lettered queue job with the given ID
+func GetDeadLetterJob(db *gorm.DB, id uint) (DeadLetterJob, error) {
+	var dlj DeadLetterJob
+	err := db.First(&dlj, id).Error
+	return dlj, err
+}
+
+// EnqueueArgs returns the arguments of a dead-lettered export job
+func (dlj DeadLetterJob) EnqueueArgs() (JobEnqueueArgs, error) {
+	var args JobEnqueueArgs
+	err := json.Unmarshal([]byte(dlj.Args), &args)
+	return args, err
+}
+
+// Requeue puts the job back on the queue, with its attempts reset, and removes it from the dead-letter table.
+// If the export job failed because the queue job was dead-lettered, it's moved back to In Progress so that it's
+// completed once the requeued job has been worked.
+func (dlj *DeadLetterJob) Requeue(db *gorm.DB, qc *que.Client) error {
+	j := &que.Job{
+		Type:     dlj.Type,
+		Queue:    dlj.Queue,
+		Priority: dlj.Priority,
+		Args:     []byte(dlj.Args),
+		RunAt:    time.Now(),
+	}
+	if err := qc.Enqueue(j); err != nil {
+		return err
+	}
+
+	if dlj.Type == "ProcessJob" && dlj.JobID != 0 {
+		var job Job
+		err := db.First(&job, dlj.JobID).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		if err == nil && job.Status == JobStatusFailed {
+			reason := fmt.Sprintf("dead-lettered queue job %d requeued", dlj.QueueJobID)
+			if _, err = job.TransitionStatus(db, JobStatusInProgress, JobStatusActorCLI, reason); err != nil {
+				return err
+			}
+		}
+	}
+
+	return dlj.Discard(db)
+}
+
+// Discard removes the job from the dead-letter table without putting it back on the queue
+func (dlj *DeadLetterJob) Discard(db *gorm.DB) error {
+	return db.Unscoped().Delete(dlj).Error
+}
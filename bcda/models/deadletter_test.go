@@ -0,0 +1,31 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bgentry/que-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeadLetterJob(t *testing.T) {
+	qj := &que.Job{ID: 12, Type: "ProcessJob", Queue: "", Priority: 20, ErrorCount: 9,
+		Args: []byte(`{"ID":34,"ACOID":"00000000-0000-0000-0000-000000000000","BeneficiaryIDs":["1"],"ResourceType":"Patient"}`)}
+
+	dlj := NewDeadLetterJob(qj, errors.New("Blue Button is down"))
+	assert.Equal(t, int64(12), dlj.QueueJobID)
+	assert.Equal(t, "ProcessJob", dlj.Type)
+	assert.Equal(t, int16(20), dlj.Priority)
+	assert.Equal(t, int32(10), dlj.ErrorCount)
+	assert.Equal(t, "Blue Button is down", dlj.LastError)
+	assert.Equal(t, uint(34), dlj.JobID)
+
+	args, err := dlj.EnqueueArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, JobEnqueueArgs{ID: 34, ACOID: "00000000-0000-0000-0000-000000000000", BeneficiaryIDs: []string{"1"}, ResourceType: "Patient"}, args)
+
+	// Jobs whose arguments don't identify an export job are still dead-lettered
+	dlj = NewDeadLetterJob(&que.Job{ID: 13, Type: "Other", Args: []byte(`[]`)}, errors.New("failed"))
+	assert.Equal(t, uint(0), dlj.JobID)
+	assert.Equal(t, "[]", dlj.Args)
+}
@@ -2,7 +2,10 @@
 // These data models are a lighter weight definition contain certain fields needed for BCDA
 package fhir
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Resource struct {
 	ResourceType string `json:"resourceType"`
@@ -15,11 +18,48 @@ type Resource struct {
 
 type Bundle struct {
 	Resource
-	Links []struct {
-		Relation string `json:"relation"`
-		URL      string `json:"url"`
-	} `json:"link"`
+	Links   []BundleLink  `json:"link"`
 	Entries []BundleEntry `json:"entry"`
 }
 
+type BundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
 type BundleEntry map[string]interface{}
+
+// RawBundle is a Bundle whose resources are left as the JSON received from the server.
+// It's used when resources are copied to a file without needing to inspect them.
+type RawBundle struct {
+	Resource
+	Links   []BundleLink     `json:"link"`
+	Entries []RawBundleEntry `json:"entry"`
+}
+
+type RawBundleEntry struct {
+	Resource json.RawMessage `json:"resource"`
+}
+
+// Parameters represents the FHIR Parameters resource used to supply operation parameters in a request body
+type Parameters struct {
+	ResourceType string      `json:"resourceType"`
+	Parameter    []Parameter `json:"parameter"`
+}
+
+type Parameter struct {
+	Name           string     `json:"name"`
+	ValueString    string     `json:"valueString,omitempty"`
+	ValueInstant   string     `json:"valueInstant,omitempty"`
+	ValueReference *Reference `json:"valueReference,omitempty"`
+}
+
+type Reference struct {
+	Reference  string      `json:"reference,omitempty"`
+	Identifier *Identifier `json:"identifier,omitempty"`
+}
+
+type Identifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/bgentry/que-go"
+	"github.com/jinzhu/gorm"
+)
+
+// FinalizeJobType is the que job type used to finalize an export job once all of its queue jobs have finished
+const FinalizeJobType = "FinalizeJob"
+
+// FinalizeJobArgs are the arguments of the que job used to finalize an export job.
+// This is not a persistent model so it is not necessary to include in GORM auto migrate.
+// swagger:ignore
+type FinalizeJobArgs struct {
+	ID uint // export job ID, named to match JobEnqueueArgs so that both identify their job the same way
+}
+
+// NewFinalizeQueueJob returns the que job used to finalize the export job with the given ID
+func NewFinalizeQueueJob(jobID uint) (*que.Job, error) {
+	args, err := json.Marshal(FinalizeJobArgs{ID: jobID})
+	if err != nil {
+		return nil, err
+	}
+
+	return &que.Job{Type: FinalizeJobType, Args: args}, nil
+}
+
+// CompleteQueueJob records the key of a finished queue job, along with the keys of any other files it wrote (e.g. its
+// claim type files), and increments the job's completed queue job count in a single transaction. The count is
+// incremented in the database, so concurrent queue jobs never lose an update.
+// It returns true to exactly one caller: the one whose queue job was the last of the job's queue jobs to finish,
+// which is responsible for finalizing the job.
+func (job *Job) CompleteQueueJob(db *gorm.DB, key *JobKey, otherKeys ...*JobKey) (last bool, err error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	for _, k := range append([]*JobKey{key}, otherKeys...) {
+		k.JobID = job.ID
+		if err = tx.Create(k).Error; err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	var completed int
+	err = tx.Raw(`UPDATE jobs SET completed_job_count = completed_job_count + 1, updated_at = now() WHERE id = ?
+		RETURNING completed_job_count`, job.ID).Row().Scan(&completed)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return false, err
+	}
+
+	job.CompletedJobCount = completed
+	return completed == job.JobCount, nil
+}
+
+// CountFinishedQueueJobs returns the number of the job's queue jobs that have finished, or only those that failed.
+// Each queue job records exactly one key that is neither a part, a claim type file nor a secondary table's file. Keys
+// replaced when the job's files were grouped are soft-deleted, but they still record finished queue jobs.
+func CountFinishedQueueJobs(db *gorm.DB, jobID uint, failedOnly bool) (int, error) {
+	query := db.Unscoped().Model(&JobKey{}).Where("job_id = ? and not part and claim_type = '' and output_table = ''", jobID)
+	if failedOnly {
+		query = query.Where("failed")
+	}
+	var count int
+	err := query.Count(&count).Error
+	return count, err
+}
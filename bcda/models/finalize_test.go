@@ -0,0 +1,64 @@
+package models
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFinalizeQueueJob(t *testing.T) {
+	j, err := NewFinalizeQueueJob(34)
+	assert.NoError(t, err)
+	assert.Equal(t, FinalizeJobType, j.Type)
+
+	// Dead-lettered finalize jobs identify their export job the same way as export queue jobs
+	var args JobEnqueueArgs
+	assert.NoError(t, json.Unmarshal(j.Args, &args))
+	assert.Equal(t, 34, args.ID)
+}
+
+func (s *ModelsTestSuite) TestCompleteQueueJob() {
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     JobStatusInProgress,
+		JobCount:   10,
+	}
+	assert.NoError(s.T(), s.db.Create(&j).Error)
+	defer s.db.Unscoped().Delete(&j)
+	defer s.db.Unscoped().Delete(JobKey{}, "job_id = ?", j.ID)
+
+	// Queue jobs finish concurrently, but only the last one is told to finalize the job
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		last int
+	)
+	for i := 0; i < j.JobCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job := j
+			isLast, err := job.CompleteQueueJob(s.db, &JobKey{FileName: uuid.NewRandom().String() + ".ndjson"})
+			assert.NoError(s.T(), err)
+			if isLast {
+				mu.Lock()
+				last++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(s.T(), 1, last)
+
+	var actual Job
+	assert.NoError(s.T(), s.db.First(&actual, j.ID).Error)
+	assert.Equal(s.T(), 10, actual.CompletedJobCount)
+
+	var keys int
+	assert.NoError(s.T(), s.db.Model(&JobKey{}).Where("job_id = ?", j.ID).Count(&keys).Error)
+	assert.Equal(s.T(), 10, keys)
+}
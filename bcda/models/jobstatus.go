@@ -0,0 +1,161 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// JobStatus is the state of an export job
+type JobStatus string
+
+const (
+	JobStatusPending    JobStatus = "Pending"
+	JobStatusInProgress JobStatus = "In Progress"
+	JobStatusCompleted  JobStatus = "Completed"
+	// JobStatusPartiallyCompleted is the status of a job that allowed partial exports and completed even though
+	// some of its queue jobs failed. Only the failed queue jobs' error files are available in their place.
+	JobStatusPartiallyCompleted JobStatus = "Partially Completed"
+	JobStatusFailed             JobStatus = "Failed"
+	JobStatusArchived           JobStatus = "Archived"
+	JobStatusExpired            JobStatus = "Expired"
+	JobStatusCancelled          JobStatus = "Cancelled"
+)
+
+// Actors recorded in the job status history
+const (
+	JobStatusActorAPI    = "api"
+	JobStatusActorWorker = "worker"
+	JobStatusActorCLI    = "bcdacli"
+)
+
+// jobStatusTransitions contains the statuses each status may move to. A status that is not a key is not a valid status.
+var jobStatusTransitions = map[JobStatus][]JobStatus{
+	JobStatusPending:            {JobStatusInProgress, JobStatusFailed, JobStatusCancelled},
+	JobStatusInProgress:         {JobStatusCompleted, JobStatusPartiallyCompleted, JobStatusFailed, JobStatusCancelled},
+	JobStatusCompleted:          {JobStatusArchived},
+	JobStatusPartiallyCompleted: {JobStatusArchived},
+	JobStatusArchived:           {JobStatusExpired},
+	JobStatusFailed:             {},
+	JobStatusExpired:            {},
+	JobStatusCancelled:          {},
+}
+
+// actorJobStatusTransitions contains the transitions that only the given actor may make, in addition to those in
+// jobStatusTransitions
+var actorJobStatusTransitions = map[string]map[JobStatus][]JobStatus{
+	// A failed job resumes when its dead-lettered queue jobs are requeued using the CLI
+	JobStatusActorCLI: {JobStatusFailed: {JobStatusInProgress}},
+}
+
+// IsValid returns true if s is a known job status
+func (s JobStatus) IsValid() bool {
+	_, ok := jobStatusTransitions[s]
+	return ok
+}
+
+// IsCompleted returns true if the job's files are available for download, even if some of them are error files
+func (s JobStatus) IsCompleted() bool {
+	return s == JobStatusCompleted || s == JobStatusPartiallyCompleted
+}
+
+// CanTransitionTo returns true if a job may move from s to the given status
+func (s JobStatus) CanTransitionTo(to JobStatus) bool {
+	return containsStatus(jobStatusTransitions[s], to)
+}
+
+// CanActorTransitionTo returns true if the actor may move a job from s to the given status
+func (s JobStatus) CanActorTransitionTo(to JobStatus, actor string) bool {
+	return s.CanTransitionTo(to) || containsStatus(actorJobStatusTransitions[actor][s], to)
+}
+
+func containsStatus(statuses []JobStatus, status JobStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// JobStatusHistory records a change in a job's status
+type JobStatusHistory struct {
+	ID         uint      `gorm:"primary_key"`
+	JobID      uint      `gorm:"not null;index"`
+	FromStatus JobStatus `gorm:"not null"`
+	ToStatus   JobStatus `gorm:"not null"`
+	Actor      string    `gorm:"not null"` // component that changed the status, e.g. api or worker
+	Reason     string    `gorm:"type:text"`
+	CreatedAt  time.Time
+}
+
+func (JobStatusHistory) TableName() string {
+	return "job_status_history"
+}
+
+// TransitionStatus moves the job to the given status and records the change in the job's status history.
+// It's the only way a job's status should be changed once the job has been created.
+// The job's current status is read from the database, so concurrent changes are serialized. If the actor cannot move
+// the current status to the given status, the job is left unchanged and false is returned.
+func (job *Job) TransitionStatus(db *gorm.DB, to JobStatus, actor, reason string) (bool, error) {
+	return job.transitionStatus(db, to, actor, reason, nil)
+}
+
+// transitionStatus is TransitionStatus, additionally calling inTx, if it isn't nil, with the transaction that changes
+// the status before it commits. If inTx returns an error, the status is left unchanged.
+func (job *Job) transitionStatus(db *gorm.DB, to JobStatus, actor, reason string, inTx func(tx *gorm.DB) error) (bool, error) {
+	if !to.IsValid() {
+		return false, fmt.Errorf("invalid job status %q", to)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	var current Job
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id, status").First(&current, job.ID).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if !current.Status.CanActorTransitionTo(to, actor) {
+		tx.Rollback()
+		job.Status = current.Status
+		return false, nil
+	}
+
+	if err := tx.Model(&current).Update("status", to).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	history := JobStatusHistory{JobID: job.ID, FromStatus: current.Status, ToStatus: to, Actor: actor, Reason: reason}
+	if err := tx.Create(&history).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if inTx != nil {
+		if err := inTx(tx); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+
+	job.Status = to
+	job.UpdatedAt = current.UpdatedAt
+	return true, nil
+}
+
+// GetJobStatusHistory returns the changes in the job's status, oldest first
+func GetJobStatusHistory(db *gorm.DB, jobID uint) ([]JobStatusHistory, error) {
+	var history []JobStatusHistory
+	err := db.Where("job_id = ?", jobID).Order("created_at, id").Find(&history).Error
+	return history, err
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from    JobStatus
+		to      JobStatus
+		allowed bool
+	}{
+		{JobStatusPending, JobStatusInProgress, true},
+		{JobStatusPending, JobStatusCompleted, false},
+		{JobStatusInProgress, JobStatusCompleted, true},
+		{JobStatusInProgress, JobStatusCancelled, true},
+		{JobStatusCompleted, JobStatusArchived, true},
+		{JobStatusCompleted, JobStatusFailed, false},
+		{JobStatusInProgress, JobStatusPartiallyCompleted, true},
+		{JobStatusPartiallyCompleted, JobStatusArchived, true},
+		{JobStatusPartiallyCompleted, JobStatusCompleted, false},
+		{JobStatusArchived, JobStatusExpired, true},
+		{JobStatusFailed, JobStatusCompleted, false},
+		{JobStatusFailed, JobStatusInProgress, false},
+		{JobStatusCancelled, JobStatusInProgress, false},
+		{JobStatusExpired, JobStatusArchived, false},
+		{JobStatus("Unknown"), JobStatusInProgress, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" to "+string(tt.to), func(t *testing.T) {
+			assert.Equal(t, tt.allowed, tt.from.CanTransitionTo(tt.to))
+		})
+	}
+
+	// Only the CLI may resume a failed job, when requeuing its dead-lettered queue jobs
+	assert.True(t, JobStatusFailed.CanActorTransitionTo(JobStatusInProgress, JobStatusActorCLI))
+	assert.False(t, JobStatusFailed.CanActorTransitionTo(JobStatusInProgress, JobStatusActorWorker))
+	assert.False(t, JobStatusFailed.CanActorTransitionTo(JobStatusCompleted, JobStatusActorCLI))
+	assert.True(t, JobStatusPending.CanActorTransitionTo(JobStatusInProgress, JobStatusActorWorker))
+
+	assert.True(t, JobStatusExpired.IsValid())
+	assert.True(t, JobStatusPartiallyCompleted.IsCompleted())
+	assert.False(t, JobStatusArchived.IsCompleted())
+	assert.False(t, JobStatus("Unknown").IsValid())
+}
+
+func (s *ModelsTestSuite) TestTransitionStatus() {
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     JobStatusPending,
+		JobCount:   1,
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+	defer s.db.Delete(JobStatusHistory{}, "job_id = ?", j.ID)
+
+	changed, err := j.TransitionStatus(s.db, JobStatusInProgress, JobStatusActorWorker, "queue job 1 started")
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), changed)
+	assert.Equal(s.T(), JobStatusInProgress, j.Status)
+
+	// Failed jobs can't be completed
+	changed, err = j.TransitionStatus(s.db, JobStatusFailed, JobStatusActorWorker, "Blue Button is down")
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), changed)
+	changed, err = j.TransitionStatus(s.db, JobStatusCompleted, JobStatusActorWorker, "all 1 queue jobs completed")
+	assert.NoError(s.T(), err)
+	assert.False(s.T(), changed)
+	assert.Equal(s.T(), JobStatusFailed, j.Status)
+
+	// Failed jobs can only be resumed by the CLI
+	changed, err = j.TransitionStatus(s.db, JobStatusInProgress, JobStatusActorWorker, "queue job 2 started")
+	assert.NoError(s.T(), err)
+	assert.False(s.T(), changed)
+	assert.Equal(s.T(), JobStatusFailed, j.Status)
+
+	_, err = j.TransitionStatus(s.db, JobStatus("Unknown"), JobStatusActorWorker, "")
+	assert.EqualError(s.T(), err, `invalid job status "Unknown"`)
+
+	var actual Job
+	assert.NoError(s.T(), s.db.First(&actual, j.ID).Error)
+	assert.Equal(s.T(), JobStatusFailed, actual.Status)
+
+	// Only the changes that were made are recorded
+	history, err := GetJobStatusHistory(s.db, j.ID)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), history, 2)
+	assert.Equal(s.T(), JobStatusPending, history[0].FromStatus)
+	assert.Equal(s.T(), JobStatusInProgress, history[0].ToStatus)
+	assert.Equal(s.T(), JobStatusActorWorker, history[0].Actor)
+	assert.Equal(s.T(), "queue job 1 started", history[0].Reason)
+	assert.Equal(s.T(), JobStatusInProgress, history[1].FromStatus)
+	assert.Equal(s.T(), JobStatusFailed, history[1].ToStatus)
+	assert.Equal(s.T(), "Blue Button is down", history[1].Reason)
+}
@@ -0,0 +1,555 @@
+package models
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// PartLimits bound the size of the files created when a job's files are grouped by resource type. A limit of 0 means
+// the files are unlimited.
+type PartLimits struct {
+	MaxBytes int64 // uncompressed size of the file
+	MaxLines int   // number of resources in the file
+}
+
+// groupFilesEnabled reports whether jobs' files are grouped by resource type when the jobs are finalized
+func groupFilesEnabled() bool {
+	return utils.GetEnvBool("BCDA_WORKER_GROUP_OUTPUT_FILES", false)
+}
+
+// partLimitsFromEnv returns the limits set by BCDA_WORKER_OUTPUT_PART_MAX_BYTES and BCDA_WORKER_OUTPUT_PART_MAX_LINES
+func partLimitsFromEnv() PartLimits {
+	return PartLimits{
+		MaxBytes: int64(utils.GetEnvInt("BCDA_WORKER_OUTPUT_PART_MAX_BYTES", 0)),
+		MaxLines: utils.GetEnvInt("BCDA_WORKER_OUTPUT_PART_MAX_LINES", 0),
+	}
+}
+
+// PartFileName returns the name of the n-th file (counting from 1) of a resource type, and claim type if the resources
+// were split by claim type, in a job whose files have been grouped, e.g. ExplanationOfBenefit-001.ndjson or
+// ExplanationOfBenefit-carrier-001.ndjson
+func PartFileName(resourceType, claimType string, n int) string {
+	if claimType != "" {
+		return fmt.Sprintf("%s-%s-%03d.ndjson", resourceType, claimType, n)
+	}
+	return fmt.Sprintf("%s-%03d.ndjson", resourceType, n)
+}
+
+// errorFileName returns the name of the error file that accompanies the named file
+func errorFileName(name string) string {
+	return strings.TrimSuffix(name, ".ndjson") + "-error.ndjson"
+}
+
+// groupFilesClaimTimeout is how long a run of GroupFiles may take before its claim on the job is assumed to have been
+// abandoned, e.g. because its worker stopped, and another run may group the job's files
+const groupFilesClaimTimeout = time.Hour
+
+// GroupFiles replaces the files written by the job's queue jobs, which are named by UUID, with files that are grouped by
+// resource type and named in sequence, e.g. ExplanationOfBenefit-001.ndjson. Resources that were split by claim type
+// stay split, e.g. ExplanationOfBenefit-carrier-001.ndjson. The resources of each type are written to as many files
+// as the limits require, and the errors of each queue job are written to the error file of the file its resources
+// begin in. Queue job files are added in the order of their names, so grouping the same files always
+// produces the same result. Encrypted files cannot be combined, so each is given its own name in the sequence.
+//
+// The queue jobs' keys are replaced by keys marked as Part. The queue jobs' keys are soft-deleted, rather than removed,
+// so that the job's finished queue jobs can still be counted. Files are grouped in the staging area, and it's safe to
+// group them more than once, or concurrently. Writing the files can take a while, so no transaction is held while
+// they're written: the job is claimed first, and the parts' keys are only recorded if the claim is still held. A run
+// that finds the job claimed by another returns an error, so that it can be tried again once the files are grouped.
+func (job *Job) GroupFiles(db *gorm.DB, limits PartLimits) error {
+	st := storage.Get()
+	jobID := strconv.FormatUint(uint64(job.ID), 10)
+
+	claim, queueJobKeys, err := job.claimGroupFiles(db)
+	if err != nil {
+		return err
+	}
+
+	if claim != "" {
+		parts, err := writeParts(st, job.ID, queueJobKeys, limits)
+		if err != nil {
+			job.releaseGroupFiles(db, claim)
+			return err
+		}
+		if err = job.replaceQueueJobKeys(db, claim, parts); err != nil {
+			return err
+		}
+	}
+
+	// The queue jobs' files are removed once they've been replaced, which may have been done by an earlier run
+	for _, k := range queueJobKeys {
+		name := fmt.Sprintf("%s/%s", jobID, strings.TrimSpace(k.FileName))
+		names := []string{name, name + ".gz"}
+		if k.HasErrorFile {
+			names = append(names, errorFileName(name))
+		}
+		for _, n := range names {
+			if err := st.Remove(storage.Staging, n); err != nil && !os.IsNotExist(err) {
+				log.Error(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// claimGroupFiles returns the keys of the job's queue jobs and, unless the files have already been grouped, claims the
+// job so that no other run groups its files. The claim is returned; it's empty if the files have already been grouped.
+func (job *Job) claimGroupFiles(db *gorm.DB) (string, []JobKey, error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return "", nil, tx.Error
+	}
+
+	var current Job
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id, group_files_claim, group_files_claimed_at").
+		First(&current, job.ID).Error; err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+
+	var keys []JobKey
+	if err := tx.Unscoped().Where("job_id = ?", job.ID).Find(&keys).Error; err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+
+	var queueJobKeys []JobKey
+	grouped := false
+	for _, k := range keys {
+		if k.Part {
+			grouped = true
+		} else {
+			queueJobKeys = append(queueJobKeys, k)
+		}
+	}
+
+	if grouped {
+		tx.Rollback()
+		return "", queueJobKeys, nil
+	}
+
+	now := time.Now()
+	if current.GroupFilesClaim != "" && current.GroupFilesClaimedAt != nil &&
+		now.Sub(*current.GroupFilesClaimedAt) < groupFilesClaimTimeout {
+		tx.Rollback()
+		return "", nil, fmt.Errorf("files of job %d are being grouped by another run", job.ID)
+	}
+
+	claim := uuid.NewRandom().String()
+	if err := tx.Model(&current).UpdateColumns(map[string]interface{}{"group_files_claim": claim,
+		"group_files_claimed_at": now}).Error; err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return "", nil, err
+	}
+	return claim, queueJobKeys, nil
+}
+
+// replaceQueueJobKeys replaces the keys of the job's queue jobs with the keys of the parts and releases the claim. The
+// keys are not replaced if the claim has been taken over by another run, which will replace them itself.
+func (job *Job) replaceQueueJobKeys(db *gorm.DB, claim string, parts []JobKey) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var current Job
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id, group_files_claim").First(&current, job.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if current.GroupFilesClaim != claim {
+		tx.Rollback()
+		return fmt.Errorf("claim on grouping the files of job %d was taken over by another run", job.ID)
+	}
+
+	if err := tx.Delete(JobKey{}, "job_id = ? and not part", job.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range parts {
+		if err := tx.Create(&parts[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Model(&current).UpdateColumns(map[string]interface{}{"group_files_claim": "",
+		"group_files_claimed_at": nil}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// releaseGroupFiles releases the claim after the files could not be grouped, so that they can be grouped again
+// without waiting for the claim to time out
+func (job *Job) releaseGroupFiles(db *gorm.DB, claim string) {
+	err := db.Model(&Job{}).Where("id = ? and group_files_claim = ?", job.ID, claim).
+		UpdateColumns(map[string]interface{}{"group_files_claim": "", "group_files_claimed_at": nil}).Error
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// writeParts groups the files of the queue job keys in the staging area and returns the keys of the parts
+func writeParts(st storage.Storage, jobID uint, keys []JobKey, limits PartLimits) ([]JobKey, error) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ResourceType != keys[j].ResourceType {
+			return keys[i].ResourceType < keys[j].ResourceType
+		}
+		if keys[i].ClaimType != keys[j].ClaimType {
+			return keys[i].ClaimType < keys[j].ClaimType
+		}
+		return strings.TrimSpace(keys[i].FileName) < strings.TrimSpace(keys[j].FileName)
+	})
+
+	var parts []JobKey
+	for start := 0; start < len(keys); {
+		end := start
+		for end < len(keys) && keys[end].ResourceType == keys[start].ResourceType &&
+			keys[end].ClaimType == keys[start].ClaimType {
+			end++
+		}
+
+		pw := &partWriter{st: st, jobID: jobID, resourceType: keys[start].ResourceType, claimType: keys[start].ClaimType,
+			limits: limits, keepUncompressed: utils.GetEnvBool("BCDA_WORKER_KEEP_UNCOMPRESSED", true)}
+		if err := pw.writeAll(keys[start:end]); err != nil {
+			pw.abort()
+			return nil, err
+		}
+		parts = append(parts, pw.parts...)
+
+		start = end
+	}
+
+	return parts, nil
+}
+
+// partWriter writes the parts of a single resource type, or of a single claim type of a resource type
+type partWriter struct {
+	st               storage.Storage
+	jobID            uint
+	resourceType     string
+	claimType        string
+	limits           PartLimits
+	keepUncompressed bool
+
+	parts []JobKey
+	cur   *part
+}
+
+// part is a file that is being written
+type part struct {
+	name     string
+	files    []io.WriteCloser
+	gz       *gzip.Writer
+	w        *bufio.Writer
+	hash     hash.Hash
+	size     int64
+	lines    int
+	errs     io.WriteCloser
+	complete bool // resources from a queue job that did not fail were added to the part
+}
+
+func (pw *partWriter) writeAll(keys []JobKey) error {
+	for _, k := range keys {
+		name := fmt.Sprintf("%d/%s", pw.jobID, strings.TrimSpace(k.FileName))
+
+		// Failed queue jobs of encrypted jobs only have an encrypted error file
+		if k.EncryptedKey != "" || k.ErrorEncryptedKey != "" {
+			if err := pw.copyEncrypted(k, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p, err := pw.current()
+		if err != nil {
+			return err
+		}
+		if k.HasErrorFile {
+			if err = pw.copyErrors(p, name); err != nil {
+				return err
+			}
+		}
+		if k.Failed {
+			continue
+		}
+		p.complete = true
+		if err = pw.copyResources(name); err != nil {
+			return err
+		}
+	}
+
+	return pw.closeCurrent()
+}
+
+// current returns the part being written, starting the next part if there isn't one
+func (pw *partWriter) current() (*part, error) {
+	if pw.cur != nil {
+		return pw.cur, nil
+	}
+
+	p := &part{name: PartFileName(pw.resourceType, pw.claimType, len(pw.parts)+1), hash: sha256.New()}
+	pw.cur = p
+	name := fmt.Sprintf("%d/%s", pw.jobID, p.name)
+
+	gzFile, err := pw.st.Create(storage.Staging, name+".gz")
+	if err != nil {
+		return nil, err
+	}
+	p.files = append(p.files, gzFile)
+	p.gz = gzip.NewWriter(gzFile)
+	writers := []io.Writer{p.gz, p.hash}
+
+	if pw.keepUncompressed {
+		f, err := pw.st.Create(storage.Staging, name)
+		if err != nil {
+			return nil, err
+		}
+		p.files = append(p.files, f)
+		writers = append(writers, f)
+	}
+
+	p.w = bufio.NewWriter(io.MultiWriter(writers...))
+	return p, nil
+}
+
+// copyResources adds the resources in the queue job's file to the parts, starting a new part whenever the next
+// resource would exceed the limits
+func (pw *partWriter) copyResources(name string) error {
+	f, err := openNDJSON(pw.st, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if wErr := pw.writeLine(line); wErr != nil {
+				return wErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (pw *partWriter) writeLine(line []byte) error {
+	p, err := pw.current()
+	if err != nil {
+		return err
+	}
+
+	if p.lines > 0 && ((pw.limits.MaxLines > 0 && p.lines >= pw.limits.MaxLines) ||
+		(pw.limits.MaxBytes > 0 && p.size+int64(len(line)) > pw.limits.MaxBytes)) {
+		if err = pw.closeCurrent(); err != nil {
+			return err
+		}
+		if p, err = pw.current(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = p.w.Write(line); err != nil {
+		return err
+	}
+	p.size += int64(len(line))
+	p.lines++
+	// The part may have been started for the rest of a queue job's resources
+	p.complete = true
+	return nil
+}
+
+// copyErrors adds the queue job's errors to the part's error file
+func (pw *partWriter) copyErrors(p *part, name string) error {
+	f, err := pw.st.Open(storage.Staging, errorFileName(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if p.errs == nil {
+		if p.errs, err = pw.st.Create(storage.Staging, errorFileName(fmt.Sprintf("%d/%s", pw.jobID, p.name))); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(p.errs, f)
+	return err
+}
+
+// copyEncrypted gives the queue job's encrypted file, and its errors, a part of their own
+func (pw *partWriter) copyEncrypted(k JobKey, name string) error {
+	if err := pw.closeCurrent(); err != nil {
+		return err
+	}
+
+	n := PartFileName(pw.resourceType, pw.claimType, len(pw.parts)+1)
+	partName := fmt.Sprintf("%d/%s", pw.jobID, n)
+	hasErrorFile := k.HasErrorFile
+	if hasErrorFile {
+		if err := copyFile(pw.st, errorFileName(name), errorFileName(partName)); os.IsNotExist(err) {
+			hasErrorFile = false
+		} else if err != nil {
+			return err
+		}
+	}
+	if !k.Failed {
+		if err := copyFile(pw.st, name, partName); err != nil {
+			return err
+		}
+	}
+
+	key := JobKey{JobID: pw.jobID, FileName: n, ResourceType: pw.resourceType, ClaimType: pw.claimType,
+		Checksum: k.Checksum, FileSize: k.FileSize, ResourceCount: k.ResourceCount, Failed: k.Failed,
+		EncryptedKey: k.EncryptedKey, Nonce: k.Nonce, Part: true, HasErrorFile: hasErrorFile}
+	if hasErrorFile {
+		key.ErrorEncryptedKey, key.ErrorNonce = k.ErrorEncryptedKey, k.ErrorNonce
+		key.ErrorChecksum, key.ErrorFileSize = k.ErrorChecksum, k.ErrorFileSize
+	}
+	pw.parts = append(pw.parts, key)
+	return nil
+}
+
+// closeCurrent finishes the part being written, if there is one, and records its key. A part that only contains the
+// errors of failed queue jobs is failed, and its empty data files are removed.
+func (pw *partWriter) closeCurrent() error {
+	p := pw.cur
+	if p == nil {
+		return nil
+	}
+	pw.cur = nil
+
+	err := p.w.Flush()
+	if err == nil {
+		err = p.gz.Close()
+	}
+	for _, f := range p.files {
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+	}
+	if p.errs != nil {
+		if cErr := p.errs.Close(); err == nil {
+			err = cErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	key := JobKey{JobID: pw.jobID, FileName: p.name, ResourceType: pw.resourceType, ClaimType: pw.claimType,
+		ResourceCount: p.lines, Part: true, HasErrorFile: p.errs != nil}
+	if p.complete {
+		key.Checksum = hex.EncodeToString(p.hash.Sum(nil))
+		key.FileSize = p.size
+	} else {
+		key.Failed = true
+		name := fmt.Sprintf("%d/%s", pw.jobID, p.name)
+		for _, n := range []string{name, name + ".gz"} {
+			if err = pw.st.Remove(storage.Staging, n); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	pw.parts = append(pw.parts, key)
+	return nil
+}
+
+// abort closes the part being written after an error. Its files are replaced when the files are grouped again.
+func (pw *partWriter) abort() {
+	if p := pw.cur; p != nil {
+		for _, f := range p.files {
+			f.Close()
+		}
+		if p.errs != nil {
+			p.errs.Close()
+		}
+		pw.cur = nil
+	}
+}
+
+// openNDJSON opens the staged file, decompressing its precompressed copy if the uncompressed file was not kept
+func openNDJSON(st storage.Storage, name string) (io.ReadCloser, error) {
+	f, err := st.Open(storage.Staging, name)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	gzFile, err := st.Open(storage.Staging, name+".gz")
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(gzFile)
+	if err != nil {
+		gzFile.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, file: gzFile}, nil
+}
+
+// gzipFile decompresses a stored file, closing the file when it's closed
+type gzipFile struct {
+	*gzip.Reader
+	file storage.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if fErr := g.file.Close(); err == nil {
+		err = fErr
+	}
+	return err
+}
+
+// copyFile copies the staged file to a new name in the staging area
+func copyFile(st storage.Storage, from, to string) error {
+	src, err := st.Open(storage.Staging, from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := st.Create(storage.Staging, to)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
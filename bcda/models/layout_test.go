@@ -0,0 +1,308 @@
+package models
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/storage"
+)
+
+func TestWriteParts(t *testing.T) {
+	dir, cleanup := setupLayoutStaging(t)
+	defer cleanup()
+	st := storage.NewLocal()
+
+	lines := func(prefix string, n int) string {
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(&b, "{\"id\":\"%s%d\"}\n", prefix, i)
+		}
+		return b.String()
+	}
+
+	writeStaged(t, dir, "b.ndjson", lines("b", 3))
+	writeStaged(t, dir, "a.ndjson", lines("a", 2))
+	writeStaged(t, dir, "a-error.ndjson", "a error\n")
+	writeStaged(t, dir, "c-error.ndjson", "c error\n")
+	// The uncompressed file may not have been kept
+	writeStagedGZIP(t, dir, "d.ndjson.gz", lines("d", 5))
+	writeStaged(t, dir, "e-error.ndjson", "e error\n")
+	writeStaged(t, dir, "f.ndjson", "encrypted")
+	writeStaged(t, dir, "g-error.ndjson", "g error\n")
+
+	keys := []JobKey{
+		{FileName: "b.ndjson", ResourceType: "Patient"},
+		{FileName: "a.ndjson", ResourceType: "Patient", HasErrorFile: true},
+		{FileName: "d.ndjson", ResourceType: "ExplanationOfBenefit"},
+		{FileName: "c.ndjson", ResourceType: "ExplanationOfBenefit", Failed: true, HasErrorFile: true},
+		{FileName: "e.ndjson", ResourceType: "Coverage", Failed: true, HasErrorFile: true},
+		{FileName: "f.ndjson", ResourceType: "Claim", Checksum: "checksum", FileSize: 9, ResourceCount: 4,
+			EncryptedKey: "key", Nonce: "nonce"},
+		{FileName: "g.ndjson", ResourceType: "Claim", Failed: true, HasErrorFile: true, ErrorEncryptedKey: "error key",
+			ErrorNonce: "error nonce", ErrorChecksum: "error checksum", ErrorFileSize: 8},
+	}
+
+	parts, err := writeParts(st, 1, keys, PartLimits{MaxLines: 3})
+	assert.NoError(t, err)
+
+	var names []string
+	for _, p := range parts {
+		names = append(names, p.FileName)
+		assert.True(t, p.Part)
+		assert.Equal(t, uint(1), p.JobID)
+	}
+	assert.Equal(t, []string{"Claim-001.ndjson", "Claim-002.ndjson", "Coverage-001.ndjson", "ExplanationOfBenefit-001.ndjson",
+		"ExplanationOfBenefit-002.ndjson", "Patient-001.ndjson", "Patient-002.ndjson"}, names)
+
+	// Queue job files are added in the order of their names, and parts are split at the line limit
+	assertPart(t, dir, parts[5], lines("a", 2)+lines("b", 1))
+	assertPart(t, dir, parts[6], strings.TrimPrefix(lines("b", 3), lines("b", 1)))
+	assertStaged(t, dir, "Patient-001-error.ndjson", "a error\n")
+	assert.True(t, parts[5].HasErrorFile)
+	assert.False(t, parts[6].HasErrorFile)
+	assertPart(t, dir, parts[3], lines("d", 3))
+	assertPart(t, dir, parts[4], strings.TrimPrefix(lines("d", 5), lines("d", 3)))
+	assertStaged(t, dir, "ExplanationOfBenefit-001-error.ndjson", "c error\n")
+
+	// A part with only the errors of failed queue jobs has no data file
+	assert.True(t, parts[2].Failed)
+	assertStaged(t, dir, "Coverage-001-error.ndjson", "e error\n")
+	_, err = os.Stat(filepath.Join(dir, "1", "Coverage-001.ndjson"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "1", "Coverage-001.ndjson.gz"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Encrypted files are copied as-is
+	assert.Equal(t, JobKey{JobID: 1, FileName: "Claim-001.ndjson", ResourceType: "Claim", Checksum: "checksum", FileSize: 9,
+		ResourceCount: 4, EncryptedKey: "key", Nonce: "nonce", Part: true}, parts[0])
+	assertStaged(t, dir, "Claim-001.ndjson", "encrypted")
+	// So are the encrypted error files of failed queue jobs, rather than being combined with other errors
+	assert.Equal(t, JobKey{JobID: 1, FileName: "Claim-002.ndjson", ResourceType: "Claim", Failed: true, Part: true,
+		HasErrorFile: true, ErrorEncryptedKey: "error key", ErrorNonce: "error nonce", ErrorChecksum: "error checksum",
+		ErrorFileSize: 8}, parts[1])
+	assertStaged(t, dir, "Claim-002-error.ndjson", "g error\n")
+
+	// Grouping the same files again produces the same parts
+	again, err := writeParts(st, 1, keys, PartLimits{MaxLines: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, parts, again)
+}
+
+func TestWritePartsMaxBytes(t *testing.T) {
+	dir, cleanup := setupLayoutStaging(t)
+	defer cleanup()
+
+	line := `{"resourceType":"Patient"}` + "\n"
+	writeStaged(t, dir, "a.ndjson", strings.Repeat(line, 5))
+	writeStaged(t, dir, "b.ndjson", "")
+
+	parts, err := writeParts(storage.NewLocal(), 1, []JobKey{{FileName: "a.ndjson", ResourceType: "Patient"},
+		{FileName: "b.ndjson", ResourceType: "Patient"}}, PartLimits{MaxBytes: int64(len(line)*2 + 1)})
+	assert.NoError(t, err)
+	assert.Len(t, parts, 3)
+	assertPart(t, dir, parts[0], strings.Repeat(line, 2))
+	assertPart(t, dir, parts[1], strings.Repeat(line, 2))
+	assertPart(t, dir, parts[2], line)
+
+	// Resource types without resources still have a file
+	writeStaged(t, dir, "c.ndjson", "")
+	parts, err = writeParts(storage.NewLocal(), 1, []JobKey{{FileName: "c.ndjson", ResourceType: "Coverage"}}, PartLimits{})
+	assert.NoError(t, err)
+	assert.Len(t, parts, 1)
+	assertPart(t, dir, parts[0], "")
+}
+
+func TestWritePartsClaimTypes(t *testing.T) {
+	dir, cleanup := setupLayoutStaging(t)
+	defer cleanup()
+
+	writeStaged(t, dir, "a.ndjson", "")
+	writeStaged(t, dir, "a-error.ndjson", "a error\n")
+	writeStaged(t, dir, "a-carrier.ndjson", "a carrier\n")
+	writeStaged(t, dir, "b.ndjson", "b\n")
+	writeStaged(t, dir, "b-carrier.ndjson", "b carrier\n")
+	writeStaged(t, dir, "b-pde.ndjson", "b pde\n")
+
+	parts, err := writeParts(storage.NewLocal(), 1, []JobKey{
+		{FileName: "a.ndjson", ResourceType: "ExplanationOfBenefit", HasErrorFile: true},
+		{FileName: "a-carrier.ndjson", ResourceType: "ExplanationOfBenefit", ClaimType: "carrier"},
+		{FileName: "b.ndjson", ResourceType: "ExplanationOfBenefit"},
+		{FileName: "b-carrier.ndjson", ResourceType: "ExplanationOfBenefit", ClaimType: "carrier"},
+		{FileName: "b-pde.ndjson", ResourceType: "ExplanationOfBenefit", ClaimType: "pde"},
+	}, PartLimits{})
+	assert.NoError(t, err)
+
+	// Resources stay split by claim type, and the queue jobs' errors accompany the resources without a claim type
+	if assert.Len(t, parts, 3) {
+		assert.Equal(t, "ExplanationOfBenefit-001.ndjson", parts[0].FileName)
+		assert.Empty(t, parts[0].ClaimType)
+		assertPart(t, dir, parts[0], "b\n")
+		assertStaged(t, dir, "ExplanationOfBenefit-001-error.ndjson", "a error\n")
+		assert.Equal(t, "ExplanationOfBenefit-carrier-001.ndjson", parts[1].FileName)
+		assert.Equal(t, "carrier", parts[1].ClaimType)
+		assertPart(t, dir, parts[1], "a carrier\nb carrier\n")
+		assert.Equal(t, "ExplanationOfBenefit-pde-001.ndjson", parts[2].FileName)
+		assert.Equal(t, "pde", parts[2].ClaimType)
+		assertPart(t, dir, parts[2], "b pde\n")
+	}
+}
+
+func (s *ModelsTestSuite) TestGroupFiles() {
+	dir, cleanup := setupLayoutStaging(s.T())
+	defer cleanup()
+
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     JobStatusInProgress,
+		JobCount:   2,
+	}
+	assert.NoError(s.T(), s.db.Create(&j).Error)
+	defer s.db.Unscoped().Delete(&j)
+	defer s.db.Unscoped().Delete(JobKey{}, "job_id = ?", j.ID)
+
+	jobDir := filepath.Join(dir, fmt.Sprint(j.ID))
+	assert.NoError(s.T(), os.MkdirAll(jobDir, os.ModePerm))
+	for _, name := range []string{"a", "b"} {
+		assert.NoError(s.T(), ioutil.WriteFile(filepath.Join(jobDir, name+".ndjson"), []byte(name+"\n"), 0600))
+		_, err := j.CompleteQueueJob(s.db, &JobKey{FileName: name + ".ndjson", ResourceType: "Patient"})
+		assert.NoError(s.T(), err)
+	}
+
+	// The files aren't grouped while another run has claimed the job, unless its claim has been abandoned
+	claimedAt := time.Now()
+	assert.NoError(s.T(), s.db.Model(&j).UpdateColumns(map[string]interface{}{"group_files_claim": uuid.New(),
+		"group_files_claimed_at": claimedAt}).Error)
+	assert.EqualError(s.T(), j.GroupFiles(s.db, PartLimits{}),
+		fmt.Sprintf("files of job %d are being grouped by another run", j.ID))
+	assert.NoError(s.T(), s.db.Model(&j).UpdateColumn("group_files_claimed_at",
+		claimedAt.Add(-groupFilesClaimTimeout)).Error)
+
+	assert.NoError(s.T(), j.GroupFiles(s.db, PartLimits{}))
+	// Grouping the files again does nothing
+	assert.NoError(s.T(), j.GroupFiles(s.db, PartLimits{}))
+
+	// The claim is released once the files are grouped
+	var current Job
+	assert.NoError(s.T(), s.db.First(&current, j.ID).Error)
+	assert.Empty(s.T(), strings.TrimSpace(current.GroupFilesClaim))
+	assert.Nil(s.T(), current.GroupFilesClaimedAt)
+
+	keys, err := GetJobKeys(s.db, j.ID)
+	assert.NoError(s.T(), err)
+	if assert.Len(s.T(), keys, 1) {
+		assert.Equal(s.T(), "Patient-001.ndjson", strings.TrimSpace(keys[0].FileName))
+		assert.Equal(s.T(), 2, keys[0].ResourceCount)
+	}
+
+	// The queue jobs' files are replaced
+	files, err := ioutil.ReadDir(jobDir)
+	assert.NoError(s.T(), err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Equal(s.T(), []string{"Patient-001.ndjson", "Patient-001.ndjson.gz"}, names)
+
+	// The queue jobs are still counted as finished
+	var finished int
+	assert.NoError(s.T(), s.db.Unscoped().Model(&JobKey{}).Where("job_id = ? and not part", j.ID).Count(&finished).Error)
+	assert.Equal(s.T(), 2, finished)
+}
+
+func (s *ModelsTestSuite) TestGroupFilesClaimTakenOver() {
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     JobStatusInProgress,
+		JobCount:   1,
+	}
+	assert.NoError(s.T(), s.db.Create(&j).Error)
+	defer s.db.Unscoped().Delete(&j)
+	defer s.db.Unscoped().Delete(JobKey{}, "job_id = ?", j.ID)
+	_, err := j.CompleteQueueJob(s.db, &JobKey{FileName: "a.ndjson", ResourceType: "Patient"})
+	assert.NoError(s.T(), err)
+
+	claim, keys, err := j.claimGroupFiles(s.db)
+	assert.NoError(s.T(), err)
+	assert.NotEmpty(s.T(), claim)
+	assert.Len(s.T(), keys, 1)
+
+	// A run whose claim was taken over, e.g. because it timed out, leaves the keys to the run that took it over
+	assert.NoError(s.T(), s.db.Model(&j).UpdateColumn("group_files_claim", uuid.New()).Error)
+	err = j.replaceQueueJobKeys(s.db, claim, []JobKey{{JobID: j.ID, FileName: "Patient-001.ndjson", Part: true}})
+	assert.EqualError(s.T(), err, fmt.Sprintf("claim on grouping the files of job %d was taken over by another run", j.ID))
+
+	keys, err = GetJobKeys(s.db, j.ID)
+	assert.NoError(s.T(), err)
+	if assert.Len(s.T(), keys, 1) {
+		assert.Equal(s.T(), "a.ndjson", strings.TrimSpace(keys[0].FileName))
+	}
+}
+
+// setupLayoutStaging points the staging area at a new directory. The returned function removes the directory and
+// restores the original staging area.
+func setupLayoutStaging(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bcda_staging_")
+	assert.NoError(t, err)
+	orig := os.Getenv("FHIR_STAGING_DIR")
+	os.Setenv("FHIR_STAGING_DIR", dir)
+	return dir, func() {
+		os.RemoveAll(dir)
+		os.Setenv("FHIR_STAGING_DIR", orig)
+	}
+}
+
+func writeStaged(t *testing.T, dir, name, data string) {
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "1"), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1", name), []byte(data), 0600))
+}
+
+func writeStagedGZIP(t *testing.T, dir, name, data string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(data))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	writeStaged(t, dir, name, buf.String())
+}
+
+func assertStaged(t *testing.T, dir, name, expected string) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "1", name))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+}
+
+// assertPart verifies the part's data, its precompressed copy and its key
+func assertPart(t *testing.T, dir string, key JobKey, expected string) {
+	assertStaged(t, dir, key.FileName, expected)
+
+	f, err := os.Open(filepath.Join(dir, "1", key.FileName+".gz"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+
+	digest := sha256.Sum256([]byte(expected))
+	assert.Equal(t, hex.EncodeToString(digest[:]), key.Checksum)
+	assert.Equal(t, int64(len(expected)), key.FileSize)
+	assert.Equal(t, strings.Count(expected, "\n"), key.ResourceCount)
+	assert.False(t, key.Failed)
+}
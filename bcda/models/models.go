@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -16,8 +17,10 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/auth/rsautils"
 	"github.com/CMSgov/bcda-app/bcda/client"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
@@ -33,6 +36,8 @@ const BCDA_FHIR_MAX_RECORDS_COVERAGE_DEFAULT = 4000
 var (
 	serviceInstance Service // Singleton service instance
 	once            sync.Once
+
+	jobNotifier func(job *Job) // Invoked when a job transitions to Completed or Failed
 )
 
 // GetService returns the singleton instance of Service. It creates the service if it has not been created before.
@@ -46,6 +51,18 @@ func GetService(r Repository, cutoffDuration time.Duration, lookbackDays int) Se
 	return serviceInstance
 }
 
+// SetJobNotifier registers the function that is called when a job transitions to the Completed or Failed status.
+// The job supplied to the notifier reflects the new status.
+func SetJobNotifier(notifier func(job *Job)) {
+	jobNotifier = notifier
+}
+
+func notifyJob(job *Job) {
+	if jobNotifier != nil {
+		jobNotifier(job)
+	}
+}
+
 func InitializeGormModels() *gorm.DB {
 	log.Println("Initialize bcda models")
 	db := database.GetGORMDbConnection()
@@ -65,6 +82,11 @@ func InitializeGormModels() *gorm.DB {
 		&CCLFBeneficiary{},
 		&Suppression{},
 		&SuppressionFile{},
+		&ACOQuota{},
+		&BlueButtonIDCacheEntry{},
+		&DeadLetterJob{},
+		&JobStatusHistory{},
+		&OutboxJob{},
 	)
 
 	db.Model(&CCLFBeneficiary{}).AddForeignKey("file_id", "cclf_files(id)", "RESTRICT", "RESTRICT")
@@ -86,52 +108,145 @@ type Job struct {
 	ACO               ACO       `gorm:"foreignkey:ACOID;association_foreignkey:UUID"` // aco
 	ACOID             uuid.UUID `gorm:"type:char(36)" json:"aco_id"`
 	RequestURL        string    `json:"request_url"` // request_url
-	Status            string    `json:"status"`      // status
+	Status            JobStatus `json:"status"`      // status
 	TransactionTime   time.Time // most recent data load transaction time from BFD
 	JobCount          int
 	CompletedJobCount int
 	JobKeys           []JobKey
+	CallbackURL       string `json:"callback_url"`                // overrides the ACO's webhook URL for this job
+	Version           string `gorm:"default:'v1'" json:"version"` // API version used to request the job, which determines the FHIR version of its data
+	AllowPartial      bool   `json:"allow_partial"`               // complete the job with the files that succeeded when some of its queue jobs fail
+	Encrypt           bool   `json:"encrypt"`                     // encrypt the job's files with the ACO's public key
+	SplitClaimTypes   bool   `json:"split_claim_types"`           // write ExplanationOfBenefit resources to a file per claim type
+	OutputFormat      string `json:"output_format"`               // tabular.Format of the job's files; empty for NDJSON
+	// GroupFilesClaim and GroupFilesClaimedAt identify the run of GroupFiles that is grouping the job's files
+	GroupFilesClaim     string     `json:"-"`
+	GroupFilesClaimedAt *time.Time `json:"-"`
 }
 
+// CheckCompletedAndCleanup finalizes the job once all of its queue jobs have finished: the job's files are moved from
+// the staging area to the payload area, from which the job's manifest is served, and the job's status is changed to
+// Completed, or Partially Completed if some of its queue jobs failed. It's run by the FinalizeJob queue job
+// and by the stuck job reaper, and it's safe to run more than once, or concurrently, for the same job.
 func (job *Job) CheckCompletedAndCleanup(db *gorm.DB) (bool, error) {
 
 	// Trivial case, no need to keep going
-	if job.Status == "Completed" {
+	if job.Status.IsCompleted() {
 		return true, nil
 	}
 
-	var completedJobs int64
-	db.Model(&JobKey{}).Where("job_id = ?", job.ID).Count(&completedJobs)
+	// Cancelled jobs are never completed; their staged files are removed when the job is cancelled.
+	if job.Status == JobStatusCancelled {
+		return false, nil
+	}
 
-	if int(completedJobs) >= job.JobCount {
+	completedJobs, err := CountFinishedQueueJobs(db, job.ID, false)
+	if err != nil {
+		return false, err
+	}
 
-		staging := fmt.Sprintf("%s/%d", os.Getenv("FHIR_STAGING_DIR"), job.ID)
-		payload := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), job.ID)
+	if completedJobs >= job.JobCount {
 
-		files, err := ioutil.ReadDir(staging)
-		if err != nil {
+		// Tabular files have a header and a footer, respectively, so they can't be concatenated into parts
+		if groupFilesEnabled() && job.OutputFormat == "" {
+			if err := job.GroupFiles(db, partLimitsFromEnv()); err != nil {
+				return true, err
+			}
+		}
+
+		// Files that are already missing have been moved by an earlier, or concurrent, run
+		if err := storage.MoveAll(storage.Get(), storage.Staging, storage.Payload, strconv.FormatUint(uint64(job.ID), 10)); err != nil {
 			log.Error(err)
 		}
+		// Queue jobs only fail without failing the job when the job allows partial exports
+		failedJobs, err := CountFinishedQueueJobs(db, job.ID, true)
+		if err != nil {
+			return true, err
+		}
 
-		for _, f := range files {
-			oldPath := fmt.Sprintf("%s/%s", staging, f.Name())
-			newPath := fmt.Sprintf("%s/%s", payload, f.Name())
-			err := os.Rename(oldPath, newPath)
-			if err != nil {
-				log.Error(err)
-			}
+		status, reason := JobStatusCompleted, fmt.Sprintf("all %d queue jobs completed", job.JobCount)
+		if failedJobs > 0 {
+			status, reason = JobStatusPartiallyCompleted, fmt.Sprintf("%d of %d queue jobs failed", failedJobs, job.JobCount)
 		}
-		err = os.Remove(staging)
+		completed, err := job.TransitionStatus(db, status, JobStatusActorWorker, reason)
 		if err != nil {
-			log.Error(err)
+			return true, err
+		}
+		// The job may be finalized more than once, so only the run that updates the status sends the notification
+		if completed {
+			notifyJob(job)
 		}
-		return true, db.Model(&job).Update("status", "Completed").Error
+		return true, nil
 	}
 
 	return false, nil
 }
 
-func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBeneHistData bool) (enqueJobs []*que.Job, err error) {
+// Fail marks the job as Failed for the given reason unless it has already finished or been cancelled.
+func (job *Job) Fail(db *gorm.DB, reason string) error {
+	failed, err := job.TransitionStatus(db, JobStatusFailed, JobStatusActorWorker, reason)
+	if err != nil {
+		return err
+	}
+	if failed {
+		notifyJob(job)
+	}
+	return nil
+}
+
+// Cancel moves a Pending or In Progress job into the Cancelled state and removes the queue jobs that have yet to be
+// worked, both from the outbox and from the queue. It returns false if the job had already reached a terminal state
+// and could not be cancelled.
+// The queue jobs are removed in a transaction on the queue that commits after the job is cancelled, so the job is never
+// cancelled while its queue jobs remain unless that commit fails, in which case the worker skips them.
+func (job *Job) Cancel(db *gorm.DB, queue *pgx.ConnPool) (bool, error) {
+	qtx, err := queue.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "could not begin queue transaction")
+	}
+	// Does nothing once the transaction has been committed
+	defer qtx.Rollback() // nolint
+
+	var outboxCount, queueCount int64
+	cancelled, err := job.transitionStatus(db, JobStatusCancelled, JobStatusActorAPI, "cancelled by requester", func(tx *gorm.DB) error {
+		var err error
+		if outboxCount, err = DeleteOutboxJobs(tx, job.ID); err != nil {
+			return errors.Wrap(err, "could not delete outbox jobs")
+		}
+		// que-go stores the job arguments as JSON; see JobEnqueueArgs
+		result, err := qtx.Exec(`DELETE FROM que_jobs WHERE args->>'ID' = $1`, strconv.FormatUint(uint64(job.ID), 10))
+		if err != nil {
+			return errors.Wrap(err, "could not delete queue jobs")
+		}
+		queueCount = result.RowsAffected()
+		return nil
+	})
+	if err != nil || !cancelled {
+		return cancelled, err
+	}
+
+	if err = qtx.Commit(); err != nil {
+		log.Errorf("Failed to remove queue jobs of cancelled job %d: %s", job.ID, err.Error())
+		return true, nil
+	}
+	log.Infof("Removed %d queue jobs and %d outbox jobs for cancelled job %d", queueCount, outboxCount, job.ID)
+	return true, nil
+}
+
+// UnattributedPatientsError is returned when an export is requested for patients that are not currently
+// attributed to the ACO (or have opted out of data sharing).
+type UnattributedPatientsError struct {
+	MBIs []string
+}
+
+func (e *UnattributedPatientsError) Error() string {
+	return fmt.Sprintf("%d requested patient(s) are not attributed to the ACO: %s", len(e.MBIs), strings.Join(e.MBIs, ","))
+}
+
+// GetEnqueJobs returns the queue jobs needed to export the requested resource types for the job's ACO.
+// If patientMBIs is supplied, only the beneficiaries with those MBIs are exported. Every requested MBI must be
+// attributed to the ACO; otherwise an *UnattributedPatientsError is returned.
+func (job *Job) GetEnqueJobs(resourceTypes []string, since string, typeFilter map[string]url.Values, patientMBIs []string, retrieveNewBeneHistData bool) (enqueJobs []*que.Job, err error) {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
 	var jobs []*que.Job
@@ -157,15 +272,22 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBe
 			return nil, err
 		}
 
+		if len(patientMBIs) > 0 {
+			newBeneficiaries, beneficiaries, err = filterBeneficiaries(patientMBIs, newBeneficiaries, beneficiaries)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// add new beneficaries to the job queue
-		jobs, err = AddJobsToQueue(job, *aco.CMSID, resourceTypes, "", retrieveNewBeneHistData, newBeneficiaries)
+		jobs, err = AddJobsToQueue(job, *aco.CMSID, resourceTypes, "", typeFilter, retrieveNewBeneHistData, newBeneficiaries)
 		if err != nil {
 			return nil, err
 		}
 		enqueJobs = append(enqueJobs, jobs...)
 
 		// add existing beneficaries to the job queue
-		jobs, err = AddJobsToQueue(job, *aco.CMSID, resourceTypes, since, retrieveNewBeneHistData, beneficiaries)
+		jobs, err = AddJobsToQueue(job, *aco.CMSID, resourceTypes, since, typeFilter, retrieveNewBeneHistData, beneficiaries)
 		if err != nil {
 			return nil, err
 		}
@@ -177,8 +299,15 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBe
 			return nil, err
 		}
 
+		if len(patientMBIs) > 0 {
+			beneficiaries, _, err = filterBeneficiaries(patientMBIs, beneficiaries, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// add beneficaries to the job queue
-		jobs, err = AddJobsToQueue(job, *aco.CMSID, resourceTypes, since, retrieveNewBeneHistData, beneficiaries)
+		jobs, err = AddJobsToQueue(job, *aco.CMSID, resourceTypes, since, typeFilter, retrieveNewBeneHistData, beneficiaries)
 		if err != nil {
 			return nil, err
 		}
@@ -188,7 +317,41 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBe
 	return enqueJobs, nil
 }
 
-func AddJobsToQueue(job *Job, CMSID string, resourceTypes []string, since string, retrieveNewBeneHistData bool, beneficiaries []*CCLFBeneficiary) (jobs []*que.Job, err error) {
+// filterBeneficiaries restricts both sets of beneficiaries to those with the supplied MBIs.
+// An *UnattributedPatientsError is returned if any of the MBIs are not found in either set.
+func filterBeneficiaries(mbis []string, first, second []*CCLFBeneficiary) (filteredFirst, filteredSecond []*CCLFBeneficiary, err error) {
+	requested := make(map[string]bool, len(mbis))
+	for _, mbi := range mbis {
+		requested[mbi] = true
+	}
+
+	found := make(map[string]bool, len(mbis))
+	filter := func(benes []*CCLFBeneficiary) (filtered []*CCLFBeneficiary) {
+		for _, bene := range benes {
+			mbi := strings.TrimSpace(bene.MBI)
+			if requested[mbi] {
+				found[mbi] = true
+				filtered = append(filtered, bene)
+			}
+		}
+		return filtered
+	}
+	filteredFirst, filteredSecond = filter(first), filter(second)
+
+	var missing []string
+	for _, mbi := range mbis {
+		if !found[mbi] {
+			missing = append(missing, mbi)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, &UnattributedPatientsError{MBIs: missing}
+	}
+
+	return filteredFirst, filteredSecond, nil
+}
+
+func AddJobsToQueue(job *Job, CMSID string, resourceTypes []string, since string, typeFilter map[string]url.Values, retrieveNewBeneHistData bool, beneficiaries []*CCLFBeneficiary) (jobs []*que.Job, err error) {
 
 	// persist in format ready for usage with _lastUpdated -- i.e., prepended with 'gt'
 	if since != "" {
@@ -212,7 +375,11 @@ func AddJobsToQueue(job *Job, CMSID string, resourceTypes []string, since string
 					BeneficiaryIDs:  jobIDs,
 					ResourceType:    rt,
 					Since:           since,
+					TypeFilter:      typeFilter[rt],
 					TransactionTime: job.TransactionTime,
+					Version:         job.Version,
+					SplitClaimTypes: job.SplitClaimTypes && rt == "ExplanationOfBenefit" && job.OutputFormat == "",
+					OutputFormat:    job.OutputFormat,
 				})
 				if err != nil {
 					return nil, err
@@ -264,12 +431,12 @@ func isPriorityACO(acoID string) bool {
 }
 
 func (j *Job) StatusMessage() string {
-	if j.Status == "In Progress" && j.JobCount > 0 {
+	if j.Status == JobStatusInProgress && j.JobCount > 0 {
 		pct := float64(j.CompletedJobCount) / float64(j.JobCount) * 100
 		return fmt.Sprintf("%s (%d%%)", j.Status, int(pct))
 	}
 
-	return j.Status
+	return string(j.Status)
 }
 
 func GetMaxBeneCount(requestType string) (int, error) {
@@ -301,6 +468,44 @@ type JobKey struct {
 	JobID        uint   `gorm:"primary_key" json:"job_id"`
 	FileName     string `gorm:"type:char(127)"`
 	ResourceType string
+	// Checksum is the hex-encoded SHA-256 digest of the file
+	Checksum      string `gorm:"type:char(64)"`
+	FileSize      int64
+	ResourceCount int
+	// Failed is set when the queue job that would have written the file failed in a job that allows partial exports.
+	// The file was not written, but its error file describes the failure.
+	Failed bool
+	// EncryptedKey and Nonce are set when the file is encrypted. They're base64-encoded and are described by
+	// encryption.Envelope.
+	EncryptedKey string
+	Nonce        string
+	// Part is set for the files created when the job's files are grouped by resource type. The keys of the files
+	// written by the job's queue jobs are soft-deleted when they're replaced by parts; see Job.GroupFiles.
+	Part bool
+	// ClaimType is set for the files of ExplanationOfBenefit resources split by claim type, e.g. "carrier". Each
+	// queue job also records a file without a claim type, which holds any resources whose claim type is unknown.
+	ClaimType string
+	// OutputTable is set for the files of a tabular job's secondary tables, e.g. "eob_line". The file of the resource
+	// type's main table, e.g. "eob", is recorded without a table; see tabular.Tables.
+	OutputTable string
+	// HasErrorFile is set when the file is accompanied by an error file, e.g. <file UUID>-error.ndjson, so that the
+	// job's manifest can list its error files without looking for them in storage
+	HasErrorFile bool
+	// ErrorEncryptedKey and ErrorNonce are set when the error file is encrypted, along with the digest and size of the
+	// encrypted error file. They're described like the file's own EncryptedKey, Nonce, Checksum and FileSize.
+	ErrorEncryptedKey string
+	ErrorNonce        string
+	ErrorChecksum     string `gorm:"type:char(64)"`
+	ErrorFileSize     int64
+}
+
+// GetJobKeys returns the keys of the job's files in the order they're listed in the job's manifest: grouped by
+// resource type, claim type and table, then in the order the files were recorded, which is the order of the parts of grouped
+// files
+func GetJobKeys(db *gorm.DB, jobID uint) ([]JobKey, error) {
+	var keys []JobKey
+	err := db.Where("job_id = ?", jobID).Order("resource_type, claim_type, output_table, id").Find(&keys).Error
+	return keys, err
 }
 
 // ACO represents an Accountable Care Organization.
@@ -314,6 +519,16 @@ type ACO struct {
 	SystemID    string    `json:"system_id"`
 	AlphaSecret string    `json:"alpha_secret"`
 	PublicKey   string    `json:"public_key"`
+	// WebhookURL receives a notification when one of the ACO's jobs completes or fails
+	WebhookURL string `json:"webhook_url"`
+	// WebhookSecret is used to sign webhook notifications
+	WebhookSecret string `json:"-"`
+	// AllowPartialExports completes the ACO's jobs with the files that succeeded when some of their queue jobs fail
+	AllowPartialExports bool `json:"allow_partial_exports"`
+	// EncryptExports encrypts the files of the ACO's jobs with its public key
+	EncryptExports bool `json:"encrypt_exports"`
+	// SplitClaimTypes splits the ExplanationOfBenefit resources exported for the ACO into a file per claim type
+	SplitClaimTypes bool `json:"split_claim_types"`
 }
 
 type CCLFBeneficiaryXref struct {
@@ -542,5 +757,9 @@ type JobEnqueueArgs struct {
 	BeneficiaryIDs  []string
 	ResourceType    string
 	Since           string
+	TypeFilter      url.Values `json:",omitempty"` // additional FHIR search criteria supplied via _typeFilter
 	TransactionTime time.Time
+	Version         string `json:",omitempty"` // API version used to request the job
+	SplitClaimTypes bool   `json:",omitempty"` // write each claim type's ExplanationOfBenefit resources to its own file
+	OutputFormat    string `json:",omitempty"` // flatten the resources into tables in this tabular.Format instead of writing NDJSON
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
 	"github.com/go-chi/chi"
+	"github.com/jackc/pgx"
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -447,6 +448,153 @@ func (s *ModelsTestSuite) TestJobwithKeysCompleted() {
 	s.db.Delete(&j)
 }
 
+func (s *ModelsTestSuite) TestJobCancel() {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	assert.NoError(s.T(), err)
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: pgxcfg})
+	assert.NoError(s.T(), err)
+	defer pool.Close()
+
+	tests := []struct {
+		status    string
+		cancelled bool
+	}{
+		{"Pending", true},
+		{"In Progress", true},
+		{"Completed", false},
+		{"Failed", false},
+		{"Archived", false},
+		{"Expired", false},
+		{"Cancelled", false},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.status, func(t *testing.T) {
+			j := Job{
+				ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+				RequestURL: "/api/v1/Patient/$export",
+				Status:     JobStatus(tt.status),
+				JobCount:   1,
+			}
+			s.db.Save(&j)
+			defer s.db.Unscoped().Delete(&j)
+
+			cancelled, err := j.Cancel(s.db, pool)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.cancelled, cancelled)
+
+			// A cancelled job should never be completed
+			if cancelled {
+				assert.NoError(t, s.db.Create(&JobKey{JobID: j.ID, FileName: "SOMETHING.ndjson"}).Error)
+				completed, err := j.CheckCompletedAndCleanup(s.db)
+				assert.NoError(t, err)
+				assert.False(t, completed)
+
+				var actual Job
+				assert.NoError(t, s.db.First(&actual, j.ID).Error)
+				assert.Equal(t, JobStatusCancelled, actual.Status)
+			}
+		})
+	}
+}
+
+func (s *ModelsTestSuite) TestJobCancelQueueUnavailable() {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	assert.NoError(s.T(), err)
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: pgxcfg})
+	assert.NoError(s.T(), err)
+	pool.Close()
+
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     JobStatusPending,
+		JobCount:   1,
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+
+	// The job can't be cancelled when its queue jobs can't be removed
+	cancelled, err := j.Cancel(s.db, pool)
+	assert.Error(s.T(), err)
+	assert.False(s.T(), cancelled)
+
+	var actual Job
+	assert.NoError(s.T(), s.db.First(&actual, j.ID).Error)
+	assert.Equal(s.T(), JobStatusPending, actual.Status)
+}
+
+func (s *ModelsTestSuite) TestJobFail() {
+	tests := []struct {
+		status   string
+		expected JobStatus
+		notified bool
+	}{
+		{"Pending", "Failed", true},
+		{"In Progress", "Failed", true},
+		{"Failed", "Failed", false},
+		{"Cancelled", "Cancelled", false},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.status, func(t *testing.T) {
+			var notified []JobStatus
+			SetJobNotifier(func(job *Job) { notified = append(notified, job.Status) })
+			defer SetJobNotifier(nil)
+
+			j := Job{
+				ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+				RequestURL: "/api/v1/Patient/$export",
+				Status:     JobStatus(tt.status),
+				JobCount:   1,
+			}
+			s.db.Save(&j)
+			defer s.db.Unscoped().Delete(&j)
+
+			assert.NoError(t, j.Fail(s.db, "Blue Button is down"))
+
+			var actual Job
+			assert.NoError(t, s.db.First(&actual, j.ID).Error)
+			assert.Equal(t, tt.expected, actual.Status)
+			if tt.notified {
+				assert.Equal(t, []JobStatus{JobStatusFailed}, notified)
+			} else {
+				assert.Empty(t, notified)
+			}
+		})
+	}
+}
+
+func (s *ModelsTestSuite) TestJobCompletedNotifiesOnce() {
+	var notified []uint
+	SetJobNotifier(func(job *Job) {
+		assert.Equal(s.T(), JobStatusCompleted, job.Status)
+		notified = append(notified, job.ID)
+	})
+	defer SetJobNotifier(nil)
+
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "In Progress",
+		JobCount:   1,
+	}
+	s.db.Save(&j)
+	defer s.db.Unscoped().Delete(&j)
+	assert.NoError(s.T(), s.db.Create(&JobKey{JobID: j.ID, FileName: "SOMETHING.ndjson"}).Error)
+
+	// Simulate two workers finding the job complete at the same time
+	other := j
+	completed, err := j.CheckCompletedAndCleanup(s.db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), completed)
+	completed, err = other.CheckCompletedAndCleanup(s.db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), completed)
+
+	assert.Equal(s.T(), []uint{j.ID}, notified)
+}
+
 func (s *ModelsTestSuite) TestGetEnqueueJobs() {
 	type expectedJobArgs struct {
 		resourceType string
@@ -660,7 +808,7 @@ func (s *ModelsTestSuite) TestGetEnqueueJobs() {
 				s.service.On("GetBeneficiaries", tt.cmsID).Return(oldBenes, nil)
 			}
 
-			enqueueJobs, err := tt.j.GetEnqueJobs(tt.resourceTypes, tt.since, tt.retrieveNewBenes)
+			enqueueJobs, err := tt.j.GetEnqueJobs(tt.resourceTypes, tt.since, nil, nil, tt.retrieveNewBenes)
 			assert.Nil(t, err)
 			assert.Equal(t, len(tt.expectedJobArgs), len(enqueueJobs))
 
@@ -680,6 +828,118 @@ func (s *ModelsTestSuite) TestGetEnqueueJobs() {
 		})
 	}
 }
+
+func (s *ModelsTestSuite) TestGetEnqueJobsPatientMBIs() {
+	benes := []*CCLFBeneficiary{
+		{Model: gorm.Model{ID: 1}, MBI: "1A00A00AA00"},
+		{Model: gorm.Model{ID: 2}, MBI: "1A00A00AA01"},
+		{Model: gorm.Model{ID: 3}, MBI: "1A00A00AA02"},
+	}
+
+	tests := []struct {
+		name       string
+		mbis       []string
+		expBeneIDs []string
+		expMissing []string
+	}{
+		{"AllAttributed", []string{"1A00A00AA00", "1A00A00AA02"}, []string{"1", "3"}, nil},
+		{"SomeUnattributed", []string{"1A00A00AA01", "9Z99Z99ZZ99", "9Z99Z99ZZ98"}, nil, []string{"9Z99Z99ZZ99", "9Z99Z99ZZ98"}},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			s.service = &MockService{}
+			serviceInstance = s.service
+			s.service.On("GetBeneficiaries", "A9994").Return(benes, nil)
+
+			j := Job{ACOID: uuid.Parse(constants.DevACOUUID), RequestURL: "/api/v1/Group/all/$export", Status: "Pending"}
+			s.db.Save(&j)
+			defer s.db.Delete(&j)
+
+			enqueueJobs, err := j.GetEnqueJobs([]string{"Patient"}, "", nil, tt.mbis, false)
+			if tt.expMissing != nil {
+				assert.Nil(t, enqueueJobs)
+				unattributed, ok := err.(*UnattributedPatientsError)
+				assert.True(t, ok)
+				assert.Equal(t, tt.expMissing, unattributed.MBIs)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, enqueueJobs, 1)
+			jobArgs := JobEnqueueArgs{}
+			assert.NoError(t, json.Unmarshal(enqueueJobs[0].Args, &jobArgs))
+			assert.Equal(t, tt.expBeneIDs, jobArgs.BeneficiaryIDs)
+		})
+	}
+}
+
+func (s *ModelsTestSuite) TestGetEnqueJobsVersion() {
+	benes := []*CCLFBeneficiary{{Model: gorm.Model{ID: 1}, MBI: "1A00A00AA00"}}
+
+	tests := []struct {
+		name       string
+		version    string
+		expVersion string
+	}{
+		// Jobs are v1 jobs unless another version is supplied
+		{"Default", "", constants.V1Version},
+		{"V1", constants.V1Version, constants.V1Version},
+		{"V2", constants.V2Version, constants.V2Version},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			s.service = &MockService{}
+			serviceInstance = s.service
+			s.service.On("GetBeneficiaries", "A9994").Return(benes, nil)
+
+			j := Job{ACOID: uuid.Parse(constants.DevACOUUID), RequestURL: "/api/v2/Patient/$export", Status: "Pending", Version: tt.version}
+			assert.NoError(t, s.db.Save(&j).Error)
+			defer s.db.Unscoped().Delete(&j)
+			assert.Equal(t, tt.expVersion, j.Version)
+
+			enqueueJobs, err := j.GetEnqueJobs([]string{"Patient"}, "", nil, nil, false)
+			assert.NoError(t, err)
+			assert.Len(t, enqueueJobs, 1)
+			jobArgs := JobEnqueueArgs{}
+			assert.NoError(t, json.Unmarshal(enqueueJobs[0].Args, &jobArgs))
+			assert.Equal(t, tt.expVersion, jobArgs.Version)
+		})
+	}
+}
+
+func (s *ModelsTestSuite) TestAddJobsToQueueSplitClaimTypes() {
+	benes := []*CCLFBeneficiary{{Model: gorm.Model{ID: 1}, MBI: "1A00A00AA00"}}
+	j := &Job{Model: gorm.Model{ID: 1}, ACOID: uuid.Parse(constants.DevACOUUID), SplitClaimTypes: true}
+
+	jobs, err := AddJobsToQueue(j, "A9994", []string{"ExplanationOfBenefit", "Patient"}, "", nil, false, benes)
+	assert.NoError(s.T(), err)
+	if assert.Len(s.T(), jobs, 2) {
+		// Only ExplanationOfBenefit resources are split by claim type
+		var eobArgs, patientArgs JobEnqueueArgs
+		assert.NoError(s.T(), json.Unmarshal(jobs[0].Args, &eobArgs))
+		assert.NoError(s.T(), json.Unmarshal(jobs[1].Args, &patientArgs))
+		assert.True(s.T(), eobArgs.SplitClaimTypes)
+		assert.False(s.T(), patientArgs.SplitClaimTypes)
+	}
+}
+
+func (s *ModelsTestSuite) TestAddJobsToQueueOutputFormat() {
+	benes := []*CCLFBeneficiary{{Model: gorm.Model{ID: 1}, MBI: "1A00A00AA00"}}
+	j := &Job{Model: gorm.Model{ID: 1}, ACOID: uuid.Parse(constants.DevACOUUID), SplitClaimTypes: true, OutputFormat: "parquet"}
+
+	jobs, err := AddJobsToQueue(j, "A9994", []string{"ExplanationOfBenefit"}, "", nil, false, benes)
+	assert.NoError(s.T(), err)
+	if assert.Len(s.T(), jobs, 1) {
+		// Tables aren't split by claim type, since each row records its claim type
+		var args JobEnqueueArgs
+		assert.NoError(s.T(), json.Unmarshal(jobs[0].Args, &args))
+		assert.Equal(s.T(), "parquet", args.OutputFormat)
+		assert.False(s.T(), args.SplitClaimTypes)
+	}
+}
+
 func (s *ModelsTestSuite) TestJobStatusMessage() {
 	j := Job{Status: "In Progress", JobCount: 25, CompletedJobCount: 6}
 	assert.Equal(s.T(), "In Progress (24%)", j.StatusMessage())
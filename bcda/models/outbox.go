@@ -0,0 +1,111 @@
+package models
+
+import (
+	"time"
+
+	"github.com/bgentry/que-go"
+	"github.com/jinzhu/gorm"
+)
+
+// OutboxJob is a queue job waiting to be added to the queue. The queue may be in a different database, so queue jobs
+// are written to the outbox in the same transaction as the export job they belong to and relayed to the queue once
+// that transaction commits. Either the export job and all of its queue jobs are created, or none of them are.
+type OutboxJob struct {
+	ID        uint   `gorm:"primary_key"`
+	JobID     uint   `gorm:"not null;index"` // export job the queue job belongs to
+	Type      string `gorm:"not null"`
+	Queue     string
+	Priority  int16
+	Args      string `gorm:"type:jsonb;not null"`
+	RunAt     time.Time
+	CreatedAt time.Time
+}
+
+// AddToOutbox writes the export job's queue jobs to the outbox. db should be the transaction that creates the job.
+func AddToOutbox(db *gorm.DB, jobID uint, jobs []*que.Job) error {
+	for _, j := range jobs {
+		// Like the queue, run jobs immediately unless told otherwise
+		runAt := j.RunAt
+		if runAt.IsZero() {
+			runAt = time.Now()
+		}
+		oj := OutboxJob{
+			JobID:    jobID,
+			Type:     j.Type,
+			Queue:    j.Queue,
+			Priority: j.Priority,
+			Args:     string(j.Args),
+			RunAt:    runAt,
+		}
+		if err := db.Create(&oj).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RelayOutboxJobs moves up to limit of the oldest queue jobs in the outbox to the queue. If jobID is not 0, only the
+// queue jobs of that export job are relayed. Outbox rows are locked while they're relayed, so concurrent relays never
+// relay the same row twice. A queue job may still be relayed twice if it cannot be removed from the outbox after it
+// has been queued, which export jobs tolerate. It returns the number of queue jobs that were relayed.
+func RelayOutboxJobs(db *gorm.DB, qc *que.Client, jobID uint, limit int) (int, error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	query := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").Order("id").Limit(limit)
+	if jobID != 0 {
+		query = query.Where("job_id = ?", jobID)
+	}
+	var jobs []OutboxJob
+	if err := query.Find(&jobs).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var (
+		relayed    []uint
+		enqueueErr error
+	)
+	for _, oj := range jobs {
+		j := &que.Job{
+			Type:     oj.Type,
+			Queue:    oj.Queue,
+			Priority: oj.Priority,
+			Args:     []byte(oj.Args),
+			RunAt:    oj.RunAt,
+		}
+		// The jobs that were queued are still removed from the outbox, so that they aren't relayed again
+		if enqueueErr = qc.Enqueue(j); enqueueErr != nil {
+			break
+		}
+		relayed = append(relayed, oj.ID)
+	}
+
+	if len(relayed) > 0 {
+		if err := tx.Delete(OutboxJob{}, "id in (?)", relayed).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return len(relayed), enqueueErr
+}
+
+// CountOutboxJobs returns the number of the export job's queue jobs that have yet to be relayed to the queue
+func CountOutboxJobs(db *gorm.DB, jobID uint) (int, error) {
+	var count int
+	err := db.Model(&OutboxJob{}).Where("job_id = ?", jobID).Count(&count).Error
+	return count, err
+}
+
+// DeleteOutboxJobs removes the export job's queue jobs that have yet to be relayed to the queue. It returns the number
+// of queue jobs that were removed.
+func DeleteOutboxJobs(db *gorm.DB, jobID uint) (int64, error) {
+	result := db.Delete(OutboxJob{}, "job_id = ?", jobID)
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// quotaWindow is the period over which the daily limits are enforced
+const quotaWindow = 24 * time.Hour
+
+// ACOQuota contains the limits placed on an ACO's export requests. A limit of zero means the ACO is unlimited.
+// ACOs without a quota use the defaults found in the BCDA_QUOTA_* environment variables.
+// Jobs that failed or were cancelled count against none of the limits, so they never keep the ACO from requesting the
+// export again: a failed job produces no files, and a cancelled job stops running once it's cancelled.
+type ACOQuota struct {
+	gorm.Model
+	ACOID             uuid.UUID `gorm:"type:char(36);unique_index" json:"aco_id"`
+	MaxConcurrentJobs int       `json:"max_concurrent_jobs"` // jobs that are Pending or In Progress and have not timed out
+	MaxDailyRequests  int       `json:"max_daily_requests"`  // jobs created in the last 24 hours
+	MaxDailyBytes     int64     `json:"max_daily_bytes"`     // bytes of data generated by jobs created in the last 24 hours
+}
+
+// quotaExcludedStatuses are the statuses of jobs that don't count against the daily limits. Jobs with these statuses
+// aren't running, so they don't count against the concurrent job limit either.
+var quotaExcludedStatuses = []JobStatus{JobStatusFailed, JobStatusCancelled}
+
+// QuotaViolation describes the limit that prevents an ACO from starting another export job
+type QuotaViolation struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+// RetryAfterSeconds returns the number of seconds to send in the Retry-After header
+func (v QuotaViolation) RetryAfterSeconds() int {
+	if v.RetryAfter < 0 {
+		return 0
+	}
+	return int(math.Ceil(v.RetryAfter.Seconds()))
+}
+
+// DefaultACOQuota returns the quota used for ACOs that do not have one of their own
+func DefaultACOQuota(acoID uuid.UUID) ACOQuota {
+	return ACOQuota{
+		ACOID:             acoID,
+		MaxConcurrentJobs: utils.GetEnvInt("BCDA_QUOTA_MAX_CONCURRENT_JOBS", 5),
+		MaxDailyRequests:  utils.GetEnvInt("BCDA_QUOTA_MAX_DAILY_REQUESTS", 100),
+		MaxDailyBytes:     int64(utils.GetEnvInt("BCDA_QUOTA_MAX_DAILY_BYTES", 0)),
+	}
+}
+
+// GetACOQuota returns the ACO's quota, or the default quota if the ACO does not have one.
+func GetACOQuota(db *gorm.DB, acoID uuid.UUID) (ACOQuota, error) {
+	var quota ACOQuota
+	err := db.First(&quota, "aco_id = ?", acoID.String()).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return DefaultACOQuota(acoID), nil
+	}
+	return quota, err
+}
+
+// SaveACOQuota creates or replaces the ACO's quota
+func SaveACOQuota(db *gorm.DB, quota ACOQuota) error {
+	var existing ACOQuota
+	err := db.First(&existing, "aco_id = ?", quota.ACOID.String()).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	quota.Model = existing.Model
+	return db.Save(&quota).Error
+}
+
+// CreateJobWithinQuota creates the job unless one of the limits in its ACO's quota prevents it, in which case the
+// limit is returned and the job isn't created. The ACO's requests are serialized while the quota is checked and the
+// job is created, so concurrent requests can't both be allowed by the same count. This is done in a transaction of its
+// own, which should be kept short: the job must be created before its queue jobs are found so that it counts against
+// the quota while they are.
+func CreateJobWithinQuota(db *gorm.DB, job *Job, now time.Time, jobTimeout time.Duration) (*QuotaViolation, error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	if err := tx.Exec("select pg_advisory_xact_lock(hashtext(?))", "aco_quota:"+job.ACOID.String()).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	quota, err := GetACOQuota(tx, job.ACOID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	violation, err := quota.Check(tx, now, jobTimeout)
+	if err != nil || violation != nil {
+		tx.Rollback()
+		return violation, err
+	}
+
+	if err = tx.Create(job).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return nil, tx.Commit().Error
+}
+
+// Check returns the first limit that prevents the ACO from starting another export job, or nil if the
+// ACO is within all of its limits. Pending and In Progress jobs created more than jobTimeout ago are no longer
+// considered to be running. The ACO's concurrent requests may all be allowed by Check; use CreateJobWithinQuota to
+// create the job.
+func (q ACOQuota) Check(db *gorm.DB, now time.Time, jobTimeout time.Duration) (*QuotaViolation, error) {
+	inProgress := []JobStatus{JobStatusPending, JobStatusInProgress}
+
+	if q.MaxConcurrentJobs > 0 {
+		var running []Job
+		err := db.Select("created_at").
+			Where("aco_id = ? and status in (?) and created_at > ?", q.ACOID.String(), inProgress, now.Add(-jobTimeout)).
+			Order("created_at").
+			Find(&running).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(running) >= q.MaxConcurrentJobs {
+			// Another request may be made once enough jobs finish to drop below the limit
+			retryAfter, err := q.expectedFinish(db, running[len(running)-q.MaxConcurrentJobs].CreatedAt, now, jobTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return &QuotaViolation{
+				Message:    fmt.Sprintf("The ACO has reached its limit of %d concurrent jobs", q.MaxConcurrentJobs),
+				RetryAfter: retryAfter,
+			}, nil
+		}
+	}
+
+	if q.MaxDailyRequests <= 0 && q.MaxDailyBytes <= 0 {
+		return nil, nil
+	}
+
+	// Jobs created within the window, oldest first, along with the amount of data they generated
+	var jobs []struct {
+		CreatedAt time.Time
+		Bytes     int64
+	}
+	err := db.Table("jobs").
+		Select("jobs.created_at, coalesce(sum(job_keys.file_size), 0) as bytes").
+		Joins("left join job_keys on job_keys.job_id = jobs.id and job_keys.deleted_at is null").
+		Where("jobs.aco_id = ? and jobs.created_at > ? and jobs.status not in (?) and jobs.deleted_at is null",
+			q.ACOID.String(), now.Add(-quotaWindow), quotaExcludedStatuses).
+		Group("jobs.id, jobs.created_at").
+		Order("jobs.created_at").
+		Scan(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if q.MaxDailyRequests > 0 && len(jobs) >= q.MaxDailyRequests {
+		// Another request may be made once enough jobs leave the window to drop below the limit
+		oldest := jobs[len(jobs)-q.MaxDailyRequests]
+		return &QuotaViolation{
+			Message:    fmt.Sprintf("The ACO has reached its limit of %d requests per day", q.MaxDailyRequests),
+			RetryAfter: oldest.CreatedAt.Add(quotaWindow).Sub(now),
+		}, nil
+	}
+
+	if q.MaxDailyBytes > 0 {
+		var total int64
+		for _, j := range jobs {
+			total += j.Bytes
+		}
+
+		if total >= q.MaxDailyBytes {
+			// Another request may be made once enough data leaves the window to drop below the limit
+			var retryAfter time.Duration
+			for _, j := range jobs {
+				total -= j.Bytes
+				if total < q.MaxDailyBytes {
+					retryAfter = j.CreatedAt.Add(quotaWindow).Sub(now)
+					break
+				}
+			}
+			return &QuotaViolation{
+				Message:    fmt.Sprintf("The ACO has reached its limit of %d bytes of data per day", q.MaxDailyBytes),
+				RetryAfter: retryAfter,
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// minConcurrentRetryAfter is the shortest time a client is asked to wait for a running job to finish
+const minConcurrentRetryAfter = time.Minute
+
+// expectedFinish estimates how long it will be until a running job created at createdAt finishes, based on how long the
+// ACO's jobs completed within the window took. Without any history, the job is expected to run until it times out.
+func (q ACOQuota) expectedFinish(db *gorm.DB, createdAt, now time.Time, jobTimeout time.Duration) (time.Duration, error) {
+	var avgSeconds sql.NullFloat64
+	err := db.Table("jobs").
+		Select("avg(extract(epoch from updated_at - created_at))").
+		Where("aco_id = ? and status in (?) and created_at > ? and deleted_at is null", q.ACOID.String(),
+			[]JobStatus{JobStatusCompleted, JobStatusPartiallyCompleted}, now.Add(-quotaWindow)).
+		Row().Scan(&avgSeconds)
+	if err != nil {
+		return 0, err
+	}
+
+	finish := createdAt.Add(jobTimeout)
+	if avgSeconds.Valid {
+		if expected := createdAt.Add(time.Duration(avgSeconds.Float64 * float64(time.Second))); expected.Before(finish) {
+			finish = expected
+		}
+	}
+
+	// The job is taking longer than usual, so it should finish soon
+	if retryAfter := finish.Sub(now); retryAfter > minConcurrentRetryAfter {
+		return retryAfter, nil
+	}
+	return minConcurrentRetryAfter, nil
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+)
+
+type QuotaTestSuite struct {
+	suite.Suite
+	db  *gorm.DB
+	aco ACO
+}
+
+func (s *QuotaTestSuite) SetupTest() {
+	InitializeGormModels()
+	s.db = database.GetGORMDbConnection()
+	s.aco = ACO{Name: "Quota Test ACO", UUID: uuid.NewRandom()}
+	assert.NoError(s.T(), s.db.Create(&s.aco).Error)
+}
+
+func (s *QuotaTestSuite) TearDownTest() {
+	var jobs []Job
+	s.db.Find(&jobs, "aco_id = ?", s.aco.UUID.String())
+	for _, j := range jobs {
+		s.db.Unscoped().Delete(JobKey{}, "job_id = ?", j.ID)
+		s.db.Unscoped().Delete(&j)
+	}
+	s.db.Unscoped().Delete(ACOQuota{}, "aco_id = ?", s.aco.UUID.String())
+	s.db.Unscoped().Delete(&s.aco)
+	database.Close(s.db)
+}
+
+func TestQuotaTestSuite(t *testing.T) {
+	suite.Run(t, new(QuotaTestSuite))
+}
+
+func (s *QuotaTestSuite) TestGetACOQuota() {
+	defer os.Unsetenv("BCDA_QUOTA_MAX_CONCURRENT_JOBS")
+	os.Setenv("BCDA_QUOTA_MAX_CONCURRENT_JOBS", "2")
+
+	// Defaults are used until the ACO has a quota of its own
+	quota, err := GetACOQuota(s.db, s.aco.UUID)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 2, quota.MaxConcurrentJobs)
+	assert.Equal(s.T(), 100, quota.MaxDailyRequests)
+	assert.Equal(s.T(), int64(0), quota.MaxDailyBytes)
+
+	quota.MaxDailyBytes = 1 << 30
+	assert.NoError(s.T(), SaveACOQuota(s.db, quota))
+	quota.MaxConcurrentJobs = 3
+	assert.NoError(s.T(), SaveACOQuota(s.db, quota))
+
+	quota, err = GetACOQuota(s.db, s.aco.UUID)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 3, quota.MaxConcurrentJobs)
+	assert.Equal(s.T(), 100, quota.MaxDailyRequests)
+	assert.Equal(s.T(), int64(1<<30), quota.MaxDailyBytes)
+
+	var count int
+	s.db.Model(&ACOQuota{}).Where("aco_id = ?", s.aco.UUID.String()).Count(&count)
+	assert.Equal(s.T(), 1, count)
+}
+
+func (s *QuotaTestSuite) TestCheck() {
+	now := time.Now()
+	s.createJob("Completed", now.Add(-25*time.Hour), 1000) // outside of the window
+	s.createJob("Completed", now.Add(-20*time.Hour), 300)
+	s.createJob("Archived", now.Add(-10*time.Hour), 200)
+	// Failed and cancelled jobs don't count against any limit
+	s.createJob("Failed", now.Add(-5*time.Hour), 400)
+	s.createJob("Cancelled", now.Add(-3*time.Hour), 400)
+	s.createJob("In Progress", now.Add(-2*time.Hour), 0)
+	s.createJob("Pending", now.Add(-1*time.Hour), 0)
+	s.createJob("Pending", now.Add(-30*time.Hour), 0) // timed out
+
+	tests := []struct {
+		name          string
+		quota         ACOQuota
+		expMessage    string
+		expRetryAfter time.Duration
+	}{
+		{"Unlimited", ACOQuota{}, "", 0},
+		{"WithinLimits", ACOQuota{MaxConcurrentJobs: 3, MaxDailyRequests: 5, MaxDailyBytes: 1000}, "", 0},
+		// The completed job in the window took 20 hours, so the oldest running job is expected to finish in 18
+		{"ConcurrentJobs", ACOQuota{MaxConcurrentJobs: 2}, "The ACO has reached its limit of 2 concurrent jobs", 18 * time.Hour},
+		// The oldest two jobs in the window must leave before another request can be made
+		{"DailyRequests", ACOQuota{MaxDailyRequests: 3}, "The ACO has reached its limit of 3 requests per day", 14 * time.Hour},
+		{"DailyRequestsAtLimit", ACOQuota{MaxDailyRequests: 4}, "The ACO has reached its limit of 4 requests per day", 4 * time.Hour},
+		// 500 bytes were generated in the window; the first job leaving the window drops the total to 200
+		{"DailyBytes", ACOQuota{MaxDailyBytes: 500}, "The ACO has reached its limit of 500 bytes of data per day", 4 * time.Hour},
+		{"DailyBytesAllJobs", ACOQuota{MaxDailyBytes: 100}, "The ACO has reached its limit of 100 bytes of data per day", 14 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			tt.quota.ACOID = s.aco.UUID
+			violation, err := tt.quota.Check(s.db, now, 24*time.Hour)
+			assert.NoError(t, err)
+			if tt.expMessage == "" {
+				assert.Nil(t, violation)
+				return
+			}
+			assert.NotNil(t, violation)
+			assert.Equal(t, tt.expMessage, violation.Message)
+			assert.InDelta(t, tt.expRetryAfter.Seconds(), violation.RetryAfter.Seconds(), 1)
+		})
+	}
+}
+
+func (s *QuotaTestSuite) TestCheckConcurrentRetryAfter() {
+	now := time.Now()
+	quota := ACOQuota{ACOID: s.aco.UUID, MaxConcurrentJobs: 1}
+	s.createJob("In Progress", now.Add(-1*time.Hour), 0)
+
+	// Without any history, the job is expected to run until it times out
+	violation, err := quota.Check(s.db, now, 24*time.Hour)
+	assert.NoError(s.T(), err)
+	assert.InDelta(s.T(), (23 * time.Hour).Seconds(), violation.RetryAfter.Seconds(), 1)
+
+	// Jobs usually take 30 minutes, so the running job is overdue and should finish soon
+	j := s.createJob("Completed", now.Add(-3*time.Hour), 0)
+	assert.NoError(s.T(), s.db.Model(&j).UpdateColumn("updated_at", now.Add(-150*time.Minute)).Error)
+	violation, err = quota.Check(s.db, now, 24*time.Hour)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), minConcurrentRetryAfter, violation.RetryAfter)
+
+	// Running jobs don't count once they time out
+	violation, err = quota.Check(s.db, now, 30*time.Minute)
+	assert.NoError(s.T(), err)
+	assert.Nil(s.T(), violation)
+}
+
+func (s *QuotaTestSuite) TestCreateJobWithinQuota() {
+	now := time.Now()
+	assert.NoError(s.T(), SaveACOQuota(s.db, ACOQuota{ACOID: s.aco.UUID, MaxConcurrentJobs: 1}))
+
+	j := Job{ACOID: s.aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: JobStatusPending}
+	violation, err := CreateJobWithinQuota(s.db, &j, now, 24*time.Hour)
+	assert.NoError(s.T(), err)
+	assert.Nil(s.T(), violation)
+	assert.NotZero(s.T(), j.ID)
+
+	// The first job counts against the quota, so the second isn't created
+	j2 := Job{ACOID: s.aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: JobStatusPending}
+	violation, err = CreateJobWithinQuota(s.db, &j2, now, 24*time.Hour)
+	assert.NoError(s.T(), err)
+	assert.NotNil(s.T(), violation)
+	assert.Zero(s.T(), j2.ID)
+
+	var count int
+	assert.NoError(s.T(), s.db.Model(&Job{}).Where("aco_id = ?", s.aco.UUID.String()).Count(&count).Error)
+	assert.Equal(s.T(), 1, count)
+}
+
+func TestQuotaViolationRetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, 2, QuotaViolation{RetryAfter: 1500 * time.Millisecond}.RetryAfterSeconds())
+	assert.Equal(t, 60, QuotaViolation{RetryAfter: time.Minute}.RetryAfterSeconds())
+	assert.Equal(t, 0, QuotaViolation{RetryAfter: -time.Second}.RetryAfterSeconds())
+}
+
+func (s *QuotaTestSuite) createJob(status JobStatus, createdAt time.Time, bytes int64) Job {
+	j := Job{ACOID: s.aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: status}
+	assert.NoError(s.T(), s.db.Create(&j).Error)
+	assert.NoError(s.T(), s.db.Model(&j).UpdateColumn("created_at", createdAt).Error)
+
+	// Split the data across files to ensure they are summed
+	if bytes > 0 {
+		for _, size := range []int64{bytes / 2, bytes - bytes/2} {
+			assert.NoError(s.T(), s.db.Create(&JobKey{JobID: j.ID, FileName: uuid.New() + ".ndjson", FileSize: size}).Error)
+		}
+	}
+	return j
+}
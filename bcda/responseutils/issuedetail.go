@@ -8,4 +8,5 @@ const (
 	BbErr       = "Blue Button Error"
 	InternalErr = "Internal Error"
 	RequestErr  = "Request Error"
+	QuotaErr    = "Quota Exceeded"
 )
@@ -0,0 +1,105 @@
+// Package v2 creates the FHIR R4 responses served by the v2 API.
+// The issue types and details codes found in the responseutils package are used by both versions of the API.
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	fhirmodels "github.com/eug48/fhir/models"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
+)
+
+// OperationOutcome is an R4 OperationOutcome. The generated R4 models marshal most issue types using their display
+// text instead of their code, e.g. "Exception" instead of "exception", which R4 parsers reject, so the issues' severity
+// and type are kept as codes. The JSON can be read with fhir.UnmarshalOperationOutcome.
+type OperationOutcome struct {
+	Issue []OperationOutcomeIssue `json:"issue"`
+}
+
+// OperationOutcomeIssue is an issue found in an OperationOutcome
+type OperationOutcomeIssue struct {
+	Severity string                `json:"severity"`
+	Code     string                `json:"code"`
+	Details  *fhir.CodeableConcept `json:"details,omitempty"`
+}
+
+type otherOperationOutcome OperationOutcome
+
+// MarshalJSON marshals the OperationOutcome along with its resource type
+func (oo OperationOutcome) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		otherOperationOutcome
+		ResourceType string `json:"resourceType"`
+	}{
+		otherOperationOutcome: otherOperationOutcome(oo),
+		ResourceType:          "OperationOutcome",
+	})
+}
+
+// CreateOpOutcome returns an R4 OperationOutcome containing a single issue.
+func CreateOpOutcome(severity, code, detailsCode, detailsDisplay string) *OperationOutcome {
+	// The severities and issue types are defined in the responseutils package, so they will always be valid.
+	// We fall back to an error/exception to avoid reporting a value that R4 clients can't parse.
+	var (
+		s fhir.IssueSeverity
+		c fhir.IssueType
+	)
+	if err := s.UnmarshalJSON([]byte(strconv.Quote(severity))); err != nil {
+		severity = responseutils.Error
+	}
+	if err := c.UnmarshalJSON([]byte(strconv.Quote(code))); err != nil {
+		code = responseutils.Exception
+	}
+
+	issue := OperationOutcomeIssue{Severity: severity, Code: code}
+	if detailsCode != "" || detailsDisplay != "" {
+		coding := fhir.Coding{Display: &detailsDisplay}
+		if detailsCode != "" {
+			coding.Code = &detailsCode
+			coding.System = getStringPtr("http://hl7.org/fhir/ValueSet/operation-outcome")
+		}
+		issue.Details = &fhir.CodeableConcept{
+			Coding: []fhir.Coding{coding},
+			Text:   &detailsDisplay,
+		}
+	}
+
+	return &OperationOutcome{Issue: []OperationOutcomeIssue{issue}}
+}
+
+// FromSTU3 returns the R4 form of an OperationOutcome created by the responseutils package. It's used for the request
+// validation shared by both versions of the API.
+func FromSTU3(outcome *fhirmodels.OperationOutcome) *OperationOutcome {
+	oo := &OperationOutcome{Issue: []OperationOutcomeIssue{}}
+	for _, issue := range outcome.Issue {
+		var detailsCode, detailsDisplay string
+		if issue.Details != nil && len(issue.Details.Coding) > 0 {
+			detailsCode = issue.Details.Coding[0].Code
+			detailsDisplay = issue.Details.Coding[0].Display
+		}
+		oo.Issue = append(oo.Issue, CreateOpOutcome(issue.Severity, issue.Code, detailsCode, detailsDisplay).Issue...)
+	}
+	return oo
+}
+
+// WriteError writes the OperationOutcome to the response using the supplied status code.
+func WriteError(outcome *OperationOutcome, w http.ResponseWriter, code int) {
+	outcomeJSON, err := json.Marshal(outcome)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err = w.Write(outcomeJSON); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func getStringPtr(value string) *string {
+	return &value
+}
@@ -0,0 +1,79 @@
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
+)
+
+func TestCreateOpOutcome(t *testing.T) {
+	oo := CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "TestCreateOpOutcome")
+	assert.Equal(t, "error", oo.Issue[0].Severity)
+	assert.Equal(t, "exception", oo.Issue[0].Code)
+	assert.Equal(t, "TestCreateOpOutcome", *oo.Issue[0].Details.Coding[0].Display)
+	assert.Equal(t, "TestCreateOpOutcome", *oo.Issue[0].Details.Text)
+	assert.Equal(t, responseutils.RequestErr, *oo.Issue[0].Details.Coding[0].Code)
+
+	b, err := json.Marshal(oo)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"resourceType":"OperationOutcome"`)
+	assert.Contains(t, string(b), `"code":"exception"`)
+
+	// The JSON must be readable by R4 parsers
+	parsed, err := fhir.UnmarshalOperationOutcome(b)
+	require.NoError(t, err)
+	assert.Equal(t, fhir.IssueSeverityError, parsed.Issue[0].Severity)
+	assert.Equal(t, fhir.IssueTypeException, parsed.Issue[0].Code)
+	assert.Equal(t, oo.Issue[0].Details, parsed.Issue[0].Details)
+
+	// No details
+	oo = CreateOpOutcome(responseutils.Warning, responseutils.Throttled, "", "")
+	assert.Equal(t, "warning", oo.Issue[0].Severity)
+	assert.Equal(t, "throttled", oo.Issue[0].Code)
+	assert.Nil(t, oo.Issue[0].Details)
+
+	// Unknown codes
+	oo = CreateOpOutcome("bad", "Exception", "", "")
+	assert.Equal(t, "error", oo.Issue[0].Severity)
+	assert.Equal(t, "exception", oo.Issue[0].Code)
+}
+
+// Every issue type used by BCDA must be readable by R4 parsers
+func TestCreateOpOutcomeIssueTypes(t *testing.T) {
+	for _, code := range []string{responseutils.Exception, responseutils.Throttled, responseutils.Structure,
+		responseutils.Not_found, responseutils.Deleted, responseutils.Processing, responseutils.Invalid} {
+		b, err := json.Marshal(CreateOpOutcome(responseutils.Error, code, "", ""))
+		assert.NoError(t, err)
+		parsed, err := fhir.UnmarshalOperationOutcome(b)
+		assert.NoError(t, err, code)
+
+		var expected fhir.IssueType
+		assert.NoError(t, expected.UnmarshalJSON([]byte(`"`+code+`"`)))
+		assert.Equal(t, expected, parsed.Issue[0].Code, code)
+	}
+}
+
+func TestFromSTU3(t *testing.T) {
+	oo := FromSTU3(responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid resource type"))
+	assert.Equal(t, CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid resource type"), oo)
+}
+
+func TestWriteError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteError(CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Not_found, "TestWriteError"), rr, http.StatusNotFound)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	oo, err := fhir.UnmarshalOperationOutcome(rr.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, fhir.IssueTypeException, oo.Issue[0].Code)
+	assert.Equal(t, responseutils.Not_found, *oo.Issue[0].Details.Coding[0].Code)
+	assert.Equal(t, "TestWriteError", *oo.Issue[0].Details.Coding[0].Display)
+}
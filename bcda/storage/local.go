@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// areaDirEnvVars contain the directories of the local storage areas
+var areaDirEnvVars = map[Area]string{
+	Staging: "FHIR_STAGING_DIR",
+	Payload: "FHIR_PAYLOAD_DIR",
+	Archive: "FHIR_ARCHIVE_DIR",
+}
+
+// Local stores files on the local filesystem. The directory of each area is read from the environment whenever it's
+// used.
+type Local struct{}
+
+// NewLocal returns storage that keeps files on the local filesystem
+func NewLocal() *Local {
+	return &Local{}
+}
+
+func (l *Local) path(area Area, name string) string {
+	return filepath.Join(os.Getenv(areaDirEnvVars[area]), filepath.FromSlash(cleanName(name)))
+}
+
+// Create creates the file, along with any missing directories
+func (l *Local) Create(area Area, name string) (io.WriteCloser, error) {
+	p := l.path(area, name)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return nil, err
+	}
+	/* #nosec -- creating file defined by variable */
+	return os.Create(p)
+}
+
+func (l *Local) Open(area Area, name string) (File, error) {
+	/* #nosec -- opening file defined by variable */
+	f, err := os.Open(l.path(area, name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Local) Stat(area Area, name string) (os.FileInfo, error) {
+	return os.Stat(l.path(area, name))
+}
+
+func (l *Local) List(area Area, dir string) ([]string, error) {
+	root := os.Getenv(areaDirEnvVars[area])
+	var names []string
+	err := filepath.Walk(l.path(area, dir), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
+// Move renames the file, which requires the areas to be on the same filesystem
+func (l *Local) Move(from, to Area, name string) error {
+	dest := l.path(to, name)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(l.path(from, name), dest)
+}
+
+func (l *Local) Remove(area Area, name string) error {
+	return os.Remove(l.path(area, name))
+}
+
+func (l *Local) RemoveAll(area Area, dir string) error {
+	if cleanName(dir) == "" {
+		return errNoDir
+	}
+	return os.RemoveAll(l.path(area, dir))
+}
@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// S3Config describes the bucket in which S3 storage keeps its files
+type S3Config struct {
+	// Endpoint is the URL of the S3 service, e.g. https://s3.us-east-1.amazonaws.com, or of a compatible service
+	// such as MinIO. Buckets are addressed by path, which every compatible service supports.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the key of every file, so that a bucket can be shared
+	Prefix      string
+	Credentials *credentials.Credentials
+	// Client sends requests to the service. http.DefaultClient is used if it's nil.
+	Client *http.Client
+}
+
+// S3ConfigFromEnv returns the configuration of S3 storage from BCDA_S3_ENDPOINT, BCDA_S3_REGION, BCDA_S3_BUCKET and
+// BCDA_S3_PREFIX. Credentials are found in the same places as the AWS SDK finds them, e.g. AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY or the instance's role.
+func S3ConfigFromEnv() (S3Config, error) {
+	cfg := S3Config{
+		Endpoint: os.Getenv("BCDA_S3_ENDPOINT"),
+		Region:   os.Getenv("BCDA_S3_REGION"),
+		Bucket:   os.Getenv("BCDA_S3_BUCKET"),
+		Prefix:   os.Getenv("BCDA_S3_PREFIX"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Credentials = sess.Config.Credentials
+
+	return cfg, nil
+}
+
+const (
+	// maxCopySize is the size of the largest object that S3 can copy in a single request
+	maxCopySize = 5 << 30
+	// defaultPartSize is the size of the parts of larger objects, which are uploaded or copied in parts. Uploads of
+	// objects with more parts than S3 allows use larger parts.
+	defaultPartSize = 64 << 20
+)
+
+// S3 stores files in an S3 bucket. Each file is an object whose key is the configured prefix followed by the name
+// of its area and the name of the file.
+type S3 struct {
+	cfg      S3Config
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	// maxCopySize and partSize are only changed by tests
+	maxCopySize int64
+	partSize    int64
+}
+
+// NewS3 returns storage that keeps files in the configured S3 bucket
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("an S3 bucket (BCDA_S3_BUCKET) must be provided")
+	}
+	if cfg.Credentials == nil {
+		return nil, errors.New("S3 credentials must be provided")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(cfg.Endpoint),
+		Region:           aws.String(cfg.Region),
+		Credentials:      cfg.Credentials,
+		HTTPClient:       client,
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &S3{cfg: cfg, svc: s3.New(sess), maxCopySize: maxCopySize, partSize: defaultPartSize}
+	s.uploader = s3manager.NewUploaderWithClient(s.svc)
+	return s, nil
+}
+
+func (s *S3) key(area Area, name string) string {
+	return s.cfg.Prefix + string(area) + "/" + cleanName(name)
+}
+
+// copySource returns the source of a copy of the object with the given key. Unlike other parameters, the SDK doesn't
+// escape it.
+func (s *S3) copySource(key string) string {
+	segments := []string{url.PathEscape(s.cfg.Bucket)}
+	for _, segment := range strings.Split(key, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return strings.Join(segments, "/")
+}
+
+// notExist returns an error that satisfies os.IsNotExist if err is the service's response to a request for an object
+// that does not exist, and err otherwise
+func notExist(op, key string, err error) error {
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// Create writes the file to a temporary file, which is uploaded when the writer is closed
+func (s *S3) Create(area Area, name string) (io.WriteCloser, error) {
+	f, err := ioutil.TempFile("", "bcda-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{File: f, s3: s, key: s.key(area, name)}, nil
+}
+
+// s3Writer uploads the temporary file to which the object's contents were written when it's closed
+type s3Writer struct {
+	*os.File
+	s3  *S3
+	key string
+}
+
+// Close uploads the file, in parts if it's larger than a part. The SDK sends the MD5 and SHA-256 digests of each
+// request's body, so the service rejects any that are corrupted along the way. An upload whose parts fail is aborted,
+// so that the service doesn't keep the parts that were uploaded.
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	size, err := w.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = w.s3.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(w.s3.cfg.Bucket),
+		Key:    aws.String(w.key),
+		Body:   io.NewSectionReader(w.File, 0, size),
+	}, func(u *s3manager.Uploader) {
+		u.PartSize = w.s3.partSize
+	})
+	return err
+}
+
+func (s *S3) Open(area Area, name string) (File, error) {
+	fi, err := s.Stat(area, name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s3: s, key: s.key(area, name), info: fi.(*s3FileInfo)}, nil
+}
+
+func (s *S3) Stat(area Area, name string) (os.FileInfo, error) {
+	key := s.key(area, name)
+	out, err := s.svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s.cfg.Bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, notExist("stat", key, err)
+	}
+
+	// Last-Modified is only used for conditional requests, so the object is still usable if it's missing
+	return &s3FileInfo{name: path.Base(name), size: aws.Int64Value(out.ContentLength),
+		modTime: aws.TimeValue(out.LastModified)}, nil
+}
+
+func (s *S3) List(area Area, dir string) ([]string, error) {
+	areaPrefix := s.key(area, "")
+	prefix := areaPrefix
+	if d := cleanName(dir); d != "" {
+		prefix += d + "/"
+	}
+
+	var names []string
+	in := &s3.ListObjectsV2Input{Bucket: aws.String(s.cfg.Bucket), Prefix: aws.String(prefix)}
+	err := s.svc.ListObjectsV2Pages(in, func(out *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range out.Contents {
+			names = append(names, strings.TrimPrefix(aws.StringValue(obj.Key), areaPrefix))
+		}
+		return true
+	})
+	return names, err
+}
+
+// Move copies the object to the other area before removing it. S3 can't rename objects.
+func (s *S3) Move(from, to Area, name string) error {
+	if err := s.copy(s.key(from, name), s.key(to, name)); err != nil {
+		return err
+	}
+	return s.Remove(from, name)
+}
+
+// copy copies the object with the src key to the dst key, copying it in parts if it's too large for a single request
+func (s *S3) copy(src, dst string) error {
+	head, err := s.svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s.cfg.Bucket), Key: aws.String(src)})
+	if err != nil {
+		return notExist("move", src, err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	if size <= s.maxCopySize {
+		_, err = s.svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(s.cfg.Bucket),
+			Key:        aws.String(dst),
+			CopySource: aws.String(s.copySource(src)),
+		})
+		return notExist("move", src, err)
+	}
+	return s.copyParts(src, dst, size)
+}
+
+// copyParts copies an object of the given size in parts of partSize bytes. The copy is aborted if any of its parts
+// fail, so that the service doesn't keep the parts that were copied.
+func (s *S3) copyParts(src, dst string, size int64) error {
+	created, err := s.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(dst),
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for offset := int64(0); offset < size && err == nil; offset += s.partSize {
+		end := offset + s.partSize
+		if end > size {
+			end = size
+		}
+		n := aws.Int64(int64(len(parts) + 1))
+		var out *s3.UploadPartCopyOutput
+		out, err = s.svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.cfg.Bucket),
+			Key:             aws.String(dst),
+			UploadId:        created.UploadId,
+			PartNumber:      n,
+			CopySource:      aws.String(s.copySource(src)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err == nil {
+			parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: n})
+		}
+	}
+
+	if err == nil {
+		_, err = s.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.cfg.Bucket),
+			Key:             aws.String(dst),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		_, aErr := s.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.cfg.Bucket),
+			Key:      aws.String(dst),
+			UploadId: created.UploadId,
+		})
+		if aErr != nil {
+			log.Errorf("Unable to abort S3 copy %s of %s: %s", aws.StringValue(created.UploadId), src, aErr.Error())
+		}
+		return notExist("move", src, err)
+	}
+	return nil
+}
+
+func (s *S3) Remove(area Area, name string) error {
+	key := s.key(area, name)
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.cfg.Bucket), Key: aws.String(key)})
+	return notExist("remove", key, err)
+}
+
+func (s *S3) RemoveAll(area Area, dir string) error {
+	if cleanName(dir) == "" {
+		return errNoDir
+	}
+
+	names, err := s.List(area, dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = s.Remove(area, name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3File reads an object. Each read after a seek requests the rest of the object from the new offset, so only the
+// ranges that are read are downloaded.
+type s3File struct {
+	s3     *S3
+	key    string
+	info   *s3FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		out, err := f.s3.svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(f.s3.cfg.Bucket),
+			Key:    aws.String(f.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", f.offset)),
+		})
+		if err != nil {
+			return 0, notExist("read", f.key, err)
+		}
+		f.body = out.Body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.offset + offset
+	case io.SeekEnd:
+		abs = f.info.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if abs != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = abs
+	return abs, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// s3FileInfo describes an object
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) Mode() os.FileMode  { return 0444 }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return false }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
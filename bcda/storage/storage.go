@@ -0,0 +1,116 @@
+// Package storage stores the files written by export jobs.
+//
+// Files are kept in one of three areas: the staging area, where the worker writes a job's files while the job is in
+// progress; the payload area, from which the API serves the files of completed jobs; and the archive area, where the
+// files of expired jobs are kept until they're removed. Files are named by their path within an area, e.g.
+// "<job ID>/<file name>".
+//
+// The backend is selected by BCDA_STORAGE_BACKEND. The local backend, the default, keeps each area in the directory
+// named by FHIR_STAGING_DIR, FHIR_PAYLOAD_DIR or FHIR_ARCHIVE_DIR, which must be shared by the API and worker nodes.
+// The s3 backend keeps the areas in an S3 bucket, or in any storage service that is compatible with S3, such as MinIO.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Area is a location in which files are stored
+type Area string
+
+const (
+	Staging Area = "staging"
+	Payload Area = "payload"
+	Archive Area = "archive"
+)
+
+// Storage stores files in areas. Errors returned for files that do not exist satisfy os.IsNotExist.
+type Storage interface {
+	// Create returns a writer for a new file, replacing any file with the same name. The file is only guaranteed to
+	// be stored once the writer has been closed without error.
+	Create(area Area, name string) (io.WriteCloser, error)
+	// Open returns the file for reading. The file may be read from any offset, so it can be used to serve ranges.
+	Open(area Area, name string) (File, error)
+	// Stat describes the file
+	Stat(area Area, name string) (os.FileInfo, error)
+	// List returns the names of the files in the directory, including those in its subdirectories.
+	// A directory that does not exist contains no files.
+	List(area Area, dir string) ([]string, error)
+	// Move moves the file to another area, keeping its name
+	Move(from, to Area, name string) error
+	// Remove removes the file
+	Remove(area Area, name string) error
+	// RemoveAll removes the directory and every file in it. It's not an error if the directory does not exist.
+	RemoveAll(area Area, dir string) error
+}
+
+// File is a stored file that has been opened for reading
+type File interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// MoveAll moves every file in the directory to another area. Files that are moved by someone else while MoveAll is
+// running are skipped, so the same directory may be moved more than once, or concurrently.
+func MoveAll(s Storage, from, to Area, dir string) error {
+	names, err := s.List(from, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err = s.Move(from, to, name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return s.RemoveAll(from, dir)
+}
+
+// errNoDir is returned when removing a directory would remove the whole area
+var errNoDir = errors.New("a directory within the area must be named")
+
+// cleanName returns the name without any leading slashes or relative path elements, so that it cannot refer to a
+// file outside of its area
+func cleanName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+var (
+	defaultStorage Storage
+	once           sync.Once
+)
+
+// Get returns the storage selected by BCDA_STORAGE_BACKEND: "local", the default, or "s3"
+func Get() Storage {
+	once.Do(func() {
+		var err error
+		if defaultStorage, err = New(os.Getenv("BCDA_STORAGE_BACKEND")); err != nil {
+			log.Fatal(err)
+		}
+	})
+	return defaultStorage
+}
+
+// New returns the storage for the named backend, configured from the environment
+func New(backend string) (Storage, error) {
+	switch backend {
+	case "", "local":
+		return NewLocal(), nil
+	case "s3":
+		cfg, err := S3ConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewS3(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
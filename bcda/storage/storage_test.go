@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocal(t *testing.T) {
+	for area, envVar := range areaDirEnvVars {
+		dir, err := ioutil.TempDir("", "bcda_storage_"+string(area)+"_")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		orig := os.Getenv(envVar)
+		defer os.Setenv(envVar, orig)
+		os.Setenv(envVar, dir)
+	}
+
+	testStorage(t, NewLocal())
+
+	// Names cannot refer to files outside of their area
+	w, err := NewLocal().Create(Staging, "../../escaped.ndjson")
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	_, err = os.Stat(os.Getenv("FHIR_STAGING_DIR") + "/escaped.ndjson")
+	assert.NoError(t, err)
+}
+
+// TestS3 runs against a fake S3 service. Set BCDA_S3_TEST_ENDPOINT and BCDA_S3_TEST_BUCKET to also run it against a
+// real service, such as a local MinIO server, using the credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func TestS3(t *testing.T) {
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+
+	cfgs := map[string]S3Config{
+		"fake": {Endpoint: server.URL, Region: "us-east-1", Bucket: "bcda", Prefix: "test/",
+			Credentials: credentials.NewStaticCredentials("id", "secret", "")},
+	}
+	if endpoint := os.Getenv("BCDA_S3_TEST_ENDPOINT"); endpoint != "" {
+		cfgs["service"] = S3Config{Endpoint: endpoint, Region: "us-east-1", Bucket: os.Getenv("BCDA_S3_TEST_BUCKET"),
+			Prefix: uuid.NewRandom().String() + "/", Credentials: credentials.NewEnvCredentials()}
+	}
+
+	for name, cfg := range cfgs {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewS3(cfg)
+			assert.NoError(t, err)
+			testStorage(t, s)
+
+			// Keys are escaped, so names may contain characters that are reserved in URLs
+			name := "2/a b+c%20d&e=f?g#h.ndjson"
+			w, err := s.Create(Staging, name)
+			assert.NoError(t, err)
+			_, err = io.WriteString(w, "reserved\n")
+			assert.NoError(t, err)
+			assert.NoError(t, w.Close())
+			assert.NoError(t, MoveAll(s, Staging, Payload, "2"))
+			names, err := s.List(Payload, "2")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{name}, names)
+			assertContents(t, s, Payload, name, "reserved\n")
+			assert.NoError(t, s.RemoveAll(Payload, "2"))
+		})
+	}
+
+	_, err := NewS3(S3Config{Endpoint: server.URL, Credentials: credentials.NewStaticCredentials("id", "secret", "")})
+	assert.EqualError(t, err, "an S3 bucket (BCDA_S3_BUCKET) must be provided")
+}
+
+// TestS3Multipart uses a file larger than a part, and copies limited to less than a part, so that the file is uploaded,
+// and moved, in parts
+func TestS3Multipart(t *testing.T) {
+	fake := newFakeS3()
+	fake.maxSingleSize = 1 << 20
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s, err := NewS3(S3Config{Endpoint: server.URL, Region: "us-east-1", Bucket: "bcda", Prefix: "test/",
+		Credentials: credentials.NewStaticCredentials("id", "secret", "")})
+	assert.NoError(t, err)
+	// Parts can't be smaller than 5 MB
+	s.maxCopySize, s.partSize = 1<<20, 5<<20
+
+	data := make([]byte, 12<<20)
+	_, err = rand.Read(data)
+	assert.NoError(t, err)
+	w, err := s.Create(Staging, "1/data.ndjson")
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.NoError(t, s.Move(Staging, Payload, "1/data.ndjson"))
+	assertContents(t, s, Payload, "1/data.ndjson", string(data))
+
+	// The file is uploaded in 3 parts, and then copied in 3 parts
+	assert.Equal(t, 6, fake.partRequests)
+	assert.Empty(t, fake.uploads)
+
+	// Uploads whose parts fail are aborted
+	fake.failParts = true
+	w, err = s.Create(Staging, "1/failed.ndjson")
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.Error(t, w.Close())
+	assert.Empty(t, fake.uploads)
+	_, err = s.Stat(Staging, "1/failed.ndjson")
+	assert.True(t, os.IsNotExist(err))
+
+	// As are copies
+	assert.Error(t, s.Move(Payload, Archive, "1/data.ndjson"))
+	assert.Empty(t, fake.uploads)
+	_, err = s.Stat(Archive, "1/data.ndjson")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNew(t *testing.T) {
+	s, err := New("")
+	assert.NoError(t, err)
+	assert.IsType(t, &Local{}, s)
+
+	_, err = New("ftp")
+	assert.EqualError(t, err, `unknown storage backend "ftp"`)
+}
+
+// testStorage verifies the behavior shared by every backend
+func testStorage(t *testing.T, s Storage) {
+	data := []byte(strings.Repeat(`{"resourceType":"Patient"}`+"\n", 100))
+
+	w, err := s.Create(Staging, "1/data.ndjson")
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	fi, err := s.Stat(Staging, "1/data.ndjson")
+	assert.NoError(t, err)
+	assert.Equal(t, "data.ndjson", fi.Name())
+	assert.Equal(t, int64(len(data)), fi.Size())
+
+	// Files can be read from any offset
+	f, err := s.Open(Staging, "1/data.ndjson")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	_, err = f.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	b, err = ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, data[len(data)-10:], b)
+	_, err = f.Seek(5, io.SeekStart)
+	assert.NoError(t, err)
+	b = make([]byte, 5)
+	_, err = io.ReadFull(f, b)
+	assert.NoError(t, err)
+	assert.Equal(t, data[5:10], b)
+	assert.NoError(t, f.Close())
+
+	// Creating a file again replaces it
+	for _, contents := range []string{"first\n", "first\nsecond\n"} {
+		w, err = s.Create(Staging, "1/data-error.ndjson")
+		assert.NoError(t, err)
+		_, err = io.WriteString(w, contents)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+	assertContents(t, s, Staging, "1/data-error.ndjson", "first\nsecond\n")
+
+	w, err = s.Create(Staging, "1/nested/empty.ndjson")
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assertContents(t, s, Staging, "1/nested/empty.ndjson", "")
+
+	names, err := s.List(Staging, "1")
+	assert.NoError(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"1/data-error.ndjson", "1/data.ndjson", "1/nested/empty.ndjson"}, names)
+
+	names, err = s.List(Staging, "2")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	assert.NoError(t, MoveAll(s, Staging, Payload, "1"))
+	assertContents(t, s, Payload, "1/data.ndjson", string(data))
+	assertContents(t, s, Payload, "1/data-error.ndjson", "first\nsecond\n")
+	names, err = s.List(Staging, "1")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	// Moving the directory again does nothing
+	assert.NoError(t, MoveAll(s, Staging, Payload, "1"))
+
+	assert.NoError(t, s.Remove(Payload, "1/data-error.ndjson"))
+	_, err = s.Stat(Payload, "1/data-error.ndjson")
+	assert.True(t, os.IsNotExist(err))
+	_, err = s.Open(Payload, "1/data-error.ndjson")
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(s.Move(Payload, Archive, "1/data-error.ndjson")))
+
+	assert.NoError(t, s.RemoveAll(Payload, "1"))
+	names, err = s.List(Payload, "1")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	assert.NoError(t, s.RemoveAll(Payload, "1"))
+	assert.Error(t, s.RemoveAll(Payload, "/"))
+}
+
+func assertContents(t *testing.T, s Storage, area Area, name, expected string) {
+	f, err := s.Open(area, name)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(b))
+}
+
+// fakeS3 implements the subset of the S3 API, addressed by path, used by S3 storage
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte // parts of the multipart uploads in progress, keyed by upload ID
+	// maxSingleSize, if set, is the size of the largest object that can be uploaded or copied in a single request
+	maxSingleSize int
+	partRequests  int
+	failParts     bool // parts are rejected
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+// s3Error responds with an S3 error document
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		s3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		s.list(w, r, parts[0])
+		return
+	}
+	key := r.URL.Path
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok || query.Get("uploadId") != "" {
+		s.multipart(w, r, key)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, ok := s.readData(w, r)
+		if !ok {
+			return
+		}
+		if s.maxSingleSize > 0 && len(data) > s.maxSingleSize {
+			s3Error(w, http.StatusBadRequest, "EntityTooLarge")
+			return
+		}
+		s.objects[key] = data
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>&quot;%x&quot;</ETag></CopyObjectResult>", md5.Sum(data))
+		}
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			if err != nil || start >= len(data) {
+				s3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[start:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// readData returns the data being uploaded, or the range of the object being copied. Uploads must include the MD5 and
+// SHA-256 digests of their data, which are verified.
+func (s *fakeS3) readData(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+		srcKey, err := url.PathUnescape(src)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return nil, false
+		}
+		data, ok := s.objects["/"+srcKey]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return nil, false
+		}
+		if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end >= len(data) {
+				s3Error(w, http.StatusBadRequest, "InvalidRange")
+				return nil, false
+			}
+			data = data[start : end+1]
+		}
+		return data, true
+	}
+
+	if r.ContentLength < 0 {
+		s3Error(w, http.StatusLengthRequired, "MissingContentLength")
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return nil, false
+	}
+
+	md5Sum := md5.Sum(data)
+	if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(md5Sum[:]) {
+		s3Error(w, http.StatusBadRequest, "BadDigest")
+		return nil, false
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != fmt.Sprintf("%x", sha256.Sum256(data)) {
+		s3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return nil, false
+	}
+	return data, true
+}
+
+// completeMultipartUpload is the body of a CompleteMultipartUpload request
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+// multipart responds to the requests that create, upload or copy parts of, complete and abort multipart uploads
+func (s *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	if uploadID == "" {
+		uploadID = uuid.NewRandom().String()
+		s.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+		return
+	}
+
+	upload, ok := s.uploads[uploadID]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		if s.failParts {
+			s3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		data, ok := s.readData(w, r)
+		if !ok {
+			return
+		}
+		s.partRequests++
+		upload[n] = data
+		etag := fmt.Sprintf(`"%x"`, md5.Sum(data))
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", html.EscapeString(etag))
+			return
+		}
+		w.Header().Set("ETag", etag)
+	case http.MethodPost:
+		var complete completeMultipartUpload
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for _, p := range complete.Parts {
+			if fmt.Sprintf(`"%x"`, md5.Sum(upload[p.PartNumber])) != p.ETag {
+				// Failures after the request has been accepted are reported in the body of a successful response
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>InvalidPart</Message></Error>")
+				return
+			}
+			data = append(data, upload[p.PartNumber]...)
+		}
+		s.objects[key] = data
+		delete(s.uploads, uploadID)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case http.MethodDelete:
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// listBucketResult is the response to a ListObjectsV2 request
+type listBucketResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+// list responds to a ListObjectsV2 request, returning at most two keys per page to exercise pagination
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for k := range s.objects {
+		key := strings.TrimPrefix(k, "/"+bucket+"/")
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := start + 2
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	var result listBucketResult
+	for _, k := range keys[start:end] {
+		result.Contents = append(result.Contents, struct{ Key string }{k})
+	}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(result); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	_, _ = w.Write(buf.Bytes())
+}
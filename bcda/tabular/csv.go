@@ -0,0 +1,45 @@
+package tabular
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// csvWriter writes the table as CSV with a header row of column names. Missing values are empty.
+type csvWriter struct {
+	w          *csv.Writer
+	header     []string
+	wroteFirst bool
+}
+
+func newCSVWriter(w io.Writer, t *Table) *csvWriter {
+	header := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		header[i] = c.Name
+	}
+	return &csvWriter{w: csv.NewWriter(w), header: header}
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.wroteFirst {
+		return nil
+	}
+	c.wroteFirst = true
+	return c.w.Write(c.header)
+}
+
+func (c *csvWriter) Write(row []string) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.w.Write(row)
+}
+
+// Close writes the header of a table without rows, so that every file describes its columns
+func (c *csvWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,65 @@
+// Package tabular flattens FHIR resources into tables that can be loaded without FHIR tooling, and writes the tables
+// as CSV or Parquet files. The tables and their columns are described in README.md.
+package tabular
+
+import (
+	"io"
+	"path"
+)
+
+// Format is a tabular file format. The empty format is NDJSON, which is not tabular.
+type Format string
+
+const (
+	CSV     Format = "csv"
+	Parquet Format = "parquet"
+)
+
+// ContentType returns the media type of the format's files
+func (f Format) ContentType() string {
+	switch f {
+	case CSV:
+		return "text/csv"
+	case Parquet:
+		return "application/vnd.apache.parquet"
+	default:
+		return "application/fhir+ndjson"
+	}
+}
+
+// FileExtension returns the extension of the format's files, e.g. .csv
+func (f Format) FileExtension() string {
+	switch f {
+	case CSV, Parquet:
+		return "." + string(f)
+	default:
+		return ".ndjson"
+	}
+}
+
+// FormatOf returns the format of the named file, based on its extension
+func FormatOf(fileName string) Format {
+	switch path.Ext(fileName) {
+	case CSV.FileExtension():
+		return CSV
+	case Parquet.FileExtension():
+		return Parquet
+	default:
+		return ""
+	}
+}
+
+// Writer writes the rows of a table. Each row has a value for each of the table's columns; empty values are missing.
+type Writer interface {
+	Write(row []string) error
+	// Close finishes the file. It does not close the underlying writer.
+	Close() error
+}
+
+// NewWriter returns a writer of the table's rows to w in the format
+func NewWriter(f Format, w io.Writer, t *Table) Writer {
+	if f == Parquet {
+		return newParquetWriter(w, t)
+	}
+	return newCSVWriter(w, t)
+}
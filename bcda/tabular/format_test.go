@@ -0,0 +1,46 @@
+package tabular
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTable = &Table{
+	Name: "test",
+	Columns: []Column{
+		{Name: "id"},
+		{Name: "amount", Type: Number},
+	},
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "text/csv", CSV.ContentType())
+	assert.Equal(t, "application/vnd.apache.parquet", Parquet.ContentType())
+	assert.Equal(t, "application/fhir+ndjson", Format("").ContentType())
+
+	assert.Equal(t, ".csv", CSV.FileExtension())
+	assert.Equal(t, ".parquet", Parquet.FileExtension())
+	assert.Equal(t, ".ndjson", Format("").FileExtension())
+
+	assert.Equal(t, CSV, FormatOf("1/abc-eob_line.csv"))
+	assert.Equal(t, Parquet, FormatOf("abc.parquet"))
+	assert.Equal(t, Format(""), FormatOf("abc.ndjson"))
+	assert.Equal(t, Format(""), FormatOf("abc-error.ndjson"))
+}
+
+func TestCSVWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(CSV, &buf, testTable)
+	assert.NoError(t, w.Write([]string{"a", "1.5"}))
+	assert.NoError(t, w.Write([]string{"b,\"c\"", ""}))
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "id,amount\na,1.5\n\"b,\"\"c\"\"\",\n", buf.String())
+
+	// Files of empty tables still have a header
+	buf.Reset()
+	w = NewWriter(CSV, &buf, testTable)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "id,amount\n", buf.String())
+}
@@ -0,0 +1,344 @@
+package tabular
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Parquet files are written in row groups of about parquetRowGroupSize bytes, each holding one uncompressed,
+// PLAIN-encoded data page per column. Every column is OPTIONAL, and missing values are null. String columns are UTF-8 BYTE_ARRAYs and number columns are
+// DOUBLEs. The file's metadata is encoded with Thrift's compact protocol, as the format requires; see
+// https://github.com/apache/parquet-format.
+const parquetMagic = "PAR1"
+
+// parquetRowGroupSize bounds the size of the rows held in memory: once the rows' values and definition levels take more
+// than this many bytes, they're written as a row group
+const parquetRowGroupSize = 16 << 20
+
+// Values from parquet.thrift
+const (
+	parquetTypeDouble    = 5
+	parquetTypeByteArray = 6
+
+	parquetRepetitionOptional = 1
+
+	parquetConvertedUTF8 = 0
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+
+	parquetCodecUncompressed = 0
+	parquetPageData          = 0
+)
+
+// parquetWriter holds the rows of the current row group in memory, since each of its columns is written in full, and
+// writes the row group once it reaches the size bound. The file's metadata, which describes every row group, is
+// written on Close.
+type parquetWriter struct {
+	w            *countingWriter
+	table        *Table
+	rowGroupSize int
+	columns      []parquetColumn
+	rows         int // in the current row group
+	size         int // of the current row group's values and definition levels
+	totalRows    int
+	rowGroups    thriftList
+}
+
+// parquetColumn holds the encoded values and definition levels of a column
+type parquetColumn struct {
+	values  bytes.Buffer
+	defined []bool
+}
+
+func newParquetWriter(w io.Writer, t *Table) *parquetWriter {
+	return &parquetWriter{w: &countingWriter{w: w}, table: t, rowGroupSize: parquetRowGroupSize,
+		columns: make([]parquetColumn, len(t.Columns))}
+}
+
+// Write adds the row to the current row group. A value of a number column that isn't a number is an error, and the row
+// isn't added.
+func (p *parquetWriter) Write(row []string) error {
+	for i, c := range p.table.Columns {
+		if c.Type == Number && row[i] != "" {
+			if _, err := strconv.ParseFloat(row[i], 64); err != nil {
+				return fmt.Errorf("%s of %s must be a number: %q", c.Name, p.table.Name, row[i])
+			}
+		}
+	}
+
+	if p.w.n == 0 {
+		if _, err := io.WriteString(p.w, parquetMagic); err != nil {
+			return err
+		}
+	}
+
+	for i, c := range p.table.Columns {
+		col := &p.columns[i]
+		v := row[i]
+		if v == "" {
+			col.defined = append(col.defined, false)
+			continue
+		}
+
+		if c.Type == Number {
+			// The value has already been parsed successfully
+			f, _ := strconv.ParseFloat(v, 64)
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+			col.values.Write(b[:])
+			p.size += len(b)
+		} else {
+			var n [4]byte
+			binary.LittleEndian.PutUint32(n[:], uint32(len(v)))
+			col.values.Write(n[:])
+			col.values.WriteString(v)
+			p.size += len(n) + len(v)
+		}
+		col.defined = append(col.defined, true)
+	}
+	p.size += len(p.columns)
+	p.rows++
+
+	if p.size >= p.rowGroupSize {
+		return p.writeRowGroup()
+	}
+	return nil
+}
+
+// writeRowGroup writes the current row group's column chunks and records their metadata
+func (p *parquetWriter) writeRowGroup() error {
+	var chunks thriftList
+	var totalSize int64
+	for i, c := range p.table.Columns {
+		offset := p.w.n
+		if err := p.writePage(p.w, &p.columns[i]); err != nil {
+			return err
+		}
+		size := p.w.n - offset
+		totalSize += size
+
+		chunks = append(chunks, thriftStruct{
+			{2, thriftI64(offset)},
+			{3, thriftStruct{
+				{1, thriftI32(parquetType(c.Type))},
+				{2, thriftList{thriftI32(parquetEncodingPlain), thriftI32(parquetEncodingRLE)}},
+				{3, thriftList{thriftBinary(c.Name)}},
+				{4, thriftI32(parquetCodecUncompressed)},
+				{5, thriftI64(p.rows)},
+				{6, thriftI64(size)},
+				{7, thriftI64(size)},
+				{9, thriftI64(offset)},
+			}},
+		})
+		p.columns[i] = parquetColumn{}
+	}
+
+	p.rowGroups = append(p.rowGroups, thriftStruct{
+		{1, chunks},
+		{2, thriftI64(totalSize)},
+		{3, thriftI64(p.rows)},
+	})
+	p.totalRows += p.rows
+	p.rows, p.size = 0, 0
+	return nil
+}
+
+func (p *parquetWriter) Close() error {
+	if p.w.n == 0 {
+		if _, err := io.WriteString(p.w, parquetMagic); err != nil {
+			return err
+		}
+	}
+	if p.rows > 0 {
+		if err := p.writeRowGroup(); err != nil {
+			return err
+		}
+	}
+
+	schema := thriftList{thriftStruct{
+		{4, thriftBinary("schema")},
+		{5, thriftI32(len(p.table.Columns))},
+	}}
+	for _, c := range p.table.Columns {
+		element := thriftStruct{
+			{1, thriftI32(parquetType(c.Type))},
+			{3, thriftI32(parquetRepetitionOptional)},
+			{4, thriftBinary(c.Name)},
+		}
+		if c.Type != Number {
+			element = append(element, thriftField{6, thriftI32(parquetConvertedUTF8)})
+		}
+		schema = append(schema, element)
+	}
+
+	metadata := thriftStruct{
+		{1, thriftI32(1)},
+		{2, schema},
+		{3, thriftI64(p.totalRows)},
+		{4, p.rowGroups},
+		{6, thriftBinary("bcda")},
+	}
+	var buf bytes.Buffer
+	metadata.encode(&buf)
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(buf.Len()))
+	buf.Write(footer[:])
+	buf.WriteString(parquetMagic)
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
+
+// writePage writes the column's data page: its header, followed by the definition levels and the values
+func (p *parquetWriter) writePage(w io.Writer, col *parquetColumn) error {
+	levels := encodeDefinitionLevels(col.defined)
+	var data bytes.Buffer
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(levels)))
+	data.Write(n[:])
+	data.Write(levels)
+	data.Write(col.values.Bytes())
+
+	header := thriftStruct{
+		{1, thriftI32(parquetPageData)},
+		{2, thriftI32(data.Len())},
+		{3, thriftI32(data.Len())},
+		{5, thriftStruct{
+			{1, thriftI32(p.rows)},
+			{2, thriftI32(parquetEncodingPlain)},
+			{3, thriftI32(parquetEncodingRLE)},
+			{4, thriftI32(parquetEncodingRLE)},
+		}},
+	}
+	var buf bytes.Buffer
+	header.encode(&buf)
+	buf.Write(data.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// encodeDefinitionLevels encodes the levels (1 for a value, 0 for null) as runs of the RLE/bit-packing hybrid encoding
+// with a bit width of 1
+func encodeDefinitionLevels(defined []bool) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(defined); {
+		j := i
+		for j < len(defined) && defined[j] == defined[i] {
+			j++
+		}
+		writeUvarint(&buf, uint64(j-i)<<1)
+		if defined[i] {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
+
+func parquetType(t ColumnType) int {
+	if t == Number {
+		return parquetTypeDouble
+	}
+	return parquetTypeByteArray
+}
+
+// countingWriter tracks the offset of the next byte written, which the file's metadata refers to
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// The few Thrift types needed to encode the file's metadata with the compact protocol
+type (
+	thriftValue interface {
+		thriftType() byte
+		encode(*bytes.Buffer)
+	}
+	thriftI32    int32
+	thriftI64    int64
+	thriftBinary string
+	thriftList   []thriftValue
+	thriftStruct []thriftField
+	thriftField  struct {
+		id    int16
+		value thriftValue
+	}
+)
+
+// Compact protocol type IDs
+const (
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+func (thriftI32) thriftType() byte    { return thriftTypeI32 }
+func (thriftI64) thriftType() byte    { return thriftTypeI64 }
+func (thriftBinary) thriftType() byte { return thriftTypeBinary }
+func (thriftList) thriftType() byte   { return thriftTypeList }
+func (thriftStruct) thriftType() byte { return thriftTypeStruct }
+
+func (v thriftI32) encode(buf *bytes.Buffer) { writeZigzag(buf, int64(v)) }
+func (v thriftI64) encode(buf *bytes.Buffer) { writeZigzag(buf, int64(v)) }
+
+func (v thriftBinary) encode(buf *bytes.Buffer) {
+	writeUvarint(buf, uint64(len(v)))
+	buf.WriteString(string(v))
+}
+
+// encode writes the list's header, which includes the type of its elements, and its elements. An empty list is
+// written as a list of structs.
+func (v thriftList) encode(buf *bytes.Buffer) {
+	elemType := byte(thriftTypeStruct)
+	if len(v) > 0 {
+		elemType = v[0].thriftType()
+	}
+	if len(v) < 15 {
+		buf.WriteByte(byte(len(v))<<4 | elemType)
+	} else {
+		buf.WriteByte(0xf0 | elemType)
+		writeUvarint(buf, uint64(len(v)))
+	}
+	for _, e := range v {
+		e.encode(buf)
+	}
+}
+
+// encode writes the struct's fields, which must be in increasing order of their IDs, followed by a stop field
+func (v thriftStruct) encode(buf *bytes.Buffer) {
+	var last int16
+	for _, f := range v {
+		if delta := f.id - last; delta > 0 && delta <= 15 {
+			buf.WriteByte(byte(delta)<<4 | f.value.thriftType())
+		} else {
+			buf.WriteByte(f.value.thriftType())
+			writeZigzag(buf, int64(f.id))
+		}
+		f.value.encode(buf)
+		last = f.id
+	}
+	buf.WriteByte(0)
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeZigzag(buf *bytes.Buffer, v int64) {
+	writeUvarint(buf, uint64((v<<1)^(v>>63)))
+}
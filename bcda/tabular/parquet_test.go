@@ -0,0 +1,284 @@
+package tabular
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+func TestParquetWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(Parquet, &buf, testTable)
+	require.NoError(t, w.Write([]string{"a", "1.5"}))
+	require.NoError(t, w.Write([]string{"", "2"}))
+	// Rows with numbers that aren't numbers are rejected
+	assert.EqualError(t, w.Write([]string{"b", "not a number"}), `amount of test must be a number: "not a number"`)
+	require.NoError(t, w.Write([]string{"c", ""}))
+	require.NoError(t, w.Close())
+
+	file := buf.Bytes()
+	metadata := readParquetMetadata(t, file)
+	assert.Equal(t, int64(3), metadata[3])
+
+	schema := metadata[2].([]interface{})
+	require.Len(t, schema, 3)
+	assert.Equal(t, "id", schema[1].(thriftFields)[4])
+	assert.Equal(t, int64(parquetTypeByteArray), schema[1].(thriftFields)[1])
+	assert.Equal(t, "amount", schema[2].(thriftFields)[4])
+	assert.Equal(t, int64(parquetTypeDouble), schema[2].(thriftFields)[1])
+
+	rowGroups := metadata[4].([]interface{})
+	require.Len(t, rowGroups, 1)
+	chunks := rowGroups[0].(thriftFields)[1].([]interface{})
+	require.Len(t, chunks, 2)
+
+	defined, values := readParquetPage(t, file, chunks[0].(thriftFields))
+	assert.Equal(t, []bool{true, false, true}, defined)
+	assert.Equal(t, []byte("\x01\x00\x00\x00a\x01\x00\x00\x00c"), values)
+
+	defined, values = readParquetPage(t, file, chunks[1].(thriftFields))
+	assert.Equal(t, []bool{true, true, false}, defined)
+	require.Len(t, values, 16)
+	assert.Equal(t, 1.5, math.Float64frombits(binary.LittleEndian.Uint64(values[:8])))
+	assert.Equal(t, 2.0, math.Float64frombits(binary.LittleEndian.Uint64(values[8:])))
+}
+
+func TestParquetWriterRowGroups(t *testing.T) {
+	var buf bytes.Buffer
+	w := newParquetWriter(&buf, testTable)
+	w.rowGroupSize = 100
+	for i := 0; i < 25; i++ {
+		require.NoError(t, w.Write([]string{strconv.Itoa(i), strconv.Itoa(i)}))
+	}
+	require.NoError(t, w.Close())
+
+	file := buf.Bytes()
+	metadata := readParquetMetadata(t, file)
+	assert.Equal(t, int64(25), metadata[3])
+
+	// Each row takes 5 or 6 bytes for the id and its length, 8 for the amount, and a byte for each definition level, so
+	// a row group is written every 7 rows
+	rowGroups := metadata[4].([]interface{})
+	require.Len(t, rowGroups, 4)
+	var ids []byte
+	for i, rowGroup := range rowGroups {
+		rows := 7
+		if i == 3 {
+			rows = 4
+		}
+		assert.Equal(t, int64(rows), rowGroup.(thriftFields)[3])
+
+		chunks := rowGroup.(thriftFields)[1].([]interface{})
+		require.Len(t, chunks, 2)
+		defined, values := readParquetPage(t, file, chunks[0].(thriftFields))
+		assert.Len(t, defined, rows)
+		ids = append(ids, values...)
+		_, values = readParquetPage(t, file, chunks[1].(thriftFields))
+		assert.Len(t, values, 8*rows)
+	}
+
+	var expected bytes.Buffer
+	for i := 0; i < 25; i++ {
+		id := strconv.Itoa(i)
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(len(id)))
+		expected.Write(n[:])
+		expected.WriteString(id)
+	}
+	assert.Equal(t, expected.Bytes(), ids)
+}
+
+// TestParquetWriterGolden compares the writer's output with testdata/rows.parquet, so that changes to the file's
+// encoding are deliberate. If the output changes on purpose, the file must be regenerated with writeGoldenParquet.
+func TestParquetWriterGolden(t *testing.T) {
+	var buf bytes.Buffer
+	writeGoldenParquet(t, &buf)
+
+	golden, err := ioutil.ReadFile("testdata/rows.parquet")
+	require.NoError(t, err)
+	assert.Equal(t, golden, buf.Bytes())
+}
+
+// writeGoldenParquet writes the rows of testdata/rows.parquet, in row groups of 5, 4 and 1 rows
+func writeGoldenParquet(t *testing.T, buf *bytes.Buffer) {
+	w := newParquetWriter(buf, testTable)
+	w.rowGroupSize = 40
+	for _, row := range [][]string{
+		{"a", "1.5"},
+		{"", "2"},
+		{"c", ""},
+		{"d", ""},
+		{"é", "-0.25"},
+		{"", ""},
+		{"g", "1e3"},
+		{"h", "7"},
+		{"long value of i", "9"},
+		{"j", "10"},
+	} {
+		require.NoError(t, w.Write(row))
+	}
+	require.NoError(t, w.Close())
+}
+
+// TestParquetWriterReader reads the rows of testdata/rows.parquet with github.com/xitongsys/parquet-go, a reader that
+// doesn't share this package's code
+func TestParquetWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	writeGoldenParquet(t, &buf)
+
+	r, err := reader.NewParquetColumnReader(&parquetFile{Reader: bytes.NewReader(buf.Bytes())}, 1)
+	require.NoError(t, err)
+	defer r.ReadStop()
+	assert.Equal(t, int64(10), r.GetNumRows())
+	assert.Len(t, r.Footer.RowGroups, 3)
+
+	ids, _, defined, err := r.ReadColumnByIndex(0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", nil, "c", "d", "é", nil, "g", "h", "long value of i", "j"}, ids)
+	assert.Equal(t, []int32{1, 0, 1, 1, 1, 0, 1, 1, 1, 1}, defined)
+
+	amounts, _, defined, err := r.ReadColumnByIndex(1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{1.5, 2.0, nil, nil, -0.25, nil, 1000.0, 7.0, 9.0, 10.0}, amounts)
+	assert.Equal(t, []int32{1, 1, 0, 0, 1, 0, 1, 1, 1, 1}, defined)
+}
+
+// parquetFile is a source.ParquetFile that reads a file in memory
+type parquetFile struct {
+	*bytes.Reader
+}
+
+func (f *parquetFile) Open(name string) (source.ParquetFile, error) {
+	r := *f.Reader
+	return &parquetFile{Reader: &r}, nil
+}
+
+func (f *parquetFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("read only")
+}
+
+func (f *parquetFile) Write(p []byte) (int, error) { return 0, errors.New("read only") }
+
+func (f *parquetFile) Close() error { return nil }
+
+func TestParquetWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(Parquet, &buf, testTable)
+	require.NoError(t, w.Close())
+
+	metadata := readParquetMetadata(t, buf.Bytes())
+	assert.Equal(t, int64(0), metadata[3])
+	assert.Len(t, metadata[2], 3)
+	assert.Len(t, metadata[4], 0)
+}
+
+// readParquetMetadata checks the file's magic numbers and decodes its metadata
+func readParquetMetadata(t *testing.T, file []byte) thriftFields {
+	require.True(t, len(file) > 12)
+	assert.Equal(t, parquetMagic, string(file[:4]))
+	assert.Equal(t, parquetMagic, string(file[len(file)-4:]))
+
+	length := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	r := bytes.NewReader(file[len(file)-8-length : len(file)-8])
+	metadata := readThriftStruct(t, r)
+	assert.Equal(t, 0, r.Len())
+	return metadata
+}
+
+// readParquetPage decodes the column chunk's data page, returning its definition levels and its encoded values
+func readParquetPage(t *testing.T, file []byte, chunk thriftFields) ([]bool, []byte) {
+	offset := chunk[3].(thriftFields)[9].(int64)
+	r := bytes.NewReader(file[offset:])
+	header := readThriftStruct(t, r)
+	size := int(header[2].(int64))
+	numValues := int(header[5].(thriftFields)[1].(int64))
+
+	data := make([]byte, size)
+	_, err := r.Read(data)
+	require.NoError(t, err)
+
+	levelsLength := int(binary.LittleEndian.Uint32(data))
+	levels := bytes.NewReader(data[4 : 4+levelsLength])
+	var defined []bool
+	for levels.Len() > 0 {
+		run, err := binary.ReadUvarint(levels)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), run&1, "bit-packed runs are not written")
+		value, err := levels.ReadByte()
+		require.NoError(t, err)
+		for i := uint64(0); i < run>>1; i++ {
+			defined = append(defined, value == 1)
+		}
+	}
+	assert.Len(t, defined, numValues)
+	return defined, data[4+levelsLength:]
+}
+
+// thriftFields is a decoded struct's fields, keyed by ID. Integers are decoded as int64, binaries as strings and lists as
+// []interface{}.
+type thriftFields map[int16]interface{}
+
+func readThriftStruct(t *testing.T, r *bytes.Reader) thriftFields {
+	fields := make(thriftFields)
+	var id int16
+	for {
+		b, err := r.ReadByte()
+		require.NoError(t, err)
+		if b == 0 {
+			return fields
+		}
+		if delta := int16(b >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(readThriftInt(t, r))
+		}
+		fields[id] = readThriftValue(t, r, b&0x0f)
+	}
+}
+
+func readThriftValue(t *testing.T, r *bytes.Reader, thriftType byte) interface{} {
+	switch thriftType {
+	case thriftTypeI32, thriftTypeI64:
+		return readThriftInt(t, r)
+	case thriftTypeBinary:
+		n, err := binary.ReadUvarint(r)
+		require.NoError(t, err)
+		b := make([]byte, n)
+		_, err = r.Read(b)
+		require.NoError(t, err)
+		return string(b)
+	case thriftTypeList:
+		b, err := r.ReadByte()
+		require.NoError(t, err)
+		n := uint64(b >> 4)
+		if n == 15 {
+			n, err = binary.ReadUvarint(r)
+			require.NoError(t, err)
+		}
+		list := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			list = append(list, readThriftValue(t, r, b&0x0f))
+		}
+		return list
+	case thriftTypeStruct:
+		return readThriftStruct(t, r)
+	default:
+		require.FailNow(t, "unexpected thrift type", "%d", thriftType)
+		return nil
+	}
+}
+
+func readThriftInt(t *testing.T, r *bytes.Reader) int64 {
+	v, err := binary.ReadVarint(r)
+	require.NoError(t, err)
+	return v
+}
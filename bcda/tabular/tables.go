@@ -0,0 +1,370 @@
+package tabular
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// ColumnType is the type of a column's values
+type ColumnType int
+
+const (
+	String ColumnType = iota
+	Number
+)
+
+// Column is a column of a table. Its value is found in the resource or, for tables with a row per line, in the line.
+type Column struct {
+	Name  string
+	Type  ColumnType
+	value func(r row) string
+}
+
+// Table is a table of values flattened from resources of a single type
+type Table struct {
+	Name    string
+	Columns []Column
+	// lines returns the elements of the resource that each have a row, e.g. the items of an ExplanationOfBenefit. Tables
+	// without lines have a row per resource.
+	lines func(resource map[string]interface{}) []interface{}
+}
+
+// Resource is a FHIR resource decoded from JSON. Numbers are decoded as json.Number so they keep their precision.
+type Resource map[string]interface{}
+
+// row is the resource, and line if the table has lines, that a row's values are found in
+type row struct {
+	resource map[string]interface{}
+	line     interface{}
+}
+
+// Parse decodes a FHIR resource
+func Parse(resource []byte) (Resource, error) {
+	d := json.NewDecoder(bytes.NewReader(resource))
+	d.UseNumber()
+	var r Resource
+	if err := d.Decode(&r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rows returns the table's rows for the resource
+func (t *Table) Rows(resource Resource) [][]string {
+	var rows []row
+	if t.lines == nil {
+		rows = []row{{resource: resource}}
+	} else {
+		for _, l := range t.lines(resource) {
+			rows = append(rows, row{resource: resource, line: l})
+		}
+	}
+
+	values := make([][]string, len(rows))
+	for i, r := range rows {
+		values[i] = make([]string, len(t.Columns))
+		for j, c := range t.Columns {
+			values[i][j] = c.value(r)
+		}
+	}
+	return values
+}
+
+// Tables returns the tables that resources of the type are flattened into, or nil if the type has none. The first table
+// is the type's main table, which has a row per resource.
+func Tables(resourceType string) []*Table {
+	switch resourceType {
+	case "Patient":
+		return []*Table{patientTable}
+	case "Coverage":
+		return []*Table{coverageTable}
+	case "ExplanationOfBenefit":
+		return []*Table{eobTable, eobLineTable}
+	default:
+		return nil
+	}
+}
+
+// AllTables returns every table, in the order they're documented
+func AllTables() []*Table {
+	return []*Table{patientTable, coverageTable, eobTable, eobLineTable}
+}
+
+const (
+	bbVariables  = "https://bluebutton.cms.gov/resources/variables/"
+	mbiSystem    = "http://hl7.org/fhir/sid/us-mbi"
+	claimGroupID = "https://bluebutton.cms.gov/resources/identifier/claim-group"
+	eobType      = "https://bluebutton.cms.gov/resources/codesystem/eob-type"
+)
+
+// The columns of each table are documented in README.md. Paths that differ between FHIR STU3 (v1) and R4 (v2) are
+// both tried.
+
+var patientTable = &Table{
+	Name: "patient",
+	Columns: []Column{
+		{Name: "patient_id", value: field("id")},
+		{Name: "mbi", value: identifier(mbiSystem)},
+		{Name: "family_name", value: field("name", "family")},
+		{Name: "given_name", value: field("name", "given")},
+		{Name: "gender", value: field("gender")},
+		{Name: "birth_date", value: field("birthDate")},
+		{Name: "death_date", value: field("deceasedDateTime")},
+		{Name: "state_code", value: field("address", "state")},
+		{Name: "county_code", value: field("address", "district")},
+		{Name: "postal_code", value: field("address", "postalCode")},
+		{Name: "race_code", value: extension(bbVariables + "race")},
+	},
+}
+
+var coverageTable = &Table{
+	Name: "coverage",
+	Columns: []Column{
+		{Name: "coverage_id", value: field("id")},
+		{Name: "patient_id", value: reference("beneficiary")},
+		{Name: "status", value: field("status")},
+		{Name: "plan", value: coveragePlan},
+		{Name: "period_start", value: field("period", "start")},
+		{Name: "period_end", value: field("period", "end")},
+		{Name: "medicare_status_code", value: extension(bbVariables + "ms_cd")},
+		{Name: "original_entitlement_reason_code", value: extension(bbVariables + "orec")},
+		{Name: "current_entitlement_reason_code", value: extension(bbVariables + "crec")},
+		{Name: "esrd_indicator", value: extension(bbVariables + "esrd_ind")},
+		{Name: "part_a_termination_code", value: extension(bbVariables + "a_trm_cd")},
+		{Name: "part_b_termination_code", value: extension(bbVariables + "b_trm_cd")},
+	},
+}
+
+var eobTable = &Table{
+	Name: "eob",
+	Columns: []Column{
+		{Name: "eob_id", value: field("id")},
+		{Name: "patient_id", value: reference("patient")},
+		{Name: "claim_id", value: identifier(bbVariables + "clm_id")},
+		{Name: "claim_group_id", value: identifier(claimGroupID)},
+		{Name: "claim_type", value: claimType},
+		{Name: "nch_claim_type_code", value: coding(bbVariables+"nch_clm_type_cd", "type", "coding")},
+		{Name: "status", value: field("status")},
+		{Name: "billable_period_start", value: field("billablePeriod", "start")},
+		{Name: "billable_period_end", value: field("billablePeriod", "end")},
+		{Name: "payment_amount", Type: Number, value: field("payment", "amount", "value")},
+		{Name: "provider_npi", value: field("provider", "identifier", "value")},
+		{Name: "coverage_id", value: reference("insurance", "coverage")},
+		{Name: "principal_diagnosis_code", value: principalDiagnosis},
+		{Name: "diagnosis_codes", value: diagnoses},
+	},
+}
+
+var eobLineTable = &Table{
+	Name: "eob_line",
+	Columns: []Column{
+		{Name: "eob_id", value: field("id")},
+		{Name: "patient_id", value: reference("patient")},
+		{Name: "claim_id", value: identifier(bbVariables + "clm_id")},
+		{Name: "claim_type", value: claimType},
+		{Name: "line_number", value: lineField("sequence")},
+		{Name: "service_code", value: lineField("service|productOrService", "coding", "code")},
+		{Name: "service_modifiers", value: lineList("modifier", "coding")},
+		{Name: "service_date_start", value: servicedDate("start")},
+		{Name: "service_date_end", value: servicedDate("end")},
+		{Name: "place_of_service_code", value: lineField("locationCodeableConcept", "coding", "code")},
+		{Name: "quantity", Type: Number, value: lineField("quantity", "value")},
+		{Name: "diagnosis_sequences", value: lineList("diagnosisLinkId|diagnosisSequence")},
+		{Name: "submitted_charge_amount", Type: Number, value: adjudication(bbVariables + "line_sbmtd_chrg_amt")},
+		{Name: "allowed_amount", Type: Number, value: adjudication(bbVariables + "line_alowd_chrg_amt")},
+		{Name: "payment_amount", Type: Number, value: adjudication(bbVariables + "line_nch_pmt_amt")},
+		{Name: "deductible_amount", Type: Number, value: adjudication(bbVariables + "line_bene_ptb_ddctbl_amt")},
+		{Name: "coinsurance_amount", Type: Number, value: adjudication(bbVariables + "line_coinsrnc_amt")},
+	},
+	lines: func(r map[string]interface{}) []interface{} {
+		return all(r, "item")
+	},
+}
+
+// field returns the first value found at the path in the resource
+func field(path ...string) func(r row) string {
+	return func(r row) string {
+		return str(first(all(r.resource, path...)))
+	}
+}
+
+// lineField returns the first value found at the path in the line
+func lineField(path ...string) func(r row) string {
+	return func(r row) string {
+		return str(first(all(r.line, path...)))
+	}
+}
+
+// lineList returns the values found at the path in the line, separated by |. Codings are represented by their code.
+func lineList(path ...string) func(r row) string {
+	return func(r row) string {
+		var values []string
+		for _, v := range all(r.line, path...) {
+			if m, ok := v.(map[string]interface{}); ok {
+				v = first(all(m, "code"))
+			}
+			if s := str(v); s != "" {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, "|")
+	}
+}
+
+// identifier returns the value of the resource's identifier in the system
+func identifier(system string) func(r row) string {
+	return func(r row) string {
+		return str(first(all(first(where(all(r.resource, "identifier"), "system", system)), "value")))
+	}
+}
+
+// coding returns the code of the coding in the system found at the path in the resource
+func coding(system string, path ...string) func(r row) string {
+	return func(r row) string {
+		return str(first(all(first(where(all(r.resource, path...), "system", system)), "code")))
+	}
+}
+
+// extension returns the value of the resource's extension with the URL: its code, quantity or amount
+func extension(url string) func(r row) string {
+	return func(r row) string {
+		ext := first(where(all(r.resource, "extension"), "url", url))
+		return str(first(all(ext, "valueCoding|valueQuantity|valueMoney", "code|value")))
+	}
+}
+
+// reference returns the ID of the resource referred to by the reference at the path, e.g. 123 for Patient/123
+func reference(path ...string) func(r row) string {
+	path = append(path[:len(path):len(path)], "reference")
+	return func(r row) string {
+		ref := str(first(all(r.resource, path...)))
+		return ref[strings.LastIndex(ref, "/")+1:]
+	}
+}
+
+// adjudication returns the amount of the line's adjudication whose category has the code, e.g.
+// https://bluebutton.cms.gov/resources/variables/line_nch_pmt_amt
+func adjudication(code string) func(r row) string {
+	return func(r row) string {
+		for _, adj := range all(r.line, "adjudication") {
+			if len(where(all(adj, "category", "coding"), "code", code)) > 0 {
+				return str(first(all(adj, "amount", "value")))
+			}
+		}
+		return ""
+	}
+}
+
+// servicedDate returns the start or end of the line's service period, or its service date when it has one
+func servicedDate(end string) func(r row) string {
+	return func(r row) string {
+		if date := str(first(all(r.line, "servicedDate"))); date != "" {
+			return date
+		}
+		return str(first(all(r.line, "servicedPeriod", end)))
+	}
+}
+
+// claimType returns the lower case claim type of an ExplanationOfBenefit, e.g. carrier
+func claimType(r row) string {
+	return strings.ToLower(coding(eobType, "type", "coding")(r))
+}
+
+// coveragePlan returns the Medicare part of the coverage, e.g. Part A, which STU3 records as its sub-plan and R4 as
+// its plan class
+func coveragePlan(r row) string {
+	res := r.resource
+	if plan := str(first(all(res, "grouping", "subPlan"))); plan != "" {
+		return plan
+	}
+	for _, c := range all(res, "class") {
+		if len(where(all(c, "type", "coding"), "code", "plan")) > 0 {
+			return str(first(all(c, "value")))
+		}
+	}
+	return ""
+}
+
+// principalDiagnosis returns the code of the diagnosis whose type is principal
+func principalDiagnosis(r row) string {
+	for _, d := range all(r.resource, "diagnosis") {
+		if len(where(all(d, "type", "coding"), "code", "principal")) > 0 {
+			return str(first(all(d, "diagnosisCodeableConcept", "coding", "code")))
+		}
+	}
+	return ""
+}
+
+// diagnoses returns the first code of each of the diagnoses, separated by |
+func diagnoses(r row) string {
+	var codes []string
+	for _, d := range all(r.resource, "diagnosis") {
+		if code := str(first(all(d, "diagnosisCodeableConcept", "coding", "code"))); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return strings.Join(codes, "|")
+}
+
+// all returns the values found at the path, which passes through every element of any arrays along the way. Each
+// name in the path may list alternatives separated by |; the first one present is used.
+func all(v interface{}, path ...string) []interface{} {
+	if a, ok := v.([]interface{}); ok {
+		var values []interface{}
+		for _, e := range a {
+			values = append(values, all(e, path...)...)
+		}
+		return values
+	}
+	if v == nil {
+		return nil
+	}
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, name := range strings.Split(path[0], "|") {
+		if e, ok := m[name]; ok {
+			return all(e, path[1:]...)
+		}
+	}
+	return nil
+}
+
+// where returns the values whose element with the name has the value
+func where(values []interface{}, name, value string) []interface{} {
+	var matches []interface{}
+	for _, v := range values {
+		if m, ok := v.(map[string]interface{}); ok && str(m[name]) == value {
+			matches = append(matches, v)
+		}
+	}
+	return matches
+}
+
+func first(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// str returns the string form of a primitive value. Other values are missing, so they're empty.
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,171 @@
+package tabular
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticRows flattens the resources of the synthetic beneficiary's bundle into the table
+func syntheticRows(t *testing.T, bundle string, table *Table) [][]string {
+	data, err := ioutil.ReadFile("../../shared_files/synthetic_beneficiary_data/" + bundle)
+	require.NoError(t, err)
+	var b struct {
+		Entry []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	require.NoError(t, json.Unmarshal(data, &b))
+
+	var rows [][]string
+	for _, e := range b.Entry {
+		r, err := Parse(e.Resource)
+		require.NoError(t, err)
+		rows = append(rows, table.Rows(r)...)
+	}
+	return rows
+}
+
+// rowMap returns the row's values keyed by column name
+func rowMap(table *Table, row []string) map[string]string {
+	m := make(map[string]string)
+	for i, c := range table.Columns {
+		m[c.Name] = row[i]
+	}
+	return m
+}
+
+func TestPatientTable(t *testing.T) {
+	rows := syntheticRows(t, "Patient", patientTable)
+	require.Len(t, rows, 1)
+	assert.Equal(t, map[string]string{
+		"patient_id":  "20000000000001",
+		"mbi":         "-1Q03Z002871",
+		"family_name": "Doe",
+		"given_name":  "Jane",
+		"gender":      "female",
+		"birth_date":  "1999-06-01",
+		"death_date":  "",
+		"state_code":  "10",
+		"county_code": "999",
+		"postal_code": "99999",
+		"race_code":   "1",
+	}, rowMap(patientTable, rows[0]))
+}
+
+func TestCoverageTable(t *testing.T) {
+	rows := syntheticRows(t, "Coverage", coverageTable)
+	require.Len(t, rows, 3)
+	partA := rowMap(coverageTable, rows[0])
+	assert.Equal(t, "part-a-20000000000001", partA["coverage_id"])
+	assert.Equal(t, "20000000000001", partA["patient_id"])
+	assert.Equal(t, "active", partA["status"])
+	assert.Equal(t, "Part A", partA["plan"])
+	assert.Equal(t, "10", partA["medicare_status_code"])
+	assert.Equal(t, "0", partA["original_entitlement_reason_code"])
+	assert.Equal(t, "0", partA["esrd_indicator"])
+	assert.Equal(t, "0", partA["part_a_termination_code"])
+	assert.Equal(t, "", partA["part_b_termination_code"])
+}
+
+func TestCoverageTableR4(t *testing.T) {
+	r, err := Parse([]byte(`{"resourceType":"Coverage","id":"part-b-1","beneficiary":{"reference":"Patient/1"},
+		"period":{"start":"2020-01-01"},
+		"class":[{"type":{"coding":[{"code":"group"}]},"value":"Medicare"},
+			{"type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/coverage-class","code":"plan"}]},"value":"Part B"}]}`))
+	require.NoError(t, err)
+	row := rowMap(coverageTable, coverageTable.Rows(r)[0])
+	assert.Equal(t, "Part B", row["plan"])
+	assert.Equal(t, "1", row["patient_id"])
+	assert.Equal(t, "2020-01-01", row["period_start"])
+}
+
+func TestEOBTables(t *testing.T) {
+	rows := syntheticRows(t, "ExplanationOfBenefit", eobTable)
+	require.Len(t, rows, 33)
+	eob := rowMap(eobTable, rows[0])
+	assert.Equal(t, map[string]string{
+		"eob_id":                   "carrier-10300336722",
+		"patient_id":               "20000000000001",
+		"claim_id":                 "10300336722",
+		"claim_group_id":           "44077735787",
+		"claim_type":               "carrier",
+		"nch_claim_type_code":      "71",
+		"status":                   "active",
+		"billable_period_start":    "2000-10-01",
+		"billable_period_end":      "2000-10-01",
+		"payment_amount":           "250",
+		"provider_npi":             "",
+		"coverage_id":              "part-b-20000000000001",
+		"principal_diagnosis_code": "2113",
+		"diagnosis_codes":          "2113|9999999",
+	}, eob)
+
+	lines := syntheticRows(t, "ExplanationOfBenefit", eobLineTable)
+	require.Len(t, lines, 52)
+	line := rowMap(eobLineTable, lines[0])
+	assert.Equal(t, "carrier-10300336722", line["eob_id"])
+	assert.Equal(t, "10300336722", line["claim_id"])
+	assert.Equal(t, "carrier", line["claim_type"])
+	assert.Equal(t, "1", line["line_number"])
+	assert.Equal(t, "45384", line["service_code"])
+	assert.Equal(t, "2000-10-01", line["service_date_start"])
+	assert.Equal(t, "2000-10-01", line["service_date_end"])
+	assert.Equal(t, "99", line["place_of_service_code"])
+	assert.Equal(t, "1", line["quantity"])
+	assert.Equal(t, "2", line["diagnosis_sequences"])
+	assert.NotEmpty(t, line["payment_amount"])
+}
+
+func TestEOBTablesR4(t *testing.T) {
+	r, err := Parse([]byte(`{"resourceType":"ExplanationOfBenefit","id":"outpatient-1","patient":{"reference":"Patient/1"},
+		"type":{"coding":[{"system":"https://bluebutton.cms.gov/resources/codesystem/eob-type","code":"OUTPATIENT"}]},
+		"insurance":[{"focal":true,"coverage":{"reference":"Coverage/part-a-1"}}],
+		"provider":{"identifier":{"system":"http://hl7.org/fhir/sid/us-npi","value":"999999999"}},
+		"item":[{"sequence":1,"diagnosisSequence":[1,3],"productOrService":{"coding":[{"code":"99213"}]},
+			"modifier":[{"coding":[{"code":"25"}]},{"coding":[{"code":"59"}]}],"servicedDate":"2020-03-02",
+			"adjudication":[{"category":{"coding":[{"system":"https://bluebutton.cms.gov/resources/codesystem/adjudication",
+				"code":"https://bluebutton.cms.gov/resources/variables/line_alowd_chrg_amt"}]},"amount":{"value":12.34}}]},
+			{"sequence":2}]}`))
+	require.NoError(t, err)
+
+	eob := rowMap(eobTable, eobTable.Rows(r)[0])
+	assert.Equal(t, "outpatient", eob["claim_type"])
+	assert.Equal(t, "part-a-1", eob["coverage_id"])
+	assert.Equal(t, "999999999", eob["provider_npi"])
+
+	lines := eobLineTable.Rows(r)
+	require.Len(t, lines, 2)
+	line := rowMap(eobLineTable, lines[0])
+	assert.Equal(t, "99213", line["service_code"])
+	assert.Equal(t, "25|59", line["service_modifiers"])
+	assert.Equal(t, "2020-03-02", line["service_date_start"])
+	assert.Equal(t, "2020-03-02", line["service_date_end"])
+	assert.Equal(t, "1|3", line["diagnosis_sequences"])
+	assert.Equal(t, "12.34", line["allowed_amount"])
+	assert.Equal(t, "", line["payment_amount"])
+	assert.Equal(t, "2", rowMap(eobLineTable, lines[1])["line_number"])
+}
+
+func TestTables(t *testing.T) {
+	assert.Equal(t, []*Table{eobTable, eobLineTable}, Tables("ExplanationOfBenefit"))
+	assert.Equal(t, []*Table{patientTable}, Tables("Patient"))
+	assert.Equal(t, []*Table{coverageTable}, Tables("Coverage"))
+	assert.Nil(t, Tables("Claim"))
+}
+
+// Every column must be documented
+func TestREADME(t *testing.T) {
+	data, err := ioutil.ReadFile("README.md")
+	require.NoError(t, err)
+	readme := string(data)
+	for _, table := range AllTables() {
+		assert.Contains(t, readme, "### "+table.Name+"\n")
+		for _, c := range table.Columns {
+			assert.Contains(t, readme, "| "+c.Name+" |", "%s.%s", table.Name, c.Name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package testUtils
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"strings"
 	"time"
@@ -18,7 +19,7 @@ type BlueButtonClient struct {
 	MBI  *string
 }
 
-func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (*models.Bundle, error) {
 	args := bbc.Called(patientID)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -2,7 +2,16 @@ package web
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/api"
+	"github.com/CMSgov/bcda-app/bcda/auth"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
 )
@@ -56,3 +65,47 @@ func SecurityHeader(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// CheckACOQuota rejects export requests from ACOs that have reached one of the limits in their quota before any work is
+// done for them. It must be used after auth.RequireTokenAuth.
+// Concurrent requests may all pass this check, so the quota is checked again when the job is created; see
+// models.CreateJobWithinQuota.
+func CheckACOQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ad, ok := r.Context().Value(auth.AuthDataContextKey).(auth.AuthData)
+		if !ok {
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.TokenErr, "")
+			responseutils.WriteError(oo, w, http.StatusUnauthorized)
+			return
+		}
+
+		db := database.GetGORMDbConnection()
+		defer database.Close(db)
+
+		quota, err := models.GetACOQuota(db, uuid.Parse(ad.ACOID))
+		if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+
+		violation, err := quota.Check(db, time.Now(), api.GetJobTimeout())
+		if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+
+		if violation != nil {
+			log.Infof("Rejecting request from ACO %s: %s", ad.ACOID, violation.Message)
+			w.Header().Set("Retry-After", strconv.Itoa(violation.RetryAfterSeconds()))
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Throttled, responseutils.QuotaErr, violation.Message)
+			responseutils.WriteError(oo, w, http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -3,15 +3,24 @@ package web
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	fhirmodels "github.com/eug48/fhir/models"
 	"github.com/go-chi/chi"
+	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+
+	"github.com/CMSgov/bcda-app/bcda/auth"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
 )
 
 type MiddlewareTestSuite struct {
@@ -163,6 +172,66 @@ func (s *MiddlewareTestSuite) TestSecurityHeader() {
 
 }
 
+func (s *MiddlewareTestSuite) TestCheckACOQuota() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	aco := models.ACO{Name: "Quota Middleware Test ACO", UUID: uuid.NewRandom()}
+	assert.NoError(s.T(), db.Create(&aco).Error)
+	defer db.Unscoped().Delete(&aco)
+
+	assert.NoError(s.T(), models.SaveACOQuota(db, models.ACOQuota{ACOID: aco.UUID, MaxDailyRequests: 1}))
+	defer db.Unscoped().Delete(models.ACOQuota{}, "aco_id = ?", aco.UUID.String())
+
+	router := chi.NewRouter()
+	router.With(CheckACOQuota).Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	serve := func(ad *auth.AuthData) *http.Response {
+		req := httptest.NewRequest("GET", "/", nil)
+		if ad != nil {
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, *ad))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	ad := &auth.AuthData{ACOID: aco.UUID.String(), CMSID: "A9999"}
+
+	// No auth data
+	assert.Equal(s.T(), http.StatusUnauthorized, serve(nil).StatusCode)
+
+	// Within quota
+	assert.Equal(s.T(), http.StatusAccepted, serve(ad).StatusCode)
+
+	// Failed and cancelled jobs don't count against the quota
+	for _, status := range []models.JobStatus{models.JobStatusFailed, models.JobStatusCancelled} {
+		j := models.Job{ACOID: aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: status}
+		assert.NoError(s.T(), db.Create(&j).Error)
+		defer db.Unscoped().Delete(&j)
+	}
+	assert.Equal(s.T(), http.StatusAccepted, serve(ad).StatusCode)
+
+	// Quota reached
+	j := models.Job{ACOID: aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: "Completed"}
+	assert.NoError(s.T(), db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+
+	resp := serve(ad)
+	assert.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	assert.NoError(s.T(), err)
+	assert.InDelta(s.T(), 24*60*60, retryAfter, 60)
+
+	var oo fhirmodels.OperationOutcome
+	assert.NoError(s.T(), json.NewDecoder(resp.Body).Decode(&oo))
+	assert.Equal(s.T(), responseutils.Throttled, oo.Issue[0].Code)
+	assert.Equal(s.T(), responseutils.QuotaErr, oo.Issue[0].Details.Coding[0].Code)
+	assert.Equal(s.T(), "The ACO has reached its limit of 1 requests per day", oo.Issue[0].Details.Coding[0].Display)
+}
+
 func (s *MiddlewareTestSuite) TearDownTest() {
 	s.server.Close()
 }
@@ -31,16 +31,23 @@ func NewAPIRouter() http.Handler {
 		r.Get(`/{:(user_guide|encryption|decryption_walkthrough).html}`, userGuideRedirect)
 	}
 	r.Route("/api/v1", func(r chi.Router) {
-		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Patient/$export", v1.BulkPatientRequest))
-		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Group/{groupId}/$export", v1.BulkGroupRequest))
+		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders, CheckACOQuota).Get(m.WrapHandler("/Patient/$export", v1.BulkPatientRequest))
+		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders, CheckACOQuota).Get(m.WrapHandler("/Group/{groupId}/$export", v1.BulkGroupRequest))
+		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders, CheckACOQuota).Post(m.WrapHandler("/Group/{groupId}/$export", v1.BulkGroupPostRequest))
+		r.With(auth.RequireTokenAuth).Get(m.WrapHandler("/jobs", v1.ListJobs))
 		r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Get(m.WrapHandler("/jobs/{jobID}", v1.JobStatus))
+		r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Delete(m.WrapHandler("/jobs/{jobID}", v1.DeleteJob))
 		r.Get(m.WrapHandler("/metadata", v1.Metadata))
 	})
 
 	if utils.GetEnvBool("VERSION_2_ENDPOINT_ACTIVE", true) {
 		r.Route("/api/v2", func(r chi.Router) {
-			r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Patient/$export", v2.BulkPatientRequest))
-			r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Group/{groupId}/$export", v2.BulkGroupRequest))
+			r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders, CheckACOQuota).Get(m.WrapHandler("/Patient/$export", v2.BulkPatientRequest))
+			r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders, CheckACOQuota).Get(m.WrapHandler("/Group/{groupId}/$export", v2.BulkGroupRequest))
+			r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders, CheckACOQuota).Post(m.WrapHandler("/Group/{groupId}/$export", v2.BulkGroupPostRequest))
+			r.With(auth.RequireTokenAuth).Get(m.WrapHandler("/jobs", v2.ListJobs))
+			r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Get(m.WrapHandler("/jobs/{jobID}", v2.JobStatus))
+			r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Delete(m.WrapHandler("/jobs/{jobID}", v2.DeleteJob))
 			r.Get(m.WrapHandler("/metadata", v2.Metadata))
 		})
 	}
@@ -61,6 +68,10 @@ func NewDataRouter() http.Handler {
 	r.Use(auth.ParseToken, logging.NewStructuredLogger(), SecurityHeader, ConnectionClose)
 	r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).
 		Get(m.WrapHandler("/data/{jobID}/{fileName}", v1.ServeData))
+	if utils.GetEnvBool("VERSION_2_ENDPOINT_ACTIVE", true) {
+		r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).
+			Get(m.WrapHandler("/data/v2/{jobID}/{fileName}", v2.ServeData))
+	}
 	return r
 }
 
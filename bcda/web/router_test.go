@@ -192,6 +192,14 @@ func (s *RouterTestSuite) TestV2EndpointsDisabled() {
 	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
 	res = s.getAPIRoute("/api/v2/metadata")
 	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
+	res = s.getAPIRoute("/api/v2/jobs")
+	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
+	res = s.getAPIRoute("/api/v2/jobs/1")
+	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
+
+	s.dataRouter = NewDataRouter()
+	res = s.getDataRoute("/data/v2/1/test.ndjson")
+	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
 }
 
 func (s *RouterTestSuite) TestV2EndpointsEnabled() {
@@ -207,6 +215,19 @@ func (s *RouterTestSuite) TestV2EndpointsEnabled() {
 	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
 	res = s.getAPIRoute("/api/v2/metadata")
 	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	res = s.getAPIRoute("/api/v2/jobs")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+	res = s.getAPIRoute("/api/v2/jobs/1")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+
+	req := httptest.NewRequest("DELETE", "/api/v2/jobs/1", nil)
+	rr := httptest.NewRecorder()
+	s.apiRouter.ServeHTTP(rr, req)
+	assert.Equal(s.T(), http.StatusUnauthorized, rr.Result().StatusCode)
+
+	s.dataRouter = NewDataRouter()
+	res = s.getDataRoute("/data/v2/1/test.ndjson")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
 }
 
 func (s *RouterTestSuite) TestJobStatusRoute() {
@@ -214,6 +235,29 @@ func (s *RouterTestSuite) TestJobStatusRoute() {
 	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
 }
 
+func (s *RouterTestSuite) TestDeleteJobRoute() {
+	req := httptest.NewRequest("DELETE", "/api/v1/jobs/1", nil)
+	rr := httptest.NewRecorder()
+	s.apiRouter.ServeHTTP(rr, req)
+	assert.Equal(s.T(), http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func (s *RouterTestSuite) TestListJobsRoute() {
+	req := httptest.NewRequest("GET", "/api/v1/jobs", nil)
+	rr := httptest.NewRecorder()
+	s.apiRouter.ServeHTTP(rr, req)
+	assert.Equal(s.T(), http.StatusUnauthorized, rr.Result().StatusCode)
+}
+
+func (s *RouterTestSuite) TestBulkGroupPostRoute() {
+	for _, path := range []string{"/api/v1/Group/all/$export", "/api/v2/Group/all/$export"} {
+		req := httptest.NewRequest("POST", path, nil)
+		rr := httptest.NewRecorder()
+		s.apiRouter.ServeHTTP(rr, req)
+		assert.Equal(s.T(), http.StatusUnauthorized, rr.Result().StatusCode, path)
+	}
+}
+
 func (s *RouterTestSuite) TestHTTPServerRedirect() {
 	router := NewHTTPRouter()
 
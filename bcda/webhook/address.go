@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// nonPublicNetworks are the special-purpose ranges, besides loopback, link-local, multicast and unspecified addresses,
+// that notifications must not be delivered to
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "This" network
+	"10.0.0.0/8",     // Private
+	"100.64.0.0/10",  // Carrier-grade NAT
+	"172.16.0.0/12",  // Private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // Private
+	"198.18.0.0/15",  // Benchmarking
+	"240.0.0.0/4",    // Reserved, including broadcast
+	"64:ff9b::/96",   // IPv4/IPv6 translation, which can reach the private IPv4 ranges
+	"100::/64",       // Discard
+	"2001::/23",      // IETF protocol assignments
+	"2002::/16",      // 6to4, which can reach the private IPv4 ranges
+	"fc00::/7",       // Unique local
+	"fec0::/10",      // Site-local
+)
+
+// allowNonPublicAddresses permits delivery to receivers on the local network. It is only set by tests.
+var allowNonPublicAddresses = false
+
+// lookupIPAddr resolves the callback URL's host
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+// isPublic reports whether notifications may be delivered to the address. Callback URLs are supplied by ACOs, so they
+// must not be able to reach BCDA's own hosts or the private network it runs in.
+func isPublic(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost ensures the host of a callback URL only resolves to public addresses.
+func CheckHost(ctx context.Context, host string) error {
+	if allowNonPublicAddresses {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublic(ip) {
+			return fmt.Errorf("%s is not a public address", host)
+		}
+		return nil
+	}
+
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !isPublic(addr.IP) {
+			return fmt.Errorf("%s resolves to %s, which is not a public address", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// dialControl rejects connections to non-public addresses. The host is checked when the callback URL is registered,
+// but it must be checked again when connecting in case its DNS records have changed since.
+func dialControl(network, address string, c syscall.RawConn) error {
+	if allowNonPublicAddresses {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
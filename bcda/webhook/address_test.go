@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.public, isPublic(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	origLookup := lookupIPAddr
+	defer func() { lookupIPAddr = origLookup }()
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "public.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "mixed.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.0.0.1")}}, nil
+		default:
+			return nil, errors.New("no such host")
+		}
+	}
+
+	assert.NoError(t, CheckHost(context.Background(), "public.example.com"))
+	assert.NoError(t, CheckHost(context.Background(), "93.184.216.34"))
+	assert.EqualError(t, CheckHost(context.Background(), "mixed.example.com"),
+		"mixed.example.com resolves to 10.0.0.1, which is not a public address")
+	assert.EqualError(t, CheckHost(context.Background(), "169.254.169.254"), "169.254.169.254 is not a public address")
+	assert.EqualError(t, CheckHost(context.Background(), "unknown.example.com"), "could not resolve unknown.example.com")
+}
+
+func TestDialControl(t *testing.T) {
+	assert.NoError(t, dialControl("tcp", "93.184.216.34:443", nil))
+	assert.EqualError(t, dialControl("tcp", "127.0.0.1:443", nil), "127.0.0.1 is not a public address")
+	assert.EqualError(t, dialControl("tcp6", "[::1]:443", nil), "::1 is not a public address")
+}
@@ -0,0 +1,196 @@
+// Package webhook notifies ACOs when their export jobs complete or fail.
+//
+// Notifications are delivered through the job queue so they can be retried, with backoff, when the ACO's
+// receiver is unavailable. Each notification is a JSON document POSTed to the callback URL supplied with the
+// export request or, if none was supplied, the webhook URL registered for the ACO. Notifications are signed
+// with the ACO's webhook secret: the SignatureHeader contains the hex-encoded HMAC-SHA256 of
+// "<timestamp>.<body>", where timestamp is the value of the TimestampHeader.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bgentry/que-go"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/manifest"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+const (
+	// QueueJobType is the que job type used to deliver notifications
+	QueueJobType = "NotifyJob"
+
+	SignatureHeader = "X-BCDA-Signature"
+	TimestampHeader = "X-BCDA-Timestamp"
+)
+
+// NotifyJobArgs are the arguments of the que job used to deliver a notification
+type NotifyJobArgs struct {
+	JobID  uint
+	Status models.JobStatus
+}
+
+// Notification is the body of the request sent to the ACO's receiver
+type Notification struct {
+	JobID  uint   `json:"jobId"`
+	Status string `json:"status"`
+	// URL of the bulk data export request
+	RequestURL string `json:"request"`
+	// Manifest of the files generated by the job. Only supplied for completed jobs.
+	Manifest *manifest.BulkResponseBody `json:"manifest,omitempty"`
+}
+
+// NewQueueJob returns the que job used to notify the ACO that the job has transitioned to its current status.
+func NewQueueJob(job *models.Job) (*que.Job, error) {
+	args, err := json.Marshal(NotifyJobArgs{JobID: job.ID, Status: job.Status})
+	if err != nil {
+		return nil, err
+	}
+
+	return &que.Job{Type: QueueJobType, Args: args}, nil
+}
+
+// GenerateSecret returns a random secret suitable for signing notifications
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature of the notification body sent at the supplied timestamp
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the signature is valid for the notification body sent at the supplied timestamp.
+// It is provided for receivers written in Go.
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(Sign(secret, timestamp, body))
+	if err != nil {
+		return false
+	}
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, actual)
+}
+
+// ProcessJob delivers the notification described by the que job. Returning an error causes que to retry
+// delivery with backoff; the worker stops retrying once BCDA_WORKER_MAX_JOB_ATTEMPTS deliveries have failed.
+func ProcessJob(j *que.Job) error {
+	var args NotifyJobArgs
+	if err := json.Unmarshal(j.Args, &args); err != nil {
+		// The arguments will never be valid, so there is no reason to retry
+		log.Errorf("Unable to parse arguments for notification %d: %s", j.ID, err.Error())
+		return nil
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	if err := notify(db, args); err != nil {
+		log.Warnf("Failed to deliver notification for job %d: %s", args.JobID, err.Error())
+		return err
+	}
+	return nil
+}
+
+func notify(db *gorm.DB, args NotifyJobArgs) error {
+	var job models.Job
+	if err := db.First(&job, args.JobID).Error; err != nil {
+		return errors.Wrap(err, "could not retrieve job from database")
+	}
+
+	var aco models.ACO
+	if err := db.First(&aco, "uuid = ?", job.ACOID).Error; err != nil {
+		return errors.Wrap(err, "could not retrieve ACO from database")
+	}
+
+	callbackURL := job.CallbackURL
+	if callbackURL == "" {
+		callbackURL = aco.WebhookURL
+	}
+	if callbackURL == "" || aco.WebhookSecret == "" {
+		log.Debugf("No webhook registered for job %d", job.ID)
+		return nil
+	}
+
+	notification := Notification{
+		JobID:      job.ID,
+		Status:     string(args.Status),
+		RequestURL: job.RequestURL,
+	}
+
+	if args.Status.IsCompleted() {
+		// The files are served from the same host that received the request
+		requestURL, err := url.Parse(job.RequestURL)
+		if err != nil {
+			return errors.Wrap(err, "could not parse request URL")
+		}
+
+		var jobKeys []models.JobKey
+		if err := db.Find(&jobKeys, "job_id = ?", job.ID).Error; err != nil {
+			return errors.Wrap(err, "could not retrieve job keys from database")
+		}
+		rb := manifest.New(job, jobKeys, requestURL.Scheme, requestURL.Host)
+		notification.Manifest = &rb
+	}
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	return send(callbackURL, aco.WebhookSecret, body)
+}
+
+func send(callbackURL, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	client := &http.Client{
+		Timeout: time.Duration(utils.GetEnvInt("BCDA_WEBHOOK_TIMEOUT_MS", 10000)) * time.Millisecond,
+		// Every connection is checked, including those made to follow redirects
+		Transport: &http.Transport{DialContext: (&net.Dialer{Control: dialControl}).DialContext},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
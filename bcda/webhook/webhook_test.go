@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bgentry/que-go"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+)
+
+type WebhookTestSuite struct {
+	suite.Suite
+	db   *gorm.DB
+	aco  models.ACO
+	jobs []models.Job
+}
+
+// receivedRequest captures a notification delivered to the test receiver
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func (s *WebhookTestSuite) SetupTest() {
+	// The test receivers listen on loopback
+	allowNonPublicAddresses = true
+	models.InitializeGormModels()
+	s.db = database.GetGORMDbConnection()
+
+	secret, err := GenerateSecret()
+	assert.NoError(s.T(), err)
+	s.aco = models.ACO{Name: "Webhook Test ACO", UUID: uuid.NewRandom(), WebhookSecret: secret}
+	assert.NoError(s.T(), s.db.Create(&s.aco).Error)
+}
+
+func (s *WebhookTestSuite) TearDownTest() {
+	for _, j := range s.jobs {
+		s.db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+		s.db.Unscoped().Delete(&j)
+	}
+	s.jobs = nil
+	s.db.Unscoped().Delete(&s.aco)
+	database.Close(s.db)
+	allowNonPublicAddresses = false
+}
+
+func TestWebhookTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookTestSuite))
+}
+
+func (s *WebhookTestSuite) TestSignAndVerify() {
+	body := []byte(`{"jobId":1}`)
+	signature := Sign("secret", "1600000000", body)
+
+	assert.True(s.T(), Verify("secret", "1600000000", body, signature))
+	assert.False(s.T(), Verify("other", "1600000000", body, signature))
+	assert.False(s.T(), Verify("secret", "1600000001", body, signature))
+	assert.False(s.T(), Verify("secret", "1600000000", []byte(`{"jobId":2}`), signature))
+	assert.False(s.T(), Verify("secret", "1600000000", body, "not hex"))
+}
+
+func (s *WebhookTestSuite) TestProcessJobCompleted() {
+	receiver := newReceiver(http.StatusOK)
+	defer receiver.Close()
+	s.setWebhookURL(receiver.URL)
+
+	j := s.createJob("Completed", "")
+	assert.NoError(s.T(), s.db.Create(&models.JobKey{JobID: j.ID, FileName: "data.ndjson", ResourceType: "Patient",
+		Checksum: "abcd", FileSize: 10, ResourceCount: 2}).Error)
+
+	assert.NoError(s.T(), ProcessJob(s.newQueueJob(j, 0)))
+
+	assert.Len(s.T(), receiver.requests(), 1)
+	req := receiver.requests()[0]
+	assert.Equal(s.T(), "application/json", req.header.Get("Content-Type"))
+	assert.True(s.T(), Verify(s.aco.WebhookSecret, req.header.Get(TimestampHeader), req.body, req.header.Get(SignatureHeader)))
+
+	var notification Notification
+	assert.NoError(s.T(), json.Unmarshal(req.body, &notification))
+	assert.Equal(s.T(), j.ID, notification.JobID)
+	assert.Equal(s.T(), "Completed", notification.Status)
+	assert.Equal(s.T(), j.RequestURL, notification.RequestURL)
+	assert.NotNil(s.T(), notification.Manifest)
+	assert.Len(s.T(), notification.Manifest.Files, 1)
+	assert.Equal(s.T(), fmt.Sprintf("https://api.example.com/data/%d/data.ndjson", j.ID), notification.Manifest.Files[0].URL)
+	assert.Equal(s.T(), 2, notification.Manifest.Files[0].Count)
+}
+
+func (s *WebhookTestSuite) TestProcessJobFailed() {
+	receiver := newReceiver(http.StatusOK)
+	defer receiver.Close()
+	s.setWebhookURL(receiver.URL)
+
+	j := s.createJob("Failed", "")
+	assert.NoError(s.T(), ProcessJob(s.newQueueJob(j, 0)))
+
+	assert.Len(s.T(), receiver.requests(), 1)
+	var notification Notification
+	assert.NoError(s.T(), json.Unmarshal(receiver.requests()[0].body, &notification))
+	assert.Equal(s.T(), "Failed", notification.Status)
+	assert.Nil(s.T(), notification.Manifest)
+}
+
+func (s *WebhookTestSuite) TestProcessJobCallbackURL() {
+	acoReceiver := newReceiver(http.StatusOK)
+	defer acoReceiver.Close()
+	s.setWebhookURL(acoReceiver.URL)
+
+	jobReceiver := newReceiver(http.StatusOK)
+	defer jobReceiver.Close()
+
+	j := s.createJob("Failed", jobReceiver.URL)
+	assert.NoError(s.T(), ProcessJob(s.newQueueJob(j, 0)))
+
+	assert.Empty(s.T(), acoReceiver.requests())
+	assert.Len(s.T(), jobReceiver.requests(), 1)
+}
+
+func (s *WebhookTestSuite) TestProcessJobNoWebhook() {
+	j := s.createJob("Failed", "")
+	assert.NoError(s.T(), ProcessJob(s.newQueueJob(j, 0)))
+}
+
+func (s *WebhookTestSuite) TestProcessJobRetry() {
+	receiver := newReceiver(http.StatusServiceUnavailable)
+	defer receiver.Close()
+	s.setWebhookURL(receiver.URL)
+
+	j := s.createJob("Failed", "")
+
+	// Errors are returned so the worker retries the delivery, regardless of the number of attempts
+	assert.EqualError(s.T(), ProcessJob(s.newQueueJob(j, 0)), "receiver responded with status 503")
+	assert.EqualError(s.T(), ProcessJob(s.newQueueJob(j, 10)), "receiver responded with status 503")
+	assert.Len(s.T(), receiver.requests(), 2)
+}
+
+func (s *WebhookTestSuite) TestProcessJobNonPublicAddress() {
+	receiver := newReceiver(http.StatusOK)
+	defer receiver.Close()
+	s.setWebhookURL(receiver.URL)
+	allowNonPublicAddresses = false
+
+	j := s.createJob("Failed", "")
+	err := ProcessJob(s.newQueueJob(j, 0))
+	assert.Error(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "127.0.0.1 is not a public address")
+	assert.Empty(s.T(), receiver.requests())
+}
+
+func (s *WebhookTestSuite) setWebhookURL(webhookURL string) {
+	assert.NoError(s.T(), s.db.Model(&s.aco).Update("webhook_url", webhookURL).Error)
+}
+
+func (s *WebhookTestSuite) createJob(status models.JobStatus, callbackURL string) models.Job {
+	j := models.Job{
+		ACOID:       s.aco.UUID,
+		RequestURL:  "https://api.example.com/api/v1/Patient/$export",
+		Status:      status,
+		CallbackURL: callbackURL,
+	}
+	assert.NoError(s.T(), s.db.Create(&j).Error)
+	s.jobs = append(s.jobs, j)
+	return j
+}
+
+func (s *WebhookTestSuite) newQueueJob(job models.Job, errorCount int32) *que.Job {
+	j, err := NewQueueJob(&job)
+	assert.NoError(s.T(), err)
+	j.ErrorCount = errorCount
+	return j
+}
+
+// testReceiver is a local HTTP server that records the notifications it receives
+type testReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []receivedRequest
+}
+
+func newReceiver(status int) *testReceiver {
+	r := &testReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.received = append(r.received, receivedRequest{header: req.Header, body: body})
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return r
+}
+
+func (r *testReceiver) requests() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received
+}
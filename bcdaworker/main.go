@@ -1,14 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"crypto/rsa"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,17 +26,33 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/metrics"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	fhirmodels "github.com/CMSgov/bcda-app/bcda/models/fhir"
 	"github.com/CMSgov/bcda-app/bcda/monitoring"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/tabular"
 	"github.com/CMSgov/bcda-app/bcda/utils"
+	"github.com/CMSgov/bcda-app/bcda/webhook"
 )
 
 var (
 	qc *que.Client
+	// enqueueQueueJob adds a job to the queue. It's replaced in tests, which have no queue client.
+	enqueueQueueJob = func(j *que.Job) error { return qc.Enqueue(j) }
+
+	// stopping is closed once the worker begins shutting down. The worker pool stops locking jobs at this point.
+	stopping = make(chan struct{})
+	// jobCtx is cancelled to interrupt the jobs that are still in progress when the shutdown timeout expires
+	jobCtx, interruptJobs = context.WithCancel(context.Background())
+
+	errWorkerShutdown = errors.New("worker shut down before the job was finished")
+
+	// errFailureThresholdExceeded is returned when more than EXPORT_FAIL_PCT of a queue job's beneficiaries fail
+	errFailureThresholdExceeded = errors.New("number of failed requests has exceeded threshold")
 )
 
 func init() {
@@ -60,7 +81,7 @@ func createWorkerDirs() {
 func processJob(j *que.Job) error {
 	m := monitoring.GetMonitor()
 	txn := m.Start("processJob", nil, nil)
-	ctx := newrelic.NewContext(context.Background(), txn)
+	ctx := newrelic.NewContext(jobCtx, txn)
 	defer m.End(txn)
 
 	log.Info("Worker started processing job ", j.ID)
@@ -80,97 +101,179 @@ func processJob(j *que.Job) error {
 	var exportJob models.Job
 	result := db.First(&exportJob, "ID = ?", jobArgs.ID)
 
+	// Queue jobs are only added to the queue once their job has been committed, so a missing job will never be found
 	if result.RecordNotFound() {
-		// Based on the current backoff delay (j.ErrorCount^4 + 3 seconds), this should've given
-		// us plenty of headroom to ensure that the parent job will never be found.
-		maxNotFoundRetries := int32(utils.GetEnvInt("BCDA_WORKER_MAX_JOB_NOT_FOUND_RETRIES", 3))
-		if j.ErrorCount >= maxNotFoundRetries {
-			log.Errorf("No job found for ID: %d acoID: %s. Retries exhausted. Removing job from queue.", jobArgs.ID,
-				jobArgs.ACOID)
-			// By returning a nil error response, we're singaling to que-go to remove this job from the jobqueue.
-			return nil
-		}
-
-		log.Warnf("No job found for ID %d acoID: %s. Will retry.", jobArgs.ID, jobArgs.ACOID)
-		return errors.Wrap(gorm.ErrRecordNotFound, "could not retrieve job from database")
+		log.Errorf("No job found for ID: %d acoID: %s. Moving job to the dead-letter table.", jobArgs.ID, jobArgs.ACOID)
+		return noRetry(errors.Wrap(gorm.ErrRecordNotFound, "could not retrieve job from database"))
 	}
 
 	if result.Error != nil {
 		return errors.Wrap(result.Error, "could not retrieve job from database")
 	}
 
+	// The export job has been cancelled. By returning a nil error response, we're signaling to que-go to remove this job from the jobqueue.
+	if exportJob.Status == models.JobStatusCancelled {
+		log.Infof("Job %d has been cancelled. Removing queue job %d from queue.", exportJob.ID, j.ID)
+		return nil
+	}
+
 	var aco models.ACO
 	err = db.First(&aco, "uuid = ?", exportJob.ACOID).Error
 	if err != nil {
 		return errors.Wrap(err, "could not retrieve ACO from database")
 	}
 
-	err = db.Model(&exportJob).Where("status = ?", "Pending").Update("status", "In Progress").Error
+	// The first queue job to start moves the job to In Progress. A failed job is never resumed by its queue jobs.
+	if exportJob.Status == models.JobStatusPending {
+		_, err = exportJob.TransitionStatus(db, models.JobStatusInProgress, models.JobStatusActorWorker,
+			fmt.Sprintf("queue job %d started", j.ID))
+		if err != nil {
+			return errors.Wrap(err, "could not update job status in database")
+		}
+	}
+
+	// Jobs queued before the API version was recorded were all v1 jobs
+	if jobArgs.Version == "" {
+		jobArgs.Version = constants.V1Version
+	}
+
+	// The job's setting is used, rather than the ACO's, so that all of its files are encrypted or none of them are
+	var publicKey *rsa.PublicKey
+	if exportJob.Encrypt {
+		if publicKey, err = aco.GetPublicKey(); err != nil {
+			err = errors.Wrap(err, "could not retrieve ACO public key")
+			log.Error(err)
+			return err
+		}
+	}
+
+	bbConfig, err := client.NewConfigForVersion(jobArgs.Version)
 	if err != nil {
-		return errors.Wrap(err, "could not update job status in database")
+		log.Error(err)
+		return err
 	}
 
-	bb, err := client.NewBlueButtonClient(client.NewConfig())
+	bb, err := client.NewBlueButtonClient(bbConfig)
 	if err != nil {
 		err = errors.Wrap(err, "could not create Blue Button client")
 		log.Error(err)
 		return err
 	}
 
-	jobID := strconv.Itoa(jobArgs.ID)
-	stagingPath := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
-	payloadPath := fmt.Sprintf("%s/%s", os.Getenv("FHIR_PAYLOAD_DIR"), jobID)
+	fileUUID, stats, err := writeBBDataToFile(ctx, bb, db, *aco.CMSID, publicKey, jobArgs)
+	fileName := fileUUID + tabular.Format(jobArgs.OutputFormat).FileExtension()
 
-	if err = createDir(stagingPath); err != nil {
-		log.Error(err)
-		return err
+	// The export job may have been cancelled while we were collecting data
+	if cancelled, cErr := isCancelled(exportJob.ID, db); cErr != nil {
+		log.Error(cErr)
+	} else if cancelled {
+		log.Infof("Job %d was cancelled while processing queue job %d. Removing staged files.", exportJob.ID, j.ID)
+		if err = storage.Get().RemoveAll(storage.Staging, strconv.Itoa(jobArgs.ID)); err != nil {
+			log.Error(err)
+		}
+		return nil
 	}
 
-	if err = createDir(payloadPath); err != nil {
-		log.Error(err)
+	// Returning errWorkerShutdown releases the queue job, without counting the attempt, so that it can be retried by
+	// another worker
+	if err == errWorkerShutdown {
+		log.Warnf("Worker shut down while processing queue job %d for job %d. Releasing it to be retried.", j.ID, exportJob.ID)
 		return err
 	}
 
-	fileUUID, err := writeBBDataToFile(ctx, bb, db, jobArgs.ACOID, *aco.CMSID, jobArgs.BeneficiaryIDs, jobID, jobArgs.ResourceType, jobArgs.Since, jobArgs.TransactionTime)
-	fileName := fileUUID + ".ndjson"
-
 	// This is only run AFTER completion of all the collection
-	if err != nil {
-		err = db.Model(&exportJob).Update("status", "Failed").Error
+	var last bool
+	if err == errFailureThresholdExceeded && exportJob.AllowPartial {
+		log.Warnf("Queue job %d exceeded the failure threshold. Job %d allows partial exports, so it will not be failed.", j.ID, exportJob.ID)
+		last, err = addFailedJobFileName(fileUUID, stats, jobArgs, &exportJob, db)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		err = exportJob.Fail(db, fmt.Sprintf("queue job %d failed: %s", j.ID, err.Error()))
 		if err != nil {
 			return err
 		}
 	} else {
-		err = addJobFileName(fileName, jobArgs.ResourceType, exportJob, db)
+		last, err = addJobFileName(fileName, jobArgs.ResourceType, stats, &exportJob, db)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
 	}
 
-	_, err = exportJob.CheckCompletedAndCleanup(db)
-	if err != nil {
-		log.Error(err)
-		return err
+	// Only the last queue job to finish finalizes the job, so its files are moved and its status is changed once
+	if last {
+		enqueueFinalizeJob(exportJob.ID)
 	}
 
-	updateJobStats(exportJob.ID, db)
+	updateJobQueueCountCloudwatchMetric()
 
 	log.Info("Worker finished processing job ", j.ID)
 
 	return nil
 }
 
-func createDir(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err = os.MkdirAll(path, os.ModePerm); err != nil {
-			return err
+// finalizeJob moves the files of an export job whose queue jobs have all finished to the payload directory and
+// completes the job. It may be run more than once for the same job.
+func finalizeJob(j *que.Job) error {
+	var args models.FinalizeJobArgs
+	if err := json.Unmarshal(j.Args, &args); err != nil {
+		return noRetry(err)
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var exportJob models.Job
+	if err := db.First(&exportJob, args.ID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return noRetry(errors.Wrap(err, "could not retrieve job from database"))
 		}
+		return errors.Wrap(err, "could not retrieve job from database")
+	}
+
+	completed, err := exportJob.CheckCompletedAndCleanup(db)
+	if err != nil {
+		log.Error(err)
+		return err
 	}
+	if !completed {
+		// e.g. the job was cancelled or failed after its last queue job finished
+		log.Warnf("Job %d was not completed by finalize queue job %d. Status: %s", exportJob.ID, j.ID, exportJob.Status)
+		return nil
+	}
+
+	log.Infof("Finalized job %d", exportJob.ID)
 	return nil
 }
 
-func writeBBDataToFile(ctx context.Context, bb client.APIClient, db *gorm.DB, acoID string, acoCMSID string, cclfBeneficiaryIDs []string, jobID, t, since string, transactionTime time.Time) (fileUUID string, error error) {
+// enqueueFinalizeJob queues the job's finalization. Finalization is not retried by failing the queue job that
+// finished last, since that would record its files again; the stuck job reaper finalizes the job instead.
+func enqueueFinalizeJob(jobID uint) {
+	j, err := models.NewFinalizeQueueJob(jobID)
+	if err == nil {
+		err = enqueueQueueJob(j)
+	}
+	if err != nil {
+		log.Errorf("Unable to queue finalization of job %d: %s", jobID, err.Error())
+	}
+}
+
+// isCancelled returns true if the export job has been cancelled by the requester
+func isCancelled(jobID uint, db *gorm.DB) (bool, error) {
+	var job models.Job
+	if err := db.Select("status").First(&job, jobID).Error; err != nil {
+		return false, err
+	}
+	return job.Status == models.JobStatusCancelled, nil
+}
+
+// writeBBDataToFile writes the resources retrieved from Blue Button for the queue job's beneficiaries to an NDJSON file
+// in the staging area. Resources, and any errors encountered, are written in the FHIR version served by the
+// job's API version. When the queue job splits ExplanationOfBenefit resources by claim type, the resources of each
+// claim type are written to a file of their own, which is described by the returned stats.
+func writeBBDataToFile(ctx context.Context, bb client.APIClient, db *gorm.DB, acoCMSID string, publicKey *rsa.PublicKey, jobArgs models.JobEnqueueArgs) (fileUUID string, stats fileStats, err error) {
 	segment := getSegment(ctx, "writeBBDataToFile")
 	defer func() {
 		if err := segment.End(); err != nil {
@@ -181,50 +284,92 @@ func writeBBDataToFile(ctx context.Context, bb client.APIClient, db *gorm.DB, ac
 	if bb == nil {
 		err := errors.New("Blue Button client is required")
 		log.Error(err)
-		return "", err
+		return "", stats, err
 	}
 
-	bbFunc := bbFuncByType(bb, t)
+	var (
+		acoID              = jobArgs.ACOID
+		cclfBeneficiaryIDs = jobArgs.BeneficiaryIDs
+		jobID              = strconv.Itoa(jobArgs.ID)
+		t                  = jobArgs.ResourceType
+		version            = jobArgs.Version
+	)
+
+	bbFunc := bbStreamFuncByType(bb, t, jobArgs.TypeFilter)
 	if bbFunc == nil {
 		err := fmt.Errorf("Invalid resource type requested: %s", t)
 		log.Error(err)
-		return "", err
+		return "", stats, err
 	}
 
 	if !utils.IsUUID(acoID) {
 		err := errors.New("Invalid ACO ID")
 		log.Error(err)
-		return "", err
+		return "", stats, err
 	}
 
-	dataDir := os.Getenv("FHIR_STAGING_DIR")
 	fileUUID = uuid.NewRandom().String()
-	f, err := os.Create(fmt.Sprintf("%s/%s/%s.ndjson", dataDir, jobID, fileUUID))
+	out, err := newQueueJobOutput(storage.Get(), fileUUID, publicKey, jobArgs)
 	if err != nil {
 		log.Error(err)
-		return "", err
+		return "", stats, err
 	}
+	defer out.close() // nolint
+	errs := newErrorFile(version, jobID, fileUUID)
 
-	defer utils.CloseFileAndLogError(f)
-
-	w := bufio.NewWriter(f)
 	errorCount := 0
 	totalBeneIDs := float64(len(cclfBeneficiaryIDs))
 	failThreshold := getFailureThreshold()
 	failed := false
 
-	for _, cclfBeneficiaryID := range cclfBeneficiaryIDs {
-		blueButtonID, err := beneBBID(cclfBeneficiaryID, bb, db)
-
+	// The beneficiaries' resources are retrieved concurrently, but they're written here (along with any errors) in the
+	// order of the beneficiaries. This keeps the file's contents, and the failure threshold, independent of the order
+	// in which the requests complete. Each page of resources is written as it's received, so only a few pages per
+	// beneficiary being retrieved are held in memory, no matter how many resources a beneficiary has.
+	lookup := newBeneLookup(db, bb, cclfBeneficiaryIDs)
+	fetchCtx, stopFetching := context.WithCancel(ctx)
+	defer stopFetching()
+	results := fetchBeneData(fetchCtx, cclfBeneficiaryIDs, beneConcurrency(t), func(cclfBeneficiaryID string, send client.BundlePageFunc) (string, error) {
+		blueButtonID, err := lookup.blueButtonID(cclfBeneficiaryID)
 		if err != nil {
-			handleBBError(ctx, err, &errorCount, fileUUID, fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", cclfBeneficiaryID), jobID)
-		} else {
-			b, err := bbFunc(blueButtonID, jobID, acoCMSID, since, transactionTime)
-			if err != nil {
-				handleBBError(ctx, err, &errorCount, fileUUID, fmt.Sprintf("Error retrieving %s for beneficiary %s in ACO %s", t, blueButtonID, acoID), jobID)
-			} else {
-				fhirBundleToResourceNDJSON(ctx, w, b, t, cclfBeneficiaryID, acoCMSID, jobID, fileUUID)
+			return fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", cclfBeneficiaryID), err
+		}
+		var pages int
+		err = bbFunc(blueButtonID, jobID, acoCMSID, jobArgs.Since, jobArgs.TransactionTime, func(page *fhirmodels.RawBundle) error {
+			if err := send(page); err != nil {
+				return err
+			}
+			pages++
+			return nil
+		})
+		if err != nil {
+			// A stale ID may have caused the failure, so the ID will be retrieved from Blue Button on the next attempt
+			lookup.invalidate(cclfBeneficiaryID)
+			msg := fmt.Sprintf("Error retrieving %s for beneficiary %s in ACO %s", t, blueButtonID, acoID)
+			if pages > 0 {
+				// The pages received before the failure have been written, so the beneficiary's resources are partial
+				msg += fmt.Sprintf("; only the first %d page(s) of resources were exported", pages)
 			}
+			return msg, err
+		}
+		return "", nil
+	})
+
+	for i, cclfBeneficiaryID := range cclfBeneficiaryIDs {
+		data := results[i]
+		err := writeBeneData(ctx, out, errs, data, t, cclfBeneficiaryID, acoCMSID)
+
+		// The worker is shutting down, so the partially written files are removed to allow the job to be retried cleanly
+		if err != nil || ctx.Err() != nil {
+			out.close() // nolint
+			removeStagedFiles(out.stagedNames()...)
+			return "", stats, errWorkerShutdown
+		}
+
+		// Pages received before the error have already been written rather than rolled back, so the error, which says
+		// the beneficiary's resources are partial, is recorded alongside them
+		if data.err != nil {
+			handleBBError(ctx, errs, data.err, &errorCount, data.errMsg)
 		}
 		failPct := (float64(errorCount) / totalBeneIDs) * 100
 		if failPct >= failThreshold {
@@ -233,48 +378,299 @@ func writeBBDataToFile(ctx context.Context, bb client.APIClient, db *gorm.DB, ac
 		}
 	}
 
-	err = w.Flush()
-	if err != nil {
-		return "", err
+	if err = out.close(); err != nil {
+		return "", stats, err
 	}
 
+	// The error file is still identified so that it can be included in partial exports, where it explains the missing
+	// resources. Only the main file is recorded for a failed queue job, so the other files are removed here.
 	if failed {
-		return "", errors.New("number of failed requests has exceeded threshold")
+		removeStagedFiles(out.otherStagedNames()...)
+		errs.add(ctx, responseutils.Exception, responseutils.BbErr,
+			fmt.Sprintf("%s resources were not exported for %d beneficiaries because too many requests to Blue Button failed",
+				t, len(cclfBeneficiaryIDs)))
+		if stats.errorFile, err = errs.write(storage.Get(), publicKey); err != nil {
+			log.Error(err)
+			return "", stats, err
+		}
+		return fileUUID, stats, errFailureThresholdExceeded
+	}
+
+	stats = out.finish()
+	if stats.errorFile, err = errs.write(storage.Get(), publicKey); err != nil {
+		log.Error(err)
+		return "", stats, err
+	}
+
+	return fileUUID, stats, nil
+}
+
+// beneData streams the pages of resources retrieved for a beneficiary. If the resources could not be retrieved,
+// err and errMsg are set before pages is closed.
+type beneData struct {
+	pages  chan *fhirmodels.RawBundle
+	err    error
+	errMsg string // describes the failed request
+}
+
+// fetchBeneData retrieves the data for each beneficiary using a pool of concurrency goroutines. The pages retrieved for
+// the beneficiary at index i are sent on the pages of the i-th beneData returned. Sending blocks until the page is
+// read, which limits the number of pages held in memory. No further pages or beneficiaries are fetched once ctx is
+// done.
+func fetchBeneData(ctx context.Context, cclfBeneficiaryIDs []string, concurrency int, fetch func(cclfBeneficiaryID string, send client.BundlePageFunc) (errMsg string, err error)) []*beneData {
+	results := make([]*beneData, len(cclfBeneficiaryIDs))
+	indexes := make(chan int, len(cclfBeneficiaryIDs))
+	for i := range cclfBeneficiaryIDs {
+		// Buffered so that the next page can be requested while the current page is written
+		results[i] = &beneData{pages: make(chan *fhirmodels.RawBundle, 1)}
+		indexes <- i
+	}
+	close(indexes)
+
+	for n := 0; n < concurrency; n++ {
+		go func() {
+			for i := range indexes {
+				if ctx.Err() != nil {
+					return
+				}
+
+				data := results[i]
+				data.errMsg, data.err = fetch(cclfBeneficiaryIDs[i], func(page *fhirmodels.RawBundle) error {
+					select {
+					case data.pages <- page:
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				})
+				close(data.pages)
+			}
+		}()
+	}
+
+	return results
+}
+
+// writeBeneData writes each page of the beneficiary's resources to the queue job's files as it's received. An error is
+// returned if ctx is done before every page has been received.
+func writeBeneData(ctx context.Context, out *queueJobOutput, errs *errorFile, data *beneData, jsonType, beneficiaryID, acoID string) error {
+	for {
+		select {
+		case page, ok := <-data.pages:
+			if !ok {
+				return nil
+			}
+			fhirBundleToResourceNDJSON(ctx, out, errs, page, jsonType, beneficiaryID, acoID)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// beneConcurrency returns the number of beneficiaries whose resources are retrieved from Blue Button at the same
+// time within a queue job. BCDA_WORKER_BENE_CONCURRENCY may be overridden for a single resource type using
+// BCDA_WORKER_BENE_CONCURRENCY_<RESOURCE TYPE>, e.g. BCDA_WORKER_BENE_CONCURRENCY_EXPLANATIONOFBENEFIT.
+func beneConcurrency(resourceType string) int {
+	c := utils.GetEnvInt("BCDA_WORKER_BENE_CONCURRENCY", 4)
+	c = utils.GetEnvInt("BCDA_WORKER_BENE_CONCURRENCY_"+strings.ToUpper(resourceType), c)
+	if c < 1 {
+		return 1
+	}
+	return c
+}
+
+// removeStagedFiles removes the files from the staging area. Files that were never written are ignored.
+func removeStagedFiles(names ...string) {
+	for _, name := range names {
+		if err := storage.Get().Remove(storage.Staging, name); err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
 	}
+}
+
+// beneStreamFunc retrieves a beneficiary's resources from Blue Button, passing each page to fn as it's received
+type beneStreamFunc func(patientID, jobID, cmsID, since string, transactionTime time.Time, fn client.BundlePageFunc) error
 
-	return fileUUID, nil
+// bbStreamFuncByType returns the function used to stream resources of type t from Blue Button.
+// Clients that cannot stream resources pass the entire bundle to fn as a single page.
+func bbStreamFuncByType(bb client.APIClient, t string, typeFilter url.Values) beneStreamFunc {
+	sbb, ok := bb.(client.StreamingAPIClient)
+	if !ok {
+		bbFunc := bbFuncByType(bb, t, typeFilter)
+		if bbFunc == nil {
+			return nil
+		}
+		return func(patientID, jobID, cmsID, since string, transactionTime time.Time, fn client.BundlePageFunc) error {
+			b, err := bbFunc(patientID, jobID, cmsID, since, transactionTime)
+			if err != nil {
+				return err
+			}
+			page, err := toRawBundle(b)
+			if err != nil {
+				return err
+			}
+			return fn(page)
+		}
+	}
+
+	streamEOB := func(patientID, jobID, cmsID, since string, transactionTime time.Time, fn client.BundlePageFunc) error {
+		return sbb.StreamExplanationOfBenefit(patientID, jobID, cmsID, since, transactionTime, typeFilter, fn)
+	}
+
+	return map[string]beneStreamFunc{
+		"ExplanationOfBenefit": streamEOB,
+		"Patient":              sbb.StreamPatient,
+		"Coverage":             sbb.StreamCoverage,
+	}[t]
+}
+
+// toRawBundle re-encodes the resources in the bundle as JSON
+func toRawBundle(b *fhirmodels.Bundle) (*fhirmodels.RawBundle, error) {
+	raw := &fhirmodels.RawBundle{}
+	if b == nil {
+		return raw, nil
+	}
+
+	raw.Resource, raw.Links = b.Resource, b.Links
+	for _, entry := range b.Entries {
+		if entry["resource"] == nil {
+			continue
+		}
+		resource, err := json.Marshal(entry["resource"])
+		if err != nil {
+			return nil, err
+		}
+		raw.Entries = append(raw.Entries, fhirmodels.RawBundleEntry{Resource: resource})
+	}
+	return raw, nil
 }
 
-func bbFuncByType(bb client.APIClient, t string) client.BeneDataFunc {
+func bbFuncByType(bb client.APIClient, t string, typeFilter url.Values) client.BeneDataFunc {
+	getEOB := func(patientID, jobID, cmsID, since string, transactionTime time.Time) (*fhirmodels.Bundle, error) {
+		return bb.GetExplanationOfBenefit(patientID, jobID, cmsID, since, transactionTime, typeFilter)
+	}
+
 	return map[string]client.BeneDataFunc{
-		"ExplanationOfBenefit": bb.GetExplanationOfBenefit,
+		"ExplanationOfBenefit": getEOB,
 		"Patient":              bb.GetPatient,
 		"Coverage":             bb.GetCoverage,
 	}[t]
 }
 
-// beneBBID returns the beneficiary's Blue Button ID. The ID value is retrieved from BB and saved.
-func beneBBID(cclfBeneID string, bb client.APIClient, db *gorm.DB) (string, error) {
+// beneLookup resolves the Blue Button IDs of a queue job's beneficiaries. The beneficiaries and their cached IDs are
+// loaded once per queue job, and Blue Button is only asked for the IDs that aren't in the cache. It's used by all of
+// the goroutines retrieving the queue job's resources, so its maps are guarded by mu, which is never held during I/O.
+type beneLookup struct {
+	db     *gorm.DB
+	bb     client.APIClient
+	mu     sync.Mutex
+	benes  map[string]models.CCLFBeneficiary // keyed by CCLF beneficiary ID
+	cached map[string]string                 // Blue Button IDs keyed by MBI
+}
+
+func newBeneLookup(db *gorm.DB, bb client.APIClient, cclfBeneficiaryIDs []string) *beneLookup {
+	l := &beneLookup{db: db, bb: bb, benes: make(map[string]models.CCLFBeneficiary), cached: make(map[string]string)}
+
+	// Beneficiaries that can't be loaded here are loaded individually when their ID is needed
+	var benes []models.CCLFBeneficiary
+	if err := db.Where("id in (?)", cclfBeneficiaryIDs).Find(&benes).Error; err != nil {
+		log.Error(err)
+		return l
+	}
+
+	mbis := make([]string, 0, len(benes))
+	for _, bene := range benes {
+		l.benes[strconv.FormatUint(uint64(bene.ID), 10)] = bene
+		mbis = append(mbis, bene.MBI)
+	}
 
-	var cclfBeneficiary models.CCLFBeneficiary
-	db.First(&cclfBeneficiary, cclfBeneID)
-	bbID, err := cclfBeneficiary.GetBlueButtonID(bb)
+	cached, err := models.GetCachedBlueButtonIDs(db, mbis)
 	if err != nil {
-		return "", err
+		log.Error(err)
+		return l
+	}
+	l.cached = cached
+
+	return l
+}
+
+// blueButtonID returns the beneficiary's Blue Button ID, using the cached ID or the ID saved on the CCLF beneficiary
+// if there is one. IDs retrieved from Blue Button are cached. The ID is also saved on the CCLF beneficiary if it has
+// changed.
+func (l *beneLookup) blueButtonID(cclfBeneID string) (string, error) {
+	l.mu.Lock()
+	cclfBeneficiary, ok := l.benes[cclfBeneID]
+	l.mu.Unlock()
+	if !ok {
+		if err := l.db.First(&cclfBeneficiary, cclfBeneID).Error; err != nil {
+			return "", errors.Wrapf(err, "could not retrieve CCLF beneficiary %s", cclfBeneID)
+		}
+	}
+
+	l.mu.Lock()
+	bbID, ok := l.cached[cclfBeneficiary.MBI]
+	l.mu.Unlock()
+	if !ok && cclfBeneficiary.BlueButtonID != "" {
+		// The saved ID is cleared by invalidate if it turns out to be stale
+		bbID = cclfBeneficiary.BlueButtonID
+	} else if !ok {
+		var err error
+		if bbID, err = cclfBeneficiary.GetBlueButtonID(l.bb); err != nil {
+			return "", err
+		}
+		if err = models.CacheBlueButtonID(l.db, cclfBeneficiary.MBI, bbID); err != nil {
+			log.Error(err)
+		} else {
+			l.mu.Lock()
+			l.cached[cclfBeneficiary.MBI] = bbID
+			l.mu.Unlock()
+		}
 	}
 
 	// Update the value in the DB only if necessary
 	if cclfBeneficiary.BlueButtonID != bbID {
-		db.Model(&cclfBeneficiary).Update("blue_button_id", bbID)
+		if err := l.db.Model(&cclfBeneficiary).Update("blue_button_id", bbID).Error; err != nil {
+			log.Error(err)
+		}
 	}
 
+	l.mu.Lock()
+	l.benes[cclfBeneID] = cclfBeneficiary
+	l.mu.Unlock()
 	return bbID, nil
 }
 
-func handleBBError(ctx context.Context, err error, errorCount *int, fileUUID, msg, jobID string) {
+// invalidate removes the beneficiary's ID from the cache and from the CCLF beneficiary, so that it's retrieved from
+// Blue Button the next time it's needed
+func (l *beneLookup) invalidate(cclfBeneID string) {
+	l.mu.Lock()
+	cclfBeneficiary, ok := l.benes[cclfBeneID]
+	_, cached := l.cached[cclfBeneficiary.MBI]
+	delete(l.cached, cclfBeneficiary.MBI)
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if cached {
+		if _, err := models.InvalidateBlueButtonIDs(l.db, cclfBeneficiary.MBI); err != nil {
+			log.Error(err)
+		}
+	}
+	if cclfBeneficiary.BlueButtonID != "" {
+		if err := l.db.Model(&cclfBeneficiary).Update("blue_button_id", "").Error; err != nil {
+			log.Error(err)
+		}
+		l.mu.Lock()
+		l.benes[cclfBeneID] = cclfBeneficiary
+		l.mu.Unlock()
+	}
+}
+
+func handleBBError(ctx context.Context, errs *errorFile, err error, errorCount *int, msg string) {
 	log.Error(err)
 	(*errorCount)++
-	appendErrorToFile(ctx, fileUUID, responseutils.Exception, responseutils.BbErr, msg, jobID)
+	errs.add(ctx, responseutils.Exception, responseutils.BbErr, msg)
 }
 
 func getFailureThreshold() float64 {
@@ -290,38 +686,11 @@ func getFailureThreshold() float64 {
 	return float64(exportFailPct)
 }
 
-func appendErrorToFile(ctx context.Context, fileUUID, code, detailsCode, detailsDisplay string, jobID string) {
-	segment := getSegment(ctx, "appendErrorToFile")
-	defer func() {
-		if err := segment.End(); err != nil {
-			log.Error(err)
-		}
-	}()
-
-	oo := responseutils.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay)
-
-	dataDir := os.Getenv("FHIR_STAGING_DIR")
-	fileName := fmt.Sprintf("%s/%s/%s-error.ndjson", dataDir, jobID, fileUUID)
-	/* #nosec -- opening file defined by variable */
-	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-
-	if err != nil {
-		log.Error(err)
-	}
-
-	defer utils.CloseFileAndLogError(f)
-
-	ooBytes, err := json.Marshal(oo)
-	if err != nil {
-		log.Error(err)
-	}
-
-	if _, err = f.WriteString(string(ooBytes) + "\n"); err != nil {
-		log.Error(err)
-	}
-}
-
-func fhirBundleToResourceNDJSON(ctx context.Context, w *bufio.Writer, b *fhirmodels.Bundle, jsonType, beneficiaryID, acoID, jobID, fileUUID string) {
+// fhirBundleToResourceNDJSON writes each resource in the bundle to the queue job's files: the main file, or the file of
+// the resource's claim type when ExplanationOfBenefit resources are split by claim type. Resources are written as
+// received from Blue Button, only removing the whitespace between tokens so that each resource occupies a single line,
+// unless they're flattened into tables.
+func fhirBundleToResourceNDJSON(ctx context.Context, out *queueJobOutput, errs *errorFile, b *fhirmodels.RawBundle, jsonType, beneficiaryID, acoID string) {
 	segment := getSegment(ctx, "fhirBundleToResourceNDJSON")
 	defer func() {
 		if err := segment.End(); err != nil {
@@ -329,84 +698,175 @@ func fhirBundleToResourceNDJSON(ctx context.Context, w *bufio.Writer, b *fhirmod
 		}
 	}()
 
+	var buf bytes.Buffer
 	for _, entry := range b.Entries {
-		if entry["resource"] == nil {
+		if len(entry.Resource) == 0 || string(entry.Resource) == "null" {
 			continue
 		}
 
-		entryJSON, err := json.Marshal(entry["resource"])
-		// This is unlikely to happen because we just unmarshalled this data a few lines above.
-		if err != nil {
+		buf.Reset()
+		if err := json.Compact(&buf, entry.Resource); err != nil {
 			log.Error(err)
-			appendErrorToFile(ctx, fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error marshaling %s to JSON for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
+			errs.add(ctx, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error marshaling %s to JSON for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID))
 			continue
 		}
-		_, err = w.WriteString(string(entryJSON) + "\n")
-		if err != nil {
+		buf.WriteByte('\n')
+		if err := out.write(buf.Bytes()); err != nil {
 			log.Error(err)
-			appendErrorToFile(ctx, fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error writing %s to file for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
+			errs.add(ctx, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error writing %s to file for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID))
 		}
 	}
 }
 
 func waitForSig() {
 	signalChan := make(chan os.Signal, 1)
-	defer close(signalChan)
+	defer signal.Stop(signalChan)
 
 	signal.Notify(signalChan,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	exitChan := make(chan int)
-	defer close(exitChan)
+	s := <-signalChan
+	log.Infof("Received %s signal, shutting down", s)
+}
+
+// shutdownWorkers stops the worker pool from working new jobs and waits up to the timeout for the jobs in progress
+// to finish. Jobs that are still in progress are then interrupted, which removes their partially written files and
+// releases them back to the queue to be retried by another worker.
+func shutdownWorkers(workers interface{ Shutdown() }, timeout time.Duration) {
+	close(stopping)
 
+	done := make(chan struct{})
 	go func() {
-		for {
-			s := <-signalChan
-			switch s {
-			case syscall.SIGINT:
-				fmt.Println("interrupt")
-				exitChan <- 0
-			case syscall.SIGTERM:
-				fmt.Println("force stop")
-				exitChan <- 0
-			case syscall.SIGQUIT:
-				fmt.Println("stop and core dump")
-				exitChan <- 0
-			}
-		}
+		workers.Shutdown()
+		close(done)
 	}()
 
-	code := <-exitChan
-	os.Exit(code)
+	select {
+	case <-done:
+		log.Info("All jobs in progress finished before shutdown")
+	case <-time.After(timeout):
+		log.Warnf("Jobs in progress did not finish within %s of shutdown. Interrupting them.", timeout)
+		interruptJobs()
+		<-done
+	}
+}
+
+// noRetryError is returned by a work function when retrying the queue job cannot succeed
+type noRetryError struct {
+	error
+}
+
+// noRetry marks the error as one that should move the queue job to the dead-letter table without retrying it
+func noRetry(err error) error {
+	return noRetryError{err}
+}
+
+// deadLetterAfterMaxAttempts wraps the work function so that a queue job is moved to the dead-letter table, rather than
+// being retried again, once it has failed BCDA_WORKER_MAX_JOB_ATTEMPTS times or fails with an error that cannot be
+// retried. onDeadLetter, if not nil, is called with each dead-lettered queue job.
+func deadLetterAfterMaxAttempts(wf que.WorkFunc, onDeadLetter func(*que.Job)) que.WorkFunc {
+	return func(j *que.Job) error {
+		err := wf(j)
+		if err == nil || err == errWorkerShutdown {
+			return err
+		}
+
+		_, permanent := err.(noRetryError)
+		if !permanent && j.ErrorCount+1 < models.MaxQueueJobAttempts() {
+			return err
+		}
+
+		db := database.GetGORMDbConnection()
+		defer database.Close(db)
+
+		dlj := models.NewDeadLetterJob(j, err)
+		if dlErr := models.SaveDeadLetterJob(db, &dlj); dlErr != nil {
+			// Leave the job on the queue so that it isn't lost
+			log.Errorf("Unable to move queue job %d to the dead-letter table: %s", j.ID, dlErr.Error())
+			return err
+		}
+		log.Errorf("Queue job %d failed %d time(s) and was moved to the dead-letter table. Last error: %s", j.ID, dlj.ErrorCount, err.Error())
+
+		if onDeadLetter != nil {
+			onDeadLetter(j)
+		}
+
+		// By returning a nil error response, we're signaling to que-go to remove this job from the jobqueue.
+		return nil
+	}
+}
+
+// failExportJob marks the export job that the dead-lettered queue job belongs to as Failed. Both export and finalize
+// queue jobs identify their export job by ID.
+func failExportJob(j *que.Job) {
+	var jobArgs models.JobEnqueueArgs
+	if err := json.Unmarshal(j.Args, &jobArgs); err != nil {
+		log.Error(err)
+		return
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var exportJob models.Job
+	if err := db.First(&exportJob, jobArgs.ID).Error; err != nil {
+		// The export job may not exist, e.g. when it's the reason the queue job was dead-lettered
+		log.Warnf("Unable to fail job %d for dead-lettered queue job %d: %s", jobArgs.ID, j.ID, err.Error())
+		return
+	}
+
+	if err := exportJob.Fail(db, fmt.Sprintf("queue job %d was moved to the dead-letter table", j.ID)); err != nil {
+		log.Error(err)
+	}
 }
 
-func setupQueue() *pgx.ConnPool {
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
+// enqueueNotification queues the webhook notification for a job that has completed or failed
+func enqueueNotification(job *models.Job) {
+	j, err := webhook.NewQueueJob(job)
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		return
+	}
+
+	if err = enqueueQueueJob(j); err != nil {
+		log.Errorf("Unable to queue notification for job %d: %s", job.ID, err.Error())
+	}
+}
+
+// newQueuePool connects to the database containing the job queue
+func newQueuePool() (*pgx.ConnPool, error) {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("QUEUE_DATABASE_URL"))
+	if err != nil {
+		return nil, err
 	}
 
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+	return pgx.NewConnPool(pgx.ConnPoolConfig{
 		ConnConfig:   pgxcfg,
 		AfterConnect: que.PrepareStatements,
 	})
+}
+
+func setupQueue() (*pgx.ConnPool, *workerPool) {
+	pgxpool, err := newQueuePool()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	qc = que.NewClient(pgxpool)
 	wm := que.WorkMap{
-		"ProcessJob": processJob,
+		"ProcessJob":           deadLetterAfterMaxAttempts(processJob, failExportJob),
+		models.FinalizeJobType: deadLetterAfterMaxAttempts(finalizeJob, failExportJob),
+		webhook.QueueJobType:   deadLetterAfterMaxAttempts(webhook.ProcessJob, nil),
 	}
+	models.SetJobNotifier(enqueueNotification)
 
 	workerPoolSize := utils.GetEnvInt("WORKER_POOL_SIZE", 2)
-	workers := que.NewWorkerPool(qc, wm, workerPoolSize)
-	go workers.Start()
+	workers := newWorkerPool(qc, wm, workerPoolSize)
+	workers.Start()
 
-	return pgxpool
+	return pgxpool, workers
 }
 
 func getQueueJobCount() float64 {
@@ -432,22 +892,67 @@ func getQueueJobCount() float64 {
 	return float64(count)
 }
 
-func updateJobStats(jID uint, db *gorm.DB) {
-	updateJobQueueCountCloudwatchMetric()
+// addJobFileName records the file written by a queue job, along with its claim type or secondary table files. It
+// returns true if the queue job was the last of the job's queue jobs to finish.
+func addJobFileName(fileName, resourceType string, stats fileStats, exportJob *models.Job, db *gorm.DB) (bool, error) {
+	var otherKeys []*models.JobKey
+	for _, f := range stats.otherFiles {
+		key := newJobKey(f.fileName, resourceType, f.stats)
+		key.ClaimType = f.claimType
+		key.OutputTable = f.table
+		otherKeys = append(otherKeys, key)
+	}
+
+	last, err := exportJob.CompleteQueueJob(db, newJobKey(fileName, resourceType, stats), otherKeys...)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return last, nil
+}
 
-	var j models.Job
-	if err := db.First(&j, jID).Error; err == nil {
-		db.Model(&j).Update(models.Job{CompletedJobCount: j.CompletedJobCount + 1})
+// newJobKey returns the key describing a file written by a queue job
+func newJobKey(fileName, resourceType string, stats fileStats) *models.JobKey {
+	key := &models.JobKey{FileName: fileName, ResourceType: resourceType, Checksum: stats.checksum,
+		FileSize: stats.size, ResourceCount: stats.count}
+	if stats.encryption != nil {
+		key.EncryptedKey = base64.StdEncoding.EncodeToString(stats.encryption.EncryptedKey)
+		key.Nonce = base64.StdEncoding.EncodeToString(stats.encryption.Nonce)
 	}
+	setErrorFile(key, stats.errorFile)
+	return key
 }
 
-func addJobFileName(fileName, resourceType string, exportJob models.Job, db *gorm.DB) error {
-	err := db.Create(&models.JobKey{JobID: exportJob.ID, FileName: fileName, ResourceType: resourceType}).Error
+// setErrorFile records the queue job's error file, if it wrote one, on the key of its main file
+func setErrorFile(key *models.JobKey, stats *fileStats) {
+	if stats == nil {
+		return
+	}
+	key.HasErrorFile = true
+	if stats.encryption != nil {
+		key.ErrorChecksum = stats.checksum
+		key.ErrorFileSize = stats.size
+		key.ErrorEncryptedKey = base64.StdEncoding.EncodeToString(stats.encryption.EncryptedKey)
+		key.ErrorNonce = base64.StdEncoding.EncodeToString(stats.encryption.Nonce)
+	}
+}
+
+// addFailedJobFileName records a queue job that exceeded the failure threshold in a job that allows partial exports.
+// The resources written before the threshold was exceeded are removed, since they don't include every beneficiary.
+// The queue job's error file, which explains the missing resources, is served in their place.
+// It returns true if the queue job was the last of the job's queue jobs to finish.
+func addFailedJobFileName(fileUUID string, stats fileStats, jobArgs models.JobEnqueueArgs, exportJob *models.Job, db *gorm.DB) (bool, error) {
+	fileName := fileUUID + tabular.Format(jobArgs.OutputFormat).FileExtension()
+	removeStagedFiles(fmt.Sprintf("%d/%s", exportJob.ID, fileName), fmt.Sprintf("%d/%s.gz", exportJob.ID, fileName))
+
+	key := &models.JobKey{FileName: fileName, ResourceType: jobArgs.ResourceType, Failed: true, HasErrorFile: true}
+	setErrorFile(key, stats.errorFile)
+	last, err := exportJob.CompleteQueueJob(db, key)
 	if err != nil {
 		log.Error(err)
-		return err
+		return false, err
 	}
-	return nil
+	return last, nil
 }
 
 func updateJobQueueCountCloudwatchMetric() {
@@ -480,9 +985,12 @@ func getSegment(ctx context.Context, name string) newrelic.Segment {
 func main() {
 	fmt.Println("Starting bcdaworker...")
 
-	workerPool := setupQueue()
+	workerPool, workers := setupQueue()
 	defer workerPool.Close()
 
+	stopRelay := startOutboxRelay(qc)
+	stopReaper := startStuckJobReaper(workerPool)
+
 	if hInt, err := strconv.Atoi(os.Getenv("WORKER_HEALTH_INT_SEC")); err == nil {
 		healthLogger := NewHealthLogger()
 		ticker := time.NewTicker(time.Duration(hInt) * time.Second)
@@ -501,4 +1009,7 @@ func main() {
 	}
 
 	waitForSig()
+	stopRelay()
+	stopReaper()
+	shutdownWorkers(workers, time.Duration(utils.GetEnvInt("BCDA_WORKER_SHUTDOWN_TIMEOUT_SEC", 20))*time.Second)
 }
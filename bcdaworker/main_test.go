@@ -2,18 +2,32 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/bgentry/que-go"
@@ -22,8 +36,13 @@ import (
 	"github.com/stretchr/testify/suite"
 
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/encryption"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	fhirmodels "github.com/CMSgov/bcda-app/bcda/models/fhir"
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/tabular"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
 )
 
@@ -32,6 +51,7 @@ type MainTestSuite struct {
 	reset   func()
 	db      *gorm.DB
 	testACO *models.ACO
+	queued  []*que.Job // jobs added to the queue by the test
 }
 
 func (s *MainTestSuite) SetupSuite() {
@@ -67,7 +87,15 @@ func (s *MainTestSuite) SetupTest() {
 	os.Setenv("BB_CLIENT_CA_FILE", "../shared_files/localhost.crt")
 	os.Setenv("ATO_PUBLIC_KEY_FILE", "../shared_files/ATO_public.pem")
 	os.Setenv("ATO_PRIVATE_KEY_FILE", "../shared_files/ATO_private.pem")
+	// Tests expect Blue Button IDs to be requested, so IDs cached by an earlier test must not be used
+	os.Setenv("BCDA_BB_ID_CACHE_TTL_HOURS", "0")
 	models.InitializeGormModels()
+
+	s.queued = nil
+	enqueueQueueJob = func(j *que.Job) error {
+		s.queued = append(s.queued, j)
+		return nil
+	}
 }
 
 func (s *MainTestSuite) TearDownTest() {
@@ -100,19 +128,33 @@ func (s *MainTestSuite) TestWriteEOBDataToFile() {
 		db.Create(&cclfBeneficiary)
 		defer db.Delete(&cclfBeneficiary)
 		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
-		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI)).Return(bbc.GetData("Patient", beneficiaryID))
+		// The saved Blue Button ID is used, so Blue Button is only asked for the EOBs
 		bbc.On("GetExplanationOfBenefit", beneficiaryIDs[i]).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryID))
 	}
 
-	_, err := writeBBDataToFile(context.Background(), &bbc, db, acoID.String(), cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
 	assert.NoError(s.T(), err)
 
+	// The file is written alongside a precompressed copy
 	files, err := ioutil.ReadDir(stagingDir)
 	assert.NoError(s.T(), err)
-	assert.Len(s.T(), files, 1)
+	assert.Len(s.T(), files, 2)
 
 	for _, f := range files {
 		filePath := fmt.Sprintf("%s/%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID, f.Name())
+		if f.Name() != fileUUID+".ndjson" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filePath)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), data, readGZIPFile(s.T(), filePath+".gz"))
+		os.Remove(filePath + ".gz")
+		checksum := sha256.Sum256(data)
+		assert.Equal(s.T(), hex.EncodeToString(checksum[:]), stats.checksum)
+		assert.Equal(s.T(), int64(len(data)), stats.size)
+		assert.Equal(s.T(), 66, stats.count)
+
 		file, err := os.Open(filePath)
 		if err != nil {
 			log.Fatal(err)
@@ -138,8 +180,341 @@ func (s *MainTestSuite) TestWriteEOBDataToFile() {
 	}
 }
 
+func (s *MainTestSuite) TestWriteEOBDataToFileCachedBlueButtonIDs() {
+	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
+	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
+	os.Setenv("EXPORT_FAIL_PCT", "70")
+	os.Setenv("BCDA_BB_ID_CACHE_TTL_HOURS", "1")
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	mbis := []string{"1C000000001", "1C000000002", "1C000000004"}
+	bbIDs := []string{"-19990000000001", "-19990000000002", "-19990000000004"}
+	_, err := models.InvalidateBlueButtonIDs(db, mbis...)
+	assert.NoError(s.T(), err)
+	defer models.InvalidateBlueButtonIDs(db, mbis...) // nolint
+
+	var cclfBeneficiaryIDs []string
+	for i, mbi := range mbis {
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: mbi}
+		db.Create(&cclfBeneficiary)
+		defer db.Unscoped().Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+		bbc.MBI = &mbis[i]
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(mbi)).Return(bbc.GetData("Patient", bbIDs[i]))
+	}
+
+	// The first beneficiary's ID is cached from an earlier job, but their EOBs can't be retrieved
+	assert.NoError(s.T(), models.CacheBlueButtonID(db, mbis[0], bbIDs[0]))
+	bbc.On("GetExplanationOfBenefit", bbIDs[0]).Return(nil, errors.New("patient not found"))
+	bbc.On("GetExplanationOfBenefit", bbIDs[1]).Return(bbc.GetBundleData("ExplanationOfBenefit", bbIDs[1]))
+	// The third beneficiary's ID is retrieved and cached by this job, but their EOBs can't be retrieved either
+	bbc.On("GetExplanationOfBenefit", bbIDs[2]).Return(nil, errors.New("patient not found"))
+
+	_, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 33, stats.count)
+
+	// Blue Button is only asked for the IDs that weren't cached
+	bbc.AssertNotCalled(s.T(), "GetPatientByIdentifierHash", client.HashIdentifier(mbis[0]))
+	bbc.AssertCalled(s.T(), "GetPatientByIdentifierHash", client.HashIdentifier(mbis[1]))
+	bbc.AssertCalled(s.T(), "GetPatientByIdentifierHash", client.HashIdentifier(mbis[2]))
+
+	// The retrieved ID is saved on the CCLF beneficiary, and the IDs of the beneficiaries whose data couldn't be
+	// retrieved are removed from them, whether they were cached earlier or by this job
+	for i, expected := range []string{"", bbIDs[1], ""} {
+		var cclfBeneficiary models.CCLFBeneficiary
+		assert.NoError(s.T(), db.First(&cclfBeneficiary, cclfBeneficiaryIDs[i]).Error)
+		assert.Equal(s.T(), expected, cclfBeneficiary.BlueButtonID)
+	}
+
+	// The retrieved ID is cached and the IDs of the beneficiaries whose data couldn't be retrieved are invalidated
+	cached, err := models.GetCachedBlueButtonIDs(db, mbis)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{mbis[1]: bbIDs[1]}, cached)
+}
+
+func (s *MainTestSuite) TestWriteEOBDataToFileStoredBlueButtonID() {
+	os.Setenv("BCDA_BB_ID_CACHE_TTL_HOURS", "1")
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	mbi, bbID := "1C000000003", "-19990000000003"
+	_, err := models.InvalidateBlueButtonIDs(db, mbi)
+	assert.NoError(s.T(), err)
+
+	// The beneficiary's ID isn't cached, but it was saved by an earlier job
+	cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: mbi, BlueButtonID: bbID}
+	db.Create(&cclfBeneficiary)
+	defer db.Unscoped().Delete(&cclfBeneficiary)
+	bbc.MBI = &mbi
+	bbc.On("GetExplanationOfBenefit", bbID).Return(bbc.GetBundleData("ExplanationOfBenefit", bbID))
+
+	cclfBeneficiaryIDs := []string{strconv.FormatUint(uint64(cclfBeneficiary.ID), 10)}
+	_, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 33, stats.count)
+
+	// Blue Button isn't asked for the saved ID
+	bbc.AssertNotCalled(s.T(), "GetPatientByIdentifierHash", client.HashIdentifier(mbi))
+	bbc.AssertExpectations(s.T())
+}
+
+func (s *MainTestSuite) TestWriteEOBDataToFileCompressedOnly() {
+	origKeep := os.Getenv("BCDA_WORKER_KEEP_UNCOMPRESSED")
+	defer os.Setenv("BCDA_WORKER_KEEP_UNCOMPRESSED", origKeep)
+	os.Setenv("BCDA_WORKER_KEEP_UNCOMPRESSED", "false")
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	beneficiaryID := "a1000003701"
+	cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+	db.Create(&cclfBeneficiary)
+	defer db.Delete(&cclfBeneficiary)
+
+	bbc := testUtils.BlueButtonClient{}
+	bbc.MBI = &beneficiaryID
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryID)).Return(bbc.GetData("Patient", beneficiaryID))
+	bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryID))
+
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil,
+		newEOBJobArgs(s.T(), acoID.String(), jobID, []string{strconv.FormatUint(uint64(cclfBeneficiary.ID), 10)}))
+	assert.NoError(s.T(), err)
+
+	files, err := ioutil.ReadDir(stagingDir)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), files, 1)
+	assert.Equal(s.T(), fileUUID+".ndjson.gz", files[0].Name())
+
+	// The recorded checksum and size describe the uncompressed data
+	data := readGZIPFile(s.T(), fmt.Sprintf("%s/%s", stagingDir, files[0].Name()))
+	checksum := sha256.Sum256(data)
+	assert.Equal(s.T(), hex.EncodeToString(checksum[:]), stats.checksum)
+	assert.Equal(s.T(), int64(len(data)), stats.size)
+	assert.Equal(s.T(), 33, stats.count)
+}
+
+func (s *MainTestSuite) TestWriteEOBDataToFileEncrypted() {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(s.T(), err)
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	beneficiaryID := "a1000003701"
+	cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+	db.Create(&cclfBeneficiary)
+	defer db.Delete(&cclfBeneficiary)
+
+	bbc := testUtils.BlueButtonClient{}
+	bbc.MBI = &beneficiaryID
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryID)).Return(bbc.GetData("Patient", beneficiaryID))
+	bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryID))
+
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, &privateKey.PublicKey,
+		newEOBJobArgs(s.T(), acoID.String(), jobID, []string{strconv.FormatUint(uint64(cclfBeneficiary.ID), 10)}))
+	assert.NoError(s.T(), err)
+
+	// Only the encrypted file is written
+	files, err := ioutil.ReadDir(stagingDir)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), files, 1)
+	assert.Equal(s.T(), fileUUID+".ndjson", files[0].Name())
+
+	// The recorded checksum and size describe the encrypted file
+	ciphertext, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", stagingDir, files[0].Name()))
+	assert.NoError(s.T(), err)
+	checksum := sha256.Sum256(ciphertext)
+	assert.Equal(s.T(), hex.EncodeToString(checksum[:]), stats.checksum)
+	assert.Equal(s.T(), int64(len(ciphertext)), stats.size)
+	assert.Equal(s.T(), 33, stats.count)
+
+	// The file is large enough to be encrypted in several segments
+	assert.True(s.T(), len(ciphertext) > 2*encryption.SegmentSize)
+
+	if assert.NotNil(s.T(), stats.encryption) {
+		data, err := encryption.Decrypt(ciphertext, *stats.encryption, privateKey)
+		assert.NoError(s.T(), err)
+		assert.Len(s.T(), strings.Split(strings.TrimSpace(string(data)), "\n"), 33)
+		assert.Contains(s.T(), string(data), `"resourceType":"ExplanationOfBenefit"`)
+	}
+}
+
+func (s *MainTestSuite) TestWriteEOBDataToFileSplitClaimTypes() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	beneficiaryID := "a1000003701"
+	cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+	db.Create(&cclfBeneficiary)
+	defer db.Delete(&cclfBeneficiary)
+
+	bbc := testUtils.BlueButtonClient{}
+	bbc.MBI = &beneficiaryID
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryID)).Return(bbc.GetData("Patient", beneficiaryID))
+	bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryID))
+
+	jobArgs := newEOBJobArgs(s.T(), acoID.String(), jobID, []string{strconv.FormatUint(uint64(cclfBeneficiary.ID), 10)})
+	jobArgs.SplitClaimTypes = true
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, jobArgs)
+	assert.NoError(s.T(), err)
+
+	// Every EOB in the test data is a carrier claim, so the main file is empty
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.ndjson", stagingDir, fileUUID))
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), data)
+	assert.Equal(s.T(), 0, stats.count)
+
+	if assert.Len(s.T(), stats.otherFiles, 1) {
+		f := stats.otherFiles[0]
+		assert.Equal(s.T(), "carrier", f.claimType)
+		assert.Equal(s.T(), fileUUID+"-carrier.ndjson", f.fileName)
+		assert.Equal(s.T(), 33, f.stats.count)
+
+		filePath := fmt.Sprintf("%s/%s", stagingDir, f.fileName)
+		data, err := ioutil.ReadFile(filePath)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), data, readGZIPFile(s.T(), filePath+".gz"))
+		checksum := sha256.Sum256(data)
+		assert.Equal(s.T(), hex.EncodeToString(checksum[:]), f.stats.checksum)
+		assert.Equal(s.T(), int64(len(data)), f.stats.size)
+		assert.Len(s.T(), strings.Split(strings.TrimSpace(string(data)), "\n"), 33)
+	}
+}
+
+func (s *MainTestSuite) TestWriteEOBDataToFileTabular() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	beneficiaryID := "a1000003701"
+	cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+	db.Create(&cclfBeneficiary)
+	defer db.Delete(&cclfBeneficiary)
+
+	bbc := testUtils.BlueButtonClient{}
+	bbc.MBI = &beneficiaryID
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryID)).Return(bbc.GetData("Patient", beneficiaryID))
+	bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryID))
+
+	jobArgs := newEOBJobArgs(s.T(), acoID.String(), jobID, []string{strconv.FormatUint(uint64(cclfBeneficiary.ID), 10)})
+	jobArgs.OutputFormat = string(tabular.CSV)
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, jobArgs)
+	assert.NoError(s.T(), err)
+
+	// The main file holds the eob table, with a row per resource
+	filePath := fmt.Sprintf("%s/%s.csv", stagingDir, fileUUID)
+	data, err := ioutil.ReadFile(filePath)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), data, readGZIPFile(s.T(), filePath+".gz"))
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	assert.NoError(s.T(), err)
+	if assert.Len(s.T(), rows, 34) {
+		assert.Equal(s.T(), "eob_id", rows[0][0])
+		assert.Equal(s.T(), "carrier-10300336722", rows[1][0])
+	}
+	assert.Equal(s.T(), 33, stats.count)
+	checksum := sha256.Sum256(data)
+	assert.Equal(s.T(), hex.EncodeToString(checksum[:]), stats.checksum)
+
+	// The eob_line table has a row per item
+	if assert.Len(s.T(), stats.otherFiles, 1) {
+		f := stats.otherFiles[0]
+		assert.Equal(s.T(), "eob_line", f.table)
+		assert.Empty(s.T(), f.claimType)
+		assert.Equal(s.T(), fileUUID+"-eob_line.csv", f.fileName)
+		assert.Equal(s.T(), 52, f.stats.count)
+
+		data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", stagingDir, f.fileName))
+		assert.NoError(s.T(), err)
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		assert.NoError(s.T(), err)
+		assert.Len(s.T(), rows, 53)
+	}
+}
+
+func TestEOBClaimType(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		expected string
+	}{
+		{"Carrier", `{"type":{"coding":[{"system":"https://bluebutton.cms.gov/resources/codesystem/eob-type","code":"CARRIER"}]}}`, "carrier"},
+		{"OtherCodings", `{"type":{"coding":[{"system":"http://hl7.org/fhir/ex-claimtype","code":"institutional"},` +
+			`{"system":"https://bluebutton.cms.gov/resources/codesystem/eob-type","code":"SNF"}]}}`, "snf"},
+		{"UnknownClaimType", `{"type":{"coding":[{"system":"https://bluebutton.cms.gov/resources/codesystem/eob-type","code":"OTHER"}]}}`, ""},
+		{"OtherSystem", `{"type":{"coding":[{"system":"http://hl7.org/fhir/ex-claimtype","code":"professional"}]}}`, ""},
+		{"NoType", `{"resourceType":"ExplanationOfBenefit"}`, ""},
+		{"InvalidJSON", `{"type":`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, eobClaimType([]byte(tt.resource)))
+		})
+	}
+}
+
 func (s *MainTestSuite) TestWriteEOBDataToFileNoClient() {
-	_, err := writeBBDataToFile(context.Background(), nil, nil, "9c05c1f8-349d-400f-9b69-7963f2262b08", "A00234", []string{"20000", "21000"}, "1", "ExplanationOfBenefit", "", time.Now())
+	_, _, err := writeBBDataToFile(context.Background(), nil, nil, "A00234", nil, newEOBJobArgs(s.T(), "9c05c1f8-349d-400f-9b69-7963f2262b08", "1", []string{"20000", "21000"}))
 	assert.NotNil(s.T(), err)
 }
 
@@ -151,7 +526,7 @@ func (s *MainTestSuite) TestWriteEOBDataToFileInvalidACO() {
 
 	db := database.GetGORMDbConnection()
 	defer db.Close()
-	_, err := writeBBDataToFile(context.Background(), &bbc, db, acoID, cmsID, beneficiaryIDs, "1", "ExplanationOfBenefit", "", time.Now())
+	_, _, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID, "1", beneficiaryIDs))
 	assert.NotNil(s.T(), err)
 }
 
@@ -181,7 +556,6 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsBelowFailureThreshold()
 		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
 		db.Create(&cclfBeneficiary)
 		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
-		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI)).Return(bbc.GetData("Patient", beneficiaryID))
 		defer db.Delete(&cclfBeneficiary)
 
 	}
@@ -190,8 +564,9 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsBelowFailureThreshold()
 	os.RemoveAll(stagingDir)
 	testUtils.CreateStaging(jobID)
 
-	fileUUID, err := writeBBDataToFile(context.Background(), &bbc, db, acoID.String(), cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
 	assert.NoError(s.T(), err)
+	assert.NotNil(s.T(), stats.errorFile)
 
 	errorFilePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_STAGING_DIR"), jobID, fileUUID)
 	fData, err := ioutil.ReadFile(errorFilePath)
@@ -206,9 +581,56 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsBelowFailureThreshold()
 	os.Remove(errorFilePath)
 }
 
+// TestWriteEOBDataToFilePartialBeneficiary verifies that the pages received for a beneficiary before a later page fails
+// are exported, and that the error says that the beneficiary's resources are partial
+func (s *MainTestSuite) TestWriteEOBDataToFilePartialBeneficiary() {
+	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
+	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
+	os.Setenv("EXPORT_FAIL_PCT", "70")
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	bbc := streamingBlueButtonClient{BlueButtonClient: &testUtils.BlueButtonClient{}, failAfter: map[string]int{beneficiaryIDs[0]: 2}}
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	var cclfBeneficiaryIDs []string
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+
+	for _, beneficiaryID := range beneficiaryIDs {
+		bbc.On("GetExplanationOfBenefit", beneficiaryID).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryID))
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+		defer db.Delete(&cclfBeneficiary)
+	}
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	fileUUID, stats, err := writeBBDataToFile(context.Background(), bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
+	assert.NoError(s.T(), err)
+	// Two resources of the first beneficiary and all 33 of the second
+	assert.Equal(s.T(), 35, stats.count)
+
+	fData, err := ioutil.ReadFile(fmt.Sprintf("%s/%s-error.ndjson", stagingDir, fileUUID))
+	assert.NoError(s.T(), err)
+	msg := fmt.Sprintf("Error retrieving ExplanationOfBenefit for beneficiary %s in ACO %s; only the first 2 page(s) of resources were exported", beneficiaryIDs[0], acoID)
+	ooResp := fmt.Sprintf(`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"exception","details":{"coding":[{"system":"http://hl7.org/fhir/ValueSet/operation-outcome","code":"Blue Button Error","display":"%s"}],"text":"%s"}}]}`, msg, msg)
+	assert.Equal(s.T(), ooResp+"\n", string(fData))
+}
+
 func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsAboveFailureThreshold() {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
+	// Retrieve the beneficiaries one at a time to verify that no more are requested once the threshold is reached
+	origConcurrency := os.Getenv("BCDA_WORKER_BENE_CONCURRENCY")
+	defer os.Setenv("BCDA_WORKER_BENE_CONCURRENCY", origConcurrency)
+	os.Setenv("BCDA_WORKER_BENE_CONCURRENCY", "1")
 	os.Setenv("EXPORT_FAIL_PCT", "60")
 
 	bbc := testUtils.BlueButtonClient{}
@@ -216,10 +638,6 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsAboveFailureThreshold()
 	beneficiaryIDs := []string{"a1000089833", "a1000065301", "a1000012463"}
 	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[0]).Return(nil, errors.New("error"))
 	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[1]).Return(nil, errors.New("error"))
-	bbc.MBI = &beneficiaryIDs[0]
-	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[0])).Return(bbc.GetData("Patient", beneficiaryIDs[0]))
-	bbc.MBI = &beneficiaryIDs[1]
-	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[1])).Return(bbc.GetData("Patient", beneficiaryIDs[1]))
 	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
 	var cclfBeneficiaryIDs []string
 	db := database.GetGORMDbConnection()
@@ -239,20 +657,23 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsAboveFailureThreshold()
 	jobID := generateUniqueJobID(s.T(), db, acoID)
 	testUtils.CreateStaging(jobID)
 
-	_, err := writeBBDataToFile(context.Background(), &bbc, db, acoID.String(), cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	fileUUID, _, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
 	assert.Equal(s.T(), "number of failed requests has exceeded threshold", err.Error())
+	// The error file is identified so that it can be served in a partial export
+	assert.NotEmpty(s.T(), fileUUID)
 
 	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
 	files, err := ioutil.ReadDir(stagingDir)
 	assert.NoError(s.T(), err)
-	assert.Equal(s.T(), 2, len(files))
+	assert.Equal(s.T(), 3, len(files))
 
 	errorFilePath := fmt.Sprintf("%s/%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID, files[0].Name())
 	fData, err := ioutil.ReadFile(errorFilePath)
 	assert.NoError(s.T(), err)
 
 	ooResp := fmt.Sprintf(`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"exception","details":{"coding":[{"system":"http://hl7.org/fhir/ValueSet/operation-outcome","code":"Blue Button Error","display":"Error retrieving ExplanationOfBenefit for beneficiary a1000089833 in ACO %s"}],"text":"Error retrieving ExplanationOfBenefit for beneficiary a1000089833 in ACO %s"}}]}
-{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"exception","details":{"coding":[{"system":"http://hl7.org/fhir/ValueSet/operation-outcome","code":"Blue Button Error","display":"Error retrieving ExplanationOfBenefit for beneficiary a1000065301 in ACO %s"}],"text":"Error retrieving ExplanationOfBenefit for beneficiary a1000065301 in ACO %s"}}]}`, acoID, acoID, acoID, acoID)
+{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"exception","details":{"coding":[{"system":"http://hl7.org/fhir/ValueSet/operation-outcome","code":"Blue Button Error","display":"Error retrieving ExplanationOfBenefit for beneficiary a1000065301 in ACO %s"}],"text":"Error retrieving ExplanationOfBenefit for beneficiary a1000065301 in ACO %s"}}]}
+{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"exception","details":{"coding":[{"system":"http://hl7.org/fhir/ValueSet/operation-outcome","code":"Blue Button Error","display":"ExplanationOfBenefit resources were not exported for 3 beneficiaries because too many requests to Blue Button failed"}],"text":"ExplanationOfBenefit resources were not exported for 3 beneficiaries because too many requests to Blue Button failed"}}]}`, acoID, acoID, acoID, acoID)
 	assert.Equal(s.T(), ooResp+"\n", string(fData))
 	bbc.AssertExpectations(s.T())
 	// should not have requested third beneficiary EOB because failure threshold was reached after second
@@ -292,12 +713,12 @@ func (s *MainTestSuite) TestWriteEOBDataToFile_BlueButtonIDNotFound() {
 		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
 	}
 
-	_, err := writeBBDataToFile(context.Background(), &bbc, db, acoID.String(), cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	_, _, err := writeBBDataToFile(context.Background(), &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, cclfBeneficiaryIDs))
 	assert.EqualError(s.T(), err, "number of failed requests has exceeded threshold")
 
 	files, err := ioutil.ReadDir(stagingDir)
 	assert.NoError(s.T(), err)
-	assert.Equal(s.T(), 2, len(files))
+	assert.Equal(s.T(), 3, len(files))
 
 	dataFilePath := fmt.Sprintf("%s/%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID, files[1].Name())
 	dataFile, err := os.Open(dataFilePath)
@@ -336,6 +757,107 @@ func (s *MainTestSuite) TestWriteEOBDataToFile_BlueButtonIDNotFound() {
 	os.Remove(errorFilePath)
 }
 
+func TestFetchBeneData(t *testing.T) {
+	ids := make([]string, 50)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+
+	var mu sync.Mutex
+	var active, maxActive int
+	fetch := func(id string, send client.BundlePageFunc) (string, error) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		// Complete the requests out of order
+		i, _ := strconv.Atoi(id)
+		time.Sleep(time.Duration(len(ids)-i) * 100 * time.Microsecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		for p := 0; p < 2; p++ {
+			if err := send(&fhirmodels.RawBundle{Resource: fhirmodels.Resource{ID: fmt.Sprintf("%s-%d", id, p)}}); err != nil {
+				return "", err
+			}
+		}
+		return id, nil
+	}
+
+	results := fetchBeneData(context.Background(), ids, 5, fetch)
+	assert.Len(t, results, len(ids))
+	for i, id := range ids {
+		var pages []string
+		for page := range results[i].pages {
+			pages = append(pages, page.ID)
+		}
+		assert.Equal(t, []string{id + "-0", id + "-1"}, pages)
+		assert.Equal(t, id, results[i].errMsg)
+	}
+	assert.True(t, maxActive > 1, "beneficiaries should be fetched concurrently")
+	assert.True(t, maxActive <= 5, "no more than 5 beneficiaries should be fetched at once")
+
+	// Nothing is fetched once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var fetched int32
+	fetchBeneData(ctx, ids, 5, func(id string, send client.BundlePageFunc) (string, error) {
+		atomic.AddInt32(&fetched, 1)
+		return "", nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fetched))
+}
+
+// TestFetchBeneDataBoundsPages verifies that pages aren't accumulated in memory while they're waiting to be written
+func TestFetchBeneDataBoundsPages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var sent int32
+	results := fetchBeneData(ctx, []string{"0"}, 1, func(id string, send client.BundlePageFunc) (string, error) {
+		for p := 0; p < 100; p++ {
+			if err := send(&fhirmodels.RawBundle{}); err != nil {
+				return "error sending page", err
+			}
+			atomic.AddInt32(&sent, 1)
+		}
+		return "", nil
+	})
+
+	// Only the buffered page is sent until the pages are read
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sent))
+
+	// Once the context is done, the blocked page is abandoned
+	cancel()
+	for range results[0].pages {
+	}
+	assert.Equal(t, context.Canceled, results[0].err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sent))
+}
+
+func TestBeneConcurrency(t *testing.T) {
+	defer os.Unsetenv("BCDA_WORKER_BENE_CONCURRENCY")
+	defer os.Unsetenv("BCDA_WORKER_BENE_CONCURRENCY_COVERAGE")
+
+	assert.Equal(t, 4, beneConcurrency("Coverage"))
+
+	os.Setenv("BCDA_WORKER_BENE_CONCURRENCY", "8")
+	assert.Equal(t, 8, beneConcurrency("Coverage"))
+	assert.Equal(t, 8, beneConcurrency("ExplanationOfBenefit"))
+
+	os.Setenv("BCDA_WORKER_BENE_CONCURRENCY_COVERAGE", "2")
+	assert.Equal(t, 2, beneConcurrency("Coverage"))
+	assert.Equal(t, 8, beneConcurrency("ExplanationOfBenefit"))
+
+	os.Setenv("BCDA_WORKER_BENE_CONCURRENCY", "0")
+	assert.Equal(t, 1, beneConcurrency("ExplanationOfBenefit"))
+}
+
 func (s *MainTestSuite) TestGetFailureThreshold() {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
@@ -353,24 +875,55 @@ func (s *MainTestSuite) TestGetFailureThreshold() {
 	assert.Equal(s.T(), 50.0, getFailureThreshold())
 }
 
-func (s *MainTestSuite) TestAppendErrorToFile() {
+func (s *MainTestSuite) TestErrorFile() {
 	db := database.GetGORMDbConnection()
 	defer db.Close()
 
 	acoID := s.testACO.UUID
 	jobID := generateUniqueJobID(s.T(), db, acoID)
 	testUtils.CreateStaging(jobID)
-	appendErrorToFile(context.Background(), acoID.String(), "", "", "", jobID)
-
 	filePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_STAGING_DIR"), jobID, acoID)
+	defer os.Remove(filePath)
+
+	// The file is only written if there are errors
+	errs := newErrorFile(constants.V1Version, jobID, acoID.String())
+	stats, err := errs.write(storage.Get(), nil)
+	assert.NoError(s.T(), err)
+	assert.Nil(s.T(), stats)
+	_, err = os.Stat(filePath)
+	assert.True(s.T(), os.IsNotExist(err))
+
+	errs.add(context.Background(), "", "", "")
+	errs.add(context.Background(), "", "", "")
+	stats, err = errs.write(storage.Get(), nil)
+	assert.NoError(s.T(), err)
+	if assert.NotNil(s.T(), stats) {
+		assert.Equal(s.T(), 2, stats.count)
+		assert.Nil(s.T(), stats.encryption)
+	}
+
 	fData, err := ioutil.ReadFile(filePath)
 	assert.NoError(s.T(), err)
 
 	ooResp := `{"resourceType":"OperationOutcome","issue":[{"severity":"error"}]}`
 
-	assert.Equal(s.T(), ooResp+"\n", string(fData))
+	assert.Equal(s.T(), ooResp+"\n"+ooResp+"\n", string(fData))
 
-	os.Remove(filePath)
+	// The errors identify beneficiaries, so they're encrypted when the job's files are
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(s.T(), err)
+	stats, err = errs.write(storage.Get(), &privateKey.PublicKey)
+	assert.NoError(s.T(), err)
+	ciphertext, err := ioutil.ReadFile(filePath)
+	assert.NoError(s.T(), err)
+	if assert.NotNil(s.T(), stats) && assert.NotNil(s.T(), stats.encryption) {
+		checksum := sha256.Sum256(ciphertext)
+		assert.Equal(s.T(), hex.EncodeToString(checksum[:]), stats.checksum)
+		assert.Equal(s.T(), int64(len(ciphertext)), stats.size)
+		plaintext, err := encryption.Decrypt(ciphertext, *stats.encryption, privateKey)
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), string(fData), string(plaintext))
+	}
 }
 
 func (s *MainTestSuite) TestProcessJobEOB() {
@@ -410,7 +963,7 @@ func (s *MainTestSuite) TestProcessJobEOB() {
 	err = db.First(&completedJob, "ID = ?", jobArgs.ID).Error
 	assert.Nil(s.T(), err)
 	// As this test actually connects to BB, we can't be sure it will succeed
-	assert.Contains(s.T(), []string{"Failed", "Completed"}, completedJob.Status)
+	assert.Contains(s.T(), []models.JobStatus{models.JobStatusFailed, models.JobStatusCompleted}, completedJob.Status)
 }
 
 func (s *MainTestSuite) TestProcessJob_InvalidArgs() {
@@ -467,64 +1020,502 @@ func (s *MainTestSuite) TestProcessJob_NoBBClient() {
 	db.Unscoped().Delete(&j)
 }
 
+func (s *MainTestSuite) TestProcessJob_Cancelled() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "Cancelled",
+		JobCount:   1,
+	}
+	db.Save(&j)
+	defer db.Unscoped().Delete(&j)
+
+	qjArgs, _ := json.Marshal(models.JobEnqueueArgs{
+		ID:             int(j.ID),
+		ACOID:          j.ACOID.String(),
+		BeneficiaryIDs: []string{},
+		ResourceType:   "Patient",
+	})
+
+	qj := que.Job{
+		Type: "ProcessJob",
+		Args: qjArgs,
+	}
+
+	// No Blue Button client is available, so the job must be skipped before any data is requested
+	origBBCert := os.Getenv("BB_CLIENT_CERT_FILE")
+	defer os.Setenv("BB_CLIENT_CERT_FILE", origBBCert)
+	os.Unsetenv("BB_CLIENT_CERT_FILE")
+
+	assert.NoError(s.T(), processJob(&qj))
+
+	var actual models.Job
+	assert.NoError(s.T(), db.First(&actual, j.ID).Error)
+	assert.Equal(s.T(), models.JobStatusCancelled, actual.Status)
+	assert.Equal(s.T(), 0, actual.CompletedJobCount)
+}
+
+// A queue job for a job that has already failed, e.g. because one of its sibling queue jobs was dead-lettered, must
+// not resume it
+func (s *MainTestSuite) TestProcessJob_Failed() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	j := models.Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     models.JobStatusFailed,
+		JobCount:   2,
+	}
+	db.Save(&j)
+	defer db.Unscoped().Delete(&j)
+	defer db.Delete(models.JobStatusHistory{}, "job_id = ?", j.ID)
+
+	qjArgs, _ := json.Marshal(models.JobEnqueueArgs{
+		ID:             int(j.ID),
+		ACOID:          j.ACOID.String(),
+		BeneficiaryIDs: []string{},
+		ResourceType:   "Patient",
+	})
+
+	qj := que.Job{
+		Type: "ProcessJob",
+		Args: qjArgs,
+	}
+
+	// The status is checked before the Blue Button client is created
+	origBBCert := os.Getenv("BB_CLIENT_CERT_FILE")
+	defer os.Setenv("BB_CLIENT_CERT_FILE", origBBCert)
+	os.Unsetenv("BB_CLIENT_CERT_FILE")
+
+	assert.Contains(s.T(), processJob(&qj).Error(), "could not create Blue Button client")
+
+	var actual models.Job
+	assert.NoError(s.T(), db.First(&actual, j.ID).Error)
+	assert.Equal(s.T(), models.JobStatusFailed, actual.Status)
+	history, err := models.GetJobStatusHistory(db, j.ID)
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), history)
+}
+
+// TestProcessJobV2 uses a fake BFD that only serves R4 data from the v2 endpoints to verify that
+// v2 jobs write R4 resources and R4 OperationOutcomes
+func (s *MainTestSuite) TestProcessJobV2() {
+	var (
+		paths []string
+		mu    sync.Mutex
+	)
+	bfd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		if !strings.HasPrefix(r.URL.Path, "/v2/fhir/") {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		resourceType := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/fhir/"), "/")
+		http.ServeFile(w, r, fmt.Sprintf("../bcda/client/testdata/v2/%s.json", resourceType))
+	}))
+	defer bfd.Close()
+
+	for k, v := range map[string]string{"BB_SERVER_LOCATION": bfd.URL, "BB_CHECK_CERT": "false", "EXPORT_FAIL_PCT": "70"} {
+		orig := os.Getenv(k)
+		defer os.Setenv(k, orig)
+		os.Setenv(k, v)
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := *s.testACO.CMSID
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 20, Name: uuid.New()}
+	assert.NoError(s.T(), db.Create(&cclfFile).Error)
+	defer db.Unscoped().Delete(&cclfFile)
+
+	// The fake BFD always returns the patient with this MBI, so the lookup for the second beneficiary fails
+	var cclfBeneficiaryIDs []string
+	for _, mbi := range []string{"-1Q03Z002871", "1A00A00AA00"} {
+		bene := models.CCLFBeneficiary{FileID: cclfFile.ID, MBI: mbi}
+		assert.NoError(s.T(), db.Create(&bene).Error)
+		defer db.Unscoped().Delete(&bene)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(bene.ID), 10))
+	}
+
+	j := models.Job{
+		ACOID:      s.testACO.UUID,
+		RequestURL: "/api/v2/Patient/$export",
+		Status:     "Pending",
+		JobCount:   1,
+		Version:    constants.V2Version,
+	}
+	assert.NoError(s.T(), db.Save(&j).Error)
+	defer db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+
+	qjArgs, err := json.Marshal(models.JobEnqueueArgs{
+		ID:              int(j.ID),
+		ACOID:           j.ACOID.String(),
+		BeneficiaryIDs:  cclfBeneficiaryIDs,
+		ResourceType:    "ExplanationOfBenefit",
+		TransactionTime: time.Now(),
+		Version:         constants.V2Version,
+	})
+	assert.NoError(s.T(), err)
+
+	payloadDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), j.ID)
+	defer os.RemoveAll(payloadDir)
+
+	assert.NoError(s.T(), processJob(&que.Job{Type: "ProcessJob", Args: qjArgs}))
+
+	// The job's only queue job finished, so the job is finalized
+	assert.Len(s.T(), s.queued, 1)
+	assert.Equal(s.T(), models.FinalizeJobType, s.queued[0].Type)
+	assert.NoError(s.T(), finalizeJob(s.queued[0]))
+
+	var jobKey models.JobKey
+	assert.NoError(s.T(), db.First(&jobKey, "job_id = ?", j.ID).Error)
+	assert.Equal(s.T(), 2, jobKey.ResourceCount)
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", payloadDir, strings.TrimSpace(jobKey.FileName)))
+	assert.NoError(s.T(), err)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		eob, err := fhir.UnmarshalExplanationOfBenefit(scanner.Bytes())
+		assert.NoError(s.T(), err)
+		assert.Equal(s.T(), fhir.ClaimProcessingCodesComplete, eob.Outcome)
+	}
+
+	assert.True(s.T(), jobKey.HasErrorFile)
+	errorFileName := strings.TrimSuffix(strings.TrimSpace(jobKey.FileName), ".ndjson") + "-error.ndjson"
+	data, err = ioutil.ReadFile(fmt.Sprintf("%s/%s", payloadDir, errorFileName))
+	assert.NoError(s.T(), err)
+	oo, err := fhir.UnmarshalOperationOutcome(bytes.TrimSpace(data))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), fhir.IssueSeverityError, oo.Issue[0].Severity)
+	assert.Equal(s.T(), fhir.IssueTypeException, oo.Issue[0].Code)
+	assert.Equal(s.T(), fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", cclfBeneficiaryIDs[1]), *oo.Issue[0].Details.Text)
+
+	for _, path := range paths {
+		assert.True(s.T(), strings.HasPrefix(path, "/v2/fhir/"), "%s is not a v2 path", path)
+	}
+}
+
 func (s *MainTestSuite) TestSetupQueue() {
 	setupQueue()
 	os.Setenv("WORKER_POOL_SIZE", "7")
 	setupQueue()
 }
 
-func (s *MainTestSuite) TestUpdateJobStats() {
+func (s *MainTestSuite) TestWriteEOBDataToFileInterrupted() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	acoID, cmsID := s.testACO.UUID, *s.testACO.CMSID
+	jobID := generateUniqueJobID(s.T(), db, acoID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	// The worker is shutting down, so no data should be requested from Blue Button
+	bbc := testUtils.BlueButtonClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := writeBBDataToFile(ctx, &bbc, db, cmsID, nil, newEOBJobArgs(s.T(), acoID.String(), jobID, []string{"1", "2"}))
+	assert.Equal(s.T(), errWorkerShutdown, err)
+	bbc.AssertExpectations(s.T())
+
+	// Partially written files are removed
+	files, err := ioutil.ReadDir(stagingDir)
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), files)
+}
+
+func (s *MainTestSuite) TestAddJobFileName() {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
 
-	j := models.Job{
-		ACOID:             uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
-		RequestURL:        "",
-		Status:            "",
-		JobCount:          4,
-		CompletedJobCount: 1,
+	j := models.Job{ACOID: s.testACO.UUID, RequestURL: "/api/v1/Patient/$export", Status: models.JobStatusInProgress,
+		JobCount: 2}
+	assert.NoError(s.T(), db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+	defer db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+
+	stats := fileStats{checksum: strings.Repeat("0", 64), size: 2, count: 1}
+	last, err := addJobFileName("first.ndjson", "Patient", stats, &j, db)
+	assert.NoError(s.T(), err)
+	assert.False(s.T(), last)
+
+	// The envelopes of encrypted files are recorded with them, and claim type files are recorded with the queue job's
+	// main file
+	stats.encryption = &encryption.Envelope{EncryptedKey: []byte("key"), Nonce: []byte("nonce")}
+	stats.otherFiles = []otherFile{{claimType: "carrier", fileName: "second-carrier.ndjson",
+		stats: fileStats{checksum: strings.Repeat("1", 64), size: 4, count: 2}}}
+	last, err = addJobFileName("second.ndjson", "Patient", stats, &j, db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), last)
+
+	var actual models.Job
+	assert.NoError(s.T(), db.First(&actual, j.ID).Error)
+	assert.Equal(s.T(), 2, actual.CompletedJobCount)
+	finished, err := models.CountFinishedQueueJobs(db, j.ID, false)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 2, finished)
+
+	var keys []models.JobKey
+	assert.NoError(s.T(), db.Order("file_name").Find(&keys, "job_id = ?", j.ID).Error)
+	if assert.Len(s.T(), keys, 3) {
+		assert.Empty(s.T(), keys[0].EncryptedKey)
+		assert.Empty(s.T(), keys[0].Nonce)
+		assert.Equal(s.T(), "second-carrier.ndjson", strings.TrimSpace(keys[1].FileName))
+		assert.Equal(s.T(), "carrier", keys[1].ClaimType)
+		assert.Equal(s.T(), 2, keys[1].ResourceCount)
+		assert.Empty(s.T(), keys[1].EncryptedKey)
+		assert.Empty(s.T(), keys[2].ClaimType)
+		assert.Equal(s.T(), "a2V5", keys[2].EncryptedKey)
+		assert.Equal(s.T(), "bm9uY2U=", keys[2].Nonce)
 	}
-	db.Create(&j)
-	updateJobStats(j.ID, db)
-	db.First(&j, j.ID)
-	assert.Equal(s.T(), 2, j.CompletedJobCount)
+}
+
+func (s *MainTestSuite) TestFinalizeJob() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	j := models.Job{ACOID: s.testACO.UUID, RequestURL: "/api/v1/Patient/$export", Status: models.JobStatusInProgress,
+		JobCount: 1}
+	assert.NoError(s.T(), db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+	defer db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+	defer db.Unscoped().Delete(models.JobStatusHistory{}, "job_id = ?", j.ID)
+
+	os.Setenv("FHIR_STAGING_DIR", "data/test/staging")
+	jobID := strconv.FormatUint(uint64(j.ID), 10)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	payloadDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_PAYLOAD_DIR"), jobID)
+	assert.NoError(s.T(), os.MkdirAll(stagingDir, os.ModePerm))
+	assert.NoError(s.T(), os.MkdirAll(payloadDir, os.ModePerm))
+	defer os.RemoveAll("data/test/staging")
+	defer os.RemoveAll(payloadDir)
+
+	assert.NoError(s.T(), ioutil.WriteFile(stagingDir+"/data.ndjson", []byte("{}\n"), 0600))
+	assert.NoError(s.T(), db.Create(&models.JobKey{JobID: j.ID, FileName: "data.ndjson", ResourceType: "Patient"}).Error)
+
+	qj, err := models.NewFinalizeQueueJob(j.ID)
+	assert.NoError(s.T(), err)
+
+	// Finalizing the job again does nothing
+	for i := 0; i < 2; i++ {
+		assert.NoError(s.T(), finalizeJob(qj))
+
+		var actual models.Job
+		assert.NoError(s.T(), db.First(&actual, j.ID).Error)
+		assert.Equal(s.T(), models.JobStatusCompleted, actual.Status)
+
+		_, err = os.Stat(payloadDir + "/data.ndjson")
+		assert.NoError(s.T(), err)
+		_, err = os.Stat(stagingDir)
+		assert.True(s.T(), os.IsNotExist(err))
+	}
+
+	history, err := models.GetJobStatusHistory(db, j.ID)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), history, 1)
+
+	// Finalize jobs for jobs that no longer exist cannot succeed
+	qj, err = models.NewFinalizeQueueJob(99999999)
+	assert.NoError(s.T(), err)
+	_, permanent := finalizeJob(qj).(noRetryError)
+	assert.True(s.T(), permanent)
 }
 
 func (s *MainTestSuite) TestQueueJobWithNoParent() {
-	retryCount := 10
-	os.Setenv("BCDA_WORKER_MAX_JOB_NOT_FOUND_RETRIES", strconv.Itoa(retryCount))
-	tests := []struct {
-		name        string
-		errorCount  int32
-		expectedErr error
-	}{
-		{"RetriesRemaining", int32(retryCount) - 1, errors.New("could not retrieve job from database: record not found")},
-		{"RetriesExhausted", int32(retryCount), nil},
+	qjArgs, _ := json.Marshal(models.JobEnqueueArgs{
+		ID:             99999999, // JobID is not found in the db
+		ACOID:          "00000000-0000-0000-0000-000000000000",
+		BeneficiaryIDs: []string{},
+		ResourceType:   "Patient",
+	})
+
+	qj := &que.Job{
+		Type:     "ProcessJob",
+		Args:     qjArgs,
+		Priority: 1,
 	}
 
-	for _, tt := range tests {
-		s.T().Run(tt.name, func(t *testing.T) {
-			qjArgs, _ := json.Marshal(models.JobEnqueueArgs{
-				ID:             99999999, // JobID is not found in the db
-				ACOID:          "00000000-0000-0000-0000-000000000000",
-				BeneficiaryIDs: []string{},
-				ResourceType:   "Patient",
-			})
-
-			qj := &que.Job{
-				Type:       "ProcessJob",
-				Args:       qjArgs,
-				Priority:   1,
-				ErrorCount: tt.errorCount,
-			}
+	// The job will never be created, so the queue job is moved to the dead-letter table without being retried
+	err := processJob(qj)
+	assert.EqualError(s.T(), err, "could not retrieve job from database: record not found")
+	_, permanent := err.(noRetryError)
+	assert.True(s.T(), permanent)
+}
 
-			err := processJob(qj)
-			if tt.expectedErr != nil {
-				assert.Equal(t, err.Error(), tt.expectedErr.Error())
-			} else {
-				assert.NoError(t, err)
-			}
-		})
+func (s *MainTestSuite) TestDeadLetterAfterMaxAttempts() {
+	origMaxAttempts := os.Getenv("BCDA_WORKER_MAX_JOB_ATTEMPTS")
+	defer os.Setenv("BCDA_WORKER_MAX_JOB_ATTEMPTS", origMaxAttempts)
+	os.Setenv("BCDA_WORKER_MAX_JOB_ATTEMPTS", "3")
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	queueJobID := time.Now().UnixNano()
+	defer db.Unscoped().Delete(models.DeadLetterJob{}, "queue_job_id in (?)", []int64{queueJobID, queueJobID + 1})
+
+	var workErr error
+	var deadLettered []int64
+	wf := deadLetterAfterMaxAttempts(func(j *que.Job) error { return workErr }, func(j *que.Job) {
+		deadLettered = append(deadLettered, j.ID)
+	})
+	qj := &que.Job{ID: queueJobID, Type: "ProcessJob", Args: []byte(`{"ID": 42}`), Priority: 10}
+
+	// Failed jobs are retried until they run out of attempts
+	workErr = errors.New("Blue Button is down")
+	qj.ErrorCount = 1
+	assert.Equal(s.T(), workErr, wf(qj))
+
+	// Jobs released by a worker shutting down are always retried
+	qj.ErrorCount = 2
+	workErr = errWorkerShutdown
+	assert.Equal(s.T(), errWorkerShutdown, wf(qj))
+	assert.Empty(s.T(), deadLettered)
+
+	// The job is removed from the queue after its final attempt
+	workErr = errors.New("Blue Button is still down")
+	assert.NoError(s.T(), wf(qj))
+	assert.Equal(s.T(), []int64{queueJobID}, deadLettered)
+
+	var dlj models.DeadLetterJob
+	assert.NoError(s.T(), db.First(&dlj, "queue_job_id = ?", queueJobID).Error)
+	assert.Equal(s.T(), "ProcessJob", dlj.Type)
+	assert.Equal(s.T(), int16(10), dlj.Priority)
+	assert.Equal(s.T(), int32(3), dlj.ErrorCount)
+	assert.Equal(s.T(), "Blue Button is still down", dlj.LastError)
+	assert.Equal(s.T(), uint(42), dlj.JobID)
+
+	// A job that is dead-lettered again is only added to the table once
+	assert.NoError(s.T(), wf(qj))
+	var count int
+	db.Model(&models.DeadLetterJob{}).Where("queue_job_id = ?", queueJobID).Count(&count)
+	assert.Equal(s.T(), 1, count)
+
+	// Jobs that cannot succeed are not retried
+	qj = &que.Job{ID: queueJobID + 1, Type: "ProcessJob", Args: []byte(`{"ID": 42}`)}
+	workErr = noRetry(errors.New("job not found"))
+	assert.NoError(s.T(), wf(qj))
+	assert.Equal(s.T(), []int64{queueJobID, queueJobID, queueJobID + 1}, deadLettered)
+}
+
+func (s *MainTestSuite) TestFailExportJob() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	j := models.Job{ACOID: s.testACO.UUID, RequestURL: "/api/v1/Patient/$export", Status: "In Progress", JobCount: 2}
+	assert.NoError(s.T(), db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+
+	args, err := json.Marshal(models.JobEnqueueArgs{ID: int(j.ID), ACOID: s.testACO.UUID.String()})
+	assert.NoError(s.T(), err)
+	failExportJob(&que.Job{Type: "ProcessJob", Args: args})
+
+	assert.NoError(s.T(), db.First(&j, j.ID).Error)
+	assert.Equal(s.T(), models.JobStatusFailed, j.Status)
+}
+
+func (s *MainTestSuite) TestAddFailedJobFileName() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	j := models.Job{ACOID: s.testACO.UUID, RequestURL: "/api/v1/Patient/$export", Status: models.JobStatusInProgress,
+		JobCount: 1, AllowPartial: true}
+	assert.NoError(s.T(), db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+	defer db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+
+	jobID := strconv.FormatUint(uint64(j.ID), 10)
+	testUtils.CreateStaging(jobID)
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	defer os.RemoveAll(stagingDir)
+
+	// The queue job wrote some resources before exceeding the failure threshold
+	fileUUID := uuid.NewRandom().String()
+	dataPath := fmt.Sprintf("%s/%s.ndjson", stagingDir, fileUUID)
+	assert.NoError(s.T(), ioutil.WriteFile(dataPath, []byte("{}\n"), 0600))
+	assert.NoError(s.T(), ioutil.WriteFile(dataPath+".gz", []byte{}, 0600))
+
+	jobArgs := newEOBJobArgs(s.T(), s.testACO.UUID.String(), jobID, []string{"1", "2", "3"})
+	last, err := addFailedJobFileName(fileUUID, fileStats{errorFile: &fileStats{}}, jobArgs, &j, db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), last)
+
+	for _, path := range []string{dataPath, dataPath + ".gz"} {
+		_, err := os.Stat(path)
+		assert.True(s.T(), os.IsNotExist(err), "%s should have been removed", path)
+	}
+
+	// The queue job's error file explains the missing resources
+	var jobKey models.JobKey
+	assert.NoError(s.T(), db.First(&jobKey, "job_id = ?", j.ID).Error)
+	assert.True(s.T(), jobKey.Failed)
+	assert.True(s.T(), jobKey.HasErrorFile)
+	assert.Equal(s.T(), fileUUID+".ndjson", jobKey.FileName)
+
+	// The job completes, but only partially
+	completed, err := j.CheckCompletedAndCleanup(db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), completed)
+	assert.NoError(s.T(), db.First(&j, j.ID).Error)
+	assert.Equal(s.T(), models.JobStatusPartiallyCompleted, j.Status)
+	os.RemoveAll(fmt.Sprintf("%s/%s", os.Getenv("FHIR_PAYLOAD_DIR"), jobID))
+}
+
+// newEOBJobArgs returns the arguments of a v1 queue job exporting ExplanationOfBenefit resources
+// streamingBlueButtonClient streams the resources of the mocked bundles one resource per page. The request for the page
+// following the failAfter[patientID]-th page fails.
+type streamingBlueButtonClient struct {
+	*testUtils.BlueButtonClient
+	failAfter map[string]int
+}
+
+func (bbc streamingBlueButtonClient) StreamExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values, fn client.BundlePageFunc) error {
+	b, err := bbc.GetExplanationOfBenefit(patientID, jobID, cmsID, since, transactionTime, typeFilter)
+	if err != nil {
+		return err
+	}
+	raw, err := toRawBundle(b)
+	if err != nil {
+		return err
+	}
+	for i, entry := range raw.Entries {
+		if n, ok := bbc.failAfter[patientID]; ok && i == n {
+			return errors.New("page request failed")
+		}
+		if err := fn(&fhirmodels.RawBundle{Entries: []fhirmodels.RawBundleEntry{entry}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bbc streamingBlueButtonClient) StreamPatient(patientID, jobID, cmsID, since string, transactionTime time.Time, fn client.BundlePageFunc) error {
+	return errors.New("not implemented")
+}
+
+func (bbc streamingBlueButtonClient) StreamCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, fn client.BundlePageFunc) error {
+	return errors.New("not implemented")
+}
+
+func newEOBJobArgs(t *testing.T, acoID, jobID string, cclfBeneficiaryIDs []string) models.JobEnqueueArgs {
+	id, err := strconv.Atoi(jobID)
+	assert.NoError(t, err)
+	return models.JobEnqueueArgs{
+		ID:              id,
+		ACOID:           acoID,
+		BeneficiaryIDs:  cclfBeneficiaryIDs,
+		ResourceType:    "ExplanationOfBenefit",
+		TransactionTime: time.Now(),
+		Version:         constants.V1Version,
 	}
 }
 
@@ -536,3 +1527,185 @@ func generateUniqueJobID(t *testing.T, db *gorm.DB, acoID uuid.UUID) string {
 	assert.NoError(t, db.Save(&j).Error)
 	return strconv.FormatUint(uint64(j.ID), 10)
 }
+
+func readGZIPFile(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	defer gz.Close()
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	return data
+}
+
+// fakeWorkerPool simulates a worker pool whose in-flight job runs until it finishes or is interrupted
+type fakeWorkerPool struct {
+	jobDuration time.Duration
+	interrupted bool
+}
+
+func (p *fakeWorkerPool) Shutdown() {
+	select {
+	case <-time.After(p.jobDuration):
+	case <-jobCtx.Done():
+		p.interrupted = true
+	}
+}
+
+func resetShutdown() {
+	stopping = make(chan struct{})
+	jobCtx, interruptJobs = context.WithCancel(context.Background())
+}
+
+func TestShutdownWorkers(t *testing.T) {
+	tests := []struct {
+		name           string
+		jobDuration    time.Duration
+		expInterrupted bool
+	}{
+		{"JobsFinish", 10 * time.Millisecond, false},
+		{"JobsInterrupted", time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetShutdown()
+
+			pool := &fakeWorkerPool{jobDuration: tt.jobDuration}
+			shutdownWorkers(pool, 100*time.Millisecond)
+
+			assert.Equal(t, tt.expInterrupted, pool.interrupted)
+			assert.Equal(t, tt.expInterrupted, jobCtx.Err() != nil)
+			select {
+			case <-stopping:
+			default:
+				t.Error("worker should be stopping")
+			}
+		})
+	}
+}
+
+func TestWorkerPoolShutdown(t *testing.T) {
+	defer resetShutdown()
+
+	// The workers would panic if they tried to lock a job without a queue client
+	pool := &workerPool{wm: que.WorkMap{}, count: 2, interval: time.Millisecond}
+	close(stopping)
+	pool.Start()
+
+	done := make(chan struct{})
+	go func() {
+		pool.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("workers should stop once the worker is shutting down")
+	}
+}
+
+func TestWorkerPoolRun(t *testing.T) {
+	pool := &workerPool{wm: que.WorkMap{
+		"Work":  func(j *que.Job) error { return nil },
+		"Panic": func(j *que.Job) error { panic("oops") },
+	}}
+
+	assert.NoError(t, pool.run(&que.Job{Type: "Work"}))
+	assert.EqualError(t, pool.run(&que.Job{Type: "Unknown"}), `unknown job type: "Unknown"`)
+
+	// Panics are returned as errors so that the job is retried
+	err := pool.run(&que.Job{Type: "Panic"})
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "oops\n"), err.Error())
+}
+
+// latencyBBClient is a client.APIClient that simulates the latency of the requests made to Blue Button
+type latencyBBClient struct {
+	latency  time.Duration
+	patients map[string]string // Patient search results, keyed by the hashed MBI
+	eob      *fhirmodels.Bundle
+}
+
+func (c *latencyBBClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, typeFilter url.Values) (*fhirmodels.Bundle, error) {
+	time.Sleep(c.latency)
+	return c.eob, nil
+}
+
+func (c *latencyBBClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (*fhirmodels.Bundle, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *latencyBBClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (*fhirmodels.Bundle, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *latencyBBClient) GetPatientByIdentifierHash(hashedIdentifier string) (string, error) {
+	time.Sleep(c.latency)
+	return c.patients[hashedIdentifier], nil
+}
+
+// BenchmarkWriteBBDataToFile measures the time taken to write an EOB file for 200 beneficiaries when each
+// request made to Blue Button takes 5ms
+func BenchmarkWriteBBDataToFile(b *testing.B) {
+	origConcurrency := os.Getenv("BCDA_WORKER_BENE_CONCURRENCY")
+	defer os.Setenv("BCDA_WORKER_BENE_CONCURRENCY", origConcurrency)
+	models.InitializeGormModels()
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	cmsID := "A9994"
+	aco := models.ACO{UUID: uuid.NewRandom(), CMSID: &cmsID, Name: "Worker Benchmark ACO"}
+	db.Create(&aco)
+	defer db.Unscoped().Delete(&aco)
+	j := models.Job{ACOID: aco.UUID, RequestURL: "/api/v1/Patient/$export", Status: "In Progress"}
+	db.Create(&j)
+	defer db.Unscoped().Delete(&j)
+	jobID := strconv.Itoa(int(j.ID))
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID))
+
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: cmsID, Timestamp: time.Now(), PerformanceYear: 19, Name: uuid.New()}
+	db.Create(&cclfFile)
+	defer db.Unscoped().Delete(&cclfFile)
+	defer db.Unscoped().Delete(models.CCLFBeneficiary{}, "file_id = ?", cclfFile.ID)
+
+	bbc := &latencyBBClient{latency: 5 * time.Millisecond, patients: make(map[string]string)}
+	var cclfBeneficiaryIDs []string
+	for i := 0; i < 200; i++ {
+		mbi, bbID := fmt.Sprintf("1A%09d", i), fmt.Sprintf("-%d", 19990000000000+i)
+		bene := models.CCLFBeneficiary{FileID: cclfFile.ID, MBI: mbi, BlueButtonID: bbID}
+		db.Create(&bene)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.Itoa(int(bene.ID)))
+
+		patient, err := (&testUtils.BlueButtonClient{MBI: &mbi}).GetData("Patient", bbID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bbc.patients[client.HashIdentifier(mbi)] = patient
+	}
+	eob, err := (&testUtils.BlueButtonClient{}).GetBundleData("ExplanationOfBenefit", "-19990000000000")
+	if err != nil {
+		b.Fatal(err)
+	}
+	bbc.eob = eob
+
+	jobArgs := models.JobEnqueueArgs{ID: int(j.ID), ACOID: aco.UUID.String(), BeneficiaryIDs: cclfBeneficiaryIDs,
+		ResourceType: "ExplanationOfBenefit", TransactionTime: time.Now(), Version: constants.V1Version}
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			os.Setenv("BCDA_WORKER_BENE_CONCURRENCY", strconv.Itoa(concurrency))
+			for n := 0; n < b.N; n++ {
+				fileUUID, _, err := writeBBDataToFile(context.Background(), bbc, db, cmsID, nil, jobArgs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				name := fmt.Sprintf("%s/%s.ndjson", jobID, fileUUID)
+				removeStagedFiles(name, name+".gz")
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bgentry/que-go"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// startOutboxRelay relays queue jobs from the outbox to the queue every BCDA_WORKER_OUTBOX_RELAY_INTERVAL_MS
+// milliseconds until the returned function is called. The API relays the queue jobs of the export jobs it creates
+// as soon as they're committed, so the relay only queues the jobs the API could not. The relay is disabled when the
+// interval is 0.
+func startOutboxRelay(qc *que.Client) (stop func()) {
+	interval := time.Duration(utils.GetEnvInt("BCDA_WORKER_OUTBOX_RELAY_INTERVAL_MS", 5000)) * time.Millisecond
+	if interval <= 0 {
+		log.Info("Outbox relay is disabled")
+		return func() {}
+	}
+
+	return runEvery(interval, func() {
+		db := database.GetGORMDbConnection()
+		defer database.Close(db)
+
+		count, err := relayOutbox(db, qc, utils.GetEnvInt("BCDA_WORKER_OUTBOX_RELAY_BATCH_SIZE", 100))
+		if count > 0 {
+			log.Infof("Relayed %d queue jobs from the outbox", count)
+		}
+		if err != nil {
+			log.Errorf("Failed to relay queue jobs from the outbox: %s", err.Error())
+		}
+	})
+}
+
+// relayOutbox relays queue jobs from the outbox to the queue, batchSize at a time, until the outbox is empty.
+// It returns the number of queue jobs that were relayed.
+func relayOutbox(db *gorm.DB, qc *que.Client, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	total := 0
+	for {
+		count, err := models.RelayOutboxJobs(db, qc, 0, batchSize)
+		total += count
+		if err != nil || count < batchSize {
+			return total, err
+		}
+	}
+}
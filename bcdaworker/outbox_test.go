@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/bgentry/que-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+)
+
+func (s *MainTestSuite) TestRelayOutbox() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	pool, err := newQueuePool()
+	assert.NoError(s.T(), err)
+	defer pool.Close()
+
+	j := models.Job{ACOID: s.testACO.UUID, RequestURL: "/api/v1/Patient/$export", Status: models.JobStatusPending, JobCount: 3}
+	assert.NoError(s.T(), db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+	jobID := strconv.FormatUint(uint64(j.ID), 10)
+	defer pool.Exec(`DELETE FROM que_jobs WHERE args->>'ID' = $1`, jobID) // nolint
+
+	var queueJobs []*que.Job
+	for i := 0; i < j.JobCount; i++ {
+		args, err := json.Marshal(models.JobEnqueueArgs{ID: int(j.ID), ACOID: s.testACO.UUID.String(), ResourceType: "Patient"})
+		assert.NoError(s.T(), err)
+		queueJobs = append(queueJobs, &que.Job{Type: "ProcessJob", Args: args})
+	}
+	assert.NoError(s.T(), models.AddToOutbox(db, j.ID, queueJobs))
+	defer models.DeleteOutboxJobs(db, j.ID) // nolint
+
+	// Outbox rows left behind by other tests may also be relayed
+	count, err := relayOutbox(db, que.NewClient(pool), 2)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), count >= j.JobCount)
+
+	outboxed, err := models.CountOutboxJobs(db, j.ID)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, outboxed)
+
+	var queued int
+	assert.NoError(s.T(), pool.QueryRow(`SELECT count(*) FROM que_jobs WHERE args->>'ID' = $1`, jobID).Scan(&queued))
+	assert.Equal(s.T(), j.JobCount, queued)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/encryption"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	responseutilsv2 "github.com/CMSgov/bcda-app/bcda/responseutils/v2"
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/tabular"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// claimTypeSystem is the code system BFD uses to identify the claim type of an ExplanationOfBenefit
+const claimTypeSystem = "https://bluebutton.cms.gov/resources/codesystem/eob-type"
+
+// claimTypes are the claim type codes that have a file of their own when ExplanationOfBenefit resources are split by
+// claim type. Resources with any other claim type are written to the queue job's main file.
+var claimTypes = map[string]bool{
+	"CARRIER":    true,
+	"DME":        true,
+	"HHA":        true,
+	"HOSPICE":    true,
+	"INPATIENT":  true,
+	"OUTPATIENT": true,
+	"PDE":        true,
+	"SNF":        true,
+}
+
+// fileStats describes the contents of a file written by writeBBDataToFile
+type fileStats struct {
+	checksum   string // hex-encoded SHA-256 digest
+	size       int64
+	count      int                  // resources, or rows when the resources are flattened into tables
+	encryption *encryption.Envelope // set when the file is encrypted
+	// otherFiles describes the files written alongside the main file: the claim type files when resources are split
+	// by claim type, or the files of the resource type's secondary tables when resources are flattened into tables
+	otherFiles []otherFile
+	// errorFile is set on the stats of the main file when the queue job's error file was written. Its checksum and size
+	// are only set when the error file is encrypted.
+	errorFile *fileStats
+}
+
+// otherFile is a file of the ExplanationOfBenefit resources of a single claim type, or of one of the resource type's
+// secondary tables
+type otherFile struct {
+	claimType string // lower case, e.g. carrier
+	table     string // e.g. eob_line
+	fileName  string
+	stats     fileStats
+}
+
+// countingHash computes the digest and size of everything written to it
+type countingHash struct {
+	hash.Hash
+	size int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	n, err := c.Hash.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// outputFile is an NDJSON, CSV or Parquet file written by a queue job to the staging area
+type outputFile struct {
+	st        storage.Storage
+	name      string // name in the staging area, including the job's directory
+	claimType string // set for claim type files
+	table     string // set for the files of secondary tables
+	w         *bufio.Writer
+	gz        *gzip.Writer
+	enc       *encryption.Writer
+	env       *encryption.Envelope
+	h         *countingHash
+	files     []io.Closer
+	closed    bool
+	count     int
+}
+
+// newOutputFile creates the file in the staging area. When a public key is given, the file is encrypted for it.
+func newOutputFile(st storage.Storage, name string, publicKey *rsa.PublicKey) (*outputFile, error) {
+	// Compute the digest and size of the file as it's written so we don't need to re-read it
+	f := &outputFile{st: st, name: name, h: &countingHash{Hash: sha256.New()}}
+	var writers []io.Writer
+
+	if publicKey != nil {
+		// Only the encrypted file is stored, and it's served as-is. It's encrypted a segment at a time as it's written,
+		// and its digest describes the encrypted file.
+		file, err := st.Create(storage.Staging, name)
+		if err != nil {
+			return nil, err
+		}
+		f.files = append(f.files, file)
+		enc, env, err := encryption.NewWriter(io.MultiWriter(file, f.h), publicKey)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.enc, f.env = enc, &env
+		writers = append(writers, enc)
+	} else {
+		// A precompressed copy of the file is always written so it can be served (and resumed) without compressing it
+		// on the fly. The uncompressed file may be omitted to save space; the API decompresses it when necessary.
+		gzFile, err := st.Create(storage.Staging, name+".gz")
+		if err != nil {
+			return nil, err
+		}
+		f.files = append(f.files, gzFile)
+		f.gz = gzip.NewWriter(gzFile)
+		writers = append(writers, f.gz, f.h)
+
+		if utils.GetEnvBool("BCDA_WORKER_KEEP_UNCOMPRESSED", true) {
+			file, err := st.Create(storage.Staging, name)
+			if err != nil {
+				gzFile.Close()
+				return nil, err
+			}
+			f.files = append(f.files, file)
+			writers = append(writers, file)
+		}
+	}
+
+	f.w = bufio.NewWriter(io.MultiWriter(writers...))
+	return f, nil
+}
+
+func (f *outputFile) write(resource []byte) error {
+	if _, err := f.w.Write(resource); err != nil {
+		return err
+	}
+	f.count++
+	return nil
+}
+
+// close flushes and closes the file. Stored files may only be written once they're closed, so they're closed before
+// they're used or removed. Closing the file again does nothing.
+func (f *outputFile) close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	err := f.w.Flush()
+	if f.gz != nil {
+		if gzErr := f.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if f.enc != nil {
+		// Closing the encrypter writes the last segment
+		if encErr := f.enc.Close(); err == nil {
+			err = encErr
+		}
+	}
+	for _, c := range f.files {
+		if cErr := c.Close(); cErr != nil {
+			log.Error(cErr)
+			if err == nil {
+				err = cErr
+			}
+		}
+	}
+	return err
+}
+
+// finish returns the stats of the closed file
+func (f *outputFile) finish() fileStats {
+	return fileStats{checksum: hex.EncodeToString(f.h.Sum(nil)), size: f.h.size, count: f.count, encryption: f.env}
+}
+
+// stagedNames returns the names of the data files that may have been written to the staging area
+func (f *outputFile) stagedNames() []string {
+	return []string{f.name, f.name + ".gz"}
+}
+
+// queueJobOutput holds the files written by a queue job: its main file and, when ExplanationOfBenefit resources are
+// split by claim type, a file for each claim type found. Resources whose claim type is unknown are written to the
+// main file, which is written even if it's empty. When resources are flattened into tables, the main file holds the
+// resource type's main table and each of its other tables has a file of its own.
+type queueJobOutput struct {
+	st              storage.Storage
+	jobID           string
+	fileUUID        string
+	publicKey       *rsa.PublicKey // set when the files are encrypted
+	splitClaimTypes bool
+
+	main       *outputFile
+	claimTypes map[string]*outputFile // keyed by lower case claim type
+
+	// tables, along with their files and writers, are set when resources are flattened into tables. The first table
+	// is written to the main file.
+	tables     []*tabular.Table
+	tableFiles []*outputFile
+	writers    []tabular.Writer
+	closed     bool
+}
+
+func newQueueJobOutput(st storage.Storage, fileUUID string, publicKey *rsa.PublicKey, jobArgs models.JobEnqueueArgs) (*queueJobOutput, error) {
+	o := &queueJobOutput{st: st, jobID: strconv.Itoa(jobArgs.ID), fileUUID: fileUUID, publicKey: publicKey,
+		splitClaimTypes: jobArgs.SplitClaimTypes, claimTypes: make(map[string]*outputFile)}
+	format := tabular.Format(jobArgs.OutputFormat)
+	if format != "" {
+		if o.tables = tabular.Tables(jobArgs.ResourceType); o.tables == nil {
+			return nil, fmt.Errorf("%s resources cannot be flattened into tables", jobArgs.ResourceType)
+		}
+	}
+
+	var err error
+	if o.main, err = newOutputFile(st, fmt.Sprintf("%s/%s%s", o.jobID, fileUUID, format.FileExtension()), publicKey); err != nil {
+		return nil, err
+	}
+
+	for i, t := range o.tables {
+		f := o.main
+		if i > 0 {
+			if f, err = newOutputFile(st, fmt.Sprintf("%s/%s", o.jobID, tableFileName(fileUUID, t.Name, format)), publicKey); err != nil {
+				o.close() // nolint
+				removeStagedFiles(o.stagedNames()...)
+				return nil, err
+			}
+			f.table = t.Name
+		}
+		o.tableFiles = append(o.tableFiles, f)
+		o.writers = append(o.writers, tabular.NewWriter(format, f.w, t))
+	}
+	return o, nil
+}
+
+// write writes the resource to the file it belongs in or, when resources are flattened into tables, writes its rows
+// to each of the tables
+func (o *queueJobOutput) write(resource []byte) error {
+	if o.tables == nil {
+		f, err := o.fileFor(resource)
+		if err != nil {
+			return err
+		}
+		return f.write(resource)
+	}
+
+	r, err := tabular.Parse(resource)
+	if err != nil {
+		return err
+	}
+	for i, t := range o.tables {
+		for _, row := range t.Rows(r) {
+			if err := o.writers[i].Write(row); err != nil {
+				return err
+			}
+			o.tableFiles[i].count++
+		}
+	}
+	return nil
+}
+
+// fileFor returns the file the resource is written to. The file of the resource's claim type is created the first time
+// one of its resources is written.
+func (o *queueJobOutput) fileFor(resource []byte) (*outputFile, error) {
+	if !o.splitClaimTypes {
+		return o.main, nil
+	}
+	claimType := eobClaimType(resource)
+	if claimType == "" {
+		return o.main, nil
+	}
+
+	f, ok := o.claimTypes[claimType]
+	if !ok {
+		var err error
+		if f, err = newOutputFile(o.st, fmt.Sprintf("%s/%s", o.jobID, claimTypeFileName(o.fileUUID, claimType)), o.publicKey); err != nil {
+			return nil, err
+		}
+		f.claimType = claimType
+		o.claimTypes[claimType] = f
+	}
+	return f, nil
+}
+
+// otherFiles returns the files written alongside the main file: the claim type files, in alphabetical order, and the
+// files of the secondary tables, in the order of the tables
+func (o *queueJobOutput) otherFiles() []*outputFile {
+	types := make([]string, 0, len(o.claimTypes))
+	for t := range o.claimTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	var files []*outputFile
+	for _, t := range types {
+		files = append(files, o.claimTypes[t])
+	}
+	if len(o.tableFiles) > 1 {
+		files = append(files, o.tableFiles[1:]...)
+	}
+	return files
+}
+
+// close closes all of the queue job's files, returning the first error encountered. The tables are finished first,
+// since the last row group and the metadata of Parquet files are only written once all of their rows are known.
+func (o *queueJobOutput) close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	var err error
+	for _, w := range o.writers {
+		if wErr := w.Close(); err == nil {
+			err = wErr
+		}
+	}
+	if mErr := o.main.close(); err == nil {
+		err = mErr
+	}
+	for _, f := range o.otherFiles() {
+		if cErr := f.close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// stagedNames returns the names of all of the data files that may have been written to the staging area
+func (o *queueJobOutput) stagedNames() []string {
+	return append(o.main.stagedNames(), o.otherStagedNames()...)
+}
+
+// otherStagedNames returns the names of the files other than the main file that may have been written to the staging
+// area
+func (o *queueJobOutput) otherStagedNames() []string {
+	var names []string
+	for _, f := range o.otherFiles() {
+		names = append(names, f.stagedNames()...)
+	}
+	return names
+}
+
+// finish returns the stats of the closed main file, which include the stats of the other files
+func (o *queueJobOutput) finish() fileStats {
+	stats := o.main.finish()
+	for _, f := range o.otherFiles() {
+		stats.otherFiles = append(stats.otherFiles, otherFile{claimType: f.claimType, table: f.table,
+			fileName: path.Base(f.name), stats: f.finish()})
+	}
+	return stats
+}
+
+// errorFile collects the OperationOutcomes describing the errors encountered by a queue job. Stored files can't be
+// appended to efficiently, so the errors are kept in memory and written to the queue job's error file once. There is
+// at most one error per beneficiary, and a few more for any resources that couldn't be written.
+type errorFile struct {
+	version string
+	name    string
+	buf     bytes.Buffer
+	count   int
+}
+
+func newErrorFile(version, jobID, fileUUID string) *errorFile {
+	return &errorFile{version: version, name: fmt.Sprintf("%s/%s-error.ndjson", jobID, fileUUID)}
+}
+
+// add adds an OperationOutcome describing the error. The OperationOutcome is written in the FHIR version served by the
+// API version: STU3 for v1 and R4 for v2.
+func (e *errorFile) add(ctx context.Context, code, detailsCode, detailsDisplay string) {
+	segment := getSegment(ctx, "errorFile.add")
+	defer func() {
+		if err := segment.End(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	var oo interface{}
+	if e.version == constants.V2Version {
+		oo = responseutilsv2.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay)
+	} else {
+		oo = responseutils.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay)
+	}
+
+	ooBytes, err := json.Marshal(oo)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	e.buf.Write(ooBytes)
+	e.buf.WriteByte('\n')
+	e.count++
+}
+
+// write writes the errors to the error file in the staging area. The file is only written if there are errors, in
+// which case its stats are returned. The error file identifies beneficiaries, so when a public key is given it's
+// encrypted for it like the queue job's other files.
+func (e *errorFile) write(st storage.Storage, publicKey *rsa.PublicKey) (*fileStats, error) {
+	if e.buf.Len() == 0 {
+		return nil, nil
+	}
+
+	f, err := st.Create(storage.Staging, e.name)
+	if err != nil {
+		return nil, err
+	}
+	stats := &fileStats{count: e.count}
+	if publicKey == nil {
+		if _, err = f.Write(e.buf.Bytes()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return stats, f.Close()
+	}
+
+	h := &countingHash{Hash: sha256.New()}
+	enc, env, err := encryption.NewWriter(io.MultiWriter(f, h), publicKey)
+	if err == nil {
+		if _, err = enc.Write(e.buf.Bytes()); err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+
+	stats.checksum, stats.size, stats.encryption = hex.EncodeToString(h.Sum(nil)), h.size, &env
+	return stats, nil
+}
+
+// claimTypeFileName returns the name of the queue job's file of the claim type, e.g. <file UUID>-carrier.ndjson
+func claimTypeFileName(fileUUID, claimType string) string {
+	return fmt.Sprintf("%s-%s.ndjson", fileUUID, claimType)
+}
+
+// tableFileName returns the name of the queue job's file of a secondary table, e.g. <file UUID>-eob_line.csv
+func tableFileName(fileUUID, table string, format tabular.Format) string {
+	return fmt.Sprintf("%s-%s%s", fileUUID, table, format.FileExtension())
+}
+
+// eobClaimType returns the lower case claim type of the ExplanationOfBenefit, e.g. carrier, found in its type coding.
+// An empty string is returned if the claim type cannot be determined.
+func eobClaimType(resource []byte) string {
+	var eob struct {
+		Type struct {
+			Coding []struct {
+				System string `json:"system"`
+				Code   string `json:"code"`
+			} `json:"coding"`
+		} `json:"type"`
+	}
+	if err := json.Unmarshal(resource, &eob); err != nil {
+		return ""
+	}
+
+	for _, c := range eob.Type.Coding {
+		if c.System == claimTypeSystem && claimTypes[strings.ToUpper(c.Code)] {
+			return strings.ToLower(c.Code)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/bgentry/que-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// workerPool works queue jobs in the same way as que's WorkerPool, with two differences for shutting down:
+//   - Its workers stop locking jobs as soon as stopping is closed. que's workers keep locking jobs until the queue is
+//     empty, even after they have been asked to shut down.
+//   - Jobs interrupted by the shutdown are released back to the queue without recording an error. The attempt doesn't
+//     count towards BCDA_WORKER_MAX_JOB_ATTEMPTS or delay the job's next run.
+type workerPool struct {
+	c        *que.Client
+	wm       que.WorkMap
+	count    int
+	queue    string
+	interval time.Duration
+	wg       sync.WaitGroup
+}
+
+func newWorkerPool(c *que.Client, wm que.WorkMap, count int) *workerPool {
+	return &workerPool{
+		c:        c,
+		wm:       wm,
+		count:    count,
+		queue:    os.Getenv("QUE_QUEUE"),
+		interval: time.Duration(utils.GetEnvInt("QUE_WAKE_INTERVAL", 5)) * time.Second,
+	}
+}
+
+// Start starts the pool's workers
+func (p *workerPool) Start() {
+	for i := 0; i < p.count; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+// Shutdown waits for the workers to finish the jobs they are working. The workers stop once stopping is closed.
+func (p *workerPool) Shutdown() {
+	p.wg.Wait()
+}
+
+// work locks and works jobs until the queue is empty, then waits for the interval before checking it again
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-time.After(p.interval):
+		}
+
+		for {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+			if !p.workOne() {
+				break
+			}
+		}
+	}
+}
+
+// workOne locks and works a single job. It returns false if there were no jobs to work.
+func (p *workerPool) workOne() bool {
+	j, err := p.c.LockJob(p.queue)
+	if err != nil {
+		log.Errorf("Unable to lock queue job: %s", err.Error())
+		return false
+	}
+	if j == nil {
+		return false
+	}
+	defer j.Done()
+
+	switch err = p.run(j); err {
+	case nil:
+		if err = j.Delete(); err != nil {
+			log.Errorf("Unable to delete queue job %d: %s", j.ID, err.Error())
+		}
+	case errWorkerShutdown:
+		// Unlocking the job leaves it on the queue, ready for another worker
+		log.Infof("Released queue job %d", j.ID)
+	default:
+		if err = j.Error(err.Error()); err != nil {
+			log.Errorf("Unable to save error on queue job %d: %s", j.ID, err.Error())
+		}
+	}
+	return true
+}
+
+// run calls the job's work function. A panic is returned as an error so that the job is retried.
+func (p *workerPool) run(j *que.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v\n%s", r, debug.Stack())
+		}
+	}()
+
+	wf, ok := p.wm[j.Type]
+	if !ok {
+		return fmt.Errorf("unknown job type: %q", j.Type)
+	}
+	return wf(j)
+}
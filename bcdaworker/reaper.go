@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/metrics"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// stuckJobReaperLockID identifies the Postgres advisory lock held while stuck jobs are reaped, so that only one worker
+// reaps them at a time
+const stuckJobReaperLockID int64 = 8817420201
+
+// reapResult counts the actions taken by reapStuckJobs
+type reapResult struct {
+	Completed  int // jobs whose queue jobs had all finished
+	Failed     int // jobs with unfinished queue jobs that are no longer in the queue or the outbox
+	Reconciled int // jobs whose CompletedJobCount did not match the number of finished queue jobs
+}
+
+// startStuckJobReaper reaps stuck jobs every BCDA_WORKER_REAPER_INTERVAL_SEC seconds until the returned function is
+// called. The reaper is disabled when the interval is 0.
+func startStuckJobReaper(pool *pgx.ConnPool) (stop func()) {
+	interval := time.Duration(utils.GetEnvInt("BCDA_WORKER_REAPER_INTERVAL_SEC", 300)) * time.Second
+	if interval <= 0 {
+		log.Info("Stuck job reaper is disabled")
+		return func() {}
+	}
+
+	return runEvery(interval, func() { runStuckJobReaper(pool) })
+}
+
+// runEvery calls f every interval until the returned function is called. The returned function waits for a call to f
+// that is in progress to return.
+func runEvery(interval time.Duration, f func()) (stop func()) {
+	ticker := time.NewTicker(interval)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+func runStuckJobReaper(pool *pgx.ConnPool) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	minAge := time.Duration(utils.GetEnvInt("BCDA_WORKER_STUCK_JOB_AGE_MIN", 60)) * time.Minute
+	result, reaped, err := reapStuckJobs(pool, db, minAge)
+	if err != nil {
+		log.Errorf("Failed to reap stuck jobs: %s", err.Error())
+		return
+	}
+	if !reaped {
+		log.Debug("Stuck jobs are being reaped by another worker")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"completed":  result.Completed,
+		"failed":     result.Failed,
+		"reconciled": result.Reconciled,
+	}).Info("Finished reaping stuck jobs")
+	putReaperMetrics(result)
+}
+
+// reapStuckJobs finishes the Pending and In Progress jobs that have not been updated within minAge and have no queue
+// work left to do. Jobs whose queue jobs have all finished are completed, and jobs with unfinished queue jobs that are
+// neither in the queue nor waiting in the outbox are failed. The number of finished queue jobs recorded on each job is also corrected.
+// No jobs are reaped, and false is returned, if another worker is already reaping them.
+func reapStuckJobs(pool *pgx.ConnPool, db *gorm.DB, minAge time.Duration) (result reapResult, reaped bool, err error) {
+	// The lock is released when the transaction ends, even if the worker dies while reaping
+	tx, err := pool.Begin()
+	if err != nil {
+		return result, false, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	if err = tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, stuckJobReaperLockID).Scan(&reaped); err != nil || !reaped {
+		return result, false, err
+	}
+
+	var jobs []models.Job
+	err = db.Where("status in (?) and updated_at < ?", []models.JobStatus{models.JobStatusPending, models.JobStatusInProgress},
+		time.Now().Add(-minAge)).Find(&jobs).Error
+	if err != nil {
+		return result, true, err
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+
+		var remaining int
+		finished, err := models.CountFinishedQueueJobs(db, job.ID, false)
+		if err != nil {
+			return result, true, err
+		}
+		// que-go stores the job arguments as JSON; see models.JobEnqueueArgs
+		err = tx.QueryRow(`SELECT count(*) FROM que_jobs WHERE args->>'ID' = $1`, strconv.FormatUint(uint64(job.ID), 10)).
+			Scan(&remaining)
+		if err != nil {
+			return result, true, err
+		}
+		// Queue jobs waiting in the outbox will still be worked once they're relayed
+		outboxed, err := models.CountOutboxJobs(db, job.ID)
+		if err != nil {
+			return result, true, err
+		}
+		remaining += outboxed
+
+		logger := log.WithFields(log.Fields{
+			"job_id":               job.ID,
+			"job_count":            job.JobCount,
+			"finished_queue_jobs":  finished,
+			"remaining_queue_jobs": remaining,
+		})
+
+		// The count is only used to report progress, so it's corrected without marking the job as updated
+		if finished != job.CompletedJobCount {
+			if err = db.Model(job).UpdateColumn("completed_job_count", finished).Error; err != nil {
+				return result, true, err
+			}
+			logger.Warnf("Corrected the completed queue job count of job %d from %d", job.ID, job.CompletedJobCount)
+			result.Reconciled++
+		}
+
+		switch {
+		case finished >= job.JobCount:
+			// Jobs are only completed once they've started
+			if job.Status == models.JobStatusPending {
+				_, err = job.TransitionStatus(db, models.JobStatusInProgress, models.JobStatusActorWorker,
+					"stuck job reaped: all queue jobs finished before the job was started")
+				if err != nil {
+					return result, true, err
+				}
+			}
+			if _, err = job.CheckCompletedAndCleanup(db); err != nil {
+				return result, true, err
+			}
+			if job.Status.IsCompleted() {
+				logger.Warnf("Completed stuck job %d", job.ID)
+				result.Completed++
+			}
+		case remaining == 0:
+			reason := fmt.Sprintf("stuck job reaped: %d of %d queue jobs finished and none remain in the queue", finished, job.JobCount)
+			if err = job.Fail(db, reason); err != nil {
+				return result, true, err
+			}
+			if job.Status == models.JobStatusFailed {
+				logger.Warnf("Failed stuck job %d", job.ID)
+				result.Failed++
+			}
+		}
+	}
+
+	return result, true, nil
+}
+
+func putReaperMetrics(result reapResult) {
+	env := os.Getenv("DEPLOYMENT_TARGET")
+	if env == "" {
+		return
+	}
+
+	sampler, err := metrics.NewSampler("BCDA", "Count")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	samples := map[string]int{
+		"StuckJobsCompleted":  result.Completed,
+		"StuckJobsFailed":     result.Failed,
+		"JobCountsReconciled": result.Reconciled,
+	}
+	for name, value := range samples {
+		err := sampler.PutSample(name, float64(value), []metrics.Dimension{
+			{Name: "Environment", Value: env},
+		})
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/bgentry/que-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+)
+
+func (s *MainTestSuite) TestReapStuckJobs() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	pool, err := newQueuePool()
+	assert.NoError(s.T(), err)
+	defer pool.Close()
+
+	newJob := func(status models.JobStatus, jobCount, finished int, updatedAt time.Time) models.Job {
+		j := models.Job{ACOID: s.testACO.UUID, RequestURL: "/api/v1/Patient/$export", Status: status, JobCount: jobCount}
+		assert.NoError(s.T(), db.Create(&j).Error)
+		for i := 0; i < finished; i++ {
+			assert.NoError(s.T(), db.Create(&models.JobKey{JobID: j.ID, FileName: "SOMETHING.ndjson"}).Error)
+		}
+		assert.NoError(s.T(), db.Model(&j).UpdateColumn("updated_at", updatedAt).Error)
+		return j
+	}
+	stale := time.Now().Add(-2 * time.Hour)
+
+	done := newJob(models.JobStatusInProgress, 1, 1, stale)
+	abandoned := newJob(models.JobStatusInProgress, 2, 1, stale)
+	queued := newJob(models.JobStatusInProgress, 2, 1, stale)
+	outboxed := newJob(models.JobStatusInProgress, 2, 1, stale)
+	recent := newJob(models.JobStatusInProgress, 2, 1, time.Now())
+	for _, j := range []models.Job{done, abandoned, queued, outboxed, recent} {
+		defer db.Unscoped().Delete(models.JobKey{}, "job_id = ?", j.ID)
+		defer db.Unscoped().Delete(models.Job{}, j.ID)
+	}
+
+	// One of the queued job's queue jobs is still waiting to be worked
+	args, err := json.Marshal(models.JobEnqueueArgs{ID: int(queued.ID), ACOID: s.testACO.UUID.String()})
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), que.NewClient(pool).Enqueue(&que.Job{Type: "ProcessJob", Args: args, RunAt: time.Now().Add(time.Hour)}))
+	defer pool.Exec(`DELETE FROM que_jobs WHERE args->>'ID' = $1`, strconv.FormatUint(uint64(queued.ID), 10)) // nolint
+
+	// One of the outboxed job's queue jobs has yet to be relayed to the queue
+	args, err = json.Marshal(models.JobEnqueueArgs{ID: int(outboxed.ID), ACOID: s.testACO.UUID.String()})
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), models.AddToOutbox(db, outboxed.ID, []*que.Job{{Type: "ProcessJob", Args: args}}))
+	defer models.DeleteOutboxJobs(db, outboxed.ID) // nolint
+
+	result, reaped, err := reapStuckJobs(pool, db, time.Hour)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), reaped)
+	// Stuck jobs left behind by other tests may also be reaped
+	assert.True(s.T(), result.Completed >= 1)
+	assert.True(s.T(), result.Failed >= 1)
+	assert.True(s.T(), result.Reconciled >= 4)
+
+	expected := map[uint]models.JobStatus{
+		done.ID:      models.JobStatusCompleted,
+		abandoned.ID: models.JobStatusFailed,
+		queued.ID:    models.JobStatusInProgress,
+		outboxed.ID:  models.JobStatusInProgress,
+		recent.ID:    models.JobStatusInProgress,
+	}
+	for id, status := range expected {
+		var actual models.Job
+		assert.NoError(s.T(), db.First(&actual, id).Error)
+		assert.Equal(s.T(), status, actual.Status, "job %d", id)
+		if id != recent.ID {
+			assert.Equal(s.T(), 1, actual.CompletedJobCount, "job %d", id)
+		}
+	}
+}
+
+func (s *MainTestSuite) TestReapStuckJobsLocked() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	pool, err := newQueuePool()
+	assert.NoError(s.T(), err)
+	defer pool.Close()
+
+	// Another worker is reaping stuck jobs
+	tx, err := pool.Begin()
+	assert.NoError(s.T(), err)
+	defer tx.Rollback() // nolint
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, stuckJobReaperLockID)
+	assert.NoError(s.T(), err)
+
+	_, reaped, err := reapStuckJobs(pool, db, time.Hour)
+	assert.NoError(s.T(), err)
+	assert.False(s.T(), reaped)
+}
@@ -0,0 +1,5 @@
+-- Files written before these columns were added will not have a checksum, size, or count
+ALTER TABLE job_keys
+    ADD COLUMN checksum char(64) NOT NULL DEFAULT '',
+    ADD COLUMN file_size bigint NOT NULL DEFAULT 0,
+    ADD COLUMN resource_count integer NOT NULL DEFAULT 0;
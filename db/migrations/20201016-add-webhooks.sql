@@ -0,0 +1,6 @@
+ALTER TABLE acos
+    ADD COLUMN webhook_url text NOT NULL DEFAULT '',
+    ADD COLUMN webhook_secret text NOT NULL DEFAULT '';
+
+ALTER TABLE jobs
+    ADD COLUMN callback_url text NOT NULL DEFAULT '';
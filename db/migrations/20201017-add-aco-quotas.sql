@@ -0,0 +1,13 @@
+CREATE TABLE aco_quotas (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    aco_id char(36) NOT NULL,
+    max_concurrent_jobs integer NOT NULL DEFAULT 0,
+    max_daily_requests integer NOT NULL DEFAULT 0,
+    max_daily_bytes bigint NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX uix_aco_quotas_aco_id ON aco_quotas (aco_id);
+CREATE INDEX idx_aco_quotas_deleted_at ON aco_quotas (deleted_at);
@@ -0,0 +1,3 @@
+-- Jobs created before the version was recorded were all requested through the v1 API
+ALTER TABLE jobs
+    ADD COLUMN version varchar(8) NOT NULL DEFAULT 'v1';
@@ -0,0 +1,8 @@
+-- Blue Button IDs keyed by MBI so they remain available across CCLF files
+CREATE TABLE blue_button_id_cache (
+    mbi varchar(11) PRIMARY KEY,
+    blue_button_id text NOT NULL,
+    updated_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX idx_blue_button_id_cache_updated_at ON blue_button_id_cache (updated_at);
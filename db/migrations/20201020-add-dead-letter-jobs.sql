@@ -0,0 +1,19 @@
+-- Queue jobs removed from que_jobs after exhausting their attempts (see BCDA_WORKER_MAX_JOB_ATTEMPTS)
+CREATE TABLE dead_letter_jobs (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    queue_job_id bigint,
+    type text NOT NULL,
+    queue text,
+    priority smallint,
+    args jsonb NOT NULL,
+    error_count integer,
+    last_error text,
+    job_id integer
+);
+
+CREATE UNIQUE INDEX uix_dead_letter_jobs_queue_job_id ON dead_letter_jobs (queue_job_id);
+CREATE INDEX idx_dead_letter_jobs_job_id ON dead_letter_jobs (job_id);
+CREATE INDEX idx_dead_letter_jobs_deleted_at ON dead_letter_jobs (deleted_at);
@@ -0,0 +1,12 @@
+-- Every change in a job's status, recorded by Job.TransitionStatus
+CREATE TABLE job_status_history (
+    id serial PRIMARY KEY,
+    job_id integer NOT NULL,
+    from_status text NOT NULL,
+    to_status text NOT NULL,
+    actor text NOT NULL,
+    reason text,
+    created_at timestamp with time zone
+);
+
+CREATE INDEX idx_job_status_history_job_id ON job_status_history (job_id);
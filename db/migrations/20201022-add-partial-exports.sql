@@ -0,0 +1,9 @@
+ALTER TABLE acos
+    ADD COLUMN allow_partial_exports boolean NOT NULL DEFAULT false;
+
+ALTER TABLE jobs
+    ADD COLUMN allow_partial boolean NOT NULL DEFAULT false;
+
+-- Set for the files of queue jobs that failed in jobs that allow partial exports; only their error files exist
+ALTER TABLE job_keys
+    ADD COLUMN failed boolean NOT NULL DEFAULT false;
@@ -0,0 +1,13 @@
+-- Queue jobs written in the same transaction as their export job and waiting to be relayed to the queue
+CREATE TABLE outbox_jobs (
+    id serial PRIMARY KEY,
+    job_id integer NOT NULL,
+    type text NOT NULL,
+    queue text,
+    priority smallint,
+    args jsonb NOT NULL,
+    run_at timestamp with time zone,
+    created_at timestamp with time zone
+);
+
+CREATE INDEX idx_outbox_jobs_job_id ON outbox_jobs (job_id);
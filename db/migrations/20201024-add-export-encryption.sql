@@ -0,0 +1,10 @@
+ALTER TABLE acos
+    ADD COLUMN encrypt_exports boolean NOT NULL DEFAULT false;
+
+ALTER TABLE jobs
+    ADD COLUMN encrypt boolean NOT NULL DEFAULT false;
+
+-- Set for encrypted files; the file's key, wrapped with the ACO's public key, and the nonce are base64-encoded
+ALTER TABLE job_keys
+    ADD COLUMN encrypted_key text,
+    ADD COLUMN nonce text;
@@ -0,0 +1,4 @@
+-- Set for the files created when a job's files are grouped by resource type. They replace the files written by the
+-- job's queue jobs, whose keys are soft-deleted.
+ALTER TABLE job_keys
+    ADD COLUMN part boolean NOT NULL DEFAULT false;
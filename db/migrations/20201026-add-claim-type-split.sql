@@ -0,0 +1,10 @@
+ALTER TABLE acos
+    ADD COLUMN split_claim_types boolean NOT NULL DEFAULT false;
+
+ALTER TABLE jobs
+    ADD COLUMN split_claim_types boolean NOT NULL DEFAULT false;
+
+-- Set for the files of ExplanationOfBenefit resources split by claim type, e.g. carrier. Each queue job also records
+-- one file without a claim type, so that the job's finished queue jobs can still be counted.
+ALTER TABLE job_keys
+    ADD COLUMN claim_type text NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+-- The tabular format (csv or parquet) of the job's files, or empty for NDJSON
+ALTER TABLE jobs
+    ADD COLUMN output_format text NOT NULL DEFAULT '';
+
+-- Set for the files of a tabular job's secondary tables, e.g. eob_line. Each queue job also records the file of its
+-- resource type's main table without a table, so that the job's finished queue jobs can still be counted.
+ALTER TABLE job_keys
+    ADD COLUMN output_table text NOT NULL DEFAULT '';
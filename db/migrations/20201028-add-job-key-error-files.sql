@@ -0,0 +1,4 @@
+-- Set for the files that are accompanied by an error file. Keys recorded before this column was added are assumed to
+-- have no error file, so their error files are no longer listed in the manifests of the jobs that had completed.
+ALTER TABLE job_keys
+    ADD COLUMN has_error_file boolean NOT NULL DEFAULT false;
@@ -0,0 +1,6 @@
+-- Set while a job's files are being grouped by resource type, so that only one run groups them at a time. The files
+-- are grouped without holding a lock on the job, and a claim that is older than the timeout is assumed to have been
+-- abandoned.
+ALTER TABLE jobs
+    ADD COLUMN group_files_claim char(36) NOT NULL DEFAULT '',
+    ADD COLUMN group_files_claimed_at timestamp with time zone;
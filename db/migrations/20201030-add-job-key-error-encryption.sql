@@ -0,0 +1,7 @@
+-- Set when a job's files are encrypted, since error files identify beneficiaries and are encrypted along with the
+-- resource files. Error files written before these were recorded are not encrypted.
+ALTER TABLE job_keys
+    ADD COLUMN error_encrypted_key text,
+    ADD COLUMN error_nonce text,
+    ADD COLUMN error_checksum char(64) NOT NULL DEFAULT '',
+    ADD COLUMN error_file_size bigint NOT NULL DEFAULT 0;